@@ -4,7 +4,11 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"time"
+
+	"github.com/pion/webrtc/v4"
 )
 
 type Credentials struct {
@@ -108,3 +112,241 @@ func ResetPassword(baseURL, username, oldPassword, newPassword string) error {
 	}
 	return nil
 }
+
+// These are the scopes an API key can be given
+const (
+	// Connect to the signaling server
+	ScopeSignaling = "signaling"
+	// Create, list and revoke API keys
+	ScopeKeys = "keys"
+)
+
+// APIKey describes one of the user's API keys, Key is only set on the key returned by CreateAPIKey.
+type APIKey struct {
+	ID         int64      `json:"id"`
+	Label      string     `json:"label"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  *time.Time `json:"created_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	Key        string     `json:"api_key,omitempty"`
+}
+
+// NewAPIKey holds the settings of a key created with CreateAPIKey, the key only gets the signaling
+// scope when Scopes is empty and never expires when ExpiresAt is nil.
+type NewAPIKey struct {
+	Label     string     `json:"label"`
+	Scopes    []string   `json:"scopes,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// CreateAPIKey creates another API key for the user owning apiKey, which needs the keys scope.
+// The returned key is the only time the new key can be read.
+func CreateAPIKey(baseURL, apiKey string, newKey NewAPIKey) (APIKey, error) {
+	var created APIKey
+	err := doAPIKeyRequest(http.MethodPost, baseURL+"/apikeys", apiKey, newKey, http.StatusCreated, &created)
+	return created, err
+}
+
+// ListAPIKeys lists the API keys of the user owning apiKey, which needs the keys scope.
+func ListAPIKeys(baseURL, apiKey string) ([]APIKey, error) {
+	var keys []APIKey
+	err := doAPIKeyRequest(http.MethodGet, baseURL+"/apikeys", apiKey, nil, http.StatusOK, &keys)
+	return keys, err
+}
+
+// RevokeAPIKey revokes one of the API keys of the user owning apiKey, which needs the keys scope.
+func RevokeAPIKey(baseURL, apiKey string, id int64) error {
+	url := fmt.Sprintf("%s/apikeys/%d", baseURL, id)
+	return doAPIKeyRequest(http.MethodDelete, url, apiKey, nil, http.StatusNoContent, nil)
+}
+
+func doAPIKeyRequest(method, url, apiKey string, body any, wantStatus int, result any) error {
+	header := http.Header{}
+	if apiKey != "" {
+		header.Set("X-API-Key", apiKey)
+	}
+	return doRequest(method, url, header, body, wantStatus, result)
+}
+
+func doRequest(method, url string, header http.Header, body any, wantStatus int, result any) error {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("marshal error: %w", err)
+		}
+		reader = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		return err
+	}
+	req.Header = header
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s failed: %w", method, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != wantStatus {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	if result == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("decode error: %w", err)
+	}
+	return nil
+}
+
+// AccessToken is a short lived token for connecting to /ws, see GetAccessToken.
+type AccessToken struct {
+	AccessToken string    `json:"access_token"`
+	TokenType   string    `json:"token_type"`
+	ExpiresIn   int64     `json:"expires_in"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// TokenRequest is what GetAccessToken exchanges for a token. It authenticates with APIKey when it's
+// set and with Username and Password otherwise. A token with Rooms can only join those rooms and
+// can't create any.
+type TokenRequest struct {
+	APIKey   string   `json:"-"`
+	Username string   `json:"username,omitempty"`
+	Password string   `json:"password,omitempty"`
+	Rooms    []uint64 `json:"rooms,omitempty"`
+}
+
+// GetAccessToken exchanges an API key or a username and password for a short lived access token.
+// The token is sent to /ws as a bearer token, or by browsers as the access_token.<token>
+// subprotocol next to the signaling subprotocol.
+func GetAccessToken(baseURL string, rqst TokenRequest) (AccessToken, error) {
+	var token AccessToken
+	err := doAPIKeyRequest(http.MethodPost, baseURL+"/token", rqst.APIKey, rqst, http.StatusOK, &token)
+	return token, err
+}
+
+// AuthEvent is a login attempt on the user's account, Suspicious is set on logins from an IP the
+// user never logged in from before and on lockouts.
+type AuthEvent struct {
+	ID         int64      `json:"id"`
+	Event      string     `json:"event"`
+	Success    bool       `json:"success"`
+	Suspicious bool       `json:"suspicious"`
+	IP         string     `json:"ip"`
+	UserAgent  string     `json:"user_agent"`
+	CreatedAt  *time.Time `json:"created_at,omitempty"`
+}
+
+// ListAuthEvents lists the most recent login attempts on the account owning apiKey, newest first.
+// apiKey needs the keys scope and limit may be 0 for the server's default.
+func ListAuthEvents(baseURL, apiKey string, limit int) ([]AuthEvent, error) {
+	url := baseURL + "/account/auth-events"
+	if limit > 0 {
+		url = fmt.Sprintf("%s?limit=%d", url, limit)
+	}
+	var events []AuthEvent
+	err := doAPIKeyRequest(http.MethodGet, url, apiKey, nil, http.StatusOK, &events)
+	return events, err
+}
+
+// Account is everything the server stores about a user, see GetAccount. Passwords and API keys are
+// only stored hashed so they aren't part of it.
+type Account struct {
+	ID           int64      `json:"id"`
+	Username     string     `json:"username"`
+	Email        string     `json:"email,omitempty"`
+	HasPassword  bool       `json:"has_password"`
+	Disabled     bool       `json:"disabled"`
+	UpdatedAt    *time.Time `json:"updated_at,omitempty"`
+	FailedLogins int64      `json:"failed_logins"`
+	LockedUntil  *time.Time `json:"locked_until,omitempty"`
+	Identities   []struct {
+		Issuer    string     `json:"issuer"`
+		Subject   string     `json:"subject"`
+		CreatedAt *time.Time `json:"created_at,omitempty"`
+	} `json:"identities"`
+	APIKeys    []APIKey    `json:"api_keys"`
+	AuthEvents []AuthEvent `json:"auth_events"`
+}
+
+// GetAccount exports the profile, API key metadata and login history of the account owning apiKey,
+// which needs the keys scope.
+func GetAccount(baseURL, apiKey string) (Account, error) {
+	var account Account
+	err := doAPIKeyRequest(http.MethodGet, baseURL+"/account", apiKey, nil, http.StatusOK, &account)
+	return account, err
+}
+
+// GetAccountWithToken exports an account without a password, like the ones provisioned through
+// OIDC. The access token has to come from a login in the last 5 minutes, since those accounts
+// never get a key with the keys scope.
+func GetAccountWithToken(baseURL, accessToken string) (Account, error) {
+	var account Account
+	header := http.Header{"Authorization": []string{"Bearer " + accessToken}}
+	err := doRequest(http.MethodGet, baseURL+"/account", header, nil, http.StatusOK, &account)
+	return account, err
+}
+
+// DeleteAccount deletes the account owning apiKey, which needs the keys scope, after confirming its
+// password. Its live session is closed and every key stops working.
+func DeleteAccount(baseURL, apiKey, password string) error {
+	body := map[string]string{"password": password}
+	return doAPIKeyRequest(http.MethodDelete, baseURL+"/account", apiKey, body, http.StatusNoContent, nil)
+}
+
+// DeleteAccountWithToken deletes an account without a password, like the ones provisioned through
+// OIDC. The access token has to come from a login in the last 5 minutes, which is how those
+// accounts confirm.
+func DeleteAccountWithToken(baseURL, accessToken string) error {
+	header := http.Header{"Authorization": []string{"Bearer " + accessToken}}
+	return doRequest(http.MethodDelete, baseURL+"/account", header, nil, http.StatusNoContent, nil)
+}
+
+// SetEmail sets the address password reset tokens are emailed to for the account owning apiKey,
+// which needs the keys scope. An empty email removes it.
+func SetEmail(baseURL, apiKey, email string) error {
+	body := map[string]string{"email": email}
+	return doAPIKeyRequest(http.MethodPut, baseURL+"/account/email", apiKey, body, http.StatusNoContent, nil)
+}
+
+// ForgotPassword asks the server to email a password reset token to the address. It succeeds
+// whether or not the address belongs to an account.
+func ForgotPassword(baseURL, email string) error {
+	body := map[string]string{"email": email}
+	return doAPIKeyRequest(http.MethodPost, baseURL+"/password/forgot", "", body, http.StatusAccepted, nil)
+}
+
+// ResetPasswordWithToken sets a new password with an emailed reset token and returns the account's
+// new API key, every other key of the account is revoked.
+func ResetPasswordWithToken(baseURL, token, newPassword string) (string, error) {
+	body := map[string]string{"token": token, "new_password": newPassword}
+	var res struct {
+		APIKey string `json:"api_key"`
+	}
+	err := doAPIKeyRequest(http.MethodPost, baseURL+"/password/reset", "", body, http.StatusOK, &res)
+	return res.APIKey, err
+}
+
+// ICEServers are the STUN and TURN servers the server hands out, the credentials of its TURN
+// servers stop working at ExpiresAt
+type ICEServers struct {
+	Servers   []webrtc.ICEServer `json:"ice_servers"`
+	ExpiresAt *time.Time         `json:"expires_at,omitempty"`
+}
+
+// GetICEServers fetches STUN and TURN servers for the user owning apiKey, which needs the signaling
+// scope. Clients get the same servers when creating or joining a room and use them on their own.
+func GetICEServers(baseURL, apiKey string) (ICEServers, error) {
+	var servers ICEServers
+	err := doAPIKeyRequest(http.MethodGet, baseURL+"/ice-servers", apiKey, nil, http.StatusOK, &servers)
+	return servers, err
+}
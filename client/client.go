@@ -2,8 +2,14 @@ package client
 
 import (
 	"fmt"
+	"log/slog"
 	"os"
 
+	"github.com/pion/ice/v4"
+	"github.com/pion/webrtc/v4"
+
+	smsg "signaling-msgs"
+
 	pm "github.com/sushiag/go-webrtc-signaling-server/client/peer_manager"
 	signaling "github.com/sushiag/go-webrtc-signaling-server/client/signaling_client"
 )
@@ -16,23 +22,75 @@ type Client struct {
 
 const apiKeyEnvName = "API_KEY"
 
+// This holds the optional settings of the client, the zero value is a valid config
+type Options struct {
+	// Logger used by the client, defaults to slog.Default()
+	Logger *slog.Logger
+
+	// The STUN and TURN servers peer connections use instead of the ones the signaling server
+	// hands out, an empty non-nil slice only gathers host candidates
+	ICEServers []webrtc.ICEServer
+	// Which ICE candidates peer connections may use, webrtc.ICETransportPolicyRelay only connects
+	// through TURN servers. Defaults to all of them.
+	ICETransportPolicy webrtc.ICETransportPolicy
+	// The UDP ports peer connections use, any port when both are zero
+	MinPort uint16
+	MaxPort uint16
+	// The public IPs of a host behind a 1:1 NAT and the type of candidates they are advertised as,
+	// see peer_manager.Options
+	NAT1To1IPs           []string
+	NAT1To1CandidateType webrtc.ICECandidateType
+	// Whether host candidates are hidden behind mDNS names, defaults to only resolving remote ones
+	MulticastDNSMode ice.MulticastDNSMode
+	// Ordering and retransmits of the data channels, ordered and reliable by default
+	DataChannel webrtc.DataChannelInit
+
+	// How signaling messages are encoded, smsg.CBOR is smaller on the wire. Defaults to smsg.JSON.
+	Codec smsg.Codec
+}
+
 // This checks if an cient connecting to the websocket has a API-Key, thiis returns an error if the API-Key is missing.
 func NewClient(wsEndpoint string) (*Client, error) {
 	apiKey, keyExists := os.LookupEnv(apiKeyEnvName)
 	if !keyExists || apiKey == "" {
 		return nil, fmt.Errorf("API_KEY environment variable is not set or empty")
 	}
-	return NewClientWithKey(wsEndpoint, apiKey)
+	return NewClientWithKey(wsEndpoint, apiKey, Options{})
 }
 
 // This creates a nnew client using the websocket endpoint and API-Key, as well as initialize the signaling client and peer manager.
-func NewClientWithKey(wsEndpoint string, apiKey string) (*Client, error) {
-	sClient, err := signaling.NewSignalingClient(wsEndpoint, apiKey)
+// The zero Options use the defaults.
+func NewClientWithKey(wsEndpoint string, apiKey string, opts Options) (*Client, error) {
+	logger := opts.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	// the options are checked before connecting so a bad config doesn't leave a connection behind
+	pmOpts := pm.Options{
+		ICEServers:           opts.ICEServers,
+		ICETransportPolicy:   opts.ICETransportPolicy,
+		MinPort:              opts.MinPort,
+		MaxPort:              opts.MaxPort,
+		NAT1To1IPs:           opts.NAT1To1IPs,
+		NAT1To1CandidateType: opts.NAT1To1CandidateType,
+		MulticastDNSMode:     opts.MulticastDNSMode,
+		DataChannel:          opts.DataChannel,
+	}
+	if err := pmOpts.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid WebRTC options: %v", err)
+	}
+
+	sClient, err := signaling.NewSignalingClientWithCodec(wsEndpoint, apiKey, opts.Codec, logger)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialized signaling client: %v", err)
 	}
 
-	pm := pm.NewPeerManager(sClient.SignalingIn, sClient.SignalingOut)
+	pmOpts.Logger = logger.With("client_id", sClient.ClientID)
+	pm, err := pm.NewPeerManager(sClient.SignalingIn, sClient.SignalingOut, pmOpts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize peer manager: %v", err)
+	}
 
 	client := &Client{
 		sClient: sClient,
@@ -0,0 +1,89 @@
+package peer_manager
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+
+	"github.com/pion/ice/v4"
+	"github.com/pion/webrtc/v4"
+)
+
+// This holds the optional settings of the peer manager, the zero value is a valid config
+type Options struct {
+	// Logger used by the peer manager, defaults to slog.Default()
+	Logger *slog.Logger
+
+	// The STUN and TURN servers peer connections use, they then replace the ones the signaling
+	// server hands out. An empty non-nil slice only gathers host candidates. When nil a public
+	// STUN server is used until the signaling server hands out its own.
+	ICEServers []webrtc.ICEServer
+	// Which ICE candidates peer connections may use, webrtc.ICETransportPolicyRelay only connects
+	// through TURN servers. Defaults to all of them.
+	ICETransportPolicy webrtc.ICETransportPolicy
+
+	// The UDP ports the ICE agent listens on, any port when both are zero
+	MinPort uint16
+	MaxPort uint16
+	// The public IPs of a host behind a 1:1 NAT, advertised as NAT1To1CandidateType candidates
+	NAT1To1IPs []string
+	// Either webrtc.ICECandidateTypeHost, which replaces the private IPs of host candidates, or
+	// webrtc.ICECandidateTypeSrflx, which adds server reflexive candidates and can't be combined with
+	// STUN servers. Defaults to host.
+	NAT1To1CandidateType webrtc.ICECandidateType
+	// Whether host candidates are hidden behind mDNS names and remote mDNS candidates resolved,
+	// defaults to ice.MulticastDNSModeQueryOnly
+	MulticastDNSMode ice.MulticastDNSMode
+
+	// How the data channel to every peer delivers messages, ordered and reliable by default.
+	// Setting MaxRetransmits or MaxPacketLifeTime makes it unreliable.
+	DataChannel webrtc.DataChannelInit
+}
+
+// Validate tells whether peer connections can be created with the options
+func (opts Options) Validate() error {
+	if (opts.MinPort != 0 || opts.MaxPort != 0) && (opts.MinPort == 0 || opts.MaxPort < opts.MinPort) {
+		return fmt.Errorf("invalid port range %d-%d", opts.MinPort, opts.MaxPort)
+	}
+	for _, ip := range opts.NAT1To1IPs {
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("invalid NAT 1:1 IP %q", ip)
+		}
+	}
+	switch opts.NAT1To1CandidateType {
+	case webrtc.ICECandidateTypeUnknown, webrtc.ICECandidateTypeHost:
+	case webrtc.ICECandidateTypeSrflx:
+		if opts.ICEServers == nil {
+			return errors.New("server reflexive NAT 1:1 IPs need ICEServers without STUN servers")
+		}
+	default:
+		return fmt.Errorf("NAT 1:1 IPs can't be advertised as %s candidates", opts.NAT1To1CandidateType)
+	}
+	return nil
+}
+
+// This builds the pion API peer connections are created with
+func (opts Options) newAPI() (*webrtc.API, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	var settings webrtc.SettingEngine
+	if opts.MinPort != 0 {
+		if err := settings.SetEphemeralUDPPortRange(opts.MinPort, opts.MaxPort); err != nil {
+			return nil, err
+		}
+	}
+	if len(opts.NAT1To1IPs) > 0 {
+		candidateType := opts.NAT1To1CandidateType
+		if candidateType == webrtc.ICECandidateTypeUnknown {
+			candidateType = webrtc.ICECandidateTypeHost
+		}
+		settings.SetNAT1To1IPs(opts.NAT1To1IPs, candidateType)
+	}
+	if opts.MulticastDNSMode != 0 {
+		settings.SetICEMulticastDNSMode(opts.MulticastDNSMode)
+	}
+	return webrtc.NewAPI(webrtc.WithSettingEngine(settings)), nil
+}
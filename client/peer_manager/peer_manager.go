@@ -2,6 +2,7 @@ package peer_manager
 
 import (
 	"fmt"
+	"log/slog"
 
 	"github.com/pion/webrtc/v4"
 
@@ -15,6 +16,12 @@ type PeerManager struct {
 	signalingOut chan<- smsg.MessageAnyPayload
 	dataChOpened chan uint64
 	peerData     chan PeerDataMsg
+	api          *webrtc.API
+	webRTCConfig webrtc.Configuration
+	dataChInit   webrtc.DataChannelInit
+	// Set when the ICE servers were given in the options
+	fixedICE bool
+	logger   *slog.Logger
 }
 
 // This represents the data messages from peers, which incluudes the peer sender's ID.
@@ -35,6 +42,7 @@ type sendICE struct {
 	ice     *webrtc.ICECandidate
 }
 
+// This is used until the server hands out its own ICE servers
 var defaultWebRTCConfig = webrtc.Configuration{
 	ICEServers: []webrtc.ICEServer{
 		{URLs: []string{"stun:stun.l.google.com:19302"}},
@@ -43,17 +51,47 @@ var defaultWebRTCConfig = webrtc.Configuration{
 
 // signalingIn:		source of signaling messsages
 // signalingOut:	output for signaling messsages
-func NewPeerManager(signalingIn <-chan smsg.MessageRawJSONPayload, signalingOut chan<- smsg.MessageAnyPayload) *PeerManager {
+// opts:			the zero value uses the defaults, invalid options make it fail
+func NewPeerManager(signalingIn <-chan smsg.MessageRawJSONPayload, signalingOut chan<- smsg.MessageAnyPayload, opts Options) (*PeerManager, error) {
+	logger := opts.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	api, err := opts.newAPI()
+	if err != nil {
+		return nil, err
+	}
+
 	client := &PeerManager{
 		peers:        make(map[uint64]*peer),
 		signalingOut: signalingOut,
 		dataChOpened: make(chan uint64, 4),
 		peerData:     make(chan PeerDataMsg, 32),
+		api:          api,
+		webRTCConfig: defaultWebRTCConfig,
+		dataChInit:   opts.DataChannel,
+		fixedICE:     opts.ICEServers != nil,
+		logger:       logger,
+	}
+	client.webRTCConfig.ICETransportPolicy = opts.ICETransportPolicy
+	if client.fixedICE {
+		client.webRTCConfig.ICEServers = opts.ICEServers
 	}
 
 	go client.signalingLoop(signalingIn)
 
-	return client
+	return client, nil
+}
+
+// This makes new peer connections use the ICE servers the server handed out, servers that don't
+// hand out any and ICE servers given in the options leave the current ones in place. Peers
+// already connected keep theirs.
+func (pm *PeerManager) useICEServers(servers []webrtc.ICEServer) {
+	if len(servers) == 0 || pm.fixedICE {
+		return
+	}
+	pm.webRTCConfig.ICEServers = servers
 }
 
 // This handles the sending for data from a peer to another peeer
@@ -27,8 +27,10 @@ func TestPeerDataExchange(t *testing.T) {
 	}
 	startMockSignalingServer(t, signalingChannels)
 
-	client1 := NewPeerManager(signalingIn1, signalingOut1)
-	client2 := NewPeerManager(signalingIn2, signalingOut2)
+	client1, err := NewPeerManager(signalingIn1, signalingOut1, Options{})
+	require.NoError(t, err)
+	client2, err := NewPeerManager(signalingIn2, signalingOut2, Options{})
+	require.NoError(t, err)
 
 	// Start SDP exchange:
 	// - Signaling starts when a client joins a room and receiveds the clients list.
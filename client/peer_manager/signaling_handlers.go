@@ -2,7 +2,6 @@ package peer_manager
 
 import (
 	"fmt"
-	"log"
 
 	"github.com/pion/webrtc/v4"
 
@@ -19,13 +18,14 @@ func (pm *PeerManager) newPeerOffer(peerID uint64) error {
 	}
 
 	// This creates peer connection to another peer
-	conn, createConnErr := webrtc.NewPeerConnection(defaultWebRTCConfig)
+	conn, createConnErr := pm.api.NewPeerConnection(pm.webRTCConfig)
 	if createConnErr != nil {
 		return fmt.Errorf("failed to initialize peer connection for peer %d: %v", peerID, createConnErr)
 	}
 
 	// This create a data channel on an existing connection
-	dataCh, createDataChErr := conn.CreateDataChannel("data", nil)
+	dataChInit := pm.dataChInit
+	dataCh, createDataChErr := conn.CreateDataChannel("data", &dataChInit)
 	if createDataChErr != nil {
 		return fmt.Errorf("failed to initialize data channel for peer %d: %v", peerID, createConnErr)
 	}
@@ -93,7 +93,7 @@ func (pm *PeerManager) handlePeerOffer(peerID uint64, offer webrtc.SessionDescri
 	}
 
 	// This creates a new peer connection
-	conn, createConnErr := webrtc.NewPeerConnection(defaultWebRTCConfig)
+	conn, createConnErr := pm.api.NewPeerConnection(pm.webRTCConfig)
 	if createConnErr != nil {
 		return fmt.Errorf("failed to initialize peer connection for peer %d: %v", peerID, createConnErr)
 	}
@@ -115,7 +115,7 @@ func (pm *PeerManager) handlePeerOffer(peerID uint64, offer webrtc.SessionDescri
 	conn.OnDataChannel(func(dataCh *webrtc.DataChannel) {
 		peer, exists := pm.peers[peerID]
 		if !exists {
-			log.Printf("[ERROR] data channel for a peer without a opened: %d", peerID)
+			pm.logger.Error("data channel for a peer without a opened connection", "peer_id", peerID)
 		}
 
 		dataCh.OnOpen(func() {
@@ -2,7 +2,6 @@ package peer_manager
 
 import (
 	"encoding/json"
-	"log"
 
 	"github.com/pion/webrtc/v4"
 
@@ -13,18 +12,29 @@ import (
 func (pm *PeerManager) signalingLoop(signalingIn <-chan smsg.MessageRawJSONPayload) {
 	for msg := range signalingIn {
 		switch msg.MsgType {
+		// This picks up the ICE servers for the room the client created
+		case smsg.RoomCreated:
+			{
+				var payload smsg.RoomCreatedPayload
+				if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+					pm.logger.Error("failed to unmarshal room created payload", "err", err)
+					continue
+				}
+				pm.useICEServers(payload.ICEServers)
+			}
 		// This handles the client when joining a room and then creates an SDP offer for each of the client active in the rooom
 		case smsg.RoomJoined:
 			{
 				var payload smsg.RoomJoinedPayload
 				if err := json.Unmarshal(msg.Payload, &payload); err != nil {
-					log.Printf("[ERROR] failed to unmarshal room joined payload")
+					pm.logger.Error("failed to unmarshal room joined payload", "err", err)
 					continue
 				}
+				pm.useICEServers(payload.ICEServers)
 
 				for _, clientID := range payload.ClientsInRoom {
 					if err := pm.newPeerOffer(clientID); err != nil {
-						log.Printf("[ERROR] failed to create SDP offer for %d: %v", clientID, err)
+						pm.logger.Error("failed to create SDP offer", "peer_id", clientID, "err", err)
 						continue
 					}
 				}
@@ -34,7 +44,7 @@ func (pm *PeerManager) signalingLoop(signalingIn <-chan smsg.MessageRawJSONPaylo
 				// This handles the incoming SDP message (offer/answer)
 				var payload smsg.SDPPayload
 				if err := json.Unmarshal(msg.Payload, &payload); err != nil {
-					log.Printf("[ERROR] failed to unmarshal SDP payload")
+					pm.logger.Error("failed to unmarshal SDP payload", "peer_id", msg.From, "err", err)
 					continue
 				}
 
@@ -43,19 +53,19 @@ func (pm *PeerManager) signalingLoop(signalingIn <-chan smsg.MessageRawJSONPaylo
 					{
 						err := pm.handlePeerOffer(msg.From, payload.SDP)
 						if err != nil {
-							log.Printf("[ERROR] failed to handle peer offer: %v", err)
+							pm.logger.Error("failed to handle peer offer", "peer_id", msg.From, "err", err)
 							break
 						}
 					}
 				case webrtc.SDPTypeAnswer:
 					{
 						if err := pm.handlePeerAnswer(msg.From, payload.SDP); err != nil {
-							log.Printf("[ERROR] failed to handle peer answer: %v", err)
+							pm.logger.Error("failed to handle peer answer", "peer_id", msg.From, "err", err)
 						}
 					}
 				default:
 					{
-						log.Printf("[WARN] unhandled SDP type: %s", payload.SDP.Type.String())
+						pm.logger.Warn("unhandled SDP type", "peer_id", msg.From, "sdp_type", payload.SDP.Type.String())
 					}
 				}
 			}
@@ -64,11 +74,13 @@ func (pm *PeerManager) signalingLoop(signalingIn <-chan smsg.MessageRawJSONPaylo
 				// This handle the incoming ICE Candites and add ii to the eixsting/offered peer connection
 				var payload smsg.ICECandidatePayload
 				if err := json.Unmarshal(msg.Payload, &payload); err != nil {
-					log.Printf("[ERROR] failed to unmarshal ICE candidate payload")
+					pm.logger.Error("failed to unmarshal ICE candidate payload", "peer_id", msg.From, "err", err)
 					continue
 				}
 
-				pm.addIceCandidate(msg.From, payload.ICE)
+				if err := pm.addIceCandidate(msg.From, payload.ICE); err != nil {
+					pm.logger.Warn("failed to add ICE candidate", "peer_id", msg.From, "err", err)
+				}
 			}
 		}
 	}
@@ -4,9 +4,10 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/gorilla/websocket"
 
@@ -18,22 +19,51 @@ type SignalingClient struct {
 	ClientID     uint64
 	SignalingIn  <-chan smsg.MessageRawJSONPayload
 	SignalingOut chan<- smsg.MessageAnyPayload
+	// The protocol version and optional features agreed on with the server
+	ProtocolVersion int
+	Features        []string
+	// How messages are encoded, JSON when the server doesn't support the requested codec
+	Codec smsg.Codec
 
-	// NOTE: it's kinda unsafe to not lock these channels but we like to live dangerously
-	// * concurrent access == skill issues
-	createRoom chan smsg.MessageRawJSONPayload
-	joinRoom   chan smsg.MessageRawJSONPayload
+	// requests are handed to the dispatch loop, which gives them IDs and matches the replies to them
+	requests chan request
+	cancel   chan chan smsg.MessageRawJSONPayload
+	closed   chan struct{}
+	// why the connection was closed, it's set before closed is
+	closeErr error
+
+	logger *slog.Logger
 }
 
-// This represents how a messages is being sent to the server and wait for the responnd
-type roomCommand struct {
-	msg    *smsg.MessageAnyPayload
-	respCh chan<- error
+// This is a message sent to the server that waits for the reply with its request ID
+type request struct {
+	msg    smsg.MessageAnyPayload
+	respCh chan smsg.MessageRawJSONPayload
 }
 
+// How long a request waits for its reply
+const requestTimeout = 10 * time.Second
+
+// ErrConnectionClosed is returned by requests that were pending when the connection to the server
+// was lost
+var ErrConnectionClosed = errors.New("the connection to the signaling server is closed")
+
 // This handles the creation and connection of a the signaling client to the signaling server, it also authenthicates using the API-Key.
-func NewSignalingClient(wsEndpoint string, apiKey string) (*SignalingClient, error) {
-	client := &SignalingClient{}
+// A nil logger falls back to slog.Default().
+func NewSignalingClient(wsEndpoint string, apiKey string, logger *slog.Logger) (*SignalingClient, error) {
+	return NewSignalingClientWithCodec(wsEndpoint, apiKey, smsg.JSON, logger)
+}
+
+// This creates a signaling client like NewSignalingClient that asks the server to encode messages
+// with the codec, a nil codec is JSON
+func NewSignalingClientWithCodec(wsEndpoint string, apiKey string, codec smsg.Codec, logger *slog.Logger) (*SignalingClient, error) {
+	if codec == nil {
+		codec = smsg.JSON
+	}
+	if logger == nil {
+		logger = slog.Default()
+	}
+	client := &SignalingClient{logger: logger}
 
 	if apiKey == "" {
 		return nil, fmt.Errorf("the apiKey cannot be an empty string")
@@ -41,10 +71,16 @@ func NewSignalingClient(wsEndpoint string, apiKey string) (*SignalingClient, err
 
 	// connect to the WS endpoint
 	headers := http.Header{"Authorization": []string{"Bearer " + apiKey}}
-	wsConn, resp, err := websocket.DefaultDialer.Dial(wsEndpoint, headers)
+	dialer := *websocket.DefaultDialer
+	dialer.Subprotocols = []string{codec.Subprotocol()}
+	wsConn, resp, err := dialer.Dial(wsEndpoint, headers)
 	if err != nil {
 		return nil, err
 	}
+	client.Codec = smsg.CodecFor(wsConn.Subprotocol())
+	if client.Codec != codec {
+		logger.Warn("server doesn't support the codec, falling back to JSON", "subprotocol", codec.Subprotocol())
+	}
 
 	// store the WS Client ID
 	clientIDStr := resp.Header.Get("X-Client-ID")
@@ -53,18 +89,124 @@ func NewSignalingClient(wsEndpoint string, apiKey string) (*SignalingClient, err
 		return nil, fmt.Errorf("got an invalid client ID from the server: %s", clientIDStr)
 	}
 	client.ClientID = clientID
+	client.logger = logger.With("client_id", clientID)
 
 	signalingIn := make(chan smsg.MessageRawJSONPayload, 32)
 	signalingOut := make(chan smsg.MessageAnyPayload, 32)
 	client.SignalingIn = signalingIn
 	client.SignalingOut = signalingOut
+	client.requests = make(chan request)
+	client.cancel = make(chan chan smsg.MessageRawJSONPayload)
+	client.closed = make(chan struct{})
 
 	// WS Read Loop
+	incoming := make(chan smsg.MessageRawJSONPayload, 32)
 	go func() {
+		defer close(incoming)
 		for {
+			_, data, err := wsConn.ReadMessage()
+			if err != nil {
+				client.logger.Error("failed to read WS message from server", "err", err)
+				client.closeErr = err
+				return
+			}
 			var msg smsg.MessageRawJSONPayload
-			if err := wsConn.ReadJSON(&msg); err != nil {
-				log.Printf("[ERROR] failed to read WS message from server: %v", err)
+			if err := client.Codec.Unmarshal(data, &msg); err != nil {
+				client.logger.Error("failed to decode WS message from server", "err", err)
+				continue
+			}
+			incoming <- msg
+		}
+	}()
+
+	go client.dispatchLoop(incoming, signalingIn, signalingOut)
+
+	// WS Send Loop
+	go func() {
+		frameType := websocket.TextMessage
+		if client.Codec.Binary() {
+			frameType = websocket.BinaryMessage
+		}
+		for msg := range signalingOut {
+			data, err := client.Codec.Marshal(msg)
+			if err != nil {
+				client.logger.Error("failed to encode WS message", "type", msg.MsgType.AsString(), "err", err)
+				continue
+			}
+			if err := wsConn.WriteMessage(frameType, data); err != nil {
+				client.logger.Error("failed to send WS message to server", "err", err)
+			}
+			client.logger.Debug("sent message to server", "type", msg.MsgType.AsString())
+		}
+	}()
+
+	// agree on the protocol before anything else is sent
+	if err := client.hello(); err != nil {
+		wsConn.Close()
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// This tells the server which protocol version and features the client speaks
+func (c *SignalingClient) hello() error {
+	resp, err := c.request(smsg.MessageAnyPayload{
+		MsgType: smsg.Hello,
+		Payload: smsg.HelloPayload{
+			ProtocolVersion: smsg.ProtocolVersion,
+			Features:        []string{smsg.FeatureRequestIDs, smsg.FeatureAcks, smsg.FeatureICEServers},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to agree on the protocol with the server: %w", err)
+	}
+
+	var welcome smsg.WelcomePayload
+	if err := json.Unmarshal(resp.Payload, &welcome); err != nil {
+		return fmt.Errorf("failed to unmarshal welcome payload: %v", err)
+	}
+	c.ProtocolVersion = welcome.ProtocolVersion
+	c.Features = welcome.Features
+	return nil
+}
+
+// This owns the pending requests, it sends them to the server with a fresh ID and hands every
+// reply to the request with the same ID. The other messages go to the peer manager.
+func (c *SignalingClient) dispatchLoop(incoming <-chan smsg.MessageRawJSONPayload, signalingIn chan<- smsg.MessageRawJSONPayload, signalingOut chan<- smsg.MessageAnyPayload) {
+	pending := make(map[uint64]chan smsg.MessageRawJSONPayload)
+	var nextID uint64
+
+	defer func() {
+		close(c.closed)
+		close(signalingIn)
+	}()
+
+	for {
+		select {
+		case req := <-c.requests:
+			nextID++
+			req.msg.RequestID = nextID
+			pending[nextID] = req.respCh
+			signalingOut <- req.msg
+
+		case respCh := <-c.cancel:
+			for id, ch := range pending {
+				if ch == respCh {
+					delete(pending, id)
+				}
+			}
+
+		case msg, ok := <-incoming:
+			if !ok {
+				return
+			}
+
+			if respCh, exists := pending[msg.RequestID]; exists && msg.RequestID != 0 {
+				delete(pending, msg.RequestID)
+				respCh <- msg
+			} else if msg.Error != nil {
+				c.logger.Warn("got an error from the server", "type", msg.MsgType.AsString(), "request_id", msg.RequestID, "err", msg.Error)
 				continue
 			}
 
@@ -73,20 +215,16 @@ func NewSignalingClient(wsEndpoint string, apiKey string) (*SignalingClient, err
 				{
 					signalingOut <- smsg.MessageAnyPayload{MsgType: smsg.Pong}
 				}
-			case smsg.RoomCreated:
+			case smsg.Ack, smsg.Welcome:
 				{
-					if client.createRoom != nil {
-						client.createRoom <- msg
-					}
+					// only the request cares about these
 				}
-			case smsg.RoomJoined:
+			case smsg.RoomCreated, smsg.RoomJoined:
 				{
-					// NOTE: we need to send the message to both the signaling channel and create
-					// room response channel here
-					if client.joinRoom != nil {
-						client.joinRoom <- msg
+					// the peer manager needs the ICE servers and the peers in these too
+					if msg.Error == nil {
+						signalingIn <- msg
 					}
-					signalingIn <- msg
 				}
 			default:
 				{
@@ -94,62 +232,75 @@ func NewSignalingClient(wsEndpoint string, apiKey string) (*SignalingClient, err
 				}
 			}
 		}
-	}()
+	}
+}
 
-	// WS Send Loop
-	go func() {
-		for msg := range signalingOut {
-			if err := wsConn.WriteJSON(msg); err != nil {
-				log.Printf("[ERROR] failed to send WS message to server: %v", err)
-			}
-			log.Printf("[DEBUG] sent '%s' message to server", msg.MsgType.AsString())
+// This sends a request and waits for its reply, a reply with an error is returned as its
+// *smsg.ErrorPayload
+func (c *SignalingClient) request(msg smsg.MessageAnyPayload) (smsg.MessageRawJSONPayload, error) {
+	// buffered so the dispatch loop never waits for a request that gave up
+	respCh := make(chan smsg.MessageRawJSONPayload, 1)
+	select {
+	case c.requests <- request{msg: msg, respCh: respCh}:
+	case <-c.closed:
+		return smsg.MessageRawJSONPayload{}, c.closedError()
+	}
+
+	timeout := time.NewTimer(requestTimeout)
+	defer timeout.Stop()
+
+	select {
+	case resp := <-respCh:
+		if resp.Error != nil {
+			return resp, resp.Error
 		}
-	}()
+		return resp, nil
+	case <-c.closed:
+		return smsg.MessageRawJSONPayload{}, c.closedError()
+	case <-timeout.C:
+		select {
+		case c.cancel <- respCh:
+		case <-c.closed:
+		}
+		return smsg.MessageRawJSONPayload{}, fmt.Errorf("%s request timed out after %s", msg.MsgType.AsString(), requestTimeout)
+	}
+}
 
-	return client, nil
+// This tells why the connection was closed, like the close reason the server gave
+func (c *SignalingClient) closedError() error {
+	if c.closeErr == nil {
+		return ErrConnectionClosed
+	}
+	return fmt.Errorf("%w: %v", ErrConnectionClosed, c.closeErr)
 }
 
 // This handles the request to create a new signaling room and waits for a response, it returns a room ID or an error.
+// Failures the server reports are *smsg.ErrorPayload errors.
 func (c *SignalingClient) CreateRoom() (uint64, error) {
-	var resp smsg.MessageRawJSONPayload
-	if c.createRoom == nil {
-		c.createRoom = make(chan smsg.MessageRawJSONPayload, 1)
-		c.SignalingOut <- smsg.MessageAnyPayload{MsgType: smsg.CreateRoom}
-	}
-
-	resp = <-c.createRoom
-
-	var err error
-	if resp.Error != "" {
-		err = errors.New(resp.Error)
+	resp, err := c.request(smsg.MessageAnyPayload{MsgType: smsg.CreateRoom})
+	if err != nil {
+		return 0, err
 	}
 
-	var respMsg smsg.RoomJoinedPayload
+	var respMsg smsg.RoomCreatedPayload
 	if err := json.Unmarshal(resp.Payload, &respMsg); err != nil {
 		return 0, fmt.Errorf("failed to unmarshal create room response payload: %v", err)
 	}
 
-	return respMsg.RoomID, err
+	return respMsg.RoomID, nil
 }
 
 // This handles the request to join an existing room and wait for a response, it returns either a list of active client ID or an error.
+// Failures the server reports are *smsg.ErrorPayload errors.
 func (c *SignalingClient) JoinRoom(roomID uint64) ([]uint64, error) {
-	var resp smsg.MessageRawJSONPayload
-	if c.joinRoom == nil {
-		c.joinRoom = make(chan smsg.MessageRawJSONPayload, 1)
-		c.SignalingOut <- smsg.MessageAnyPayload{
-			MsgType: smsg.JoinRoom,
-			Payload: smsg.JoinRoomPayload{
-				RoomID: roomID,
-			},
-		}
-	}
-
-	resp = <-c.joinRoom
-
-	var err error
-	if resp.Error != "" {
-		err = errors.New(resp.Error)
+	resp, err := c.request(smsg.MessageAnyPayload{
+		MsgType: smsg.JoinRoom,
+		Payload: smsg.JoinRoomPayload{
+			RoomID: roomID,
+		},
+	})
+	if err != nil {
+		return []uint64{}, err
 	}
 
 	var respMsg smsg.RoomJoinedPayload
@@ -158,10 +309,10 @@ func (c *SignalingClient) JoinRoom(roomID uint64) ([]uint64, error) {
 	}
 
 	if respMsg.RoomID != roomID {
-		log.Printf("[WARN] got put in room %d instead of the requestd %d", respMsg.RoomID, roomID)
+		c.logger.Warn("got put in a different room than requested", "room_id", respMsg.RoomID, "requested_room_id", roomID)
 	}
 
-	return respMsg.ClientsInRoom, err
+	return respMsg.ClientsInRoom, nil
 }
 
 // This handles the request to leave room.
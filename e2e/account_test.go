@@ -0,0 +1,104 @@
+package e2e_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sushiag/go-webrtc-signaling-server/client"
+	server "github.com/sushiag/go-webrtc-signaling-server/server/server"
+	sqlitedb "github.com/sushiag/go-webrtc-signaling-server/server/server/register"
+	smsg "signaling-msgs"
+)
+
+func TestAccountExportAndDeletion(t *testing.T) {
+	const testdata = "account.db"
+	const adminKey = "super-secret-admin-key"
+	queries, dbConn := sqlitedb.NewDatabase(testdata)
+	defer func() {
+		_ = dbConn.Close()
+		_ = os.Remove(testdata)
+	}()
+
+	srv, serverAddr := server.StartServerWithOptions("0", queries, server.Options{AdminAPIKey: adminKey, DisableRateLimits: true})
+	defer srv.Close()
+	baseURL := fmt.Sprintf("http://%s", serverAddr)
+
+	require.NoError(t, client.RegisterUser(baseURL, "spongebob", "initPass4ever"))
+	apiKey, err := client.RegenerateAPIKey(baseURL, "spongebob", "initPass4ever")
+	require.NoError(t, err)
+	signalingKey, err := client.CreateAPIKey(baseURL, apiKey, client.NewAPIKey{Label: "phone", Scopes: []string{"signaling"}})
+	require.NoError(t, err)
+
+	// the export has everything but the secrets
+	account, err := client.GetAccount(baseURL, apiKey)
+	require.NoError(t, err)
+	require.Equal(t, "spongebob", account.Username)
+	require.True(t, account.HasPassword)
+	require.False(t, account.Disabled)
+	require.Nil(t, account.LockedUntil)
+	require.Empty(t, account.Identities)
+	require.Len(t, account.APIKeys, 2)
+	for _, key := range account.APIKeys {
+		require.Empty(t, key.Key)
+	}
+	require.Len(t, account.AuthEvents, 1)
+	require.Equal(t, "regenerate", account.AuthEvents[0].Event)
+
+	_, err = client.GetAccount(baseURL, signalingKey.Key)
+	require.ErrorContains(t, err, "403")
+
+	// a live session in a room
+	wsConn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://%s/ws", serverAddr), http.Header{"X-API-Key": []string{signalingKey.Key}})
+	require.NoError(t, err)
+	defer wsConn.Close()
+	require.NoError(t, wsConn.WriteJSON(smsg.MessageAnyPayload{MsgType: smsg.CreateRoom}))
+	readMessage(t, wsConn, smsg.RoomCreated)
+
+	// deletion needs the password
+	require.ErrorContains(t, client.DeleteAccount(baseURL, apiKey, "wrongPassword"), "401")
+	require.ErrorContains(t, client.DeleteAccount(baseURL, signalingKey.Key, "initPass4ever"), "403")
+	require.NoError(t, client.DeleteAccount(baseURL, apiKey, "initPass4ever"))
+
+	// the session is closed and its room with it
+	require.NoError(t, wsConn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	for {
+		_, _, err = wsConn.ReadMessage()
+		if err != nil {
+			break
+		}
+	}
+	require.True(t, websocket.IsCloseError(err, websocket.CloseNormalClosure), err)
+
+	require.Eventually(t, func() bool {
+		req, err := http.NewRequest(http.MethodGet, baseURL+"/admin/rooms", nil)
+		require.NoError(t, err)
+		req.Header.Set("X-Admin-Key", adminKey)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		var rooms []json.RawMessage
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&rooms))
+		return len(rooms) == 0
+	}, 3*time.Second, 50*time.Millisecond)
+
+	// nothing of the user is left
+	_, err = client.GetAccount(baseURL, apiKey)
+	require.ErrorContains(t, err, "401")
+	for _, table := range []string{"users", "api_keys", "auth_events"} {
+		var count int
+		require.NoError(t, dbConn.QueryRow("SELECT COUNT(*) FROM "+table).Scan(&count))
+		require.Zero(t, count, table)
+	}
+
+	// so the name is free again
+	require.NoError(t, client.RegisterUser(baseURL, "spongebob", "newPass4ever"))
+}
@@ -0,0 +1,139 @@
+package e2e_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sushiag/go-webrtc-signaling-server/client"
+	server "github.com/sushiag/go-webrtc-signaling-server/server/server"
+	sqlitedb "github.com/sushiag/go-webrtc-signaling-server/server/server/register"
+	smsg "signaling-msgs"
+)
+
+func TestAdminAPI(t *testing.T) {
+	const testdata = "admin.db"
+	const adminKey = "super-secret-admin-key"
+	queries, dbConn := sqlitedb.NewDatabase(testdata)
+
+	srv, serverAddr := server.StartServerWithOptions("0", queries, server.Options{AdminAPIKey: adminKey})
+	defer srv.Close()
+
+	defer func() {
+		_ = dbConn.Close()
+		_ = os.Remove(testdata)
+	}()
+
+	baseURL := fmt.Sprintf("http://%s", serverAddr)
+	wsURL := fmt.Sprintf("ws://%s/ws", serverAddr)
+
+	adminRequest := func(method, path string, body any, out any) int {
+		var reqBody bytes.Buffer
+		if body != nil {
+			require.NoError(t, json.NewEncoder(&reqBody).Encode(body))
+		}
+		req, err := http.NewRequest(method, baseURL+path, &reqBody)
+		require.NoError(t, err)
+		req.Header.Set("X-Admin-Key", adminKey)
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		if out != nil && resp.StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(out))
+		}
+		return resp.StatusCode
+	}
+
+	// requests without the admin key are rejected
+	resp, err := http.Get(baseURL + "/admin/connections")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	require.NoError(t, client.RegisterUser(baseURL, "spongebob", "initPass4ever"))
+	apiKey, err := client.RegenerateAPIKey(baseURL, "spongebob", "initPass4ever")
+	require.NoError(t, err)
+
+	wsConn, wsResp, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"X-API-Key": []string{apiKey}})
+	require.NoError(t, err)
+	defer wsConn.Close()
+	userID := wsResp.Header.Get("X-Client-ID")
+
+	readMsg := func() smsg.MessageRawJSONPayload {
+		require.NoError(t, wsConn.SetReadDeadline(time.Now().Add(3*time.Second)))
+		var msg smsg.MessageRawJSONPayload
+		require.NoError(t, wsConn.ReadJSON(&msg))
+		return msg
+	}
+
+	// list connections
+	var conns []struct {
+		UserID      uint64    `json:"user_id"`
+		RemoteAddr  string    `json:"remote_addr"`
+		ConnectedAt time.Time `json:"connected_at"`
+	}
+	require.Eventually(t, func() bool {
+		require.Equal(t, http.StatusOK, adminRequest(http.MethodGet, "/admin/connections", nil, &conns))
+		return len(conns) == 1
+	}, 3*time.Second, 50*time.Millisecond)
+	require.Equal(t, userID, fmt.Sprint(conns[0].UserID))
+	require.NotEmpty(t, conns[0].RemoteAddr)
+	require.False(t, conns[0].ConnectedAt.IsZero())
+
+	// list rooms
+	require.NoError(t, wsConn.WriteJSON(smsg.MessageAnyPayload{MsgType: smsg.CreateRoom}))
+	created := readMsg()
+	require.Equal(t, smsg.RoomCreated, created.MsgType)
+	var createdPayload smsg.RoomCreatedPayload
+	require.NoError(t, json.Unmarshal(created.Payload, &createdPayload))
+
+	var rooms []struct {
+		RoomID  uint64   `json:"room_id"`
+		HostID  uint64   `json:"host_id"`
+		Members []uint64 `json:"members"`
+	}
+	require.Equal(t, http.StatusOK, adminRequest(http.MethodGet, "/admin/rooms", nil, &rooms))
+	require.Len(t, rooms, 1)
+	require.Equal(t, createdPayload.RoomID, rooms[0].RoomID)
+	require.Equal(t, userID, fmt.Sprint(rooms[0].HostID))
+
+	// broadcast a server notice
+	require.Equal(t, http.StatusOK, adminRequest(http.MethodPost, "/admin/notice", map[string]string{"message": "maintenance in 5 minutes"}, nil))
+	notice := readMsg()
+	require.Equal(t, smsg.ServerNotice, notice.MsgType)
+	var noticePayload smsg.ServerNoticePayload
+	require.NoError(t, json.Unmarshal(notice.Payload, &noticePayload))
+	require.Equal(t, "maintenance in 5 minutes", noticePayload.Message)
+
+	// close the room
+	require.Equal(t, http.StatusNoContent, adminRequest(http.MethodDelete, fmt.Sprintf("/admin/rooms/%d", createdPayload.RoomID), nil, nil))
+	closed := readMsg()
+	require.Equal(t, smsg.RoomClosed, closed.MsgType)
+	require.Equal(t, http.StatusOK, adminRequest(http.MethodGet, "/admin/rooms", nil, &rooms))
+	require.Empty(t, rooms)
+	require.Equal(t, http.StatusNotFound, adminRequest(http.MethodDelete, fmt.Sprintf("/admin/rooms/%d", createdPayload.RoomID), nil, nil))
+
+	// revoking the API key kicks the user and the key stops working
+	require.Equal(t, http.StatusNoContent, adminRequest(http.MethodDelete, fmt.Sprintf("/admin/users/%s/apikey", userID), nil, nil))
+	require.NoError(t, wsConn.SetReadDeadline(time.Now().Add(3*time.Second)))
+	_, _, err = wsConn.ReadMessage()
+	require.True(t, websocket.IsCloseError(err, websocket.ClosePolicyViolation), "expected a policy violation close, got: %v", err)
+
+	_, _, err = websocket.DefaultDialer.Dial(wsURL, http.Header{"X-API-Key": []string{apiKey}})
+	require.Error(t, err)
+
+	require.Eventually(t, func() bool {
+		require.Equal(t, http.StatusOK, adminRequest(http.MethodGet, "/admin/connections", nil, &conns))
+		return len(conns) == 0
+	}, 3*time.Second, 50*time.Millisecond)
+}
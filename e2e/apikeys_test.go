@@ -0,0 +1,123 @@
+package e2e_test
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sushiag/go-webrtc-signaling-server/client"
+	server "github.com/sushiag/go-webrtc-signaling-server/server/server"
+	sqlitedb "github.com/sushiag/go-webrtc-signaling-server/server/server/register"
+	"github.com/sushiag/go-webrtc-signaling-server/server/server/storage"
+)
+
+func TestAPIKeys(t *testing.T) {
+	const testdata = "apikeys.db"
+	queries, dbConn := sqlitedb.NewDatabase(testdata)
+
+	srv, serverAddr := server.StartServerWithOptions("0", queries, server.Options{DisableRateLimits: true})
+	defer srv.Close()
+
+	defer func() {
+		_ = dbConn.Close()
+		_ = os.Remove(testdata)
+	}()
+
+	baseURL := fmt.Sprintf("http://%s", serverAddr)
+	wsURL := fmt.Sprintf("ws://%s/ws", serverAddr)
+
+	dial := func(apiKey string) int {
+		conn, resp, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"X-API-Key": []string{apiKey}})
+		if err == nil {
+			conn.Close()
+		}
+		require.NotNil(t, resp)
+		return resp.StatusCode
+	}
+
+	require.NoError(t, client.RegisterUser(baseURL, "spongebob", "initPass4ever"))
+	defaultKey, err := client.RegenerateAPIKey(baseURL, "spongebob", "initPass4ever")
+	require.NoError(t, err)
+
+	// keys are only stored hashed
+	var stored int
+	require.NoError(t, dbConn.QueryRow("SELECT COUNT(*) FROM api_keys WHERE hash = ?", defaultKey).Scan(&stored))
+	require.Zero(t, stored)
+	require.NoError(t, dbConn.QueryRow("SELECT COUNT(*) FROM api_keys WHERE hash = ?", storage.HashAPIKey(defaultKey)).Scan(&stored))
+	require.Equal(t, 1, stored)
+
+	// a second key that can only signal
+	expiresAt := time.Now().Add(time.Hour).Truncate(time.Second).UTC()
+	signalingKey, err := client.CreateAPIKey(baseURL, defaultKey, client.NewAPIKey{Label: "raspberry pi", ExpiresAt: &expiresAt})
+	require.NoError(t, err)
+	require.NotEmpty(t, signalingKey.Key)
+	require.NotEqual(t, defaultKey, signalingKey.Key)
+	require.Equal(t, signalingKey.Key[:len(signalingKey.Prefix)], signalingKey.Prefix)
+	require.Equal(t, []string{client.ScopeSignaling}, signalingKey.Scopes)
+	require.Equal(t, expiresAt, *signalingKey.ExpiresAt)
+
+	require.Equal(t, http.StatusSwitchingProtocols, dial(signalingKey.Key))
+	require.Equal(t, http.StatusSwitchingProtocols, dial(defaultKey))
+
+	// signaling-only keys can't manage keys
+	_, err = client.ListAPIKeys(baseURL, signalingKey.Key)
+	require.ErrorContains(t, err, "403")
+	_, err = client.CreateAPIKey(baseURL, signalingKey.Key, client.NewAPIKey{Label: "sneaky", Scopes: []string{client.ScopeKeys}})
+	require.ErrorContains(t, err, "403")
+
+	// invalid requests
+	_, err = client.CreateAPIKey(baseURL, defaultKey, client.NewAPIKey{Label: ""})
+	require.ErrorContains(t, err, "422")
+	_, err = client.CreateAPIKey(baseURL, defaultKey, client.NewAPIKey{Label: "admin", Scopes: []string{"admin"}})
+	require.ErrorContains(t, err, "422")
+	past := time.Now().Add(-time.Minute)
+	_, err = client.CreateAPIKey(baseURL, defaultKey, client.NewAPIKey{Label: "expired", ExpiresAt: &past})
+	require.ErrorContains(t, err, "422")
+	_, err = client.ListAPIKeys(baseURL, "not-a-key")
+	require.ErrorContains(t, err, "401")
+
+	// listing shows both keys, used ones with when they were last used, never the keys themselves
+	keys, err := client.ListAPIKeys(baseURL, defaultKey)
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+	require.Equal(t, "default", keys[0].Label)
+	require.ElementsMatch(t, []string{client.ScopeSignaling, client.ScopeKeys}, keys[0].Scopes)
+	require.Equal(t, "raspberry pi", keys[1].Label)
+	require.Equal(t, signalingKey.ID, keys[1].ID)
+	for _, key := range keys {
+		require.Empty(t, key.Key)
+		require.NotNil(t, key.CreatedAt)
+		require.NotNil(t, key.LastUsedAt)
+	}
+
+	// other users can't touch the keys
+	require.NoError(t, client.RegisterUser(baseURL, "patrickstar", "initPass4ever"))
+	patrickKey, err := client.RegenerateAPIKey(baseURL, "patrickstar", "initPass4ever")
+	require.NoError(t, err)
+	require.ErrorContains(t, client.RevokeAPIKey(baseURL, patrickKey, signalingKey.ID), "404")
+	patrickKeys, err := client.ListAPIKeys(baseURL, patrickKey)
+	require.NoError(t, err)
+	require.Len(t, patrickKeys, 1)
+
+	// revoked keys stop working right away
+	require.NoError(t, client.RevokeAPIKey(baseURL, defaultKey, signalingKey.ID))
+	require.Equal(t, http.StatusUnauthorized, dial(signalingKey.Key))
+	require.ErrorContains(t, client.RevokeAPIKey(baseURL, defaultKey, signalingKey.ID), "404")
+
+	// regenerating replaces every key
+	_, err = client.CreateAPIKey(baseURL, defaultKey, client.NewAPIKey{Label: "laptop"})
+	require.NoError(t, err)
+	newKey, err := client.RegenerateAPIKey(baseURL, "spongebob", "initPass4ever")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusUnauthorized, dial(defaultKey))
+	keys, err = client.ListAPIKeys(baseURL, newKey)
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	require.Equal(t, "default", keys[0].Label)
+}
@@ -0,0 +1,285 @@
+package e2e_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sushiag/go-webrtc-signaling-server/client"
+	server "github.com/sushiag/go-webrtc-signaling-server/server/server"
+	sqlitedb "github.com/sushiag/go-webrtc-signaling-server/server/server/register"
+)
+
+type authInfo struct {
+	status    int
+	UserID    int64      `json:"user_id"`
+	Username  string     `json:"username"`
+	Method    string     `json:"method"`
+	Scopes    []string   `json:"scopes"`
+	Rooms     []uint64   `json:"rooms"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	APIKeyID  int64      `json:"api_key_id"`
+}
+
+func TestAuthenticators(t *testing.T) {
+	const testdata = "auth.db"
+	queries, dbConn := sqlitedb.NewDatabase(testdata)
+	defer func() {
+		_ = dbConn.Close()
+		_ = os.Remove(testdata)
+	}()
+
+	ca := newTestCA(t, "signaling test CA")
+	otherCA := newTestCA(t, "someone else's CA")
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{*ca.issue(t, "127.0.0.1", true)},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	}
+
+	// a custom authenticator for a header set by a trusted proxy
+	proxyAuth := authenticatorFunc(func(r *http.Request) (*server.Principal, error) {
+		username := r.Header.Get("X-Proxy-User")
+		if username == "" {
+			return nil, errNoProxyUser
+		}
+		user, err := queries.GetUserByUsername(r.Context(), username)
+		if err != nil {
+			return nil, err
+		}
+		return &server.Principal{User: user, Method: "proxy", Scopes: []string{server.ScopeSignaling}}, nil
+	})
+	opts := server.Options{DisableRateLimits: true, TLS: tlsConfig, Authenticators: []server.Authenticator{proxyAuth}}
+	srv, serverAddr := server.StartServerWithOptions("0", queries, opts)
+	defer srv.Close()
+	baseURL := fmt.Sprintf("https://%s", serverAddr)
+
+	anonymous := httpsClient(ca, nil)
+	get := func(c *http.Client, path string, header http.Header) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, baseURL+path, nil)
+		require.NoError(t, err)
+		req.Header = header
+		resp, err := c.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+	introspect := func(c *http.Client, header http.Header) authInfo {
+		req, err := http.NewRequest(http.MethodGet, baseURL+"/auth", nil)
+		require.NoError(t, err)
+		req.Header = header
+		resp, err := c.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		info := authInfo{status: resp.StatusCode}
+		if resp.StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&info))
+			require.Equal(t, fmt.Sprint(info.UserID), resp.Header.Get("X-Client-ID"))
+		}
+		return info
+	}
+
+	require.Equal(t, http.StatusUnauthorized, introspect(anonymous, nil).status)
+
+	// API keys
+	register := func(username string) string {
+		body := fmt.Sprintf(`{"username": %q, "password": "initPass4ever"}`, username)
+		req, err := http.NewRequest(http.MethodPost, baseURL+"/register", strings.NewReader(body))
+		require.NoError(t, err)
+		resp, err := anonymous.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		var created struct {
+			APIKey string `json:"api_key"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&created))
+		return created.APIKey
+	}
+	apiKey := register("spongebob")
+	info := introspect(anonymous, http.Header{"X-Api-Key": {apiKey}})
+	require.Equal(t, http.StatusOK, info.status)
+	require.Equal(t, "spongebob", info.Username)
+	require.Equal(t, server.AuthAPIKey, info.Method)
+	require.ElementsMatch(t, []string{server.ScopeSignaling, server.ScopeKeys}, info.Scopes)
+	require.NotZero(t, info.APIKeyID)
+	require.Nil(t, info.ExpiresAt)
+	require.Equal(t, http.StatusOK, introspect(anonymous, http.Header{"Authorization": {"Bearer " + apiKey}}).status)
+	require.Equal(t, http.StatusUnauthorized, introspect(anonymous, http.Header{"X-Api-Key": {"not-a-key"}}).status)
+
+	// access tokens only allow signaling, and only in their rooms
+	token := getTokenOver(t, anonymous, baseURL, apiKey, `{"rooms": [7]}`)
+	bearer := http.Header{"Authorization": {"Bearer " + token}}
+	info = introspect(anonymous, bearer)
+	require.Equal(t, http.StatusOK, info.status)
+	require.Equal(t, server.AuthAccessToken, info.Method)
+	require.Equal(t, []string{server.ScopeSignaling}, info.Scopes)
+	require.Equal(t, []uint64{7}, info.Rooms)
+	require.NotNil(t, info.ExpiresAt)
+	require.Equal(t, http.StatusForbidden, get(anonymous, "/apikeys", bearer).StatusCode)
+	require.Equal(t, http.StatusUnauthorized, introspect(anonymous, http.Header{"Authorization": {"Bearer a.b.c"}}).status)
+
+	// a token can't be swapped for one without the room restriction
+	req, err := http.NewRequest(http.MethodPost, baseURL+"/token", nil)
+	require.NoError(t, err)
+	req.Header = bearer
+	resp, err := anonymous.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// client certificates name the user in their common name
+	certClient := httpsClient(ca, ca.issue(t, "spongebob", false))
+	info = introspect(certClient, nil)
+	require.Equal(t, http.StatusOK, info.status)
+	require.Equal(t, "spongebob", info.Username)
+	require.Equal(t, server.AuthClientCert, info.Method)
+	require.ElementsMatch(t, []string{server.ScopeSignaling, server.ScopeKeys}, info.Scopes)
+	require.NotNil(t, info.ExpiresAt)
+	require.Equal(t, http.StatusOK, get(certClient, "/apikeys", nil).StatusCode)
+	require.NotEmpty(t, getTokenOver(t, certClient, baseURL, "", ""))
+
+	// explicit credentials win over the certificate, rejected ones don't fall back to it
+	register("patrickstar")
+	require.Equal(t, http.StatusUnauthorized, introspect(certClient, http.Header{"X-Api-Key": {"not-a-key"}}).status)
+
+	unknownCert := httpsClient(ca, ca.issue(t, "squidward", false))
+	require.Equal(t, http.StatusUnauthorized, introspect(unknownCert, nil).status)
+
+	// certificates of other CAs don't get past the handshake
+	strangerCert := httpsClient(ca, otherCA.issue(t, "spongebob", false))
+	_, err = strangerCert.Get(baseURL + "/auth")
+	require.Error(t, err)
+
+	// /ws takes every kind of credentials that allows signaling
+	dialer := websocket.Dialer{TLSClientConfig: certClient.Transport.(*http.Transport).TLSClientConfig, HandshakeTimeout: 3 * time.Second}
+	wsURL := fmt.Sprintf("wss://%s/ws", serverAddr)
+	for _, header := range []http.Header{nil, {"X-Api-Key": {apiKey}}, bearer, {"X-Proxy-User": {"patrickstar"}}} {
+		conn, resp, err := dialer.Dial(wsURL, header)
+		require.NoError(t, err)
+		require.NotEmpty(t, resp.Header.Get("X-Client-ID"))
+		conn.Close()
+	}
+	anonymousDialer := websocket.Dialer{TLSClientConfig: anonymous.Transport.(*http.Transport).TLSClientConfig, HandshakeTimeout: 3 * time.Second}
+	_, resp, err = anonymousDialer.Dial(wsURL, nil)
+	require.Error(t, err)
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// custom authenticators are asked last
+	info = introspect(anonymous, http.Header{"X-Proxy-User": {"patrickstar"}})
+	require.Equal(t, http.StatusOK, info.status)
+	require.Equal(t, "proxy", info.Method)
+	require.Equal(t, "patrickstar", info.Username)
+	require.Equal(t, http.StatusForbidden, get(anonymous, "/apikeys", http.Header{"X-Proxy-User": {"patrickstar"}}).StatusCode)
+}
+
+var errNoProxyUser = errors.New("no proxy user")
+
+// This adapts a function to server.Authenticator, requests without the proxy header count as
+// carrying no credentials
+type authenticatorFunc func(r *http.Request) (*server.Principal, error)
+
+func (f authenticatorFunc) Authenticate(r *http.Request) (*server.Principal, error) {
+	principal, err := f(r)
+	if errors.Is(err, errNoProxyUser) {
+		return nil, server.ErrNoCredentials
+	}
+	return principal, err
+}
+
+func getTokenOver(t *testing.T, c *http.Client, baseURL, apiKey, body string) string {
+	req, err := http.NewRequest(http.MethodPost, baseURL+"/token", strings.NewReader(body))
+	require.NoError(t, err)
+	if apiKey != "" {
+		req.Header.Set("X-API-Key", apiKey)
+	}
+	resp, err := c.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var token client.AccessToken
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&token))
+	return token.AccessToken
+}
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCA{cert: cert, key: key}
+}
+
+// This issues a server certificate for the IP or a client certificate for the username
+func (ca *testCA) issue(t *testing.T, name string, isServer bool) *tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if isServer {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		template.IPAddresses = []net.IP{net.ParseIP(name)}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// This is a client trusting the CA's server certificates, presenting cert when it isn't nil even
+// if the server doesn't list its CA
+func httpsClient(ca *testCA, cert *tls.Certificate) *http.Client {
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	config := &tls.Config{RootCAs: roots}
+	if cert != nil {
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return cert, nil
+		}
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: config}, Timeout: 5 * time.Second}
+}
@@ -0,0 +1,113 @@
+package e2e_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/pion/webrtc/v4"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sushiag/go-webrtc-signaling-server/client"
+	server "github.com/sushiag/go-webrtc-signaling-server/server/server"
+	sqlitedb "github.com/sushiag/go-webrtc-signaling-server/server/server/register"
+	smsg "signaling-msgs"
+)
+
+func TestSlowConsumerIsDisconnected(t *testing.T) {
+	const testdata = "backpressure.db"
+	const adminKey = "super-secret-admin-key"
+	queries, dbConn := sqlitedb.NewDatabase(testdata)
+
+	srv, serverAddr := server.StartServerWithOptions("0", queries, server.Options{
+		AdminAPIKey:       adminKey,
+		DisableRateLimits: true,
+		SendQueueSize:     4,
+		OverflowPolicy:    server.OverflowDisconnect,
+		WriteTimeout:      500 * time.Millisecond,
+	})
+	defer srv.Close()
+
+	defer func() {
+		_ = dbConn.Close()
+		_ = os.Remove(testdata)
+	}()
+
+	baseURL := fmt.Sprintf("http://%s", serverAddr)
+	wsURL := fmt.Sprintf("ws://%s/ws", serverAddr)
+
+	slowConsumerDisconnects := func() int64 {
+		req, err := http.NewRequest(http.MethodGet, baseURL+"/admin/metrics", nil)
+		require.NoError(t, err)
+		req.Header.Set("X-Admin-Key", adminKey)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var metrics struct {
+			SlowConsumerDisconnects int64 `json:"signaling_slow_consumer_disconnects"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&metrics))
+		return metrics.SlowConsumerDisconnects
+	}
+
+	dial := func(username string) (*websocket.Conn, string) {
+		require.NoError(t, client.RegisterUser(baseURL, username, "initPass4ever"))
+		apiKey, err := client.RegenerateAPIKey(baseURL, username, "initPass4ever")
+		require.NoError(t, err)
+		wsConn, resp, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"X-API-Key": []string{apiKey}})
+		require.NoError(t, err)
+		return wsConn, resp.Header.Get("X-Client-ID")
+	}
+
+	sender, _ := dial("spongebob")
+	defer sender.Close()
+	// this one never reads its messages
+	slowConn, slowID := dial("patrickstar")
+	defer slowConn.Close()
+
+	var to uint64
+	_, err := fmt.Sscan(slowID, &to)
+	require.NoError(t, err)
+
+	before := slowConsumerDisconnects()
+
+	// big messages fill up the socket buffers quickly, after that the server side queue
+	// fills up and the slow client gets dropped
+	sdp := "v=0\r\no=- 0 0 IN IP4 127.0.0.1\r\ns=-\r\nt=0 0\r\n" + strings.Repeat("a=x-padding:"+strings.Repeat("0", 66)+"\r\n", 700)
+	done := make(chan error, 1)
+	go func() {
+		for range 1000 {
+			err := sender.WriteJSON(smsg.MessageAnyPayload{MsgType: smsg.SDP, To: to, Payload: smsg.SDPPayload{SDP: webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: sdp}}})
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	require.Eventually(t, func() bool {
+		return slowConsumerDisconnects() > before
+	}, 10*time.Second, 50*time.Millisecond)
+	require.NoError(t, <-done)
+
+	// the rest of the server keeps working
+	require.NoError(t, sender.SetReadDeadline(time.Now().Add(3*time.Second)))
+	require.NoError(t, sender.WriteJSON(smsg.MessageAnyPayload{MsgType: smsg.CreateRoom}))
+	for {
+		var msg smsg.MessageRawJSONPayload
+		require.NoError(t, sender.ReadJSON(&msg))
+		if msg.MsgType == smsg.RoomCreated {
+			require.Nil(t, msg.Error)
+			break
+		}
+	}
+}
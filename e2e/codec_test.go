@@ -0,0 +1,90 @@
+package e2e_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/require"
+
+	smsg "signaling-msgs"
+
+	"github.com/sushiag/go-webrtc-signaling-server/client"
+	server "github.com/sushiag/go-webrtc-signaling-server/server/server"
+	sqlitedb "github.com/sushiag/go-webrtc-signaling-server/server/server/register"
+)
+
+func TestCodecs(t *testing.T) {
+	const testdata = "codecs.db"
+	queries, dbConn := sqlitedb.NewDatabase(testdata)
+	defer func() {
+		_ = dbConn.Close()
+		_ = os.Remove(testdata)
+	}()
+
+	srv, serverAddr := server.StartServerWithOptions("0", queries, server.Options{DisableRateLimits: true})
+	defer srv.Close()
+	baseURL := fmt.Sprintf("http://%s", serverAddr)
+	wsURL := fmt.Sprintf("ws://%s/ws", serverAddr)
+
+	apiKeys := make(map[string]string)
+	for _, username := range []string{"spongebob", "patrickstar", "squidward"} {
+		require.NoError(t, client.RegisterUser(baseURL, username, "initPass4ever"))
+		apiKey, err := client.RegenerateAPIKey(baseURL, username, "initPass4ever")
+		require.NoError(t, err)
+		apiKeys[username] = apiKey
+	}
+
+	// the server speaks CBOR to clients that ask for it
+	raw, resp, err := (&websocket.Dialer{Subprotocols: []string{smsg.CBOR.Subprotocol()}}).Dial(wsURL, http.Header{"X-API-Key": []string{apiKeys["squidward"]}})
+	require.NoError(t, err)
+	defer raw.Close()
+	require.Equal(t, smsg.CBOR.Subprotocol(), resp.Header.Get("Sec-WebSocket-Protocol"))
+
+	hello, err := smsg.CBOR.Marshal(smsg.MessageAnyPayload{MsgType: smsg.Hello, RequestID: 1, Payload: smsg.HelloPayload{ProtocolVersion: smsg.ProtocolVersion}})
+	require.NoError(t, err)
+	require.NoError(t, raw.WriteMessage(websocket.BinaryMessage, hello))
+	require.NoError(t, raw.SetReadDeadline(time.Now().Add(3*time.Second)))
+	frameType, data, err := raw.ReadMessage()
+	require.NoError(t, err)
+	require.Equal(t, websocket.BinaryMessage, frameType)
+	var welcome smsg.MessageRawJSONPayload
+	require.NoError(t, smsg.CBOR.Unmarshal(data, &welcome))
+	require.Equal(t, smsg.Welcome, welcome.MsgType)
+	require.Equal(t, uint64(1), welcome.RequestID)
+	var payload smsg.WelcomePayload
+	require.NoError(t, json.Unmarshal(welcome.Payload, &payload))
+	require.Equal(t, smsg.ProtocolVersion, payload.ProtocolVersion)
+
+	// a CBOR client and a JSON client signal each other through the server
+	clientA, err := client.NewClientWithKey(wsURL, apiKeys["spongebob"], client.Options{Codec: smsg.CBOR})
+	require.NoError(t, err)
+	clientB, err := client.NewClientWithKey(wsURL, apiKeys["patrickstar"], client.Options{Codec: smsg.JSON})
+	require.NoError(t, err)
+
+	roomID, err := clientA.CreateRoom()
+	require.NoError(t, err)
+	_, err = clientB.JoinRoom(roomID)
+	require.NoError(t, err)
+
+	select {
+	case peerID := <-clientA.GetDataChOpened():
+		require.Equal(t, clientB.GetClientID(), peerID)
+	case <-time.After(5 * time.Second):
+		t.Fatal("clients took longer than 5 secs to open their data channels")
+	}
+	require.Eventually(t, func() bool {
+		return clientB.SendDataToPeer(clientA.GetClientID(), []byte("hello in any codec")) == nil
+	}, 5*time.Second, 50*time.Millisecond)
+	select {
+	case msg := <-clientA.GetPeerDataMsgCh():
+		require.Equal(t, []byte("hello in any codec"), msg.Data)
+	case <-time.After(5 * time.Second):
+		t.Fatal("message didn't arrive")
+	}
+}
@@ -0,0 +1,158 @@
+package e2e_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/websocket"
+
+	"signaling-msgs/schema"
+)
+
+// The JSON messages the server sent over connections dialed with websocket.DefaultDialer, which
+// the client copies. They are checked against the protocol's schema once all tests ran.
+var sentByServer = &messageRecorder{}
+
+func TestMain(m *testing.M) {
+	websocket.DefaultDialer.NetDialContext = sentByServer.dial
+	code := m.Run()
+	if code == 0 {
+		code = checkConformance()
+	}
+	os.Exit(code)
+}
+
+// This validates every recorded message against the schema, it prints the ones that don't match
+func checkConformance() int {
+	validator, err := schema.NewValidator()
+	if err != nil {
+		fmt.Printf("failed to compile the message schema: %v\n", err)
+		return 1
+	}
+
+	sentByServer.mu.Lock()
+	defer sentByServer.mu.Unlock()
+	failed := 0
+	for _, msg := range sentByServer.messages {
+		if err := validator.Validate(msg); err != nil {
+			fmt.Printf("the server sent a message that doesn't match the schema: %s\n%v\n", msg, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		fmt.Printf("%d of %d messages don't match the schema\n", failed, len(sentByServer.messages))
+		return 1
+	}
+	return 0
+}
+
+type messageRecorder struct {
+	mu       sync.Mutex
+	messages [][]byte
+}
+
+func (r *messageRecorder) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &recordingConn{Conn: conn, recorder: r}, nil
+}
+
+func (r *messageRecorder) record(msg []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.messages = append(r.messages, bytes.Clone(msg))
+}
+
+// This reads what the server sends as it goes by, the upgrade response and then the WebSocket
+// frames. Connections that aren't upgraded or that use TLS aren't recorded.
+type recordingConn struct {
+	net.Conn
+	recorder *messageRecorder
+
+	buf      []byte
+	upgraded bool
+	stopped  bool
+	// the text message that is being put together from its frames
+	message []byte
+	inText  bool
+}
+
+func (c *recordingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 && !c.stopped {
+		c.buf = append(c.buf, p[:n]...)
+		c.parse()
+	}
+	return n, err
+}
+
+func (c *recordingConn) parse() {
+	if !c.upgraded {
+		statusLine := []byte("HTTP/1.1 101 ")
+		if !bytes.HasPrefix(c.buf, statusLine[:min(len(c.buf), len(statusLine))]) {
+			c.stopped = true
+			return
+		}
+		end := bytes.Index(c.buf, []byte("\r\n\r\n"))
+		if end < 0 {
+			return
+		}
+		c.buf = c.buf[end+4:]
+		c.upgraded = true
+	}
+
+	for len(c.buf) >= 2 {
+		fin := c.buf[0]&0x80 != 0
+		opcode := int(c.buf[0] & 0x0f)
+		length := uint64(c.buf[1] & 0x7f)
+		header := 2
+		switch length {
+		case 126:
+			if len(c.buf) < 4 {
+				return
+			}
+			length = uint64(binary.BigEndian.Uint16(c.buf[2:4]))
+			header = 4
+		case 127:
+			if len(c.buf) < 10 {
+				return
+			}
+			length = binary.BigEndian.Uint64(c.buf[2:10])
+			header = 10
+		}
+		// frames from the server aren't masked
+		if uint64(len(c.buf)-header) < length {
+			return
+		}
+		payload := c.buf[header : header+int(length)]
+		c.buf = c.buf[header+int(length):]
+
+		switch opcode {
+		case websocket.TextMessage:
+			c.message = append(c.message[:0], payload...)
+			c.inText = true
+		case websocket.BinaryMessage:
+			c.inText = false
+		case 0:
+			if c.inText {
+				c.message = append(c.message, payload...)
+			}
+		default:
+			// control frames can come between the frames of a message
+			continue
+		}
+		if fin && c.inText {
+			c.recorder.record(c.message)
+			c.inText = false
+		}
+	}
+}
@@ -48,7 +48,7 @@ func TestEndToEndSignalingFourUsers(t *testing.T) {
 	nClients := len(apiKeys)
 	clients := make([]*client.Client, nClients)
 	for i := 0; i < nClients; i++ {
-		c, err := client.NewClientWithKey(wsURL, apiKeys[i])
+		c, err := client.NewClientWithKey(wsURL, apiKeys[i], client.Options{})
 		require.NoError(t, err, "failed to initialize client %d", i)
 		clients[i] = c
 	}
@@ -0,0 +1,61 @@
+package e2e_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/require"
+
+	server "github.com/sushiag/go-webrtc-signaling-server/server/server"
+	sqlitedb "github.com/sushiag/go-webrtc-signaling-server/server/server/register"
+)
+
+func TestHealthEndpoints(t *testing.T) {
+	const testdata = "health.db"
+	queries, dbConn := sqlitedb.NewDatabase(testdata)
+
+	srv, serverAddr := server.StartServer("0", queries)
+	defer srv.Close()
+
+	defer func() {
+		_ = dbConn.Close()
+		_ = os.Remove(testdata)
+	}()
+
+	baseURL := fmt.Sprintf("http://%s", serverAddr)
+
+	getJSON := func(path string) (int, map[string]any) {
+		resp, err := http.Get(baseURL + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		var body map[string]any
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		return resp.StatusCode, body
+	}
+
+	code, body := getJSON("/healthz")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "ok", body["status"])
+
+	code, body = getJSON("/readyz")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "ready", body["status"])
+
+	code, body = getJSON("/version")
+	require.Equal(t, http.StatusOK, code)
+	require.NotEmpty(t, body["go_version"])
+
+	// the database going away should make the server not ready while it stays alive
+	require.NoError(t, dbConn.Close())
+
+	code, _ = getJSON("/readyz")
+	require.Equal(t, http.StatusServiceUnavailable, code)
+
+	code, _ = getJSON("/healthz")
+	require.Equal(t, http.StatusOK, code)
+}
@@ -0,0 +1,155 @@
+package e2e_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"maps"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/pion/turn/v4"
+	"github.com/pion/webrtc/v4"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sushiag/go-webrtc-signaling-server/client"
+	server "github.com/sushiag/go-webrtc-signaling-server/server/server"
+	sqlitedb "github.com/sushiag/go-webrtc-signaling-server/server/server/register"
+)
+
+func TestICEServers(t *testing.T) {
+	const testdata = "iceservers.db"
+	queries, dbConn := sqlitedb.NewDatabase(testdata)
+	defer func() {
+		_ = dbConn.Close()
+		_ = os.Remove(testdata)
+	}()
+
+	const secret = "turn-shared-secret"
+	turnAddr, turnUsers := startTURNServer(t, secret)
+	ice := &server.ICEConfig{
+		STUNURLs:   []string{"stun:" + turnAddr},
+		TURNURLs:   []string{"turn:" + turnAddr + "?transport=udp"},
+		TURNSecret: secret,
+	}
+	srv, serverAddr := server.StartServerWithOptions("0", queries, server.Options{DisableRateLimits: true, ICE: ice})
+	defer srv.Close()
+	baseURL := fmt.Sprintf("http://%s", serverAddr)
+	wsURL := fmt.Sprintf("ws://%s/ws", serverAddr)
+
+	require.NoError(t, client.RegisterUser(baseURL, "spongebob", "initPass4ever"))
+	require.NoError(t, client.RegisterUser(baseURL, "patrickstar", "initPass4ever"))
+	apiKeyA, err := client.RegenerateAPIKey(baseURL, "spongebob", "initPass4ever")
+	require.NoError(t, err)
+	apiKeyB, err := client.RegenerateAPIKey(baseURL, "patrickstar", "initPass4ever")
+	require.NoError(t, err)
+
+	// the TURN credentials are the expiry and user ID signed with the shared secret
+	servers, err := client.GetICEServers(baseURL, apiKeyA)
+	require.NoError(t, err)
+	require.Len(t, servers.Servers, 2)
+	require.Equal(t, ice.STUNURLs, servers.Servers[0].URLs)
+	require.Empty(t, servers.Servers[0].Username)
+
+	turnServer := servers.Servers[1]
+	require.Equal(t, ice.TURNURLs, turnServer.URLs)
+	expiry, userID, found := strings.Cut(turnServer.Username, ":")
+	require.True(t, found)
+	require.Equal(t, "1", userID)
+	expiresAt, err := strconv.ParseInt(expiry, 10, 64)
+	require.NoError(t, err)
+	require.NotNil(t, servers.ExpiresAt)
+	require.Equal(t, servers.ExpiresAt.Unix(), expiresAt)
+	require.WithinDuration(t, time.Now().Add(24*time.Hour), *servers.ExpiresAt, time.Minute)
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(turnServer.Username))
+	require.Equal(t, base64.StdEncoding.EncodeToString(mac.Sum(nil)), turnServer.Credential)
+
+	// the servers are for signaling, keys without the scope can't get them
+	_, err = client.GetICEServers(baseURL, "")
+	require.ErrorContains(t, err, "401")
+	keysOnly, err := client.CreateAPIKey(baseURL, apiKeyA, client.NewAPIKey{Label: "laptop", Scopes: []string{client.ScopeKeys}})
+	require.NoError(t, err)
+	_, err = client.GetICEServers(baseURL, keysOnly.Key)
+	require.ErrorContains(t, err, "403")
+
+	// both peers connect with the servers handed out with the room and authenticate at the TURN
+	// server with their own credentials
+	clientA, err := client.NewClientWithKey(wsURL, apiKeyA, client.Options{})
+	require.NoError(t, err)
+	clientB, err := client.NewClientWithKey(wsURL, apiKeyB, client.Options{})
+	require.NoError(t, err)
+
+	roomID, err := clientA.CreateRoom()
+	require.NoError(t, err)
+	_, err = clientB.JoinRoom(roomID)
+	require.NoError(t, err)
+
+	select {
+	case peerID := <-clientA.GetDataChOpened():
+		require.Equal(t, clientB.GetClientID(), peerID)
+	case <-time.After(5 * time.Second):
+		t.Fatal("clients took longer than 5 secs to open their data channels")
+	}
+
+	require.Eventually(t, func() bool {
+		users := turnUsers()
+		return users[clientA.GetClientID()] && users[clientB.GetClientID()]
+	}, 5*time.Second, 20*time.Millisecond)
+
+	// servers without ICE servers leave clients to their own
+	plainSrv, plainAddr := server.StartServerWithOptions("0", queries, server.Options{DisableRateLimits: true})
+	defer plainSrv.Close()
+	servers, err = client.GetICEServers(fmt.Sprintf("http://%s", plainAddr), apiKeyA)
+	require.NoError(t, err)
+	require.Equal(t, []webrtc.ICEServer{}, servers.Servers)
+	require.Nil(t, servers.ExpiresAt)
+}
+
+// This starts a TURN server that accepts credentials derived from secret, the returned func reports
+// the IDs of the users that authenticated at it
+func startTURNServer(t *testing.T, secret string) (string, func() map[uint64]bool) {
+	listener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	var mu sync.Mutex
+	users := make(map[uint64]bool)
+	checkCredentials := turn.LongTermTURNRESTAuthHandler(secret, nil)
+
+	turnServer, err := turn.NewServer(turn.ServerConfig{
+		Realm: "signaling.test",
+		AuthHandler: func(username, realm string, srcAddr net.Addr) ([]byte, bool) {
+			key, ok := checkCredentials(username, realm, srcAddr)
+			if ok {
+				_, userID, _ := strings.Cut(username, ":")
+				id, _ := strconv.ParseUint(userID, 10, 64)
+				mu.Lock()
+				users[id] = true
+				mu.Unlock()
+			}
+			return key, ok
+		},
+		PacketConnConfigs: []turn.PacketConnConfig{{
+			PacketConn: listener,
+			RelayAddressGenerator: &turn.RelayAddressGeneratorStatic{
+				RelayAddress: net.ParseIP("127.0.0.1"),
+				Address:      "127.0.0.1",
+			},
+		}},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { turnServer.Close() })
+
+	return listener.LocalAddr().String(), func() map[uint64]bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return maps.Clone(users)
+	}
+}
@@ -0,0 +1,129 @@
+package e2e_test
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sushiag/go-webrtc-signaling-server/client"
+	server "github.com/sushiag/go-webrtc-signaling-server/server/server"
+	sqlitedb "github.com/sushiag/go-webrtc-signaling-server/server/server/register"
+)
+
+func TestLockoutAndAuthEvents(t *testing.T) {
+	const testdata = "lockout.db"
+	queries, dbConn := sqlitedb.NewDatabase(testdata)
+	defer func() {
+		_ = dbConn.Close()
+		_ = os.Remove(testdata)
+	}()
+
+	lockout := server.LockoutPolicy{Threshold: 3, BaseDelay: time.Second, MaxDelay: 2 * time.Second}
+	srv, serverAddr := server.StartServerWithOptions("0", queries, server.Options{DisableRateLimits: true, Lockout: &lockout})
+	defer srv.Close()
+	baseURL := fmt.Sprintf("http://%s", serverAddr)
+
+	require.NoError(t, client.RegisterUser(baseURL, "spongebob", "initPass4ever"))
+	_, err := client.RegenerateAPIKey(baseURL, "spongebob", "initPass4ever")
+	require.NoError(t, err)
+
+	// failed attempts in a row lock the account, even for the right password
+	for range lockout.Threshold {
+		_, err = client.RegenerateAPIKey(baseURL, "spongebob", "wrongPassword")
+		require.ErrorContains(t, err, "401")
+	}
+	_, err = client.RegenerateAPIKey(baseURL, "spongebob", "initPass4ever")
+	require.ErrorContains(t, err, "429")
+	require.ErrorContains(t, client.ResetPassword(baseURL, "spongebob", "initPass4ever", "newPass4ever"), "429")
+	_, err = client.GetAccessToken(baseURL, client.TokenRequest{Username: "spongebob", Password: "initPass4ever"})
+	require.ErrorContains(t, err, "429")
+
+	// the lock runs out, a successful login resets the count
+	time.Sleep(lockout.BaseDelay + 100*time.Millisecond)
+	apiKey, err := client.RegenerateAPIKey(baseURL, "spongebob", "initPass4ever")
+	require.NoError(t, err)
+	_, err = client.RegenerateAPIKey(baseURL, "spongebob", "wrongPassword")
+	require.ErrorContains(t, err, "401")
+	apiKey, err = client.RegenerateAPIKey(baseURL, "spongebob", "initPass4ever")
+	require.NoError(t, err)
+
+	// the audit trail, newest first
+	events, err := client.ListAuthEvents(baseURL, apiKey, 0)
+	require.NoError(t, err)
+	require.Len(t, events, 11)
+	require.Equal(t, "regenerate", events[0].Event)
+	require.True(t, events[0].Success)
+	require.False(t, events[0].Suspicious)
+	require.Equal(t, "127.0.0.1", events[0].IP)
+	require.Equal(t, "Go-http-client/1.1", events[0].UserAgent)
+	require.NotNil(t, events[0].CreatedAt)
+	require.False(t, events[1].Success)
+
+	var lockouts, failures int
+	for _, event := range events {
+		if event.Event == "lockout" {
+			lockouts++
+			require.True(t, event.Suspicious)
+		}
+		if !event.Success {
+			failures++
+		}
+	}
+	require.Equal(t, 1, lockouts)
+	require.Equal(t, 8, failures)
+
+	events, err = client.ListAuthEvents(baseURL, apiKey, 1)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+
+	// logins from an IP the user never logged in from before are suspicious
+	require.NoError(t, client.RegisterUser(baseURL, "patrickstar", "initPass4ever"))
+	_, err = dbConn.Exec(`INSERT INTO auth_events (user_id, username, event, success, ip, user_agent)
+		SELECT id, username, 'token', 1, '10.1.1.1', 'curl' FROM users WHERE username = 'patrickstar'`)
+	require.NoError(t, err)
+	patrickKey, err := client.RegenerateAPIKey(baseURL, "patrickstar", "initPass4ever")
+	require.NoError(t, err)
+	events, err = client.ListAuthEvents(baseURL, patrickKey, 0)
+	require.NoError(t, err)
+	// users only see their own events
+	require.Len(t, events, 2)
+	require.True(t, events[0].Suspicious)
+	require.Equal(t, "10.1.1.1", events[1].IP)
+
+	_, err = client.ListAuthEvents(baseURL, "not-a-key", 0)
+	require.ErrorContains(t, err, "401")
+}
+
+func TestUnknownUsersTakeAsLong(t *testing.T) {
+	const testdata = "unknownusers.db"
+	queries, dbConn := sqlitedb.NewDatabase(testdata)
+	defer func() {
+		_ = dbConn.Close()
+		_ = os.Remove(testdata)
+	}()
+
+	srv, serverAddr := server.StartServerWithOptions("0", queries, server.Options{DisableRateLimits: true})
+	defer srv.Close()
+	baseURL := fmt.Sprintf("http://%s", serverAddr)
+	require.NoError(t, client.RegisterUser(baseURL, "spongebob", "initPass4ever"))
+
+	// the fastest of a few attempts, so a busy machine doesn't make either look slow
+	fastest := func(username string) time.Duration {
+		var best time.Duration
+		for i := range 3 {
+			start := time.Now()
+			_, err := client.RegenerateAPIKey(baseURL, username, "wrongPassword")
+			require.ErrorContains(t, err, "401")
+			if took := time.Since(start); i == 0 || took < best {
+				best = took
+			}
+		}
+		return best
+	}
+	known, unknown := fastest("spongebob"), fastest("planktonplankton")
+	require.Greater(t, unknown, known/2, "unknown users took %s, known ones %s", unknown, known)
+}
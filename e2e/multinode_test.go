@@ -0,0 +1,229 @@
+package e2e_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gorilla/websocket"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/pion/webrtc/v4"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sushiag/go-webrtc-signaling-server/client"
+	server "github.com/sushiag/go-webrtc-signaling-server/server/server"
+	"github.com/sushiag/go-webrtc-signaling-server/server/server/redisbus"
+	sqlitedb "github.com/sushiag/go-webrtc-signaling-server/server/server/register"
+	smsg "signaling-msgs"
+)
+
+func TestMultiNodeSignaling(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		bus := server.NewMemoryBus()
+		defer bus.Close()
+		testMultiNodeSignaling(t, "multinode_memory.db", bus, bus)
+	})
+
+	t.Run("redis", func(t *testing.T) {
+		redisServer := miniredis.RunT(t)
+
+		newBus := func() *redisbus.Bus {
+			redisClient := redis.NewClient(&redis.Options{Addr: redisServer.Addr()})
+			t.Cleanup(func() { _ = redisClient.Close() })
+			bus := redisbus.New(redisClient)
+			t.Cleanup(func() { _ = bus.Close() })
+			return bus
+		}
+		testMultiNodeSignaling(t, "multinode_redis.db", newBus(), newBus())
+	})
+}
+
+// This connects two peers to two different nodes sharing a database and checks that they can
+// share a room and signal each other through the bus
+func testMultiNodeSignaling(t *testing.T, testdata string, bus1 server.Bus, bus2 server.Bus) {
+	const adminKey = "super-secret-admin-key"
+	queries, dbConn := sqlitedb.NewDatabase(testdata)
+
+	srv1, addr1 := server.StartServerWithOptions("0", queries, server.Options{Bus: bus1, NodeID: 1, AdminAPIKey: adminKey})
+	defer srv1.Close()
+	srv2, addr2 := server.StartServerWithOptions("0", queries, server.Options{Bus: bus2, NodeID: 2})
+	defer srv2.Close()
+
+	defer func() {
+		_ = dbConn.Close()
+		_ = os.Remove(testdata)
+	}()
+
+	dial := func(addr string, username string) (*websocket.Conn, uint64) {
+		baseURL := fmt.Sprintf("http://%s", addr)
+		require.NoError(t, client.RegisterUser(baseURL, username, "initPass4ever"))
+		apiKey, err := client.RegenerateAPIKey(baseURL, username, "initPass4ever")
+		require.NoError(t, err)
+
+		wsConn, resp, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://%s/ws", addr), http.Header{"X-API-Key": []string{apiKey}})
+		require.NoError(t, err)
+		var userID uint64
+		_, err = fmt.Sscan(resp.Header.Get("X-Client-ID"), &userID)
+		require.NoError(t, err)
+		return wsConn, userID
+	}
+
+	readMsg := func(wsConn *websocket.Conn) smsg.MessageRawJSONPayload {
+		require.NoError(t, wsConn.SetReadDeadline(time.Now().Add(3*time.Second)))
+		var msg smsg.MessageRawJSONPayload
+		require.NoError(t, wsConn.ReadJSON(&msg))
+		return msg
+	}
+
+	host, hostID := dial(addr1, "spongebob")
+	defer host.Close()
+	guest, guestID := dial(addr2, "patrickstar")
+	defer guest.Close()
+
+	// the room lives on the host's node
+	require.NoError(t, host.WriteJSON(smsg.MessageAnyPayload{MsgType: smsg.CreateRoom}))
+	created := readMsg(host)
+	require.Equal(t, smsg.RoomCreated, created.MsgType)
+	var createdPayload smsg.RoomCreatedPayload
+	require.NoError(t, json.Unmarshal(created.Payload, &createdPayload))
+
+	// the guest joins it through the other node, the reply still carries the request's ID
+	require.NoError(t, guest.WriteJSON(smsg.MessageAnyPayload{MsgType: smsg.JoinRoom, RequestID: 42, Payload: smsg.JoinRoomPayload{RoomID: createdPayload.RoomID}}))
+	joined := readMsg(guest)
+	require.Equal(t, smsg.RoomJoined, joined.MsgType)
+	require.Equal(t, uint64(42), joined.RequestID)
+	var joinedPayload smsg.RoomJoinedPayload
+	require.NoError(t, json.Unmarshal(joined.Payload, &joinedPayload))
+	require.Equal(t, createdPayload.RoomID, joinedPayload.RoomID)
+	require.ElementsMatch(t, []uint64{hostID, guestID}, joinedPayload.ClientsInRoom)
+
+	// signaling works both ways
+	candidate := smsg.ICECandidatePayload{ICE: webrtc.ICECandidateInit{Candidate: "candidate:1 1 udp 2122260223 10.0.0.1 54321 typ host"}}
+	require.NoError(t, host.WriteJSON(smsg.MessageAnyPayload{MsgType: smsg.ICECandidate, To: guestID, Payload: candidate}))
+	forwarded := readMsg(guest)
+	require.Equal(t, smsg.ICECandidate, forwarded.MsgType)
+	require.Equal(t, hostID, forwarded.From)
+	var forwardedCandidate smsg.ICECandidatePayload
+	require.NoError(t, json.Unmarshal(forwarded.Payload, &forwardedCandidate))
+	require.Equal(t, candidate, forwardedCandidate)
+
+	require.NoError(t, guest.WriteJSON(smsg.MessageAnyPayload{MsgType: smsg.ICECandidate, To: hostID, Payload: candidate}))
+	forwarded = readMsg(host)
+	require.Equal(t, smsg.ICECandidate, forwarded.MsgType)
+	require.Equal(t, guestID, forwarded.From)
+
+	// messages for users on the other node are only acked once they got there, users connected
+	// nowhere get the same error as on a single node
+	require.NoError(t, host.WriteJSON(smsg.MessageAnyPayload{MsgType: smsg.ICECandidate, To: guestID, RequestID: 7, Payload: candidate}))
+	require.Equal(t, smsg.ICECandidate, readMsg(guest).MsgType)
+	ack := readMsg(host)
+	require.Equal(t, smsg.Ack, ack.MsgType)
+	require.Equal(t, uint64(7), ack.RequestID)
+	require.Nil(t, ack.Error)
+
+	require.NoError(t, host.WriteJSON(smsg.MessageAnyPayload{MsgType: smsg.ICECandidate, To: 999_999, RequestID: 8, Payload: candidate}))
+	require.NoError(t, host.SetReadDeadline(time.Now().Add(5*time.Second)))
+	require.NoError(t, host.ReadJSON(&ack))
+	require.Equal(t, smsg.Ack, ack.MsgType)
+	require.Equal(t, uint64(8), ack.RequestID)
+	require.NotNil(t, ack.Error)
+	require.Equal(t, smsg.CodePeerNotFound, ack.Error.Code)
+
+	adminRequest := func(method string, path string, out any) int {
+		req, err := http.NewRequest(method, fmt.Sprintf("http://%s%s", addr1, path), nil)
+		require.NoError(t, err)
+		req.Header.Set("X-Admin-Key", adminKey)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		if out != nil {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(out))
+		}
+		return resp.StatusCode
+	}
+
+	// the remote guest shows up in the room on the host's node and gets notified when it's closed
+	var rooms []struct {
+		RoomID  uint64   `json:"room_id"`
+		Members []uint64 `json:"members"`
+	}
+	require.Equal(t, http.StatusOK, adminRequest(http.MethodGet, "/admin/rooms", &rooms))
+	require.Len(t, rooms, 1)
+	require.ElementsMatch(t, []uint64{hostID, guestID}, rooms[0].Members)
+
+	require.Equal(t, http.StatusNoContent, adminRequest(http.MethodDelete, fmt.Sprintf("/admin/rooms/%d", createdPayload.RoomID), nil))
+	require.Equal(t, smsg.RoomClosed, readMsg(host).MsgType)
+	require.Equal(t, smsg.RoomClosed, readMsg(guest).MsgType)
+
+	// a guest disconnecting from its node is removed from the room on the other node
+	require.NoError(t, host.WriteJSON(smsg.MessageAnyPayload{MsgType: smsg.CreateRoom}))
+	created = readMsg(host)
+	require.NoError(t, json.Unmarshal(created.Payload, &createdPayload))
+	require.NoError(t, guest.WriteJSON(smsg.MessageAnyPayload{MsgType: smsg.JoinRoom, Payload: smsg.JoinRoomPayload{RoomID: createdPayload.RoomID}}))
+	require.Equal(t, smsg.RoomJoined, readMsg(guest).MsgType)
+
+	require.NoError(t, guest.Close())
+	require.Eventually(t, func() bool {
+		require.Equal(t, http.StatusOK, adminRequest(http.MethodGet, "/admin/rooms", &rooms))
+		return len(rooms) == 1 && len(rooms[0].Members) == 1 && rooms[0].Members[0] == hostID
+	}, 3*time.Second, 50*time.Millisecond)
+}
+
+// This is a bus whose publishes hang until they time out, like a partitioned Redis
+type stalledBus struct {
+	*server.MemoryBus
+}
+
+func (b stalledBus) Publish(ctx context.Context, _ string, _ []byte) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestStalledBusDoesNotBlockShards(t *testing.T) {
+	const testdata = "stalledbus.db"
+	queries, dbConn := sqlitedb.NewDatabase(testdata)
+	defer func() {
+		_ = dbConn.Close()
+		_ = os.Remove(testdata)
+	}()
+
+	bus := stalledBus{server.NewMemoryBus()}
+	defer bus.Close()
+	srv, serverAddr := server.StartServerWithOptions("0", queries, server.Options{DisableRateLimits: true, Bus: bus, NodeID: 1, Shards: 1})
+	defer srv.Close()
+	baseURL := fmt.Sprintf("http://%s", serverAddr)
+
+	conns := make(map[string]*websocket.Conn)
+	var receiverID uint64
+	for _, username := range []string{"spongebob", "patrickstar"} {
+		require.NoError(t, client.RegisterUser(baseURL, username, "initPass4ever"))
+		apiKey, err := client.RegenerateAPIKey(baseURL, username, "initPass4ever")
+		require.NoError(t, err)
+		conn, resp, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://%s/ws", serverAddr), http.Header{"X-API-Key": []string{apiKey}})
+		require.NoError(t, err)
+		defer conn.Close()
+		conns[username] = conn
+		_, err = fmt.Sscan(resp.Header.Get("X-Client-ID"), &receiverID)
+		require.NoError(t, err)
+	}
+	sender, receiver := conns["spongebob"], conns["patrickstar"]
+
+	// a message for a user that isn't on this node goes to the bus, which hangs
+	candidate := smsg.ICECandidatePayload{ICE: webrtc.ICECandidateInit{Candidate: "candidate:1 1 udp 2122260223 203.0.113.7 54321 typ host"}}
+	require.NoError(t, sender.WriteJSON(smsg.MessageAnyPayload{MsgType: smsg.ICECandidate, To: 999, Payload: candidate}))
+
+	// the shard keeps forwarding between its own users in the meantime
+	start := time.Now()
+	require.NoError(t, sender.WriteJSON(smsg.MessageAnyPayload{MsgType: smsg.ICECandidate, To: receiverID, Payload: candidate}))
+	require.NoError(t, receiver.SetReadDeadline(time.Now().Add(3*time.Second)))
+	var msg smsg.MessageRawJSONPayload
+	require.NoError(t, receiver.ReadJSON(&msg))
+	require.Equal(t, smsg.ICECandidate, msg.MsgType)
+	require.Less(t, time.Since(start), time.Second)
+}
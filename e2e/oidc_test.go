@@ -0,0 +1,315 @@
+package e2e_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sushiag/go-webrtc-signaling-server/client"
+	server "github.com/sushiag/go-webrtc-signaling-server/server/server"
+	"github.com/sushiag/go-webrtc-signaling-server/server/server/db"
+	sqlitedb "github.com/sushiag/go-webrtc-signaling-server/server/server/register"
+)
+
+func TestOIDCLogin(t *testing.T) {
+	const testdata = "oidc.db"
+	queries, dbConn := sqlitedb.NewDatabase(testdata)
+	defer func() {
+		_ = dbConn.Close()
+		_ = os.Remove(testdata)
+	}()
+
+	provider := newMockOIDCProvider(t, "signaling", "s3cret")
+
+	oidcConfig := &server.OIDCConfig{Issuer: provider.URL, ClientID: "signaling", ClientSecret: "s3cret"}
+	srv, serverAddr := server.StartServerWithOptions("0", queries, server.Options{DisableRateLimits: true, OIDC: oidcConfig})
+	defer srv.Close()
+	baseURL := fmt.Sprintf("http://%s", serverAddr)
+
+	dial := func(header http.Header) int {
+		conn, resp, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://%s/ws", serverAddr), header)
+		if err == nil {
+			conn.Close()
+		}
+		require.NotNil(t, resp)
+		return resp.StatusCode
+	}
+
+	// the first login provisions a user named after the provider's username
+	provider.setUser("1001", "sandy.cheeks")
+	login := oidcLogin(t, baseURL, "")
+	require.Equal(t, http.StatusOK, login.status)
+	require.True(t, login.Created)
+	require.Equal(t, "sandy_cheeks", login.Username)
+	require.Equal(t, "Bearer", login.TokenType)
+	require.Equal(t, http.StatusSwitchingProtocols, dial(http.Header{"Authorization": []string{"Bearer " + login.AccessToken}}))
+
+	// later logins find the linked user, API keys can be asked for instead of access tokens
+	login = oidcLogin(t, baseURL, "?issue=api_key")
+	require.Equal(t, http.StatusOK, login.status)
+	require.False(t, login.Created)
+	require.Equal(t, "sandy_cheeks", login.Username)
+	require.Empty(t, login.AccessToken)
+	require.Equal(t, http.StatusSwitchingProtocols, dial(http.Header{"X-API-Key": []string{login.APIKey}}))
+
+	// provisioned users have no password
+	_, err := client.GetAccessToken(baseURL, client.TokenRequest{Username: "sandy_cheeks", Password: ""})
+	require.ErrorContains(t, err, "401")
+
+	// another provider user with the same name gets a numbered name
+	provider.setUser("1002", "sandy.cheeks")
+	login = oidcLogin(t, baseURL, "")
+	require.Equal(t, http.StatusOK, login.status)
+	require.True(t, login.Created)
+	require.Equal(t, "sandy_cheeks2", login.Username)
+
+	// disabled users can't log in
+	_, err = queries.SetUserDisabled(context.Background(), db.SetUserDisabledParams{Disabled: 1, Username: "sandy_cheeks2"})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusForbidden, oidcLogin(t, baseURL, "").status)
+
+	// callbacks need the login that was started in the same browser
+	resp, err := http.Get(baseURL + "/auth/oidc/callback?code=stolen&state=guessed")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// logins the provider refused
+	provider.setRefuse(true)
+	require.Equal(t, http.StatusUnauthorized, oidcLogin(t, baseURL, "").status)
+	provider.setRefuse(false)
+
+	// names shorter than registered usernames are padded
+	provider.setUser("1005", "bob")
+	login = oidcLogin(t, baseURL, "")
+	require.Equal(t, http.StatusOK, login.status)
+	require.True(t, login.Created)
+	require.Equal(t, "bob_user", login.Username)
+
+	// provisioned users export and delete their account with the access token of a fresh login,
+	// API keys and tokens exchanged for them don't do
+	provider.setUser("1004", "plankton")
+	login = oidcLogin(t, baseURL, "?issue=api_key")
+	require.Equal(t, http.StatusOK, login.status)
+	_, err = client.GetAccount(baseURL, login.APIKey)
+	require.ErrorContains(t, err, "403")
+	require.ErrorContains(t, client.DeleteAccount(baseURL, login.APIKey, ""), "403")
+	exchanged, err := client.GetAccessToken(baseURL, client.TokenRequest{APIKey: login.APIKey})
+	require.NoError(t, err)
+	_, err = client.GetAccountWithToken(baseURL, exchanged.AccessToken)
+	require.ErrorContains(t, err, "403")
+	require.ErrorContains(t, client.DeleteAccountWithToken(baseURL, exchanged.AccessToken), "403")
+
+	login = oidcLogin(t, baseURL, "")
+	require.Equal(t, http.StatusOK, login.status)
+	account, err := client.GetAccountWithToken(baseURL, login.AccessToken)
+	require.NoError(t, err)
+	require.Equal(t, "plankton", account.Username)
+	require.False(t, account.HasPassword)
+	require.Len(t, account.Identities, 1)
+	require.Equal(t, "1004", account.Identities[0].Subject)
+	require.Equal(t, http.StatusSwitchingProtocols, dial(http.Header{"Authorization": []string{"Bearer " + login.AccessToken}}))
+	require.NoError(t, client.DeleteAccountWithToken(baseURL, login.AccessToken))
+	_, err = queries.GetUserByUsername(context.Background(), "plankton")
+	require.ErrorIs(t, err, sql.ErrNoRows)
+	require.Equal(t, http.StatusUnauthorized, dial(http.Header{"Authorization": []string{"Bearer " + login.AccessToken}}))
+
+	// linking to existing local users by name when configured to
+	require.NoError(t, client.RegisterUser(baseURL, "patrickstar", "initPass4ever"))
+	linkConfig := *oidcConfig
+	linkConfig.LinkExistingUsers = true
+	linkSrv, linkAddr := server.StartServerWithOptions("0", queries, server.Options{DisableRateLimits: true, OIDC: &linkConfig})
+	defer linkSrv.Close()
+
+	provider.setUser("1003", "patrickstar")
+	login = oidcLogin(t, fmt.Sprintf("http://%s", linkAddr), "")
+	require.Equal(t, http.StatusOK, login.status)
+	require.False(t, login.Created)
+	require.Equal(t, "patrickstar", login.Username)
+}
+
+type oidcLoginResponse struct {
+	status      int
+	Username    string `json:"username"`
+	Created     bool   `json:"created"`
+	APIKey      string `json:"api_key"`
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+}
+
+// This runs the whole login like a browser would, following the redirects with its own cookies
+func oidcLogin(t *testing.T, baseURL, query string) oidcLoginResponse {
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	browser := &http.Client{Jar: jar, Timeout: 5 * time.Second}
+
+	resp, err := browser.Get(baseURL + "/auth/oidc/login" + query)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	result := oidcLoginResponse{status: resp.StatusCode}
+	if resp.StatusCode == http.StatusOK {
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	}
+	return result
+}
+
+// This is a minimal OpenID Connect provider that logs in whichever user was set last without asking
+type mockOIDCProvider struct {
+	*httptest.Server
+	t            *testing.T
+	clientID     string
+	clientSecret string
+	key          *rsa.PrivateKey
+
+	mu       sync.Mutex
+	subject  string
+	username string
+	refuse   bool
+	// authorization requests waiting for their code to be exchanged
+	codes map[string]url.Values
+}
+
+func newMockOIDCProvider(t *testing.T, clientID, clientSecret string) *mockOIDCProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	p := &mockOIDCProvider{t: t, clientID: clientID, clientSecret: clientSecret, key: key, codes: make(map[string]url.Values)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.discovery)
+	mux.HandleFunc("/authorize", p.authorize)
+	mux.HandleFunc("/token", p.token)
+	mux.HandleFunc("/jwks", p.jwks)
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+func (p *mockOIDCProvider) setUser(subject, username string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.subject, p.username = subject, username
+}
+
+func (p *mockOIDCProvider) setRefuse(refuse bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.refuse = refuse
+}
+
+func (p *mockOIDCProvider) discovery(w http.ResponseWriter, r *http.Request) {
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"issuer":                                p.URL,
+		"authorization_endpoint":                p.URL + "/authorize",
+		"token_endpoint":                        p.URL + "/token",
+		"jwks_uri":                              p.URL + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (p *mockOIDCProvider) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	redirect, err := url.Parse(query.Get("redirect_uri"))
+	if err != nil || query.Get("client_id") != p.clientID || query.Get("response_type") != "code" {
+		http.Error(w, "bad authorization request", http.StatusBadRequest)
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	back := url.Values{"state": {query.Get("state")}}
+	if p.refuse {
+		back.Set("error", "access_denied")
+	} else {
+		code := fmt.Sprintf("code-%d", len(p.codes))
+		query.Set("sub", p.subject)
+		query.Set("preferred_username", p.username)
+		p.codes[code] = query
+		back.Set("code", code)
+	}
+	redirect.RawQuery = back.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (p *mockOIDCProvider) token(w http.ResponseWriter, r *http.Request) {
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID, clientSecret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+	}
+	if clientID != p.clientID || clientSecret != p.clientSecret {
+		http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+		return
+	}
+
+	p.mu.Lock()
+	request, exists := p.codes[r.PostFormValue("code")]
+	delete(p.codes, r.PostFormValue("code"))
+	p.mu.Unlock()
+
+	// the code only works once and only with the verifier of the login that got it
+	challenge := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if !exists || base64.RawURLEncoding.EncodeToString(challenge[:]) != request.Get("code_challenge") {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"error":"invalid_grant"}`))
+		return
+	}
+
+	now := time.Now()
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":                p.URL,
+		"aud":                p.clientID,
+		"sub":                request.Get("sub"),
+		"nonce":              request.Get("nonce"),
+		"preferred_username": request.Get("preferred_username"),
+		"iat":                now.Unix(),
+		"exp":                now.Add(time.Minute).Unix(),
+	})
+	idToken.Header["kid"] = "mock"
+	signed, err := idToken.SignedString(p.key)
+	require.NoError(p.t, err)
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"access_token": "mock-access-token",
+		"token_type":   "Bearer",
+		"expires_in":   60,
+		"id_token":     signed,
+	})
+}
+
+func (p *mockOIDCProvider) jwks(w http.ResponseWriter, r *http.Request) {
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "mock",
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(p.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(p.key.E)).Bytes()),
+		}},
+	})
+}
@@ -0,0 +1,266 @@
+package e2e_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sushiag/go-webrtc-signaling-server/client"
+	server "github.com/sushiag/go-webrtc-signaling-server/server/server"
+	sqlitedb "github.com/sushiag/go-webrtc-signaling-server/server/server/register"
+)
+
+var resetTokenReg = regexp.MustCompile(`[0-9a-f]{64}`)
+
+func TestPasswordReset(t *testing.T) {
+	const testdata = "passwordreset.db"
+	queries, dbConn := sqlitedb.NewDatabase(testdata)
+	defer func() {
+		_ = dbConn.Close()
+		_ = os.Remove(testdata)
+	}()
+
+	mailer := &server.MemoryMailer{}
+	reset := &server.PasswordResetConfig{Mailer: mailer, URL: "https://app.example.com/reset?lang=en"}
+	lockout := server.LockoutPolicy{Threshold: 2, BaseDelay: time.Hour, MaxDelay: time.Hour}
+	srv, serverAddr := server.StartServerWithOptions("0", queries, server.Options{DisableRateLimits: true, Lockout: &lockout, PasswordReset: reset})
+	defer srv.Close()
+	baseURL := fmt.Sprintf("http://%s", serverAddr)
+
+	// the email can be given on registration or set later
+	register := func(username, email string) int {
+		body, err := json.Marshal(map[string]string{"username": username, "password": "initPass4ever", "email": email})
+		require.NoError(t, err)
+		resp, err := http.Post(baseURL+"/register", "application/json", bytes.NewReader(body))
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	require.Equal(t, http.StatusCreated, register("spongebob", "SpongeBob@BikiniBottom.sea"))
+	require.Equal(t, http.StatusConflict, register("spongebob2", "spongebob@bikinibottom.sea"))
+	require.Equal(t, http.StatusUnprocessableEntity, register("spongebob3", "Bob <spongebob@bikinibottom.sea>"))
+
+	require.NoError(t, client.RegisterUser(baseURL, "patrickstar", "initPass4ever"))
+	patrickKey, err := client.RegenerateAPIKey(baseURL, "patrickstar", "initPass4ever")
+	require.NoError(t, err)
+	require.ErrorContains(t, client.SetEmail(baseURL, patrickKey, "spongebob@bikinibottom.sea"), "409")
+	require.ErrorContains(t, client.SetEmail(baseURL, patrickKey, "not an email"), "422")
+	require.NoError(t, client.SetEmail(baseURL, patrickKey, "patrick@bikinibottom.sea"))
+	account, err := client.GetAccount(baseURL, patrickKey)
+	require.NoError(t, err)
+	require.Equal(t, "patrick@bikinibottom.sea", account.Email)
+	require.NoError(t, client.SetEmail(baseURL, patrickKey, ""))
+	account, err = client.GetAccount(baseURL, patrickKey)
+	require.NoError(t, err)
+	require.Empty(t, account.Email)
+
+	// unknown addresses look the same but get no mail
+	require.NoError(t, client.ForgotPassword(baseURL, "patrick@bikinibottom.sea"))
+	require.ErrorContains(t, client.ForgotPassword(baseURL, "nope"), "422")
+
+	// spongebob forgot the password and got locked out trying
+	oldKey, err := client.RegenerateAPIKey(baseURL, "spongebob", "initPass4ever")
+	require.NoError(t, err)
+	for range lockout.Threshold {
+		_, err = client.RegenerateAPIKey(baseURL, "spongebob", "forgotten")
+		require.ErrorContains(t, err, "401")
+	}
+
+	forgot := func() (server.Mail, string) {
+		sent := len(mailer.Sent())
+		require.NoError(t, client.ForgotPassword(baseURL, "SPONGEBOB@bikinibottom.sea"))
+		require.Eventually(t, func() bool { return len(mailer.Sent()) == sent+1 }, 3*time.Second, 20*time.Millisecond)
+		mail := mailer.Sent()[sent]
+
+		link, err := url.Parse(regexp.MustCompile(`https://\S+`).FindString(mail.Body))
+		require.NoError(t, err)
+		require.Equal(t, "app.example.com", link.Host)
+		require.Equal(t, "en", link.Query().Get("lang"))
+		return mail, link.Query().Get("token")
+	}
+	mail, firstToken := forgot()
+	require.Equal(t, "spongebob@bikinibottom.sea", mail.To)
+	require.Contains(t, mail.Body, "spongebob")
+	require.Len(t, mailer.Sent(), 1)
+
+	// only the newest token works
+	_, token := forgot()
+	_, err = client.ResetPasswordWithToken(baseURL, firstToken, "newPass4ever")
+	require.ErrorContains(t, err, "401")
+	_, err = client.ResetPasswordWithToken(baseURL, token, "short")
+	require.ErrorContains(t, err, "422")
+
+	// a session opened with the old key is closed by the reset
+	wsConn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://%s/ws", serverAddr), http.Header{"X-API-Key": []string{oldKey}})
+	require.NoError(t, err)
+	defer wsConn.Close()
+
+	newKey, err := client.ResetPasswordWithToken(baseURL, token, "newPass4ever")
+	require.NoError(t, err)
+
+	require.NoError(t, wsConn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	for {
+		_, _, err = wsConn.ReadMessage()
+		if err != nil {
+			break
+		}
+	}
+	var closeErr *websocket.CloseError
+	require.True(t, errors.As(err, &closeErr), "expected a close error, got %v", err)
+	require.Equal(t, websocket.ClosePolicyViolation, closeErr.Code)
+	require.Equal(t, "password reset", closeErr.Text)
+
+	// the token is used up, the old key and password are gone and the lockout is lifted
+	_, err = client.ResetPasswordWithToken(baseURL, token, "otherPass4ever")
+	require.ErrorContains(t, err, "401")
+	_, err = client.GetAccount(baseURL, oldKey)
+	require.ErrorContains(t, err, "401")
+	account, err = client.GetAccount(baseURL, newKey)
+	require.NoError(t, err)
+	require.Zero(t, account.FailedLogins)
+	require.Nil(t, account.LockedUntil)
+	require.Equal(t, "password_reset", account.AuthEvents[0].Event)
+	require.True(t, account.AuthEvents[0].Success)
+	_, err = client.RegenerateAPIKey(baseURL, "spongebob", "initPass4ever")
+	require.ErrorContains(t, err, "401")
+	_, err = client.RegenerateAPIKey(baseURL, "spongebob", "newPass4ever")
+	require.NoError(t, err)
+
+	// expired tokens don't work
+	_, token = forgot()
+	_, err = dbConn.Exec("UPDATE password_resets SET expires_at = '2000-01-01 00:00:00'")
+	require.NoError(t, err)
+	_, err = client.ResetPasswordWithToken(baseURL, token, "otherPass4ever")
+	require.ErrorContains(t, err, "401")
+
+	// servers without a mailer don't offer resets
+	plainSrv, plainAddr := server.StartServerWithOptions("0", queries, server.Options{DisableRateLimits: true})
+	defer plainSrv.Close()
+	require.ErrorContains(t, client.ForgotPassword(fmt.Sprintf("http://%s", plainAddr), "spongebob@bikinibottom.sea"), "404")
+}
+
+func TestPasswordResetOverSMTP(t *testing.T) {
+	const testdata = "passwordreset_smtp.db"
+	queries, dbConn := sqlitedb.NewDatabase(testdata)
+	defer func() {
+		_ = dbConn.Close()
+		_ = os.Remove(testdata)
+	}()
+
+	smtpAddr, received := startSMTPStandIn(t)
+	reset := &server.PasswordResetConfig{Mailer: &server.SMTPMailer{Addr: smtpAddr, From: "noreply@signaling.test"}}
+	srv, serverAddr := server.StartServerWithOptions("0", queries, server.Options{DisableRateLimits: true, PasswordReset: reset})
+	defer srv.Close()
+	baseURL := fmt.Sprintf("http://%s", serverAddr)
+
+	require.NoError(t, client.RegisterUser(baseURL, "squidward", "initPass4ever"))
+	apiKey, err := client.RegenerateAPIKey(baseURL, "squidward", "initPass4ever")
+	require.NoError(t, err)
+	require.NoError(t, client.SetEmail(baseURL, apiKey, "squidward@bikinibottom.sea"))
+	require.NoError(t, client.ForgotPassword(baseURL, "squidward@bikinibottom.sea"))
+
+	var msg smtpMessage
+	select {
+	case msg = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no mail was sent")
+	}
+	require.Equal(t, "noreply@signaling.test", msg.from)
+	require.Equal(t, []string{"squidward@bikinibottom.sea"}, msg.to)
+
+	parsed, err := mail.ReadMessage(strings.NewReader(msg.data))
+	require.NoError(t, err)
+	require.Equal(t, "squidward@bikinibottom.sea", parsed.Header.Get("To"))
+	require.Equal(t, "Reset your password", parsed.Header.Get("Subject"))
+	var body bytes.Buffer
+	_, err = body.ReadFrom(parsed.Body)
+	require.NoError(t, err)
+
+	// without a reset page the mail carries the bare token
+	token := resetTokenReg.FindString(body.String())
+	require.NotEmpty(t, token)
+	_, err = client.ResetPasswordWithToken(baseURL, token, "newPass4ever")
+	require.NoError(t, err)
+	_, err = client.RegenerateAPIKey(baseURL, "squidward", "newPass4ever")
+	require.NoError(t, err)
+}
+
+type smtpMessage struct {
+	from string
+	to   []string
+	data string
+}
+
+// This is just enough of an SMTP server for net/smtp to deliver mail to, every delivered message is
+// sent on the returned channel
+func startSMTPStandIn(t *testing.T) (string, <-chan smtpMessage) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	received := make(chan smtpMessage, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSMTP(conn, received)
+		}
+	}()
+	return listener.Addr().String(), received
+}
+
+func serveSMTP(conn net.Conn, received chan<- smtpMessage) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+
+	var msg smtpMessage
+	_ = tp.PrintfLine("220 localhost stand-in")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			_ = tp.PrintfLine("250 localhost")
+		case "MAIL":
+			msg = smtpMessage{from: strings.Trim(strings.TrimPrefix(arg, "FROM:"), "<>")}
+			_ = tp.PrintfLine("250 OK")
+		case "RCPT":
+			msg.to = append(msg.to, strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>"))
+			_ = tp.PrintfLine("250 OK")
+		case "DATA":
+			_ = tp.PrintfLine("354 go ahead")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			msg.data = string(data)
+			received <- msg
+			_ = tp.PrintfLine("250 OK")
+		case "QUIT":
+			_ = tp.PrintfLine("221 bye")
+			return
+		default:
+			_ = tp.PrintfLine("502 not implemented")
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package e2e_test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/pion/webrtc/v4"
+	"github.com/stretchr/testify/require"
+
+	smsg "signaling-msgs"
+
+	"github.com/sushiag/go-webrtc-signaling-server/client"
+	server "github.com/sushiag/go-webrtc-signaling-server/server/server"
+	sqlitedb "github.com/sushiag/go-webrtc-signaling-server/server/server/register"
+)
+
+const offerSDP = "v=0\r\n" +
+	"o=- 4215775240449105457 2 IN IP4 127.0.0.1\r\n" +
+	"s=-\r\n" +
+	"t=0 0\r\n" +
+	"a=group:BUNDLE 0\r\n" +
+	"m=video 9 UDP/TLS/RTP/SAVPF 96 97 102 103\r\n" +
+	"c=IN IP4 0.0.0.0\r\n" +
+	"a=mid:0\r\n" +
+	"a=ice-ufrag:abcd\r\n" +
+	"a=ice-pwd:abcdefghijklmnopqrstuvwx\r\n" +
+	"a=setup:actpass\r\n" +
+	"a=sendrecv\r\n" +
+	"a=rtpmap:96 VP8/90000\r\n" +
+	"a=rtcp-fb:96 nack\r\n" +
+	"a=rtpmap:97 rtx/90000\r\n" +
+	"a=fmtp:97 apt=96\r\n" +
+	"a=rtpmap:102 H264/90000\r\n" +
+	"a=rtcp-fb:102 nack\r\n" +
+	"a=fmtp:102 level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f\r\n" +
+	"a=rtpmap:103 rtx/90000\r\n" +
+	"a=fmtp:103 apt=102\r\n" +
+	"a=candidate:1 1 udp 2122260223 192.168.1.2 54321 typ host\r\n" +
+	"a=candidate:2 1 udp 1686052607 203.0.113.7 54321 typ srflx raddr 192.168.1.2 rport 54321\r\n"
+
+func TestPayloadValidation(t *testing.T) {
+	const testdata = "payloads.db"
+	queries, dbConn := sqlitedb.NewDatabase(testdata)
+	defer func() {
+		_ = dbConn.Close()
+		_ = os.Remove(testdata)
+	}()
+
+	srv, serverAddr := server.StartServerWithOptions("0", queries, server.Options{
+		DisableRateLimits: true,
+		Payloads: server.PayloadPolicy{
+			MaxMessageSize:      16 << 10,
+			MaxSDPSize:          4 << 10,
+			StripHostCandidates: true,
+			DisallowedCodecs:    []string{"h264"},
+		},
+	})
+	defer srv.Close()
+	baseURL := fmt.Sprintf("http://%s", serverAddr)
+	wsURL := fmt.Sprintf("ws://%s/ws", serverAddr)
+
+	conns := make(map[string]*websocket.Conn)
+	var receiverID uint64
+	for _, username := range []string{"spongebob", "patrickstar"} {
+		require.NoError(t, client.RegisterUser(baseURL, username, "initPass4ever"))
+		apiKey, err := client.RegenerateAPIKey(baseURL, username, "initPass4ever")
+		require.NoError(t, err)
+
+		conn, resp, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"X-API-Key": []string{apiKey}})
+		require.NoError(t, err)
+		defer conn.Close()
+		conns[username] = conn
+		receiverID, err = strconv.ParseUint(resp.Header.Get("X-Client-ID"), 10, 64)
+		require.NoError(t, err)
+	}
+	sender, receiver := conns["spongebob"], conns["patrickstar"]
+
+	send := func(msgType smsg.MessageType, requestID uint64, payload any) smsg.MessageRawJSONPayload {
+		require.NoError(t, sender.WriteJSON(smsg.MessageAnyPayload{MsgType: msgType, To: receiverID, RequestID: requestID, Payload: payload}))
+		reply := readMessage(t, sender, smsg.Ack)
+		require.Equal(t, requestID, reply.RequestID)
+		return reply
+	}
+
+	// malformed payloads are rejected with the request's ID
+	reply := send(smsg.SDP, 1, smsg.SDPPayload{SDP: webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: "not an SDP"}})
+	require.Equal(t, smsg.CodeInvalidPayload, reply.Error.Code)
+	reply = send(smsg.SDP, 2, json.RawMessage(`{"sdp": {"type": "bogus", "sdp": ""}}`))
+	require.Equal(t, smsg.CodeInvalidPayload, reply.Error.Code)
+	reply = send(smsg.ICECandidate, 3, smsg.ICECandidatePayload{ICE: webrtc.ICECandidateInit{Candidate: "candidate:1 1 udp not-a-priority"}})
+	require.Equal(t, smsg.CodeInvalidPayload, reply.Error.Code)
+
+	// so are oversized ones
+	huge := offerSDP + strings.Repeat("a=x-padding:0123456789\r\n", 200)
+	reply = send(smsg.SDP, 4, smsg.SDPPayload{SDP: webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: huge}})
+	require.Equal(t, smsg.CodePayloadTooLarge, reply.Error.Code)
+	reply = send(smsg.ICECandidate, 5, smsg.ICECandidatePayload{ICE: webrtc.ICECandidateInit{Candidate: strings.Repeat("x", 2000)}})
+	require.Equal(t, smsg.CodePayloadTooLarge, reply.Error.Code)
+
+	// the policy strips host candidates and disallowed codecs from SDPs
+	reply = send(smsg.SDP, 6, smsg.SDPPayload{SDP: webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offerSDP}})
+	require.Nil(t, reply.Error)
+	forwarded := readMessage(t, receiver, smsg.SDP)
+	var sdpPayload smsg.SDPPayload
+	require.NoError(t, json.Unmarshal(forwarded.Payload, &sdpPayload))
+	require.Equal(t, webrtc.SDPTypeOffer, sdpPayload.SDP.Type)
+	require.Contains(t, sdpPayload.SDP.SDP, "m=video 9 UDP/TLS/RTP/SAVPF 96 97\r\n")
+	require.Contains(t, sdpPayload.SDP.SDP, "a=fmtp:97 apt=96\r\n")
+	require.NotContains(t, sdpPayload.SDP.SDP, "H264")
+	require.NotContains(t, sdpPayload.SDP.SDP, "apt=102")
+	require.NotContains(t, sdpPayload.SDP.SDP, "typ host")
+	require.Contains(t, sdpPayload.SDP.SDP, "typ srflx")
+
+	// candidates dropped by the policy are acked but never forwarded, the unknown fields of the
+	// ones that are forwarded are dropped
+	reply = send(smsg.ICECandidate, 7, smsg.ICECandidatePayload{ICE: webrtc.ICECandidateInit{Candidate: "candidate:1 1 udp 2122260223 192.168.1.2 54321 typ host"}})
+	require.Nil(t, reply.Error)
+	reply = send(smsg.ICECandidate, 8, json.RawMessage(`{"ice": {"candidate": "candidate:2 1 udp 1686052607 203.0.113.7 54321 typ srflx raddr 192.168.1.2 rport 54321"}, "blob": "sneaky"}`))
+	require.Nil(t, reply.Error)
+	forwarded = readMessage(t, receiver, smsg.ICECandidate)
+	require.NotContains(t, string(forwarded.Payload), "sneaky")
+	var candidatePayload smsg.ICECandidatePayload
+	require.NoError(t, json.Unmarshal(forwarded.Payload, &candidatePayload))
+	require.Contains(t, candidatePayload.ICE.Candidate, "typ srflx")
+
+	// messages over the size limit disconnect the sender
+	blob := json.RawMessage(fmt.Sprintf(`{"blob": %q}`, strings.Repeat("x", 32<<10)))
+	require.NoError(t, sender.WriteJSON(smsg.MessageAnyPayload{MsgType: smsg.ICECandidate, To: receiverID, Payload: blob}))
+	var msg smsg.MessageRawJSONPayload
+	err := sender.ReadJSON(&msg)
+	var closeErr *websocket.CloseError
+	require.True(t, errors.As(err, &closeErr), "expected a close error, got %v", err)
+	require.Equal(t, websocket.CloseMessageTooBig, closeErr.Code)
+}
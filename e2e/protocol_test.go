@@ -0,0 +1,97 @@
+package e2e_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/require"
+
+	smsg "signaling-msgs"
+
+	"github.com/sushiag/go-webrtc-signaling-server/client"
+	server "github.com/sushiag/go-webrtc-signaling-server/server/server"
+	sqlitedb "github.com/sushiag/go-webrtc-signaling-server/server/server/register"
+)
+
+func TestProtocolNegotiation(t *testing.T) {
+	const testdata = "protocol.db"
+	queries, dbConn := sqlitedb.NewDatabase(testdata)
+	defer func() {
+		_ = dbConn.Close()
+		_ = os.Remove(testdata)
+	}()
+
+	srv, serverAddr := server.StartServerWithOptions("0", queries, server.Options{DisableRateLimits: true})
+	defer srv.Close()
+	baseURL := fmt.Sprintf("http://%s", serverAddr)
+	wsURL := fmt.Sprintf("ws://%s/ws", serverAddr)
+
+	require.NoError(t, client.RegisterUser(baseURL, "spongebob", "initPass4ever"))
+	apiKey, err := client.RegenerateAPIKey(baseURL, "spongebob", "initPass4ever")
+	require.NoError(t, err)
+
+	dial := func() *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"X-API-Key": []string{apiKey}})
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	// this reads the next message as it was sent
+	readRaw := func(conn *websocket.Conn) map[string]json.RawMessage {
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(3*time.Second)))
+		_, data, err := conn.ReadMessage()
+		require.NoError(t, err)
+		var msg map[string]json.RawMessage
+		require.NoError(t, json.Unmarshal(data, &msg))
+		return msg
+	}
+
+	// clients that don't say hello speak version 1 and only know the numbers
+	legacy := dial()
+	require.NoError(t, legacy.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(`{"type":%d}`, smsg.CreateRoom))))
+	require.Equal(t, fmt.Sprint(smsg.RoomCreated), string(readRaw(legacy)["type"]))
+
+	// version 2 clients get the names, and only the features both sides know
+	current := dial()
+	require.NoError(t, current.WriteJSON(smsg.MessageAnyPayload{
+		MsgType:   smsg.Hello,
+		RequestID: 1,
+		Payload:   smsg.HelloPayload{ProtocolVersion: 2, Features: []string{smsg.FeatureRequestIDs, "time_travel"}},
+	}))
+	welcome := readRaw(current)
+	require.Equal(t, `"welcome"`, string(welcome["type"]))
+	require.Equal(t, "1", string(welcome["request_id"]))
+	var payload smsg.WelcomePayload
+	require.NoError(t, json.Unmarshal(welcome["payload"], &payload))
+	require.Equal(t, 2, payload.ProtocolVersion)
+	require.Equal(t, []string{smsg.FeatureRequestIDs}, payload.Features)
+	require.NotZero(t, payload.ClientID)
+
+	require.NoError(t, current.WriteMessage(websocket.TextMessage, []byte(`{"type":"create-room"}`)))
+	require.Equal(t, `"room-created"`, string(readRaw(current)["type"]))
+
+	// the version can't change afterwards
+	require.NoError(t, current.WriteJSON(smsg.MessageAnyPayload{MsgType: smsg.Hello, Payload: smsg.HelloPayload{ProtocolVersion: 1}}))
+	reply := readMessage(t, current, smsg.Welcome)
+	require.Equal(t, smsg.CodeInvalidPayload, reply.Error.Code)
+
+	// clients speaking a version the server doesn't are told why they are disconnected
+	future := dial()
+	require.NoError(t, future.WriteJSON(smsg.MessageAnyPayload{MsgType: smsg.Hello, Payload: smsg.HelloPayload{ProtocolVersion: 99}}))
+	require.NoError(t, future.SetReadDeadline(time.Now().Add(3*time.Second)))
+	_, _, err = future.ReadMessage()
+	var closeErr *websocket.CloseError
+	require.ErrorAs(t, err, &closeErr)
+	require.Equal(t, websocket.CloseProtocolError, closeErr.Code)
+	require.Contains(t, closeErr.Text, "unsupported protocol version 99")
+
+	// the client says hello on its own
+	_, err = client.NewClientWithKey(wsURL, apiKey, client.Options{})
+	require.NoError(t, err)
+}
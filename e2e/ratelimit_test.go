@@ -0,0 +1,99 @@
+package e2e_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sushiag/go-webrtc-signaling-server/client"
+	server "github.com/sushiag/go-webrtc-signaling-server/server/server"
+	sqlitedb "github.com/sushiag/go-webrtc-signaling-server/server/server/register"
+	smsg "signaling-msgs"
+)
+
+func TestRateLimits(t *testing.T) {
+	const testdata = "ratelimit.db"
+	queries, dbConn := sqlitedb.NewDatabase(testdata)
+
+	limits := server.DefaultRateLimits()
+	limits.Messages[smsg.CreateRoom] = server.RateLimit{Rate: 0.001, Burst: 2}
+	limits.Auth = server.RateLimit{Rate: 0.001, Burst: 3}
+	limits.MaxViolationsPerMinute = 3
+
+	srv, serverAddr := server.StartServerWithOptions("0", queries, server.Options{RateLimits: &limits, AdminAPIKey: "krabby-patty-formula"})
+	defer srv.Close()
+
+	defer func() {
+		_ = dbConn.Close()
+		_ = os.Remove(testdata)
+	}()
+
+	baseURL := fmt.Sprintf("http://%s", serverAddr)
+	wsURL := fmt.Sprintf("ws://%s/ws", serverAddr)
+
+	// the password based endpoints share a per IP budget
+	require.NoError(t, client.RegisterUser(baseURL, "spongebob", "initPass4ever"))
+	apiKey, err := client.RegenerateAPIKey(baseURL, "spongebob", "initPass4ever")
+	require.NoError(t, err)
+	_, err = client.RegenerateAPIKey(baseURL, "spongebob", "wrongPass4ever")
+	require.Error(t, err)
+
+	body, err := json.Marshal(map[string]string{"username": "spongebob", "password": "initPass4ever"})
+	require.NoError(t, err)
+	resp, err := http.Post(baseURL+"/regenerate", "application/json", bytes.NewReader(body))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	require.NotEmpty(t, resp.Header.Get("Retry-After"))
+
+	// so do guesses at the admin key
+	req, err := http.NewRequest(http.MethodGet, baseURL+"/admin/connections", nil)
+	require.NoError(t, err)
+	req.Header.Set("X-Admin-Key", "plankton")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+
+	// signaling messages are limited per connection and message type
+	wsConn, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"X-API-Key": []string{apiKey}})
+	require.NoError(t, err)
+	defer wsConn.Close()
+
+	createRoom := func() (smsg.MessageRawJSONPayload, error) {
+		if err := wsConn.WriteJSON(smsg.MessageAnyPayload{MsgType: smsg.CreateRoom}); err != nil {
+			return smsg.MessageRawJSONPayload{}, err
+		}
+		require.NoError(t, wsConn.SetReadDeadline(time.Now().Add(3*time.Second)))
+		var msg smsg.MessageRawJSONPayload
+		err := wsConn.ReadJSON(&msg)
+		return msg, err
+	}
+
+	for range 2 {
+		msg, err := createRoom()
+		require.NoError(t, err)
+		require.Equal(t, smsg.RoomCreated, msg.MsgType)
+		require.Nil(t, msg.Error)
+	}
+
+	// going over the limit gets an error reply
+	for range limits.MaxViolationsPerMinute {
+		msg, err := createRoom()
+		require.NoError(t, err)
+		require.Equal(t, smsg.RoomCreated, msg.MsgType)
+		require.Equal(t, smsg.CodeRateLimited, msg.Error.Code)
+	}
+
+	// and doing it over and over gets the client kicked
+	_, err = createRoom()
+	require.True(t, websocket.IsCloseError(err, websocket.ClosePolicyViolation), "expected a policy violation close, got: %v", err)
+}
@@ -0,0 +1,106 @@
+package e2e_test
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/require"
+
+	smsg "signaling-msgs"
+
+	"github.com/sushiag/go-webrtc-signaling-server/client"
+	server "github.com/sushiag/go-webrtc-signaling-server/server/server"
+	sqlitedb "github.com/sushiag/go-webrtc-signaling-server/server/server/register"
+)
+
+func TestRequestReplies(t *testing.T) {
+	const testdata = "requests.db"
+	queries, dbConn := sqlitedb.NewDatabase(testdata)
+	defer func() {
+		_ = dbConn.Close()
+		_ = os.Remove(testdata)
+	}()
+
+	srv, serverAddr := server.StartServerWithOptions("0", queries, server.Options{DisableRateLimits: true})
+	defer srv.Close()
+	baseURL := fmt.Sprintf("http://%s", serverAddr)
+	wsURL := fmt.Sprintf("ws://%s/ws", serverAddr)
+
+	apiKeys := make(map[string]string)
+	for _, username := range []string{"spongebob", "patrickstar", "squidward"} {
+		require.NoError(t, client.RegisterUser(baseURL, username, "initPass4ever"))
+		apiKey, err := client.RegenerateAPIKey(baseURL, username, "initPass4ever")
+		require.NoError(t, err)
+		apiKeys[username] = apiKey
+	}
+
+	host, err := client.NewClientWithKey(wsURL, apiKeys["spongebob"], client.Options{})
+	require.NoError(t, err)
+	guest, err := client.NewClientWithKey(wsURL, apiKeys["patrickstar"], client.Options{})
+	require.NoError(t, err)
+
+	// concurrent requests each get their own reply
+	const numRooms = 5
+	roomIDs := make(chan uint64, numRooms)
+	errs := make(chan error, numRooms)
+	for range numRooms {
+		go func() {
+			roomID, err := host.CreateRoom()
+			errs <- err
+			roomIDs <- roomID
+		}()
+	}
+	created := make(map[uint64]struct{})
+	for range numRooms {
+		require.NoError(t, <-errs)
+		created[<-roomIDs] = struct{}{}
+	}
+	require.Len(t, created, numRooms)
+
+	joined := make(chan []uint64, numRooms)
+	for roomID := range created {
+		go func() {
+			clients, err := guest.JoinRoom(roomID)
+			errs <- err
+			joined <- clients
+		}()
+	}
+	for range numRooms {
+		require.NoError(t, <-errs)
+		require.ElementsMatch(t, []uint64{host.GetClientID(), guest.GetClientID()}, <-joined)
+	}
+
+	// failures come back as typed errors
+	_, err = guest.JoinRoom(987654321)
+	require.ErrorIs(t, err, &smsg.ErrorPayload{Code: smsg.CodeRoomNotFound})
+	for roomID := range created {
+		_, err = guest.JoinRoom(roomID)
+		require.ErrorIs(t, err, &smsg.ErrorPayload{Code: smsg.CodeAlreadyInRoom})
+		break
+	}
+
+	// requests without a reply of their own are acknowledged, the ack echoes the request ID
+	raw, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"X-API-Key": []string{apiKeys["squidward"]}})
+	require.NoError(t, err)
+	defer raw.Close()
+
+	candidate := smsg.ICECandidatePayload{}
+	require.NoError(t, raw.WriteJSON(smsg.MessageAnyPayload{MsgType: smsg.ICECandidate, To: host.GetClientID(), RequestID: 7, Payload: candidate}))
+	ack := readMessage(t, raw, smsg.Ack)
+	require.Equal(t, uint64(7), ack.RequestID)
+	require.Nil(t, ack.Error)
+
+	require.NoError(t, raw.WriteJSON(smsg.MessageAnyPayload{MsgType: smsg.ICECandidate, To: 987654321, RequestID: 8, Payload: candidate}))
+	ack = readMessage(t, raw, smsg.Ack)
+	require.Equal(t, uint64(8), ack.RequestID)
+	require.Equal(t, smsg.CodePeerNotFound, ack.Error.Code)
+
+	require.NoError(t, raw.WriteJSON(smsg.MessageAnyPayload{MsgType: smsg.JoinRoom, RequestID: 9, Payload: "not a room"}))
+	reply := readMessage(t, raw, smsg.RoomJoined)
+	require.Equal(t, uint64(9), reply.RequestID)
+	require.Equal(t, smsg.CodeInvalidPayload, reply.Error.Code)
+}
@@ -0,0 +1,159 @@
+package e2e_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sushiag/go-webrtc-signaling-server/client"
+	server "github.com/sushiag/go-webrtc-signaling-server/server/server"
+	sqlitedb "github.com/sushiag/go-webrtc-signaling-server/server/server/register"
+
+	smsg "signaling-msgs"
+)
+
+func TestAccessTokens(t *testing.T) {
+	const testdata = "tokens.db"
+	queries, dbConn := sqlitedb.NewDatabase(testdata)
+	defer func() {
+		_ = dbConn.Close()
+		_ = os.Remove(testdata)
+	}()
+
+	oldKey := server.TokenKey{ID: "old", Algorithm: server.TokenHS256, Secret: randomBytes(t, 32)}
+	newKey := server.TokenKey{ID: "new", Algorithm: server.TokenEdDSA, PrivateKey: ed25519Key(t)}
+
+	// the old node signs with the old key, the rotated one signs with the new key and still accepts the old one
+	oldSrv, oldAddr := server.StartServerWithOptions("0", queries, server.Options{DisableRateLimits: true, TokenKeys: []server.TokenKey{oldKey}})
+	defer oldSrv.Close()
+	srv, serverAddr := server.StartServerWithOptions("0", queries, server.Options{DisableRateLimits: true, TokenKeys: []server.TokenKey{newKey, oldKey}})
+	defer srv.Close()
+
+	baseURL := fmt.Sprintf("http://%s", serverAddr)
+	wsURL := fmt.Sprintf("ws://%s/ws", serverAddr)
+
+	dial := func(url string, header http.Header) (*websocket.Conn, int) {
+		conn, resp, err := websocket.DefaultDialer.Dial(url, header)
+		require.NotNil(t, resp)
+		if err != nil {
+			return nil, resp.StatusCode
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn, resp.StatusCode
+	}
+	bearer := func(token string) http.Header {
+		return http.Header{"Authorization": []string{"Bearer " + token}}
+	}
+
+	require.NoError(t, client.RegisterUser(baseURL, "spongebob", "initPass4ever"))
+	apiKey, err := client.RegenerateAPIKey(baseURL, "spongebob", "initPass4ever")
+	require.NoError(t, err)
+
+	// exchanging an API key or a password
+	byKey, err := client.GetAccessToken(baseURL, client.TokenRequest{APIKey: apiKey})
+	require.NoError(t, err)
+	require.Equal(t, "Bearer", byKey.TokenType)
+	require.EqualValues(t, 300, byKey.ExpiresIn)
+	require.WithinDuration(t, time.Now().Add(5*time.Minute), byKey.ExpiresAt, 5*time.Second)
+
+	byPassword, err := client.GetAccessToken(baseURL, client.TokenRequest{Username: "spongebob", Password: "initPass4ever"})
+	require.NoError(t, err)
+
+	_, err = client.GetAccessToken(baseURL, client.TokenRequest{Username: "spongebob", Password: "wrong"})
+	require.ErrorContains(t, err, "401")
+	_, err = client.GetAccessToken(baseURL, client.TokenRequest{APIKey: "not-a-key"})
+	require.ErrorContains(t, err, "401")
+
+	// the token is accepted as a header, a subprotocol and a query parameter
+	_, status := dial(wsURL, bearer(byKey.AccessToken))
+	require.Equal(t, http.StatusSwitchingProtocols, status)
+
+	conn, status := dial(wsURL, http.Header{"Sec-WebSocket-Protocol": []string{"signaling, access_token." + byPassword.AccessToken}})
+	require.Equal(t, http.StatusSwitchingProtocols, status)
+	require.Equal(t, "signaling", conn.Subprotocol())
+
+	_, status = dial(wsURL+"?access_token="+byPassword.AccessToken, nil)
+	require.Equal(t, http.StatusSwitchingProtocols, status)
+
+	// tampered tokens and tokens of unknown keys are rejected
+	_, status = dial(wsURL, bearer(byKey.AccessToken+"x"))
+	require.Equal(t, http.StatusUnauthorized, status)
+	foreignSrv, foreignAddr := server.StartServerWithOptions("0", queries, server.Options{DisableRateLimits: true})
+	defer foreignSrv.Close()
+	foreign, err := client.GetAccessToken(fmt.Sprintf("http://%s", foreignAddr), client.TokenRequest{APIKey: apiKey})
+	require.NoError(t, err)
+	_, status = dial(wsURL, bearer(foreign.AccessToken))
+	require.Equal(t, http.StatusUnauthorized, status)
+
+	// tokens signed before the rotation keep working until they expire
+	fromOld, err := client.GetAccessToken(fmt.Sprintf("http://%s", oldAddr), client.TokenRequest{APIKey: apiKey})
+	require.NoError(t, err)
+	_, status = dial(wsURL, bearer(fromOld.AccessToken))
+	require.Equal(t, http.StatusSwitchingProtocols, status)
+
+	// a room scoped token can only join its rooms
+	host, status := dial(wsURL, bearer(byKey.AccessToken))
+	require.Equal(t, http.StatusSwitchingProtocols, status)
+	require.NoError(t, host.WriteJSON(smsg.MessageAnyPayload{MsgType: smsg.CreateRoom}))
+	created := readMessage(t, host, smsg.RoomCreated)
+	require.Nil(t, created.Error)
+	var room smsg.RoomCreatedPayload
+	require.NoError(t, json.Unmarshal(created.Payload, &room))
+
+	require.NoError(t, client.RegisterUser(baseURL, "patrickstar", "initPass4ever"))
+	scoped, err := client.GetAccessToken(baseURL, client.TokenRequest{Username: "patrickstar", Password: "initPass4ever", Rooms: []uint64{room.RoomID}})
+	require.NoError(t, err)
+	guest, status := dial(wsURL, bearer(scoped.AccessToken))
+	require.Equal(t, http.StatusSwitchingProtocols, status)
+
+	require.NoError(t, guest.WriteJSON(smsg.MessageAnyPayload{MsgType: smsg.CreateRoom}))
+	require.Equal(t, smsg.CodeForbidden, readMessage(t, guest, smsg.RoomCreated).Error.Code)
+	require.NoError(t, guest.WriteJSON(smsg.MessageAnyPayload{MsgType: smsg.JoinRoom, Payload: smsg.JoinRoomPayload{RoomID: room.RoomID + 1}}))
+	require.Equal(t, smsg.CodeForbidden, readMessage(t, guest, smsg.RoomJoined).Error.Code)
+	require.NoError(t, guest.WriteJSON(smsg.MessageAnyPayload{MsgType: smsg.JoinRoom, Payload: smsg.JoinRoomPayload{RoomID: room.RoomID}}))
+	joined := readMessage(t, guest, smsg.RoomJoined)
+	require.Nil(t, joined.Error)
+
+	// expired tokens are rejected
+	shortSrv, shortAddr := server.StartServerWithOptions("0", queries, server.Options{DisableRateLimits: true, TokenKeys: []server.TokenKey{newKey}, TokenTTL: time.Second})
+	defer shortSrv.Close()
+	short, err := client.GetAccessToken(fmt.Sprintf("http://%s", shortAddr), client.TokenRequest{APIKey: apiKey})
+	require.NoError(t, err)
+	time.Sleep(2 * time.Second)
+	_, status = dial(wsURL, bearer(short.AccessToken))
+	require.Equal(t, http.StatusUnauthorized, status)
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	require.NoError(t, err)
+	return b
+}
+
+func ed25519Key(t *testing.T) ed25519.PrivateKey {
+	_, key, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	return key
+}
+
+// This reads messages until one of the given type arrives
+func readMessage(t *testing.T, conn *websocket.Conn, msgType smsg.MessageType) smsg.MessageRawJSONPayload {
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	for {
+		var msg smsg.MessageRawJSONPayload
+		require.NoError(t, conn.ReadJSON(&msg))
+		if msg.MsgType == msgType {
+			return msg
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package e2e_test
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/pion/turn/v4"
+	"github.com/pion/webrtc/v4"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sushiag/go-webrtc-signaling-server/client"
+	server "github.com/sushiag/go-webrtc-signaling-server/server/server"
+	sqlitedb "github.com/sushiag/go-webrtc-signaling-server/server/server/register"
+)
+
+func TestBuiltInTURNServer(t *testing.T) {
+	const testdata = "turnserver.db"
+	queries, dbConn := sqlitedb.NewDatabase(testdata)
+	defer func() {
+		_ = dbConn.Close()
+		_ = os.Remove(testdata)
+	}()
+
+	// the relays are on the loopback interface, so the peers' relay addresses have to be allowed
+	turnCfg := &server.TURNServerConfig{
+		ListenAddr:            "127.0.0.1:0",
+		PublicIP:              "127.0.0.1",
+		MaxAllocationsPerUser: 3,
+		AllowedPeers:          []netip.Prefix{netip.MustParsePrefix("127.0.0.1/32")},
+	}
+	srv, serverAddr := server.StartServerWithOptions("0", queries, server.Options{DisableRateLimits: true, TURN: turnCfg})
+	defer srv.Close()
+	baseURL := fmt.Sprintf("http://%s", serverAddr)
+	wsURL := fmt.Sprintf("ws://%s/ws", serverAddr)
+
+	apiKeys := make(map[string]string)
+	for _, username := range []string{"spongebob", "patrickstar", "squidward", "sandycheeks"} {
+		require.NoError(t, client.RegisterUser(baseURL, username, "initPass4ever"))
+		apiKey, err := client.RegenerateAPIKey(baseURL, username, "initPass4ever")
+		require.NoError(t, err)
+		apiKeys[username] = apiKey
+	}
+
+	// the built-in server is handed out as both a STUN and a TURN server
+	servers, err := client.GetICEServers(baseURL, apiKeys["spongebob"])
+	require.NoError(t, err)
+	require.Len(t, servers.Servers, 2)
+	require.Len(t, servers.Servers[0].URLs, 1)
+	stunURL := servers.Servers[0].URLs[0]
+	require.True(t, strings.HasPrefix(stunURL, "stun:127.0.0.1:"))
+	turnAddr := strings.TrimPrefix(stunURL, "stun:")
+	require.Equal(t, []string{"turn:" + turnAddr + "?transport=udp"}, servers.Servers[1].URLs)
+
+	// peers that may only use relays connect through it
+	relayOnly := client.Options{ICETransportPolicy: webrtc.ICETransportPolicyRelay}
+	clientA, err := client.NewClientWithKey(wsURL, apiKeys["spongebob"], relayOnly)
+	require.NoError(t, err)
+	clientB, err := client.NewClientWithKey(wsURL, apiKeys["patrickstar"], relayOnly)
+	require.NoError(t, err)
+
+	roomID, err := clientA.CreateRoom()
+	require.NoError(t, err)
+	_, err = clientB.JoinRoom(roomID)
+	require.NoError(t, err)
+
+	select {
+	case peerID := <-clientA.GetDataChOpened():
+		require.Equal(t, clientB.GetClientID(), peerID)
+	case <-time.After(10 * time.Second):
+		t.Fatal("clients took longer than 10 secs to open their data channels over the relay")
+	}
+	require.Eventually(t, func() bool {
+		return clientB.SendDataToPeer(clientA.GetClientID(), []byte("relayed hello")) == nil
+	}, 5*time.Second, 50*time.Millisecond)
+	select {
+	case msg := <-clientA.GetPeerDataMsgCh():
+		require.Equal(t, clientB.GetClientID(), msg.From)
+		require.Equal(t, []byte("relayed hello"), msg.Data)
+	case <-time.After(5 * time.Second):
+		t.Fatal("relayed message didn't arrive")
+	}
+
+	// a user holds at most MaxAllocationsPerUser relays
+	squidward, err := client.GetICEServers(baseURL, apiKeys["squidward"])
+	require.NoError(t, err)
+	creds := squidward.Servers[1]
+	for range turnCfg.MaxAllocationsPerUser {
+		require.NoError(t, allocateRelay(t, turnAddr, creds.Username, creds.Credential.(string)))
+	}
+	require.Error(t, allocateRelay(t, turnAddr, creds.Username, creds.Credential.(string)))
+
+	// forged credentials and the credentials of disabled users don't work
+	sandy, err := client.GetICEServers(baseURL, apiKeys["sandycheeks"])
+	require.NoError(t, err)
+	creds = sandy.Servers[1]
+	forged := strings.Replace(creds.Username, ":4", ":3", 1)
+	require.Error(t, allocateRelay(t, turnAddr, forged, creds.Credential.(string)))
+	_, err = dbConn.Exec("UPDATE users SET disabled = 1 WHERE username = 'sandycheeks'")
+	require.NoError(t, err)
+	require.Error(t, allocateRelay(t, turnAddr, creds.Username, creds.Credential.(string)))
+}
+
+// This allocates a relay on the TURN server, it's released when the test ends
+func allocateRelay(t *testing.T, turnAddr, username, password string) error {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	turnClient, err := turn.NewClient(&turn.ClientConfig{
+		STUNServerAddr: turnAddr,
+		TURNServerAddr: turnAddr,
+		Username:       username,
+		Password:       password,
+		Conn:           conn,
+	})
+	require.NoError(t, err)
+	t.Cleanup(turnClient.Close)
+	require.NoError(t, turnClient.Listen())
+
+	relay, err := turnClient.Allocate()
+	if err != nil {
+		return err
+	}
+	t.Cleanup(func() { relay.Close() })
+	return nil
+}
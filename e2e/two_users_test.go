@@ -50,11 +50,11 @@ func TestEndToEndSignaling(t *testing.T) {
 
 	require.NoError(t, os.Setenv("API_KEY", apiKeyB))
 
-	clientA, err := client.NewClientWithKey(wsURL, apiKeyA)
+	clientA, err := client.NewClientWithKey(wsURL, apiKeyA, client.Options{})
 	require.NoError(t, err)
 	t.Logf("client A connected to the signaling server")
 
-	clientB, err := client.NewClientWithKey(wsURL, apiKeyB)
+	clientB, err := client.NewClientWithKey(wsURL, apiKeyB, client.Options{})
 	require.NoError(t, err)
 	t.Logf("client B connected to the signaling server")
 
@@ -0,0 +1,117 @@
+package e2e_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/pion/ice/v4"
+	"github.com/pion/webrtc/v4"
+	"github.com/stretchr/testify/require"
+
+	smsg "signaling-msgs"
+
+	"github.com/sushiag/go-webrtc-signaling-server/client"
+	server "github.com/sushiag/go-webrtc-signaling-server/server/server"
+	sqlitedb "github.com/sushiag/go-webrtc-signaling-server/server/server/register"
+)
+
+func TestWebRTCOptions(t *testing.T) {
+	const testdata = "webrtcoptions.db"
+	queries, dbConn := sqlitedb.NewDatabase(testdata)
+	defer func() {
+		_ = dbConn.Close()
+		_ = os.Remove(testdata)
+	}()
+
+	// the server hands out a STUN server that doesn't exist, clients with their own ICE servers
+	// don't use it
+	unreachable := &server.ICEConfig{STUNURLs: []string{"stun:192.0.2.1:3478"}}
+	srv, serverAddr := server.StartServerWithOptions("0", queries, server.Options{DisableRateLimits: true, ICE: unreachable})
+	defer srv.Close()
+	baseURL := fmt.Sprintf("http://%s", serverAddr)
+	wsURL := fmt.Sprintf("ws://%s/ws", serverAddr)
+
+	apiKeys := make(map[string]string)
+	for _, username := range []string{"spongebob", "patrickstar", "squidward", "sandycheeks"} {
+		require.NoError(t, client.RegisterUser(baseURL, username, "initPass4ever"))
+		apiKey, err := client.RegenerateAPIKey(baseURL, username, "initPass4ever")
+		require.NoError(t, err)
+		apiKeys[username] = apiKey
+	}
+
+	// invalid options are refused before connecting
+	_, err := client.NewClientWithKey(wsURL, apiKeys["spongebob"], client.Options{MinPort: 50100, MaxPort: 50000})
+	require.ErrorContains(t, err, "port range")
+	_, err = client.NewClientWithKey(wsURL, apiKeys["spongebob"], client.Options{NAT1To1IPs: []string{"not an ip"}})
+	require.ErrorContains(t, err, "NAT 1:1 IP")
+
+	// a raw peer hosts the room and looks at the candidates the client trickles to it
+	host, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"X-API-Key": []string{apiKeys["spongebob"]}})
+	require.NoError(t, err)
+	defer host.Close()
+	require.NoError(t, host.WriteJSON(smsg.MessageAnyPayload{MsgType: smsg.CreateRoom}))
+	var created smsg.RoomCreatedPayload
+	require.NoError(t, json.Unmarshal(readMessage(t, host, smsg.RoomCreated).Payload, &created))
+
+	const minPort, maxPort = 50000, 50100
+	guest, err := client.NewClientWithKey(wsURL, apiKeys["patrickstar"], client.Options{
+		ICEServers:       []webrtc.ICEServer{},
+		MinPort:          minPort,
+		MaxPort:          maxPort,
+		NAT1To1IPs:       []string{"203.0.113.7"},
+		MulticastDNSMode: ice.MulticastDNSModeDisabled,
+	})
+	require.NoError(t, err)
+	_, err = guest.JoinRoom(created.RoomID)
+	require.NoError(t, err)
+
+	msg := readMessage(t, host, smsg.ICECandidate)
+	require.Equal(t, guest.GetClientID(), msg.From)
+	var payload smsg.ICECandidatePayload
+	require.NoError(t, json.Unmarshal(msg.Payload, &payload))
+	candidate, err := ice.UnmarshalCandidate(payload.ICE.Candidate)
+	require.NoError(t, err)
+	require.Equal(t, ice.CandidateTypeHost, candidate.Type())
+	require.Equal(t, "203.0.113.7", candidate.Address())
+	require.GreaterOrEqual(t, candidate.Port(), minPort)
+	require.LessOrEqual(t, candidate.Port(), maxPort)
+
+	// host only peers with unordered, unreliable data channels still reach each other locally
+	hostOnly := client.Options{
+		ICEServers:       []webrtc.ICEServer{},
+		MulticastDNSMode: ice.MulticastDNSModeDisabled,
+		DataChannel:      webrtc.DataChannelInit{Ordered: new(bool), MaxRetransmits: new(uint16)},
+	}
+	clientA, err := client.NewClientWithKey(wsURL, apiKeys["squidward"], hostOnly)
+	require.NoError(t, err)
+	clientB, err := client.NewClientWithKey(wsURL, apiKeys["sandycheeks"], hostOnly)
+	require.NoError(t, err)
+
+	roomID, err := clientA.CreateRoom()
+	require.NoError(t, err)
+	_, err = clientB.JoinRoom(roomID)
+	require.NoError(t, err)
+
+	select {
+	case peerID := <-clientA.GetDataChOpened():
+		require.Equal(t, clientB.GetClientID(), peerID)
+	case <-time.After(5 * time.Second):
+		t.Fatal("clients took longer than 5 secs to open their data channels")
+	}
+	require.Eventually(t, func() bool {
+		return clientB.SendDataToPeer(clientA.GetClientID(), []byte("unordered hello")) == nil
+	}, 5*time.Second, 50*time.Millisecond)
+	select {
+	case msg := <-clientA.GetPeerDataMsgCh():
+		require.Equal(t, clientB.GetClientID(), msg.From)
+		require.Equal(t, []byte("unordered hello"), msg.Data)
+	case <-time.After(5 * time.Second):
+		t.Fatal("message didn't arrive")
+	}
+}
@@ -0,0 +1,473 @@
+// Command admin manages the signaling server's users and API keys directly in the database.
+//
+// Usage:
+//
+//	admin [-db Server.db|postgres://...] <command> [flags]
+//
+// Run `admin help` for the list of commands.
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	_ "github.com/mattn/go-sqlite3"
+	"golang.org/x/crypto/bcrypt"
+
+	server "github.com/sushiag/go-webrtc-signaling-server/server/server"
+	"github.com/sushiag/go-webrtc-signaling-server/server/server/db"
+	"github.com/sushiag/go-webrtc-signaling-server/server/server/migrate"
+	"github.com/sushiag/go-webrtc-signaling-server/server/server/storage"
+)
+
+// This is a subcommand of the admin CLI
+type command struct {
+	name    string
+	usage   string
+	summary string
+	run     func(ctx context.Context, queries db.Querier, args []string, out io.Writer) error
+	// This is set instead of run by commands that work on the schema, they also run on databases
+	// with pending migrations
+	runSchema func(ctx context.Context, migrator *migrate.Migrator, args []string, out io.Writer) error
+}
+
+var commands = []command{
+	{"create-user", "-username NAME [-password PASS]", "create a user and print its API key", createUser, nil},
+	{"list-users", "", "list every user", listUsers, nil},
+	{"disable-user", "-username NAME", "stop a user from authenticating", disableUser, nil},
+	{"enable-user", "-username NAME", "re-enable a disabled user", enableUser, nil},
+	{"unlock-user", "-username NAME", "lift a lockout caused by failed password attempts", unlockUser, nil},
+	{"delete-user", "-username NAME", "delete a user", deleteUser, nil},
+	{"list-keys", "-username NAME", "list a user's API keys", listKeys, nil},
+	{"rotate-key", "-username NAME", "replace every API key of a user with a new one and print it", rotateKey, nil},
+	{"revoke-key", "-username NAME", "remove every API key of a user", revokeKey, nil},
+	{"reset-password", "-username NAME [-password PASS]", "set a new password, a random one is printed if omitted", resetPassword, nil},
+	{"stats", "", "print user and API key counts", stats, nil},
+	{"migrate", "up | down [-steps N] | status", "apply, revert or list the schema migrations", nil, migrateSchema},
+}
+
+var errUsage = errors.New("invalid usage")
+
+func main() {
+	os.Exit(run())
+}
+
+func run() int {
+	global := flag.NewFlagSet("admin", flag.ExitOnError)
+	dbPath := global.String("db", "Server.db", "path to the SQLite database or a postgres:// URL")
+	global.Usage = func() { printUsage(global.Output()) }
+	_ = global.Parse(os.Args[1:])
+
+	args := global.Args()
+	if len(args) == 0 || args[0] == "help" {
+		printUsage(os.Stdout)
+		return 0
+	}
+
+	cmd, ok := findCommand(args[0])
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", args[0])
+		printUsage(os.Stderr)
+		return 2
+	}
+
+	queries, dbConn, err := storage.Open(*dbPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "admin: %v\n", err)
+		return 1
+	}
+	defer dbConn.Close()
+
+	ctx := context.Background()
+	if cmd.runSchema != nil {
+		var migrator *migrate.Migrator
+		if migrator, err = storage.Migrator(dbConn, *dbPath); err == nil {
+			err = cmd.runSchema(ctx, migrator, args[1:], os.Stdout)
+		}
+	} else if err = storage.CheckMigrated(ctx, dbConn, *dbPath); err == nil {
+		err = cmd.run(ctx, queries, args[1:], os.Stdout)
+	}
+
+	if err != nil {
+		if errors.Is(err, errUsage) {
+			fmt.Fprintf(os.Stderr, "usage: admin %s %s\n", cmd.name, cmd.usage)
+			return 2
+		}
+		fmt.Fprintf(os.Stderr, "admin %s: %v\n", cmd.name, err)
+		return 1
+	}
+	return 0
+}
+
+func findCommand(name string) (command, bool) {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd, true
+		}
+	}
+	return command{}, false
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "usage: admin [-db Server.db|postgres://...] <command> [flags]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "commands:")
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, cmd := range commands {
+		fmt.Fprintf(tw, "  %s %s\t%s\n", cmd.name, cmd.usage, cmd.summary)
+	}
+	tw.Flush()
+}
+
+// This parses the flags of a subcommand that only takes a username and optionally a password
+func parseUserFlags(name string, args []string, withPassword bool) (username string, password string, err error) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.StringVar(&username, "username", "", "username of the account")
+	if withPassword {
+		fs.StringVar(&password, "password", "", "password of the account")
+	}
+	if err := fs.Parse(args); err != nil || username == "" || fs.NArg() != 0 {
+		return "", "", errUsage
+	}
+	return username, password, nil
+}
+
+// This looks up a user and turns a missing row into a readable error
+func getUser(ctx context.Context, queries db.Querier, username string) (db.User, error) {
+	user, err := queries.GetUserByUsername(ctx, username)
+	if errors.Is(err, sql.ErrNoRows) {
+		return user, fmt.Errorf("user %q not found", username)
+	}
+	return user, err
+}
+
+func createUser(ctx context.Context, queries db.Querier, args []string, out io.Writer) error {
+	username, password, err := parseUserFlags("create-user", args, true)
+	if err != nil {
+		return err
+	}
+	if err := server.ValidateUsername(username); err != nil {
+		return err
+	}
+
+	generated := password == ""
+	if generated {
+		password = rand.Text()
+	}
+	if err := server.ValidatePassword(password); err != nil {
+		return err
+	}
+
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %w", err)
+	}
+	userID, err := queries.CreateUser(ctx, db.CreateUserParams{
+		Username: username,
+		Password: string(hashed),
+	})
+	if err != nil {
+		if storage.IsUniqueViolation(err) {
+			return fmt.Errorf("username %q is already taken", username)
+		}
+		return err
+	}
+	apiKey, err := server.IssueDefaultAPIKey(ctx, queries, userID)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "created user %s\n", username)
+	if generated {
+		fmt.Fprintf(out, "password: %s\n", password)
+	}
+	fmt.Fprintf(out, "api key: %s\n", apiKey)
+	return nil
+}
+
+func listUsers(ctx context.Context, queries db.Querier, args []string, out io.Writer) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+
+	users, err := queries.ListUsers(ctx)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tUSERNAME\tAPI KEYS\tDISABLED\tLOCKED UNTIL\tUPDATED AT")
+	for _, user := range users {
+		keys, err := queries.ListAPIKeys(ctx, user.ID)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%d\t%t\t%s\t%s\n", user.ID, user.Username, len(keys), user.Disabled != 0, orDash(user.LockedUntil), user.UpdatedAt.String)
+	}
+	return tw.Flush()
+}
+
+func setDisabled(ctx context.Context, queries db.Querier, name string, args []string, out io.Writer, disabled bool) error {
+	username, _, err := parseUserFlags(name, args, false)
+	if err != nil {
+		return err
+	}
+
+	var value int64
+	if disabled {
+		value = 1
+	}
+	updated, err := queries.SetUserDisabled(ctx, db.SetUserDisabledParams{Disabled: value, Username: username})
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return fmt.Errorf("user %q not found", username)
+	}
+
+	if disabled {
+		fmt.Fprintf(out, "disabled user %s, live sessions stay up until they reconnect or are kicked through the admin API\n", username)
+	} else {
+		fmt.Fprintf(out, "enabled user %s\n", username)
+	}
+	return nil
+}
+
+func disableUser(ctx context.Context, queries db.Querier, args []string, out io.Writer) error {
+	return setDisabled(ctx, queries, "disable-user", args, out, true)
+}
+
+func enableUser(ctx context.Context, queries db.Querier, args []string, out io.Writer) error {
+	return setDisabled(ctx, queries, "enable-user", args, out, false)
+}
+
+func unlockUser(ctx context.Context, queries db.Querier, args []string, out io.Writer) error {
+	username, _, err := parseUserFlags("unlock-user", args, false)
+	if err != nil {
+		return err
+	}
+
+	user, err := getUser(ctx, queries, username)
+	if err != nil {
+		return err
+	}
+	if err := queries.ResetFailedLogins(ctx, user.ID); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "unlocked user %s\n", username)
+	return nil
+}
+
+func deleteUser(ctx context.Context, queries db.Querier, args []string, out io.Writer) error {
+	username, _, err := parseUserFlags("delete-user", args, false)
+	if err != nil {
+		return err
+	}
+
+	user, err := getUser(ctx, queries, username)
+	if err != nil {
+		return err
+	}
+	if err := queries.DeleteUser(ctx, user.ID); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "deleted user %s (ID %d)\n", username, user.ID)
+	return nil
+}
+
+func listKeys(ctx context.Context, queries db.Querier, args []string, out io.Writer) error {
+	username, _, err := parseUserFlags("list-keys", args, false)
+	if err != nil {
+		return err
+	}
+
+	user, err := getUser(ctx, queries, username)
+	if err != nil {
+		return err
+	}
+	keys, err := queries.ListAPIKeys(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tLABEL\tPREFIX\tSCOPES\tCREATED AT\tLAST USED AT\tEXPIRES AT")
+	for _, key := range keys {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n", key.ID, key.Label, key.Prefix, key.Scopes, key.CreatedAt, orDash(key.LastUsedAt), orDash(key.ExpiresAt))
+	}
+	return tw.Flush()
+}
+
+func orDash(value sql.NullString) string {
+	if !value.Valid {
+		return "-"
+	}
+	return value.String
+}
+
+func rotateKey(ctx context.Context, queries db.Querier, args []string, out io.Writer) error {
+	username, _, err := parseUserFlags("rotate-key", args, false)
+	if err != nil {
+		return err
+	}
+	user, err := getUser(ctx, queries, username)
+	if err != nil {
+		return err
+	}
+
+	if _, err := queries.RevokeAllAPIKeys(ctx, user.ID); err != nil {
+		return err
+	}
+	apiKey, err := server.IssueDefaultAPIKey(ctx, queries, user.ID)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "api key: %s\n", apiKey)
+	return nil
+}
+
+func revokeKey(ctx context.Context, queries db.Querier, args []string, out io.Writer) error {
+	username, _, err := parseUserFlags("revoke-key", args, false)
+	if err != nil {
+		return err
+	}
+
+	user, err := getUser(ctx, queries, username)
+	if err != nil {
+		return err
+	}
+	revoked, err := queries.RevokeAllAPIKeys(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "revoked %d API keys of %s\n", revoked, username)
+	return nil
+}
+
+func resetPassword(ctx context.Context, queries db.Querier, args []string, out io.Writer) error {
+	username, password, err := parseUserFlags("reset-password", args, true)
+	if err != nil {
+		return err
+	}
+	if _, err := getUser(ctx, queries, username); err != nil {
+		return err
+	}
+
+	generated := password == ""
+	if generated {
+		password = rand.Text()
+	}
+	if err := server.ValidatePassword(password); err != nil {
+		return err
+	}
+
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %w", err)
+	}
+	if err := queries.UpdateUserPassword(ctx, db.UpdateUserPasswordParams{Password: string(hashed), Username: username}); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "password of %s updated\n", username)
+	if generated {
+		fmt.Fprintf(out, "password: %s\n", password)
+	}
+	return nil
+}
+
+func stats(ctx context.Context, queries db.Querier, args []string, out io.Writer) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+
+	total, err := queries.CountUsers(ctx)
+	if err != nil {
+		return err
+	}
+	disabled, err := queries.CountDisabledUsers(ctx)
+	if err != nil {
+		return err
+	}
+	withKey, err := queries.CountUsersWithAPIKey(ctx)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "users\t%d\n", total)
+	fmt.Fprintf(tw, "disabled users\t%d\n", disabled)
+	fmt.Fprintf(tw, "users with an API key\t%d\n", withKey)
+	return tw.Flush()
+}
+
+func migrateSchema(ctx context.Context, migrator *migrate.Migrator, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+
+	switch args[0] {
+	case "up":
+		if len(args) != 1 {
+			return errUsage
+		}
+		applied, err := migrator.Up(ctx)
+		for _, m := range applied {
+			fmt.Fprintf(out, "applied %04d_%s\n", m.Version, m.Name)
+		}
+		if err == nil && len(applied) == 0 {
+			fmt.Fprintln(out, "no pending migrations")
+		}
+		return err
+
+	case "down":
+		fs := flag.NewFlagSet("migrate down", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		steps := fs.Int("steps", 1, "number of migrations to revert")
+		if err := fs.Parse(args[1:]); err != nil || fs.NArg() != 0 || *steps < 1 {
+			return errUsage
+		}
+		reverted, err := migrator.Down(ctx, *steps)
+		for _, m := range reverted {
+			fmt.Fprintf(out, "reverted %04d_%s\n", m.Version, m.Name)
+		}
+		if err == nil && len(reverted) == 0 {
+			fmt.Fprintln(out, "no applied migrations")
+		}
+		return err
+
+	case "status":
+		if len(args) != 1 {
+			return errUsage
+		}
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+
+		tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED AT")
+		for _, status := range statuses {
+			appliedAt := "pending"
+			if status.Applied {
+				appliedAt = status.AppliedAt
+			}
+			fmt.Fprintf(tw, "%04d\t%s\t%s\n", status.Version, status.Name, appliedAt)
+		}
+		return tw.Flush()
+
+	default:
+		return errUsage
+	}
+}
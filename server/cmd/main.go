@@ -1,27 +1,294 @@
 package main
 
 import (
-	"log"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/redis/go-redis/v9"
 	server "github.com/sushiag/go-webrtc-signaling-server/server/server"
-	sqlitedb "github.com/sushiag/go-webrtc-signaling-server/server/server/register"
+	"github.com/sushiag/go-webrtc-signaling-server/server/server/redisbus"
+	"github.com/sushiag/go-webrtc-signaling-server/server/server/storage"
+
+	"signaling-msgs/logging"
 )
 
 func main() {
-	const serverData = "Server.db"
-	queries, dbConn := sqlitedb.NewDatabase(serverData)
-	httpServer, wsURL := server.StartServer("0", queries)
-	log.Printf("[SERVER] WebSocket server started at %s", wsURL)
+	autoMigrate := flag.Bool("auto-migrate", false, "apply pending database migrations at startup")
+	flag.Parse()
 
-	defer func() {
-		if err := httpServer.Close(); err != nil {
-			log.Fatalf("[SERVER] Failed to stop the server: %v", err)
+	logger := logging.FromEnv()
+
+	opts := server.Options{Logger: logger}
+
+	// This connects the node to the others when REDIS_URL is set
+	if redisURL := os.Getenv("REDIS_URL"); redisURL != "" {
+		redisOpts, err := redis.ParseURL(redisURL)
+		if err != nil {
+			logger.Error("invalid REDIS_URL", "err", err)
+			os.Exit(1)
 		}
+		redisClient := redis.NewClient(redisOpts)
+		defer redisClient.Close()
+
+		bus := redisbus.New(redisClient)
+		defer bus.Close()
+		opts.Bus = bus
+
+		if nodeID := os.Getenv("NODE_ID"); nodeID != "" {
+			id, err := strconv.ParseUint(nodeID, 10, 16)
+			if err != nil {
+				logger.Error("invalid NODE_ID", "err", err)
+				os.Exit(1)
+			}
+			opts.NodeID = uint16(id)
+		}
+	}
+
+	// This shares the access token keys between nodes, see server.ParseTokenKeys for the format
+	if tokenKeys := os.Getenv("TOKEN_KEYS"); tokenKeys != "" {
+		keys, err := server.ParseTokenKeys(tokenKeys)
+		if err != nil {
+			logger.Error("invalid TOKEN_KEYS", "err", err)
+			os.Exit(1)
+		}
+		opts.TokenKeys = keys
+	}
+	if tokenTTL := os.Getenv("TOKEN_TTL"); tokenTTL != "" {
+		ttl, err := time.ParseDuration(tokenTTL)
+		if err != nil {
+			logger.Error("invalid TOKEN_TTL", "err", err)
+			os.Exit(1)
+		}
+		opts.TokenTTL = ttl
+	}
+
+	// This enables single sign-on when OIDC_ISSUER is set
+	if issuer := os.Getenv("OIDC_ISSUER"); issuer != "" {
+		opts.OIDC = &server.OIDCConfig{
+			Issuer:            issuer,
+			ClientID:          os.Getenv("OIDC_CLIENT_ID"),
+			ClientSecret:      os.Getenv("OIDC_CLIENT_SECRET"),
+			RedirectURL:       os.Getenv("OIDC_REDIRECT_URL"),
+			LinkExistingUsers: os.Getenv("OIDC_LINK_EXISTING_USERS") == "true",
+		}
+	}
+
+	// This enables password resets when SMTP_ADDR is set
+	if smtpAddr := os.Getenv("SMTP_ADDR"); smtpAddr != "" {
+		reset := &server.PasswordResetConfig{
+			Mailer: &server.SMTPMailer{
+				Addr:     smtpAddr,
+				From:     os.Getenv("SMTP_FROM"),
+				Username: os.Getenv("SMTP_USERNAME"),
+				Password: os.Getenv("SMTP_PASSWORD"),
+			},
+			URL: os.Getenv("PASSWORD_RESET_URL"),
+		}
+		if resetTTL := os.Getenv("PASSWORD_RESET_TTL"); resetTTL != "" {
+			ttl, err := time.ParseDuration(resetTTL)
+			if err != nil {
+				logger.Error("invalid PASSWORD_RESET_TTL", "err", err)
+				os.Exit(1)
+			}
+			reset.TTL = ttl
+		}
+		opts.PasswordReset = reset
+	}
+
+	// This runs the built-in STUN and TURN server when TURN_PUBLIC_IP is set
+	if publicIP := os.Getenv("TURN_PUBLIC_IP"); publicIP != "" {
+		turnServer := &server.TURNServerConfig{
+			ListenAddr: os.Getenv("TURN_LISTEN_ADDR"),
+			PublicIP:   publicIP,
+			Realm:      os.Getenv("TURN_REALM"),
+		}
+		if relayPorts := os.Getenv("TURN_RELAY_PORTS"); relayPorts != "" {
+			minPort, maxPort, err := parsePortRange(relayPorts)
+			if err != nil {
+				logger.Error("invalid TURN_RELAY_PORTS", "err", err)
+				os.Exit(1)
+			}
+			turnServer.MinRelayPort, turnServer.MaxRelayPort = minPort, maxPort
+		}
+		if maxAllocations := os.Getenv("TURN_MAX_ALLOCATIONS"); maxAllocations != "" {
+			n, err := strconv.Atoi(maxAllocations)
+			if err != nil {
+				logger.Error("invalid TURN_MAX_ALLOCATIONS", "err", err)
+				os.Exit(1)
+			}
+			turnServer.MaxAllocationsPerUser = n
+		}
+		// This is comma separated, like 10.0.0.0/8,192.168.1.5/32
+		for _, peer := range splitList(os.Getenv("TURN_ALLOWED_PEERS")) {
+			prefix, err := netip.ParsePrefix(peer)
+			if err != nil {
+				logger.Error("invalid TURN_ALLOWED_PEERS", "err", err)
+				os.Exit(1)
+			}
+			turnServer.AllowedPeers = append(turnServer.AllowedPeers, prefix)
+		}
+		opts.TURN = turnServer
+	}
+
+	// This hands clients STUN and TURN servers when STUN_URLS or TURN_URLS is set, both are comma
+	// separated and the TURN servers must accept credentials derived from TURN_SECRET. The built-in
+	// TURN server uses TURN_SECRET too so nodes accept each other's credentials.
+	stunURLs, turnURLs := splitList(os.Getenv("STUN_URLS")), splitList(os.Getenv("TURN_URLS"))
+	if len(stunURLs) > 0 || len(turnURLs) > 0 || opts.TURN != nil {
+		ice := &server.ICEConfig{STUNURLs: stunURLs, TURNURLs: turnURLs, TURNSecret: os.Getenv("TURN_SECRET")}
+		if credentialTTL := os.Getenv("TURN_CREDENTIAL_TTL"); credentialTTL != "" {
+			ttl, err := time.ParseDuration(credentialTTL)
+			if err != nil {
+				logger.Error("invalid TURN_CREDENTIAL_TTL", "err", err)
+				os.Exit(1)
+			}
+			ice.TURNCredentialTTL = ttl
+		}
+		opts.ICE = ice
+	}
+
+	// This sets what the server strips from the SDPs and ICE candidates it forwards,
+	// DISALLOWED_CODECS is comma separated
+	opts.Payloads = server.PayloadPolicy{
+		StripHostCandidates:    os.Getenv("STRIP_HOST_CANDIDATES") == "true",
+		StripPrivateCandidates: os.Getenv("STRIP_PRIVATE_CANDIDATES") == "true",
+		DisallowedCodecs:       splitList(os.Getenv("DISALLOWED_CODECS")),
+	}
+	if maxSDPSize := os.Getenv("MAX_SDP_SIZE"); maxSDPSize != "" {
+		n, err := strconv.Atoi(maxSDPSize)
+		if err != nil {
+			logger.Error("invalid MAX_SDP_SIZE", "err", err)
+			os.Exit(1)
+		}
+		opts.Payloads.MaxSDPSize = n
+	}
+
+	// This serves HTTPS when TLS_CERT_FILE is set, clients with a certificate signed by a CA in
+	// TLS_CLIENT_CA_FILE are authenticated as the user in its common name
+	if certFile := os.Getenv("TLS_CERT_FILE"); certFile != "" {
+		tlsConfig, err := loadTLSConfig(certFile, os.Getenv("TLS_KEY_FILE"), os.Getenv("TLS_CLIENT_CA_FILE"))
+		if err != nil {
+			logger.Error("invalid TLS config", "err", err)
+			os.Exit(1)
+		}
+		opts.TLS = tlsConfig
+	}
+
+	// This uses Postgres when DATABASE_URL is a postgres:// URL and SQLite otherwise
+	database := os.Getenv("DATABASE_URL")
+	if database == "" {
+		database = "Server.db"
+	}
+	queries, dbConn, err := storage.Open(database)
+	if err != nil {
+		logger.Error("failed to open the database", "err", err)
+		os.Exit(1)
+	}
+	if err := migrateDatabase(dbConn, database, *autoMigrate, logger); err != nil {
+		logger.Error("failed to migrate the database", "err", err)
+		os.Exit(1)
+	}
+	httpServer, wsURL := server.StartServerWithOptions("0", queries, opts)
+	logger.Info("WebSocket server started", "addr", wsURL)
+
+	defer func() {
 		if err := dbConn.Close(); err != nil {
-			log.Fatalf("[SERVER] Failed to close the database: %v", err)
+			logger.Error("failed to close the database", "err", err)
 		}
 	}()
 
-	select {}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+
+	// This gives in-flight requests some time to finish, /readyz reports not ready in the meantime
+	logger.Info("shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := httpServer.Shutdown(ctx); err != nil {
+		logger.Error("failed to gracefully stop the server", "err", err)
+	}
+}
+
+// This applies the pending migrations when asked to, otherwise it refuses to start on an outdated schema
+func migrateDatabase(dbConn *sql.DB, database string, autoMigrate bool, logger *slog.Logger) error {
+	ctx := context.Background()
+	if !autoMigrate {
+		return storage.CheckMigrated(ctx, dbConn, database)
+	}
+
+	migrator, err := storage.Migrator(dbConn, database)
+	if err != nil {
+		return err
+	}
+	applied, err := migrator.Up(ctx)
+	for _, m := range applied {
+		logger.Info("applied migration", "version", m.Version, "name", m.Name)
+	}
+	return err
+}
+
+// This loads the server certificate and, when a CA file is given, verifies client certificates
+// signed by it
+func loadTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if clientCAFile == "" {
+		return config, nil
+	}
+
+	pem, err := os.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	config.ClientCAs = x509.NewCertPool()
+	if !config.ClientCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates in %s", clientCAFile)
+	}
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	return config, nil
+}
+
+// This splits a comma separated list, skipping empty entries
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// This parses a port range written as min-max
+func parsePortRange(portRange string) (uint16, uint16, error) {
+	minPort, maxPort, found := strings.Cut(portRange, "-")
+	if !found {
+		return 0, 0, fmt.Errorf("port range %q must be written as min-max", portRange)
+	}
+	lo, err := strconv.ParseUint(minPort, 10, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+	hi, err := strconv.ParseUint(maxPort, 10, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+	return uint16(lo), uint16(hi), nil
 }
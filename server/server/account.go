@@ -0,0 +1,219 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/sushiag/go-webrtc-signaling-server/server/server/db"
+	"github.com/sushiag/go-webrtc-signaling-server/server/server/storage"
+)
+
+const authEventDeleteAccount = "delete_account"
+
+// How recent the login behind an access token has to be for it to stand in for the keys scope of
+// users without a password, who never get a key with it
+const recentLoginWindow = 5 * time.Minute
+
+// This is everything the server stores about a user, as GET /account shows it. Passwords and API
+// keys are only stored hashed and are left out.
+type accountInfo struct {
+	ID           int64           `json:"id"`
+	Username     string          `json:"username"`
+	Email        string          `json:"email,omitempty"`
+	HasPassword  bool            `json:"has_password"`
+	Disabled     bool            `json:"disabled"`
+	UpdatedAt    *time.Time      `json:"updated_at,omitempty"`
+	FailedLogins int64           `json:"failed_logins"`
+	LockedUntil  *time.Time      `json:"locked_until,omitempty"`
+	Identities   []identityInfo  `json:"identities"`
+	APIKeys      []apiKeyInfo    `json:"api_keys"`
+	AuthEvents   []authEventInfo `json:"auth_events"`
+}
+
+// This is an external identity linked to the user
+type identityInfo struct {
+	Issuer    string     `json:"issuer"`
+	Subject   string     `json:"subject"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+}
+
+// This exports what the server stores about the user the request is authenticated as. Users
+// without a password export it with an access token they got by logging in just before.
+func getAccount(w http.ResponseWriter, r *http.Request, queries db.Querier, auth Authenticator) {
+	principal, err := auth.Authenticate(r)
+	if err != nil {
+		writeAuthError(w, r, err)
+		return
+	}
+	user := principal.User
+	if !slices.Contains(principal.Scopes, ScopeKeys) && !(user.Password == "" && principal.recentLogin()) {
+		writeAuthError(w, r, errMissingScope)
+		return
+	}
+
+	info, err := loadAccountInfo(r.Context(), queries, user)
+	if err != nil {
+		requestLogger(r).Error("failed to export account", "username", user.Username, "err", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, info)
+}
+
+func loadAccountInfo(ctx context.Context, queries db.Querier, user db.User) (accountInfo, error) {
+	info := accountInfo{
+		ID:           user.ID,
+		Username:     user.Username,
+		Email:        user.Email.String,
+		HasPassword:  user.Password != "",
+		Disabled:     user.Disabled != 0,
+		UpdatedAt:    parseDBTime(user.UpdatedAt),
+		FailedLogins: user.FailedLogins,
+		LockedUntil:  parseDBTime(user.LockedUntil),
+		Identities:   []identityInfo{},
+		APIKeys:      []apiKeyInfo{},
+		AuthEvents:   []authEventInfo{},
+	}
+
+	identities, err := queries.ListUserIdentities(ctx, user.ID)
+	if err != nil {
+		return accountInfo{}, err
+	}
+	for _, identity := range identities {
+		info.Identities = append(info.Identities, identityInfo{
+			Issuer:    identity.Issuer,
+			Subject:   identity.Subject,
+			CreatedAt: parseDBTime(sql.NullString{String: identity.CreatedAt, Valid: true}),
+		})
+	}
+
+	keys, err := queries.ListAPIKeys(ctx, user.ID)
+	if err != nil {
+		return accountInfo{}, err
+	}
+	for _, key := range keys {
+		info.APIKeys = append(info.APIKeys, newAPIKeyInfo(key))
+	}
+
+	events, err := queries.ListAuthEvents(ctx, db.ListAuthEventsParams{
+		UserID: sql.NullInt64{Int64: user.ID, Valid: true},
+		Limit:  maxAuthEventsLimit,
+	})
+	if err != nil {
+		return accountInfo{}, err
+	}
+	for _, event := range events {
+		info.AuthEvents = append(info.AuthEvents, newAuthEventInfo(event))
+	}
+	return info, nil
+}
+
+// This sets the email password reset links are sent to, an empty email removes it
+func setAccountEmail(w http.ResponseWriter, r *http.Request, queries db.Querier, auth Authenticator) {
+	principal, err := authenticate(r, auth, ScopeKeys)
+	if err != nil {
+		writeAuthError(w, r, err)
+		return
+	}
+	user := principal.User
+	logger := requestLogger(r).With("username", user.Username)
+
+	var rqst struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&rqst); err != nil {
+		http.Error(w, "Invalid input", http.StatusUnprocessableEntity)
+		return
+	}
+
+	var email sql.NullString
+	if rqst.Email != "" {
+		address, err := checkEmailField(rqst.Email)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		email = sql.NullString{String: address, Valid: true}
+	}
+
+	if _, err := queries.SetUserEmail(r.Context(), db.SetUserEmailParams{Email: email, ID: user.ID}); err != nil {
+		if storage.IsUniqueViolation(err) {
+			http.Error(w, "Email is already in use", http.StatusConflict)
+			return
+		}
+		logger.Error("failed to set email", "err", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	logger.Info("email updated", "removed", !email.Valid)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// This deletes the user the request is authenticated as, along with their keys, identities and
+// auth events. The password has to be confirmed and the user's live session is
+// closed, which takes them out of their rooms. Users without a password, like the ones OIDC
+// provisioned, confirm with an access token they got by logging in just before.
+func deleteAccount(w http.ResponseWriter, r *http.Request, wsm *WebSocketManager, queries db.Querier, auth Authenticator, lockout LockoutPolicy) {
+	principal, err := auth.Authenticate(r)
+	if err != nil {
+		writeAuthError(w, r, err)
+		return
+	}
+	keyUser := principal.User
+	logger := requestLogger(r).With("username", keyUser.Username)
+
+	var rqst struct {
+		Password string `json:"password"`
+	}
+	// the body is optional for users without a password
+	if err := json.NewDecoder(r.Body).Decode(&rqst); err != nil && !(errors.Is(err, io.EOF) && keyUser.Password == "") {
+		http.Error(w, "Invalid input", http.StatusUnprocessableEntity)
+		return
+	}
+
+	if keyUser.Password == "" {
+		if !principal.recentLogin() {
+			logger.Info("account deletion rejected, no recent login")
+			http.Error(w, "Log in again and delete the account with the access token of that login", http.StatusForbidden)
+			return
+		}
+	} else {
+		if !slices.Contains(principal.Scopes, ScopeKeys) {
+			writeAuthError(w, r, errMissingScope)
+			return
+		}
+		if _, err := checkPassword(r, queries, lockout, authEventDeleteAccount, keyUser.Username, rqst.Password); err != nil {
+			logger.Info("account deletion rejected", "err", err)
+			writeLoginError(w, r, err)
+			return
+		}
+	}
+
+	if err := queries.DeleteUser(r.Context(), keyUser.ID); err != nil {
+		logger.Error("failed to delete account", "err", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// The account is gone either way, a session that can't be closed now fails its next reconnect
+	ctx, cancel := context.WithTimeout(r.Context(), adminTimeout)
+	defer cancel()
+	userID := uint64(keyUser.ID)
+	err = wsm.exec(ctx, wsm.shardFor(userID), func(s *shard) {
+		s.forceDisconnect(userID, websocket.CloseNormalClosure, "account deleted")
+	})
+	if err != nil {
+		logger.Warn("failed to close the session of a deleted account", "err", err)
+	}
+
+	logger.Info("account deleted")
+	w.WriteHeader(http.StatusNoContent)
+}
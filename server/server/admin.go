@@ -0,0 +1,269 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sushiag/go-webrtc-signaling-server/server/server/db"
+)
+
+// Environment variable holding the admin credential, the admin API is disabled when it's empty
+const adminAPIKeyEnvName = "ADMIN_API_KEY"
+
+// This is how long an admin request waits for the run loop
+const adminTimeout = 5 * time.Second
+
+type adminConnection struct {
+	UserID      uint64    `json:"user_id"`
+	ConnID      string    `json:"conn_id"`
+	RemoteAddr  string    `json:"remote_addr"`
+	ConnectedAt time.Time `json:"connected_at"`
+	Rooms       []uint64  `json:"rooms"`
+}
+
+type adminRoom struct {
+	RoomID  uint64   `json:"room_id"`
+	HostID  uint64   `json:"host_id"`
+	Members []uint64 `json:"members"`
+}
+
+// This serves the /admin endpoints, every one of them requires the admin API key
+func adminRoutes(wsm *WebSocketManager, queries db.Querier, adminKey string) http.Handler {
+	admin := http.NewServeMux()
+
+	admin.HandleFunc("GET /admin/connections", func(w http.ResponseWriter, r *http.Request) {
+		adminListConnections(w, r, wsm)
+	})
+	admin.HandleFunc("DELETE /admin/connections/{userID}", func(w http.ResponseWriter, r *http.Request) {
+		adminDisconnectUser(w, r, wsm)
+	})
+	admin.HandleFunc("GET /admin/rooms", func(w http.ResponseWriter, r *http.Request) {
+		adminListRooms(w, r, wsm)
+	})
+	admin.HandleFunc("DELETE /admin/rooms/{roomID}", func(w http.ResponseWriter, r *http.Request) {
+		adminCloseRoom(w, r, wsm)
+	})
+	admin.HandleFunc("POST /admin/notice", func(w http.ResponseWriter, r *http.Request) {
+		adminBroadcastNotice(w, r, wsm)
+	})
+	admin.HandleFunc("DELETE /admin/users/{userID}/apikey", func(w http.ResponseWriter, r *http.Request) {
+		adminRevokeAPIKey(w, r, wsm, queries)
+	})
+	admin.Handle("GET /admin/metrics", expvar.Handler())
+
+	return requireAdminKey(admin, adminKey)
+}
+
+// This only lets requests carrying the admin API key through
+func requireAdminKey(next http.Handler, adminKey string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("X-Admin-Key")
+		if key == "" {
+			key = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		}
+
+		if subtle.ConstantTimeCompare([]byte(key), []byte(adminKey)) != 1 {
+			requestLogger(r).Warn("unauthorized admin request")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func adminListConnections(w http.ResponseWriter, r *http.Request, wsm *WebSocketManager) {
+	ctx, cancel := context.WithTimeout(r.Context(), adminTimeout)
+	defer cancel()
+
+	conns := []adminConnection{}
+	err := wsm.execAll(ctx, func(s *shard) {
+		for userID, conn := range s.connections {
+			rooms := slices.Sorted(maps.Keys(s.userRooms[userID]))
+
+			conns = append(conns, adminConnection{
+				UserID:      userID,
+				ConnID:      conn.ID,
+				RemoteAddr:  conn.RemoteAddr,
+				ConnectedAt: conn.ConnectedAt,
+				Rooms:       rooms,
+			})
+		}
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	slices.SortFunc(conns, func(a, b adminConnection) int { return cmp.Compare(a.UserID, b.UserID) })
+	writeJSON(w, r, http.StatusOK, conns)
+}
+
+func adminListRooms(w http.ResponseWriter, r *http.Request, wsm *WebSocketManager) {
+	ctx, cancel := context.WithTimeout(r.Context(), adminTimeout)
+	defer cancel()
+
+	rooms := []adminRoom{}
+	err := wsm.execAll(ctx, func(s *shard) {
+		for roomID, room := range s.rooms {
+			members := make([]uint64, 0, len(room.Users))
+			for userID := range room.Users {
+				members = append(members, userID)
+			}
+			slices.Sort(members)
+
+			rooms = append(rooms, adminRoom{
+				RoomID:  roomID,
+				HostID:  room.HostID,
+				Members: members,
+			})
+		}
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	slices.SortFunc(rooms, func(a, b adminRoom) int { return cmp.Compare(a.RoomID, b.RoomID) })
+	writeJSON(w, r, http.StatusOK, rooms)
+}
+
+func adminDisconnectUser(w http.ResponseWriter, r *http.Request, wsm *WebSocketManager) {
+	userID, err := strconv.ParseUint(r.PathValue("userID"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), adminTimeout)
+	defer cancel()
+
+	var disconnected bool
+	err = wsm.exec(ctx, wsm.shardFor(userID), func(s *shard) {
+		disconnected = s.forceDisconnect(userID, websocket.ClosePolicyViolation, "disconnected by an administrator")
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if !disconnected {
+		http.Error(w, "user is not connected", http.StatusNotFound)
+		return
+	}
+
+	requestLogger(r).Info("admin disconnected user", "user_id", userID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func adminCloseRoom(w http.ResponseWriter, r *http.Request, wsm *WebSocketManager) {
+	roomID, err := strconv.ParseUint(r.PathValue("roomID"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid room ID", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), adminTimeout)
+	defer cancel()
+
+	var closed bool
+	err = wsm.exec(ctx, wsm.shardFor(roomID), func(s *shard) {
+		closed = s.closeRoom(roomID, "closed by an administrator")
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if !closed {
+		http.Error(w, "room not found", http.StatusNotFound)
+		return
+	}
+
+	requestLogger(r).Info("admin closed room", "room_id", roomID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func adminBroadcastNotice(w http.ResponseWriter, r *http.Request, wsm *WebSocketManager) {
+	var rqst struct {
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&rqst); err != nil || strings.TrimSpace(rqst.Message) == "" {
+		http.Error(w, "a non-empty message is required", http.StatusUnprocessableEntity)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), adminTimeout)
+	defer cancel()
+
+	var recipients int
+	err := wsm.execAll(ctx, func(s *shard) {
+		recipients += s.broadcastNotice(rqst.Message)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	requestLogger(r).Info("admin broadcast a server notice", "recipients", recipients)
+	writeJSON(w, r, http.StatusOK, struct {
+		Recipients int `json:"recipients"`
+	}{recipients})
+}
+
+func adminRevokeAPIKey(w http.ResponseWriter, r *http.Request, wsm *WebSocketManager, queries db.Querier) {
+	userID, err := strconv.ParseInt(r.PathValue("userID"), 10, 64)
+	if err != nil || userID <= 0 {
+		http.Error(w, "invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := queries.GetUserByID(r.Context(), userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "user not found", http.StatusNotFound)
+		} else {
+			requestLogger(r).Error("failed to look up user", "user_id", userID, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	revoked, err := queries.RevokeAllAPIKeys(r.Context(), userID)
+	if err != nil {
+		requestLogger(r).Error("failed to revoke API keys", "user_id", userID, "err", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// A revoked key shouldn't keep a live session around
+	ctx, cancel := context.WithTimeout(r.Context(), adminTimeout)
+	defer cancel()
+	err = wsm.exec(ctx, wsm.shardFor(uint64(userID)), func(s *shard) {
+		s.forceDisconnect(uint64(userID), websocket.ClosePolicyViolation, "API keys revoked")
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	requestLogger(r).Info("admin revoked API keys", "user_id", userID, "revoked", revoked)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, r *http.Request, statusCode int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		requestLogger(r).Warn("failed to write JSON response", "err", err)
+	}
+}
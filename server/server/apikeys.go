@@ -0,0 +1,282 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sushiag/go-webrtc-signaling-server/server/server/db"
+	sqlitedb "github.com/sushiag/go-webrtc-signaling-server/server/server/register"
+	"github.com/sushiag/go-webrtc-signaling-server/server/server/storage"
+
+	"signaling-msgs/logging"
+)
+
+// These are what an API key may be used for, a key stores them space separated
+const (
+	// Connect to /ws and signal
+	ScopeSignaling = "signaling"
+	// Create, list and revoke the API keys of the user
+	ScopeKeys = "keys"
+)
+
+// These are the scopes of the key handed out by /register and /regenerate
+var defaultScopes = []string{ScopeSignaling, ScopeKeys}
+
+// This is the label of the key handed out by /register and /regenerate
+const defaultKeyLabel = "default"
+
+// This is how many characters of a key are kept in clear so users can tell their keys apart
+const apiKeyPrefixLen = 8
+
+const maxKeyLabelLen = 64
+
+// This is how timestamps are stored, it's the format of SQLite's CURRENT_TIMESTAMP and always UTC
+const dbTimeFormat = time.DateTime
+
+var (
+	errAPIKeyInvalid = errors.New("invalid API key")
+	errAPIKeyExpired = errors.New("API key expired")
+)
+
+// This is an API key as the key endpoints show it, Key is only set right after it was created
+type apiKeyInfo struct {
+	ID         int64      `json:"id"`
+	Label      string     `json:"label"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  *time.Time `json:"created_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	Key        string     `json:"api_key,omitempty"`
+}
+
+func newAPIKeyInfo(key db.ApiKey) apiKeyInfo {
+	return apiKeyInfo{
+		ID:         key.ID,
+		Label:      key.Label,
+		Prefix:     key.Prefix,
+		Scopes:     strings.Fields(key.Scopes),
+		CreatedAt:  parseDBTime(sql.NullString{String: key.CreatedAt, Valid: true}),
+		LastUsedAt: parseDBTime(key.LastUsedAt),
+		ExpiresAt:  parseDBTime(key.ExpiresAt),
+	}
+}
+
+func formatDBTime(t time.Time) sql.NullString {
+	return sql.NullString{String: t.UTC().Format(dbTimeFormat), Valid: true}
+}
+
+func parseDBTime(value sql.NullString) *time.Time {
+	if !value.Valid {
+		return nil
+	}
+	t, err := time.Parse(dbTimeFormat, value.String)
+	if err != nil {
+		return nil
+	}
+	return &t
+}
+
+// IssueDefaultAPIKey creates the kind of API key /register hands out for the user, see issueAPIKey
+func IssueDefaultAPIKey(ctx context.Context, queries db.Querier, userID int64) (string, error) {
+	apiKey, _, err := issueAPIKey(ctx, queries, userID, defaultKeyLabel, defaultScopes, nil)
+	return apiKey, err
+}
+
+// This creates a new API key for the user. Only a hash of it is stored so the returned key can't
+// be looked up again later.
+func issueAPIKey(ctx context.Context, queries db.Querier, userID int64, label string, scopes []string, expiresAt *time.Time) (string, db.ApiKey, error) {
+	apiKey, err := sqlitedb.GenerateAPIKey()
+	if err != nil {
+		return "", db.ApiKey{}, fmt.Errorf("failed to generate API key: %w", err)
+	}
+
+	var expires sql.NullString
+	if expiresAt != nil {
+		expires = formatDBTime(*expiresAt)
+	}
+
+	key, err := queries.CreateAPIKey(ctx, db.CreateAPIKeyParams{
+		UserID:    userID,
+		Prefix:    apiKey[:apiKeyPrefixLen],
+		Hash:      storage.HashAPIKey(apiKey),
+		Label:     label,
+		Scopes:    strings.Join(scopes, " "),
+		ExpiresAt: expires,
+	})
+	if err != nil {
+		return "", db.ApiKey{}, fmt.Errorf("failed to store API key: %w", err)
+	}
+	return apiKey, key, nil
+}
+
+// This takes the API key from the X-API-Key header, or from the Authorization header for clients
+// that send it as a bearer token
+func apiKeyFromRequest(r *http.Request) string {
+	if apiKey := r.Header.Get("X-API-Key"); apiKey != "" {
+		return apiKey
+	}
+	if authHeader := r.Header.Get("Authorization"); strings.HasPrefix(authHeader, "Bearer ") {
+		return strings.TrimPrefix(authHeader, "Bearer ")
+	}
+	return ""
+}
+
+// This verifies the API key against the stored hashes, keys of disabled users are rejected like
+// unknown keys
+func authenticateAPIKey(ctx context.Context, queries db.Querier, apiKey string) (db.User, db.ApiKey, error) {
+	if apiKey == "" {
+		return db.User{}, db.ApiKey{}, ErrNoCredentials
+	}
+
+	row, err := queries.GetAPIKeyByHash(ctx, storage.HashAPIKey(apiKey))
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && row.User.Disabled != 0) {
+		return db.User{}, db.ApiKey{}, errAPIKeyInvalid
+	}
+	if err != nil {
+		return db.User{}, db.ApiKey{}, err
+	}
+
+	now := time.Now()
+	if expiresAt := parseDBTime(row.ApiKey.ExpiresAt); expiresAt != nil && !now.Before(*expiresAt) {
+		return db.User{}, db.ApiKey{}, errAPIKeyExpired
+	}
+
+	// This is only informational so a failure doesn't stop the key from working
+	err = queries.TouchAPIKey(ctx, db.TouchAPIKeyParams{LastUsedAt: formatDBTime(now), ID: row.ApiKey.ID})
+	if err != nil {
+		logging.FromContext(ctx, nil).Warn("failed to record API key use", "key_id", row.ApiKey.ID, "err", err)
+	}
+	return row.User, row.ApiKey, nil
+}
+
+// This writes the response of a failed authenticate
+func writeAuthError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, errMissingScope):
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	case errors.Is(err, ErrNoCredentials), errors.Is(err, errAPIKeyInvalid), errors.Is(err, errAPIKeyExpired),
+		errors.Is(err, errAccessTokenInvalid), errors.Is(err, errClientCertRejected):
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	default:
+		requestLogger(r).Error("failed to authenticate request", "err", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+// This creates a new API key for the user the request is authenticated as
+func createAPIKey(w http.ResponseWriter, r *http.Request, queries db.Querier, auth Authenticator) {
+	principal, err := authenticate(r, auth, ScopeKeys)
+	if err != nil {
+		writeAuthError(w, r, err)
+		return
+	}
+	user := principal.User
+	logger := requestLogger(r).With("username", user.Username)
+
+	var rqst struct {
+		Label     string     `json:"label"`
+		Scopes    []string   `json:"scopes"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&rqst); err != nil {
+		http.Error(w, "Invalid input", http.StatusUnprocessableEntity)
+		return
+	}
+
+	switch {
+	case rqst.Label == "" || len(rqst.Label) > maxKeyLabelLen || !onlyASCII(rqst.Label):
+		http.Error(w, fmt.Sprintf("label must be 1-%d ASCII characters", maxKeyLabelLen), http.StatusUnprocessableEntity)
+		return
+	case rqst.ExpiresAt != nil && !rqst.ExpiresAt.After(time.Now()):
+		http.Error(w, "expires_at must be in the future", http.StatusUnprocessableEntity)
+		return
+	}
+
+	if len(rqst.Scopes) == 0 {
+		rqst.Scopes = []string{ScopeSignaling}
+	}
+	for _, scope := range rqst.Scopes {
+		if !slices.Contains(defaultScopes, scope) {
+			http.Error(w, fmt.Sprintf("unknown scope %q", scope), http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	slices.Sort(rqst.Scopes)
+	rqst.Scopes = slices.Compact(rqst.Scopes)
+
+	apiKey, key, err := issueAPIKey(r.Context(), queries, user.ID, rqst.Label, rqst.Scopes, rqst.ExpiresAt)
+	if err != nil {
+		logger.Error("failed to create API key", "err", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	logger.Info("API key created", "key_id", key.ID, "label", key.Label)
+
+	info := newAPIKeyInfo(key)
+	info.Key = apiKey
+	writeJSON(w, r, http.StatusCreated, info)
+}
+
+// This lists the API keys of the user the request is authenticated as
+func listAPIKeys(w http.ResponseWriter, r *http.Request, queries db.Querier, auth Authenticator) {
+	principal, err := authenticate(r, auth, ScopeKeys)
+	if err != nil {
+		writeAuthError(w, r, err)
+		return
+	}
+	user := principal.User
+
+	keys, err := queries.ListAPIKeys(r.Context(), user.ID)
+	if err != nil {
+		requestLogger(r).Error("failed to list API keys", "username", user.Username, "err", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	infos := make([]apiKeyInfo, 0, len(keys))
+	for _, key := range keys {
+		infos = append(infos, newAPIKeyInfo(key))
+	}
+	writeJSON(w, r, http.StatusOK, infos)
+}
+
+// This revokes one of the API keys of the user the request is authenticated as, it may be the key
+// used for the request itself
+func revokeAPIKey(w http.ResponseWriter, r *http.Request, queries db.Querier, auth Authenticator) {
+	principal, err := authenticate(r, auth, ScopeKeys)
+	if err != nil {
+		writeAuthError(w, r, err)
+		return
+	}
+	user := principal.User
+
+	keyID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || keyID <= 0 {
+		http.Error(w, "invalid key ID", http.StatusBadRequest)
+		return
+	}
+
+	revoked, err := queries.RevokeAPIKey(r.Context(), db.RevokeAPIKeyParams{ID: keyID, UserID: user.ID})
+	if err != nil {
+		requestLogger(r).Error("failed to revoke API key", "username", user.Username, "key_id", keyID, "err", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	// Keys of other users are reported as missing too
+	if revoked == 0 {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+
+	requestLogger(r).Info("API key revoked", "username", user.Username, "key_id", keyID)
+	w.WriteHeader(http.StatusNoContent)
+}
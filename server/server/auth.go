@@ -1,101 +1,230 @@
 package server
 
 import (
-	"encoding/json"
-	"log"
+	"database/sql"
+	"errors"
+	"fmt"
 	"net/http"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
 
-	smsg "signaling-msgs"
-
-	"github.com/gorilla/websocket"
 	"github.com/sushiag/go-webrtc-signaling-server/server/server/db"
 )
 
-// This wraps a send into outgoing
-func (wsm *WebSocketManager) SafeWriteJSON(c *Connection, v smsg.MessageAnyPayload) error {
-	c.Outgoing <- v
-	return nil
+// These are the ways a request can be authenticated, a Principal's Method is one of them
+const (
+	AuthAPIKey      = "api_key"
+	AuthAccessToken = "access_token"
+	AuthClientCert  = "client_certificate"
+)
+
+// ErrNoCredentials is what an Authenticator returns for requests that don't carry the kind of
+// credentials it checks
+var ErrNoCredentials = errors.New("no credentials")
+
+var (
+	errMissingScope       = errors.New("credentials lack the required scope")
+	errClientCertRejected = errors.New("client certificate doesn't belong to an enabled user")
+)
+
+// Principal is the user a request was authenticated as and what its credentials allow
+type Principal struct {
+	User db.User
+	// Which kind of credentials were used, one of the Auth constants or what a custom
+	// Authenticator sets
+	Method string
+	// What the credentials may be used for, see ScopeSignaling and ScopeKeys
+	Scopes []string
+	// The only rooms the user may join, any room when empty
+	Rooms []uint64
+	// When the credentials stop working, nil when they don't expire
+	ExpiresAt *time.Time
+	// When the user logged in to get the credentials, only set for access tokens issued at a
+	// password or OIDC login
+	LoggedInAt *time.Time
+	// The API key the request was authenticated with, zero for other methods
+	APIKeyID int64
+}
+
+// This tells whether the credentials come from a login within recentLoginWindow. Room scoped tokens
+// are handed to others so they don't count.
+func (p *Principal) recentLogin() bool {
+	return p.LoggedInAt != nil && time.Since(*p.LoggedInAt) < recentLoginWindow && len(p.Rooms) == 0
+}
+
+// Authenticator finds out who sent a request. Every endpoint that authenticates users goes through
+// the server's chain of authenticators, which asks each in turn.
+type Authenticator interface {
+	// Authenticate returns ErrNoCredentials when the request doesn't carry the kind of credentials
+	// the authenticator checks, any other error rejects the request
+	Authenticate(r *http.Request) (*Principal, error)
 }
 
-// This extracts the x-api-key from the HTTP handlers and checks the user API-Key
-func (wsm *WebSocketManager) Authenticate(r *http.Request, queries *db.Queries) (uint64, bool) {
-	apikey := r.Header.Get("X-Api-Key")
-	if apikey == "" {
-		log.Printf("[AUTHENTICATION] Missing API key")
-		return 0, false
+// This asks every authenticator in order, the first one that finds its credentials on the request
+// decides. Rejected credentials don't fall through to the next authenticator.
+type authChain []Authenticator
+
+func (chain authChain) Authenticate(r *http.Request) (*Principal, error) {
+	for _, auth := range chain {
+		principal, err := auth.Authenticate(r)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+		return principal, err
 	}
+	return nil, ErrNoCredentials
+}
 
-	user, err := queries.GetUserByApikeys(r.Context(), apikey)
+// This builds the server's authenticators, explicit credentials are checked before the
+// connection's client certificate
+func newAuthChain(queries db.Querier, tokens *tokenAuthority, extra []Authenticator) authChain {
+	chain := authChain{
+		&tokenAuthenticator{queries: queries, tokens: tokens},
+		&apiKeyAuthenticator{queries: queries},
+		&clientCertAuthenticator{queries: queries},
+	}
+	return append(chain, extra...)
+}
+
+// This authenticates the request and checks its credentials allow scope
+func authenticate(r *http.Request, auth Authenticator, scope string) (*Principal, error) {
+	principal, err := auth.Authenticate(r)
 	if err != nil {
-		log.Printf("[AUTHENTICATION] Invalid API key")
-		return 0, false
+		return nil, err
+	}
+	if !slices.Contains(principal.Scopes, scope) {
+		return nil, errMissingScope
 	}
+	return principal, nil
+}
 
-	log.Printf("[AUTHENTICATION] User %s#%d authenticated", user.Username, user.ID)
-	return uint64(user.ID), true
+// This checks API keys from X-API-Key or the Authorization header
+type apiKeyAuthenticator struct {
+	queries db.Querier
 }
 
-// This handles the initial API key authentication via HTTP
-func (wsm *WebSocketManager) AuthHandler(w http.ResponseWriter, r *http.Request, queries db.Queries) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+func (a *apiKeyAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	apiKey := apiKeyFromRequest(r)
+	if apiKey == "" {
+		return nil, ErrNoCredentials
 	}
+	user, key, err := authenticateAPIKey(r.Context(), a.queries, apiKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Principal{
+		User:      user,
+		Method:    AuthAPIKey,
+		Scopes:    strings.Fields(key.Scopes),
+		ExpiresAt: parseDBTime(key.ExpiresAt),
+		APIKeyID:  key.ID,
+	}, nil
+}
 
-	var payload struct {
-		ApiKey string `json:"apikey"`
+// This checks the access tokens handed out by /token, they only allow signaling
+type tokenAuthenticator struct {
+	queries db.Querier
+	tokens  *tokenAuthority
+}
+
+func (a *tokenAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	raw := accessTokenFromRequest(r)
+	if raw == "" {
+		return nil, ErrNoCredentials
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
-		return
+	claims, err := a.tokens.verify(raw)
+	if err != nil {
+		return nil, err
+	}
+	userID, err := strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid subject", errAccessTokenInvalid)
 	}
 
-	user, err := queries.GetUserByApikeys(r.Context(), payload.ApiKey)
+	// tokens outlive neither their user nor the user being disabled
+	user, err := a.queries.GetUserByID(r.Context(), userID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && user.Disabled != 0) {
+		return nil, fmt.Errorf("%w: user is gone or disabled", errAccessTokenInvalid)
+	}
 	if err != nil {
-		http.Error(w, "Unauthorized access", http.StatusUnauthorized)
-		return
+		return nil, err
+	}
+	expiresAt := claims.ExpiresAt.UTC()
+	principal := &Principal{
+		User:      user,
+		Method:    AuthAccessToken,
+		Scopes:    []string{ScopeSignaling},
+		Rooms:     claims.Rooms,
+		ExpiresAt: &expiresAt,
+	}
+	if claims.AuthTime != nil {
+		loggedInAt := claims.AuthTime.UTC()
+		principal.LoggedInAt = &loggedInAt
 	}
+	return principal, nil
+}
 
-	w.Header().Set("X-Client-ID", strconv.FormatUint(uint64(user.ID), 10))
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(struct {
-		UserID   uint64 `json:"userID"`
-		Username string `json:"username"`
-	}{
-		UserID:   uint64(user.ID),
-		Username: user.Username,
-	})
+// This checks the client certificate of a TLS connection, it was already verified against the
+// CAs of Options.TLS during the handshake. The certificate's common name is the username and it
+// allows what the keys of /register do.
+type clientCertAuthenticator struct {
+	queries db.Querier
 }
 
-// This authenticates the client before upgrading the websocket
-func (wsm *WebSocketManager) Handler(w http.ResponseWriter, r *http.Request, queries *db.Queries) {
-	userID, ok := wsm.Authenticate(r, queries)
-	if !ok {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
+func (a *clientCertAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, ErrNoCredentials
 	}
+	cert := r.TLS.VerifiedChains[0][0]
+	notAfter := cert.NotAfter.UTC()
 
-	upgrader := websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool { return true },
+	user, err := a.queries.GetUserByUsername(r.Context(), cert.Subject.CommonName)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && user.Disabled != 0) {
+		return nil, errClientCertRejected
 	}
-	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("[WS] Upgrade failed: %v", err)
-		return
+		return nil, err
 	}
+	return &Principal{
+		User:      user,
+		Method:    AuthClientCert,
+		Scopes:    slices.Clone(defaultScopes),
+		ExpiresAt: &notAfter,
+	}, nil
+}
 
-	if _, ok := wsm.Connections[userID]; ok {
-		log.Printf("[WS] Duplicate connection attempt for user %d. Denying new connection.", userID)
-		closeMsg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "Duplicate connection detected")
-		conn.WriteMessage(websocket.CloseMessage, closeMsg)
-		conn.Close()
+// This is what GET /auth says about the credentials of the request
+type principalInfo struct {
+	UserID    int64      `json:"user_id"`
+	Username  string     `json:"username"`
+	Method    string     `json:"method"`
+	Scopes    []string   `json:"scopes"`
+	Rooms     []uint64   `json:"rooms,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	APIKeyID  int64      `json:"api_key_id,omitempty"`
+}
+
+// This tells clients who their credentials authenticate them as, which works for every kind of
+// credentials without needing a scope
+func handleAuthIntrospection(w http.ResponseWriter, r *http.Request, auth Authenticator) {
+	principal, err := auth.Authenticate(r)
+	if err != nil {
+		requestLogger(r).Info("introspection rejected", "err", err)
+		writeAuthError(w, r, err)
 		return
 	}
-	connection := NewConnection(userID, conn, wsm.messageChan, wsm.disconnectChan)
-	wsm.Connections[userID] = connection
-
-	log.Printf("[WS] User %d connected", userID)
 
+	w.Header().Set("X-Client-ID", strconv.FormatInt(principal.User.ID, 10))
+	writeJSON(w, r, http.StatusOK, principalInfo{
+		UserID:    principal.User.ID,
+		Username:  principal.User.Username,
+		Method:    principal.Method,
+		Scopes:    principal.Scopes,
+		Rooms:     principal.Rooms,
+		ExpiresAt: principal.ExpiresAt,
+		APIKeyID:  principal.APIKeyID,
+	})
 }
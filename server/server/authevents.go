@@ -0,0 +1,270 @@
+package server
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/sushiag/go-webrtc-signaling-server/server/server/db"
+)
+
+// These are what auth events record, besides the password checks they are named after the endpoint
+const (
+	authEventRegenerate  = "regenerate"
+	authEventNewPassword = "newpassword"
+	authEventToken       = "token"
+	authEventOIDC        = "oidc"
+	// The account got locked by too many failed attempts
+	authEventLockout = "lockout"
+)
+
+const (
+	defaultAuthEventsLimit = 50
+	maxAuthEventsLimit     = 200
+	maxUserAgentLen        = 256
+)
+
+var (
+	errBadCredentials  = errors.New("username and password do not match")
+	errAccountDisabled = errors.New("account is disabled")
+)
+
+// This is returned for accounts that are locked after too many failed attempts
+type accountLockedError struct {
+	until time.Time
+}
+
+func (e *accountLockedError) Error() string {
+	return fmt.Sprintf("account is locked until %s", e.until.UTC().Format(time.RFC3339))
+}
+
+// LockoutPolicy decides how long an account is locked after failed password attempts in a row
+type LockoutPolicy struct {
+	// Failed attempts before the account is locked, zero turns lockout off
+	Threshold int
+	// How long the account is locked once it reaches Threshold, doubled for every later failure
+	BaseDelay time.Duration
+	// The longest an account is locked at once
+	MaxDelay time.Duration
+}
+
+// DefaultLockoutPolicy locks an account for a minute after 5 failed attempts, up to an hour
+func DefaultLockoutPolicy() LockoutPolicy {
+	return LockoutPolicy{Threshold: 5, BaseDelay: time.Minute, MaxDelay: time.Hour}
+}
+
+// This returns how long an account is locked after the given number of failed attempts
+func (p LockoutPolicy) delay(failures int64) time.Duration {
+	if p.Threshold <= 0 || failures < int64(p.Threshold) {
+		return 0
+	}
+	delay := float64(p.BaseDelay) * math.Pow(2, float64(failures-int64(p.Threshold)))
+	if delay > float64(p.MaxDelay) {
+		return p.MaxDelay
+	}
+	return time.Duration(delay)
+}
+
+// This checks the username and password for the event, counting failed attempts towards the
+// lockout and recording the attempt as an auth event. Locked accounts are rejected without
+// checking the password.
+func checkPassword(r *http.Request, queries db.Querier, lockout LockoutPolicy, event, username, password string) (db.User, error) {
+	ctx := r.Context()
+
+	user, err := queries.GetUserByUsername(ctx, username)
+	if errors.Is(err, sql.ErrNoRows) {
+		// unknown users take as long as known ones, so response times don't tell them apart
+		passwordMatches("", password)
+		recordAuthEvent(r, queries, 0, username, event, false, false)
+		return db.User{}, errBadCredentials
+	}
+	if err != nil {
+		return db.User{}, err
+	}
+
+	now := time.Now()
+	if lockedUntil := parseDBTime(user.LockedUntil); lockedUntil != nil && now.Before(*lockedUntil) {
+		recordAuthEvent(r, queries, user.ID, username, event, false, false)
+		return db.User{}, &accountLockedError{until: *lockedUntil}
+	}
+
+	if !passwordMatches(user.Password, password) {
+		recordAuthEvent(r, queries, user.ID, username, event, false, false)
+
+		failures, err := queries.RecordFailedLogin(ctx, user.ID)
+		if err != nil {
+			return db.User{}, err
+		}
+		if delay := lockout.delay(failures); delay > 0 {
+			if err := queries.LockUser(ctx, db.LockUserParams{LockedUntil: formatDBTime(now.Add(delay)), ID: user.ID}); err != nil {
+				return db.User{}, err
+			}
+			requestLogger(r).Warn("account locked after failed attempts", "username", username, "failures", failures, "delay", delay)
+			recordAuthEvent(r, queries, user.ID, username, authEventLockout, false, true)
+		}
+		return db.User{}, errBadCredentials
+	}
+
+	if user.Disabled != 0 {
+		recordAuthEvent(r, queries, user.ID, username, event, false, false)
+		return db.User{}, errAccountDisabled
+	}
+
+	if user.FailedLogins != 0 || user.LockedUntil.Valid {
+		if err := queries.ResetFailedLogins(ctx, user.ID); err != nil {
+			return db.User{}, err
+		}
+	}
+	recordLogin(r, queries, user, event)
+	return user, nil
+}
+
+// This is compared with the passwords of unknown users and users without a password, it has the
+// cost of real hashes and matches nothing
+var dummyPasswordHash = sync.OnceValue(func() []byte {
+	secret := make([]byte, 32)
+	_, _ = rand.Read(secret)
+	hash, _ := bcrypt.GenerateFromPassword([]byte(hex.EncodeToString(secret)), bcrypt.DefaultCost)
+	return hash
+})
+
+// This compares a password with a bcrypt hash, an empty hash takes as long and matches nothing
+func passwordMatches(hash, password string) bool {
+	if hash == "" {
+		_ = bcrypt.CompareHashAndPassword(dummyPasswordHash(), []byte(password))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// This writes the response of a failed checkPassword
+func writeLoginError(w http.ResponseWriter, r *http.Request, err error) {
+	var locked *accountLockedError
+	switch {
+	case errors.Is(err, errBadCredentials):
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	case errors.As(err, &locked):
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(time.Until(locked.until).Seconds()))))
+		http.Error(w, "Account locked, try again later", http.StatusTooManyRequests)
+	case errors.Is(err, errAccountDisabled):
+		http.Error(w, "Account disabled", http.StatusForbidden)
+	default:
+		requestLogger(r).Error("failed to check password", "err", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+// This records a successful login, logins from an IP the user never logged in from before are
+// flagged as suspicious
+func recordLogin(r *http.Request, queries db.Querier, user db.User, event string) {
+	ctx := r.Context()
+	userID := sql.NullInt64{Int64: user.ID, Valid: true}
+	ip := remoteIP(r)
+
+	suspicious := false
+	if total, err := queries.CountSuccessfulLogins(ctx, userID); err == nil && total > 0 {
+		fromIP, err := queries.CountSuccessfulLoginsFromIP(ctx, db.CountSuccessfulLoginsFromIPParams{UserID: userID, Ip: ip})
+		suspicious = err == nil && fromIP == 0
+	}
+	if suspicious {
+		requestLogger(r).Warn("login from a new IP", "username", user.Username, "event", event)
+	}
+	recordAuthEvent(r, queries, user.ID, user.Username, event, true, suspicious)
+}
+
+// This stores an auth event, userID is zero when the username doesn't exist. Failing to record an
+// event doesn't fail the request.
+func recordAuthEvent(r *http.Request, queries db.Querier, userID int64, username, event string, success, suspicious bool) {
+	userAgent := r.UserAgent()
+	if len(userAgent) > maxUserAgentLen {
+		userAgent = userAgent[:maxUserAgentLen]
+	}
+
+	err := queries.CreateAuthEvent(r.Context(), db.CreateAuthEventParams{
+		UserID:     sql.NullInt64{Int64: userID, Valid: userID != 0},
+		Username:   username,
+		Event:      event,
+		Success:    boolToInt(success),
+		Suspicious: boolToInt(suspicious),
+		Ip:         remoteIP(r),
+		UserAgent:  userAgent,
+	})
+	if err != nil {
+		requestLogger(r).Warn("failed to record auth event", "event", event, "err", err)
+	}
+}
+
+func boolToInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// This is an auth event as GET /account/auth-events shows it
+type authEventInfo struct {
+	ID         int64      `json:"id"`
+	Event      string     `json:"event"`
+	Success    bool       `json:"success"`
+	Suspicious bool       `json:"suspicious"`
+	IP         string     `json:"ip"`
+	UserAgent  string     `json:"user_agent"`
+	CreatedAt  *time.Time `json:"created_at,omitempty"`
+}
+
+func newAuthEventInfo(event db.AuthEvent) authEventInfo {
+	return authEventInfo{
+		ID:         event.ID,
+		Event:      event.Event,
+		Success:    event.Success != 0,
+		Suspicious: event.Suspicious != 0,
+		IP:         event.Ip,
+		UserAgent:  event.UserAgent,
+		CreatedAt:  parseDBTime(sql.NullString{String: event.CreatedAt, Valid: true}),
+	}
+}
+
+// This lists the most recent auth events of the user the request is authenticated as, newest
+// first. ?limit= picks how many.
+func listAuthEvents(w http.ResponseWriter, r *http.Request, queries db.Querier, auth Authenticator) {
+	principal, err := authenticate(r, auth, ScopeKeys)
+	if err != nil {
+		writeAuthError(w, r, err)
+		return
+	}
+	user := principal.User
+
+	limit := defaultAuthEventsLimit
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		limit, err = strconv.Atoi(raw)
+		if err != nil || limit <= 0 || limit > maxAuthEventsLimit {
+			http.Error(w, fmt.Sprintf("limit must be 1-%d", maxAuthEventsLimit), http.StatusBadRequest)
+			return
+		}
+	}
+
+	events, err := queries.ListAuthEvents(r.Context(), db.ListAuthEventsParams{
+		UserID: sql.NullInt64{Int64: user.ID, Valid: true},
+		Limit:  int64(limit),
+	})
+	if err != nil {
+		requestLogger(r).Error("failed to list auth events", "username", user.Username, "err", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	infos := make([]authEventInfo, 0, len(events))
+	for _, event := range events {
+		infos = append(infos, newAuthEventInfo(event))
+	}
+	writeJSON(w, r, http.StatusOK, infos)
+}
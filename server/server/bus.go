@@ -0,0 +1,383 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	smsg "signaling-msgs"
+)
+
+// This connects the WebSocketManagers of several server nodes. Every node subscribes to the
+// topics of the users connected to it and of the rooms it owns, messages for users and rooms on
+// other nodes are published to those topics.
+type Bus interface {
+	// Publish sends msg to every subscriber of the topic across all nodes
+	Publish(ctx context.Context, topic string, msg []byte) error
+	// Subscribe calls handler for every message published to the topic until unsubscribe is called,
+	// handlers are called one at a time in the order the messages were published
+	Subscribe(ctx context.Context, topic string, handler func(msg []byte)) (unsubscribe func(), err error)
+	// Close releases the bus, no handlers are called after it returns
+	Close() error
+}
+
+// This is how long bus operations may take before they are given up on
+const busTimeout = 5 * time.Second
+
+// How long a node waits for the node of a remote recipient to confirm an SDP or ICE candidate
+// message before telling the sender the recipient isn't connected anywhere
+const remoteDeliveryTimeout = 3 * time.Second
+
+// How many publishes can wait for the bus, past that they are dropped so a slow bus costs
+// messages rather than memory
+const busQueueSize = 4096
+
+var errBusClosed = errors.New("bus is closed")
+
+func userTopic(userID uint64) string {
+	return "signaling.user." + strconv.FormatUint(userID, 10)
+}
+
+func roomTopic(roomID uint64) string {
+	return "signaling.room." + strconv.FormatUint(roomID, 10)
+}
+
+// This is what a node wants another node to do
+type busKind uint8
+
+const (
+	// Send Msg to the user
+	busDeliver busKind = iota
+	// Add RoomID to the user's room index
+	busTrackRoom
+	// Remove RoomID from the user's room index
+	busUntrackRoom
+	// Add the user's connection to the room, Msg is the join request
+	busJoinRoom
+	// Remove the user's connection from the room
+	busLeaveRoom
+	// The message with RequestID the connection sent was delivered, see awaitDelivery
+	busDelivered
+)
+
+// This is the message nodes exchange over the bus, it always refers to a single connection
+type busEnvelope struct {
+	Kind   busKind         `json:"kind"`
+	UserID uint64          `json:"user_id"`
+	ConnID string          `json:"conn_id"`
+	RoomID uint64          `json:"room_id,omitempty"`
+	Msg    json.RawMessage `json:"msg,omitempty"`
+	// Set on busDeliver when the sender waits for the delivery to be confirmed, the node of the
+	// recipient echoes it back in a busDelivered envelope to the sender's connection
+	RequestID    uint64 `json:"request_id,omitempty"`
+	SenderConnID string `json:"sender_conn_id,omitempty"`
+}
+
+// This stands in for a connection that lives on another node, messages sent to it go over the bus
+func newRemoteConnection(userID uint64, connID string) *Connection {
+	return &Connection{
+		ID:     connID,
+		UserID: userID,
+		remote: true,
+	}
+}
+
+// This is work for the bus. Publishes may be dropped when the bus falls behind, subscription
+// changes never are.
+type busOp struct {
+	run     func()
+	publish bool
+}
+
+// This buffers the node's bus operations like a shard's mailbox does, so shards hand them off
+// without waiting on the bus
+func (wsm *WebSocketManager) busMailbox() {
+	var queue []busOp
+	publishes := 0
+
+	for {
+		var ops chan<- busOp
+		var next busOp
+		if len(queue) > 0 {
+			ops = wsm.busOps
+			next = queue[0]
+		}
+
+		select {
+		case op := <-wsm.busInbox:
+			if op.publish {
+				if publishes >= busQueueSize {
+					droppedBusPublishes.Add(1)
+					wsm.logger.Warn("bus is falling behind, dropping publish")
+					continue
+				}
+				publishes++
+			}
+			queue = append(queue, op)
+		case ops <- next:
+			if next.publish {
+				publishes--
+			}
+			queue[0] = busOp{}
+			queue = queue[1:]
+		}
+	}
+}
+
+// This runs the bus operations one at a time in the order they were queued, a slow or unreachable
+// bus only holds up this goroutine and never the shards
+func (wsm *WebSocketManager) busRun() {
+	for op := range wsm.busOps {
+		op.run()
+	}
+}
+
+// This publishes an envelope about the given connection, errors are only logged since the other
+// node is expected to clean up after connections that stopped getting messages. It returns before
+// the envelope is published.
+func (wsm *WebSocketManager) publish(topic string, kind busKind, conn *Connection, roomID uint64, msg *smsg.MessageAnyPayload) {
+	wsm.publishEnvelope(topic, busEnvelope{Kind: kind, UserID: conn.UserID, ConnID: conn.ID, RoomID: roomID}, msg)
+}
+
+func (wsm *WebSocketManager) publishEnvelope(topic string, envelope busEnvelope, msg *smsg.MessageAnyPayload) {
+	if msg != nil {
+		raw, err := json.Marshal(msg)
+		if err != nil {
+			wsm.logger.Error("failed to marshal message for the bus", "type", msg.MsgType.AsString(), "err", err)
+			return
+		}
+		envelope.Msg = raw
+	}
+
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		wsm.logger.Error("failed to marshal bus envelope", "err", err)
+		return
+	}
+
+	wsm.busInbox <- busOp{publish: true, run: func() {
+		ctx, cancel := context.WithTimeout(context.Background(), busTimeout)
+		defer cancel()
+		if err := wsm.bus.Publish(ctx, topic, data); err != nil {
+			wsm.logger.Warn("failed to publish to the bus", "topic", topic, "err", err)
+		}
+	}}
+}
+
+// This subscribes to a topic whose envelopes are handled by the given shard, it returns before
+// the subscription is made. Subscribing and unsubscribing run in the order they were asked for,
+// so unsubscribing right away still cancels the subscription.
+func (wsm *WebSocketManager) subscribe(topic string, s *shard) func() {
+	var unsubscribe func()
+	wsm.busInbox <- busOp{run: func() {
+		unsubscribe = wsm.subscribeNow(topic, s)
+	}}
+	return func() {
+		wsm.busInbox <- busOp{run: func() {
+			unsubscribe()
+		}}
+	}
+}
+
+func (wsm *WebSocketManager) subscribeNow(topic string, s *shard) func() {
+	ctx, cancel := context.WithTimeout(context.Background(), busTimeout)
+	defer cancel()
+
+	unsubscribe, err := wsm.bus.Subscribe(ctx, topic, func(data []byte) {
+		var envelope busEnvelope
+		if err := json.Unmarshal(data, &envelope); err != nil {
+			wsm.logger.Warn("dropping malformed bus envelope", "topic", topic, "err", err)
+			return
+		}
+		s.post(func(s *shard) {
+			s.handleEnvelope(envelope)
+		})
+	})
+	if err != nil {
+		wsm.logger.Error("failed to subscribe to the bus", "topic", topic, "err", err)
+		return func() {}
+	}
+	return unsubscribe
+}
+
+// This adds a room to the index of the user owning the connection, wherever the user is connected
+func (wsm *WebSocketManager) trackRoom(conn *Connection, roomID uint64) {
+	if conn.remote {
+		wsm.publish(userTopic(conn.UserID), busTrackRoom, conn, roomID, nil)
+		return
+	}
+	wsm.shardFor(conn.UserID).post(func(us *shard) {
+		us.trackRoom(conn, roomID)
+	})
+}
+
+// This removes a room from the index of the user owning the connection
+func (wsm *WebSocketManager) untrackRoom(conn *Connection, roomID uint64) {
+	if conn.remote {
+		wsm.publish(userTopic(conn.UserID), busUntrackRoom, conn, roomID, nil)
+		return
+	}
+	wsm.shardFor(conn.UserID).post(func(us *shard) {
+		us.untrackRoom(conn, roomID)
+	})
+}
+
+// This takes the connection out of a room, wherever the room lives
+func (wsm *WebSocketManager) leaveRoom(conn *Connection, roomID uint64) {
+	wsm.shardFor(roomID).post(func(rs *shard) {
+		if _, local := rs.rooms[roomID]; !local && wsm.bus != nil {
+			wsm.publish(roomTopic(roomID), busLeaveRoom, conn, roomID, nil)
+			return
+		}
+		rs.removeFromRoom(roomID, conn)
+	})
+}
+
+// This handles an envelope another node published to a topic of this shard
+func (s *shard) handleEnvelope(envelope busEnvelope) {
+	remote := newRemoteConnection(envelope.UserID, envelope.ConnID)
+
+	switch envelope.Kind {
+	case busDeliver:
+		var msg smsg.MessageRawJSONPayload
+		if err := json.Unmarshal(envelope.Msg, &msg); err != nil {
+			s.logger.Warn("dropping malformed message from the bus", "err", err)
+			return
+		}
+		conn, exists := s.connections[envelope.UserID]
+		if !exists {
+			return
+		}
+		_ = s.wsm.SafeWriteJSON(conn, smsg.MessageAnyPayload{
+			MsgType:   msg.MsgType,
+			To:        msg.To,
+			From:      msg.From,
+			RequestID: msg.RequestID,
+			Payload:   msg.Payload,
+			Error:     msg.Error,
+		})
+		if envelope.RequestID != 0 {
+			s.wsm.publishEnvelope(userTopic(msg.From), busEnvelope{
+				Kind:      busDelivered,
+				UserID:    msg.From,
+				ConnID:    envelope.SenderConnID,
+				RequestID: envelope.RequestID,
+			}, nil)
+		}
+
+	case busDelivered:
+		s.confirmDelivery(envelope.ConnID, envelope.RequestID)
+
+	case busTrackRoom:
+		s.trackRoom(remote, envelope.RoomID)
+
+	case busUntrackRoom:
+		s.untrackRoom(remote, envelope.RoomID)
+
+	case busJoinRoom:
+		var req smsg.MessageRawJSONPayload
+		if len(envelope.Msg) > 0 {
+			if err := json.Unmarshal(envelope.Msg, &req); err != nil {
+				s.logger.Warn("dropping malformed join request from the bus", "err", err)
+				return
+			}
+		}
+		s.addUserToRoom(envelope.RoomID, remote, req.RequestID)
+
+	case busLeaveRoom:
+		s.removeFromRoom(envelope.RoomID, remote)
+	}
+}
+
+// This is a Bus that only connects the managers of a single process, it's meant for tests and
+// for running several nodes in one binary
+type MemoryBus struct {
+	requests chan func(*memoryBusState)
+	closed   chan struct{}
+}
+
+type memoryBusState struct {
+	subs   map[string]map[uint64]func([]byte)
+	nextID uint64
+}
+
+// This creates a new in-memory bus
+func NewMemoryBus() *MemoryBus {
+	b := &MemoryBus{
+		requests: make(chan func(*memoryBusState)),
+		closed:   make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+// The subscriptions are owned by this loop, publishing runs the handlers inside it which keeps
+// every topic in order
+func (b *MemoryBus) run() {
+	state := &memoryBusState{subs: make(map[string]map[uint64]func([]byte))}
+	for {
+		select {
+		case req := <-b.requests:
+			req(state)
+		case <-b.closed:
+			return
+		}
+	}
+}
+
+func (b *MemoryBus) do(ctx context.Context, req func(*memoryBusState)) error {
+	select {
+	case b.requests <- req:
+		return nil
+	case <-b.closed:
+		return errBusClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (b *MemoryBus) Publish(ctx context.Context, topic string, msg []byte) error {
+	return b.do(ctx, func(state *memoryBusState) {
+		for _, handler := range state.subs[topic] {
+			handler(msg)
+		}
+	})
+}
+
+func (b *MemoryBus) Subscribe(ctx context.Context, topic string, handler func(msg []byte)) (func(), error) {
+	idCh := make(chan uint64, 1)
+	err := b.do(ctx, func(state *memoryBusState) {
+		handlers, exists := state.subs[topic]
+		if !exists {
+			handlers = make(map[uint64]func([]byte))
+			state.subs[topic] = handlers
+		}
+
+		id := state.nextID
+		state.nextID++
+		handlers[id] = handler
+		idCh <- id
+	})
+	if err != nil {
+		return nil, err
+	}
+	id := <-idCh
+
+	unsubscribe := func() {
+		_ = b.do(context.Background(), func(state *memoryBusState) {
+			delete(state.subs[topic], id)
+			if len(state.subs[topic]) == 0 {
+				delete(state.subs, topic)
+			}
+		})
+	}
+	return unsubscribe, nil
+}
+
+// This stops the bus, it must only be called once
+func (b *MemoryBus) Close() error {
+	close(b.closed)
+	return nil
+}
@@ -1,79 +1,296 @@
 package server
 
 import (
-	"log"
+	"errors"
+	"log/slog"
+	"slices"
 	"time"
 
 	"github.com/gorilla/websocket"
 
 	smsg "signaling-msgs"
+	"signaling-msgs/logging"
 )
 
-// This creates and starts a new websocket connection hanlder. this creates a seperate goroutine reading for incoming/outgoing messages
-func NewConnection(userID uint64, conn *websocket.Conn, inboundMessages chan<- *smsg.MessageRawJSONPayload, disconnectOut chan<- uint64) *Connection {
-	c := &Connection{
-		UserID:       userID,
-		Conn:         conn,
-		Outgoing:     make(chan smsg.MessageAnyPayload),
-		Disconnected: disconnectOut,
+// This decides what happens when a client doesn't read its messages fast enough and its send queue fills up
+type OverflowPolicy uint8
+
+const (
+	// Drop the oldest queued ICE candidate to make room, clients are disconnected if there are none to drop
+	OverflowDropOldestICE OverflowPolicy = iota
+	// Disconnect the client as soon as its send queue is full
+	OverflowDisconnect
+)
+
+const (
+	defaultSendQueueSize = 64
+	defaultWriteTimeout  = 10 * time.Second
+	pingInterval         = 30 * time.Second
+)
+
+var errConnectionClosed = errors.New("connection is closed")
+
+// This configures the bounded send queue of every connection
+type sendQueueConfig struct {
+	size         int
+	policy       OverflowPolicy
+	writeTimeout time.Duration
+}
+
+func newSendQueueConfig(opts Options) sendQueueConfig {
+	cfg := sendQueueConfig{
+		size:         opts.SendQueueSize,
+		policy:       opts.OverflowPolicy,
+		writeTimeout: opts.WriteTimeout,
+	}
+	if cfg.size <= 0 {
+		cfg.size = defaultSendQueueSize
+	}
+	if cfg.writeTimeout <= 0 {
+		cfg.writeTimeout = defaultWriteTimeout
+	}
+	return cfg
+}
+
+// This creates the connection state without starting its loops, every connection gets its own ID
+// that is attached to all of its log lines
+func newConnection(userID uint64, conn *websocket.Conn, logger *slog.Logger) *Connection {
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	connID := logging.NewID()
+	return &Connection{
+		ID:          connID,
+		UserID:      userID,
+		Conn:        conn,
+		RemoteAddr:  conn.RemoteAddr().String(),
+		ConnectedAt: time.Now(),
+		codec:       smsg.CodecFor(conn.Subprotocol()),
+		Outgoing:    make(chan smsg.MessageAnyPayload),
+		toWrite:     make(chan smsg.MessageAnyPayload),
+		done:        make(chan struct{}),
+		logger:      logger.With("conn_id", connID, "user_id", userID),
+	}
+}
+
+// This starts the read, send queue and write loops of the connection, incoming messages are
+// passed to onMessage and onClose is called once the client is gone
+func (c *Connection) start(cfg sendQueueConfig) {
+	go c.readLoop()
+	go c.queueLoop(cfg)
+	go c.writeLoop(cfg.writeTimeout)
+}
+
+// This queues a message for the client, it never blocks for long since the queue loop is always
+// ready to take messages and applies the overflow policy itself
+func (c *Connection) send(msg smsg.MessageAnyPayload) error {
+	select {
+	case c.Outgoing <- msg:
+		return nil
+	case <-c.done:
+		return errConnectionClosed
+	}
+}
+
+// This queues a message on the connection's bounded send queue, it doesn't block the caller
+// when the client is slow, the connection's overflow policy deals with that instead. Messages to
+// connections on other nodes are published to the bus.
+func (wsm *WebSocketManager) SafeWriteJSON(c *Connection, v smsg.MessageAnyPayload) error {
+	if c.remote {
+		wsm.publish(userTopic(c.UserID), busDeliver, c, 0, &v)
+		return nil
 	}
-	go c.readLoop(inboundMessages)
-	go c.writeLoop()
-	return c
+	return c.send(v)
 }
 
-func (c *Connection) readLoop(inboundMessages chan<- *smsg.MessageRawJSONPayload) {
+// This sends a close message with the given code and closes the socket, the read loop then
+// notices and takes care of the cleanup
+func (c *Connection) kick(closeCode int, reason string) {
+	closeMsg := websocket.FormatCloseMessage(closeCode, reason)
+	if err := c.Conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(time.Second)); err != nil {
+		c.logger.Debug("failed to send close message", "err", err)
+	}
+	c.Conn.Close()
+}
+
+func (c *Connection) readLoop() {
 	defer func() {
-		c.Disconnected <- c.UserID
+		c.onClose()
 		c.Conn.Close()
-		close(c.Outgoing)
-		log.Printf("[WS] User %d disconnected (read)", c.UserID)
+		close(c.done)
+		c.logger.Info("user disconnected")
 	}()
 
 	for {
-		msg := &smsg.MessageRawJSONPayload{}
-		if err := c.Conn.ReadJSON(&msg); err != nil {
-			log.Printf("[WS] failed to read WS message from %d: %v", c.UserID, err)
+		_, data, err := c.Conn.ReadMessage()
+		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("[WS] unexpected close from user %d: %v", c.UserID, err)
+				c.logger.Warn("unexpected close", "err", err)
+			} else {
+				c.logger.Debug("failed to read WS message", "err", err)
 			}
 			return
 		}
+		msg := &smsg.MessageRawJSONPayload{}
+		if err := c.codec.Unmarshal(data, msg); err != nil {
+			c.logger.Debug("failed to decode WS message", "err", err)
+			return
+		}
 
-		log.Printf("[WS] got WS message from %d", c.UserID)
+		c.logger.Debug("got WS message", "type", msg.MsgType.AsString())
+
+		if c.limiter != nil {
+			allowed, shouldDisconnect := c.limiter.allow(msg.MsgType, time.Now())
+			if shouldDisconnect {
+				c.logger.Warn("disconnecting client for repeatedly exceeding the rate limit")
+				c.kick(websocket.ClosePolicyViolation, "rate limit exceeded")
+				return
+			}
+			if !allowed {
+				c.logger.Info("rate limited message", "type", msg.MsgType.AsString())
+				_ = c.send(errorReply(msg, smsg.CodeRateLimited, "rate limit exceeded"))
+				continue
+			}
+		}
 
 		// NOTE: it's important we make sure to set this 'From' field on the incoming messsage
 		// before using it somewhere else so the client cannot pretend to be someone else
 		msg.From = c.UserID
-		inboundMessages <- msg
+		c.onMessage(msg)
 	}
 }
 
-func (c *Connection) writeLoop() {
-	ticker := time.NewTicker(30 * time.Second)
-	defer ticker.Stop()
+// This owns the bounded send queue of the connection. It takes messages from Outgoing and hands
+// them to the write loop in order, when the queue is full the overflow policy kicks in.
+func (c *Connection) queueLoop(cfg sendQueueConfig) {
+	var queue []smsg.MessageAnyPayload
+	var dropped int
+	kicked := false
 
 	for {
+		// only offer a message to the write loop when there is one
+		var toWrite chan<- smsg.MessageAnyPayload
+		var next smsg.MessageAnyPayload
+		if len(queue) > 0 {
+			toWrite = c.toWrite
+			next = queue[0]
+		}
+
 		select {
 		case msg := <-c.Outgoing:
+			if kicked {
+				continue
+			}
+
+			if len(queue) < cfg.size {
+				queue = append(queue, msg)
+				continue
+			}
+
+			if cfg.policy == OverflowDropOldestICE {
+				if i := slices.IndexFunc(queue, isICECandidate); i >= 0 {
+					droppedMessages.Add(queue[i].MsgType.AsString(), 1)
+					dropped++
+					c.logger.Debug("send queue full, dropped the oldest ICE candidate", "dropped", dropped)
+					queue = append(slices.Delete(queue, i, i+1), msg)
+					continue
+				}
+			}
+
+			for _, queued := range append(queue, msg) {
+				droppedMessages.Add(queued.MsgType.AsString(), 1)
+			}
+			slowConsumerDisconnects.Add(1)
+			c.logger.Warn("send queue full, disconnecting slow consumer", "queued", len(queue), "dropped", dropped)
+			queue = nil
+			kicked = true
+
+			// the close handshake can take a while and the queue loop must stay responsive
+			go c.kick(websocket.ClosePolicyViolation, "slow consumer")
+
+		case toWrite <- next:
+			queue = queue[1:]
+
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *Connection) writeLoop(writeTimeout time.Duration) {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case msg := <-c.toWrite:
 			{
-				if err := c.Conn.WriteJSON(msg); err != nil {
-					log.Printf("[WS Server] Write error to %d: %v", c.UserID, err)
-					c.Disconnected <- c.UserID
+				frameType, data, err := c.encode(msg)
+				if err != nil {
+					c.logger.Warn("failed to encode message", "type", msg.MsgType.AsString(), "err", err)
+					continue
+				}
+				c.Conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+				if err := c.Conn.WriteMessage(frameType, data); err != nil {
+					// closing the socket makes the read loop clean up the connection
+					c.logger.Warn("write error", "err", err)
+					c.Conn.Close()
+					return
 				}
-				log.Printf("[DEBUG] sent '%s' msg to %d", msg.MsgType.AsString(), c.UserID)
+				c.logger.Debug("sent message", "type", msg.MsgType.AsString())
 			}
 
 		// TODO: we can probably ping only when there has been no activitiy for some time
 		// instead on a fixed interval
 		case <-ticker.C:
 			{
-				if err := c.Conn.WriteMessage(websocket.PingMessage, []byte{}); err != nil {
-					log.Printf("[WS] Ping to user %d failed: %v", c.UserID, err)
-					c.Disconnected <- c.UserID
+				if err := c.Conn.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(writeTimeout)); err != nil {
+					c.logger.Warn("ping failed", "err", err)
+					c.Conn.Close()
 					return
 				}
 			}
+
+		case <-c.done:
+			return
 		}
 	}
 }
+
+// This encodes the message with the connection's codec, JSON clients speaking protocol version 1
+// get message types as numbers
+func (c *Connection) encode(msg smsg.MessageAnyPayload) (int, []byte, error) {
+	frameType := websocket.TextMessage
+	if c.codec.Binary() {
+		frameType = websocket.BinaryMessage
+	}
+
+	var data []byte
+	var err error
+	if c.codec == smsg.JSON && c.protocolVersion.Load() < 2 {
+		data, err = msg.MarshalV1()
+	} else {
+		data, err = c.codec.Marshal(msg)
+	}
+	return frameType, data, err
+}
+
+func isICECandidate(msg smsg.MessageAnyPayload) bool {
+	return msg.MsgType == smsg.ICECandidate
+}
+
+// This returns the type of the message the client waits for after sending a message of the given
+// type, errors are sent back with that type so the client's pending request fails right away
+func responseTypeFor(msgType smsg.MessageType) smsg.MessageType {
+	switch msgType {
+	case smsg.CreateRoom:
+		return smsg.RoomCreated
+	case smsg.JoinRoom:
+		return smsg.RoomJoined
+	case smsg.Hello:
+		return smsg.Welcome
+	default:
+		return smsg.Ack
+	}
+}
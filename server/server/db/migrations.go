@@ -0,0 +1,9 @@
+package db
+
+import "embed"
+
+// These are the migrations of the SQLite database, NNNN_name.up.sql files with an optional
+// NNNN_name.down.sql next to them
+//
+//go:embed migrations/*.sql
+var Migrations embed.FS
@@ -0,0 +1,3 @@
+-- This is a migration of its own since databases created before migrations existed already have
+-- a users table that 0001 leaves alone
+ALTER TABLE users ADD COLUMN disabled INTEGER NOT NULL DEFAULT 0;
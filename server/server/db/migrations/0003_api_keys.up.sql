@@ -0,0 +1,39 @@
+-- API keys move to their own table where only a SHA-256 hash of each key is kept, the keys users
+-- already have keep working. sha256_hex is registered on every connection by the storage package.
+CREATE TABLE legacy_api_keys (
+    user_id INTEGER NOT NULL,
+    api_key TEXT NOT NULL
+);
+INSERT INTO legacy_api_keys (user_id, api_key)
+SELECT id, api_key FROM users WHERE api_key IS NOT NULL;
+
+-- SQLite can't drop a UNIQUE column so the table is rebuilt without it
+CREATE TABLE users_new (
+    id INTEGER PRIMARY KEY,
+    username TEXT NOT NULL UNIQUE,
+    password TEXT NOT NULL,
+    updated_at TEXT DEFAULT CURRENT_TIMESTAMP,
+    disabled INTEGER NOT NULL DEFAULT 0
+);
+INSERT INTO users_new (id, username, password, updated_at, disabled)
+SELECT id, username, password, updated_at, disabled FROM users;
+DROP TABLE users;
+ALTER TABLE users_new RENAME TO users;
+
+CREATE TABLE api_keys (
+    id INTEGER PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    prefix TEXT NOT NULL,
+    hash TEXT NOT NULL UNIQUE,
+    label TEXT NOT NULL,
+    scopes TEXT NOT NULL,
+    created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_used_at TEXT NULL,
+    expires_at TEXT NULL
+);
+CREATE INDEX api_keys_user_id ON api_keys (user_id);
+
+INSERT INTO api_keys (user_id, prefix, hash, label, scopes)
+SELECT user_id, substr(api_key, 1, 8), sha256_hex(api_key), 'default', 'signaling keys'
+FROM legacy_api_keys;
+DROP TABLE legacy_api_keys;
@@ -0,0 +1,11 @@
+-- Links users to the accounts of external identity providers, an identity is the issuer and
+-- subject of the provider's ID tokens. Users provisioned this way have an empty password.
+CREATE TABLE user_identities (
+    id INTEGER PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    issuer TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (issuer, subject)
+);
+CREATE INDEX user_identities_user_id ON user_identities (user_id);
@@ -0,0 +1,17 @@
+-- Failed password attempts lock an account for a while, and every login attempt is recorded.
+-- Attempts for unknown usernames are recorded without a user.
+ALTER TABLE users ADD COLUMN failed_logins INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN locked_until TEXT NULL;
+
+CREATE TABLE auth_events (
+    id INTEGER PRIMARY KEY,
+    user_id INTEGER NULL REFERENCES users (id) ON DELETE CASCADE,
+    username TEXT NOT NULL,
+    event TEXT NOT NULL,
+    success INTEGER NOT NULL,
+    suspicious INTEGER NOT NULL DEFAULT 0,
+    ip TEXT NOT NULL,
+    user_agent TEXT NOT NULL,
+    created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX auth_events_user_id ON auth_events (user_id, id);
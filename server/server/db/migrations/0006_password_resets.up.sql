@@ -0,0 +1,13 @@
+-- Users can leave an email address to have password reset links sent to. Reset tokens are
+-- single-use and only stored hashed, like API keys.
+ALTER TABLE users ADD COLUMN email TEXT NULL;
+CREATE UNIQUE INDEX users_email ON users (email);
+
+CREATE TABLE password_resets (
+    id INTEGER PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    hash TEXT NOT NULL UNIQUE,
+    expires_at TEXT NOT NULL,
+    created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX password_resets_user_id ON password_resets (user_id);
@@ -8,10 +8,53 @@ import (
 	"database/sql"
 )
 
-type User struct {
+type ApiKey struct {
+	ID         int64
+	UserID     int64
+	Prefix     string
+	Hash       string
+	Label      string
+	Scopes     string
+	CreatedAt  string
+	LastUsedAt sql.NullString
+	ExpiresAt  sql.NullString
+}
+
+type AuthEvent struct {
+	ID         int64
+	UserID     sql.NullInt64
+	Username   string
+	Event      string
+	Success    int64
+	Suspicious int64
+	Ip         string
+	UserAgent  string
+	CreatedAt  string
+}
+
+type PasswordReset struct {
 	ID        int64
-	Username  string
-	Password  string
-	ApiKey    interface{}
-	UpdatedAt sql.NullString
+	UserID    int64
+	Hash      string
+	ExpiresAt string
+	CreatedAt string
+}
+
+type UserIdentity struct {
+	ID        int64
+	UserID    int64
+	Issuer    string
+	Subject   string
+	CreatedAt string
+}
+
+type User struct {
+	ID           int64
+	Username     string
+	Password     string
+	UpdatedAt    sql.NullString
+	Disabled     int64
+	FailedLogins int64
+	LockedUntil  sql.NullString
+	Email        sql.NullString
 }
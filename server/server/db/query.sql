@@ -1,6 +1,7 @@
--- name: CreateUser :exec
-INSERT INTO users (username, password, api_key)
-VALUES (?, ?, ?);
+-- name: CreateUser :one
+INSERT INTO users (username, password, email)
+VALUES (?, ?, ?)
+RETURNING id;
 
 -- name: UpdateUserPassword :exec
 UPDATE users
@@ -14,10 +15,117 @@ WHERE id = ?;
 -- name: GetUserByUsername :one
 SELECT * FROM users WHERE username = ? LIMIT 1;
 
--- name: GetUserByApikeys :one
-SELECT * FROM users WHERE api_key = ?;
+-- name: GetUserByID :one
+SELECT * FROM users WHERE id = ? LIMIT 1;
+
+-- name: Ping :one
+SELECT 1;
+
+-- name: ListUsers :many
+SELECT * FROM users ORDER BY id;
+
+-- name: SetUserDisabled :execrows
+UPDATE users
+SET disabled = ?, updated_at = CURRENT_TIMESTAMP
+WHERE username = ?;
+
+-- name: CountUsers :one
+SELECT COUNT(*) FROM users;
+
+-- name: CountDisabledUsers :one
+SELECT COUNT(*) FROM users WHERE disabled = 1;
+
+-- name: CountUsersWithAPIKey :one
+SELECT COUNT(DISTINCT user_id) FROM api_keys;
+
+-- name: CreateAPIKey :one
+INSERT INTO api_keys (user_id, prefix, hash, label, scopes, expires_at)
+VALUES (?, ?, ?, ?, ?, ?)
+RETURNING *;
+
+-- name: GetAPIKeyByHash :one
+SELECT sqlc.embed(api_keys), sqlc.embed(users)
+FROM api_keys
+JOIN users ON users.id = api_keys.user_id
+WHERE api_keys.hash = ?;
+
+-- name: TouchAPIKey :exec
+UPDATE api_keys
+SET last_used_at = ?
+WHERE id = ?;
+
+-- name: ListAPIKeys :many
+SELECT * FROM api_keys WHERE user_id = ? ORDER BY id;
+
+-- name: RevokeAPIKey :execrows
+DELETE FROM api_keys
+WHERE id = ? AND user_id = ?;
+
+-- name: RevokeAllAPIKeys :execrows
+DELETE FROM api_keys
+WHERE user_id = ?;
+
+-- name: CreateUserIdentity :exec
+INSERT INTO user_identities (user_id, issuer, subject)
+VALUES (?, ?, ?);
+
+-- name: GetUserByIdentity :one
+SELECT users.* FROM users
+JOIN user_identities ON user_identities.user_id = users.id
+WHERE user_identities.issuer = ? AND user_identities.subject = ?;
 
--- name: UpdateAPIKey :exec
+-- name: RecordFailedLogin :one
 UPDATE users
-SET api_key = ?, updated_at = CURRENT_TIMESTAMP
-WHERE username = ?;
\ No newline at end of file
+SET failed_logins = failed_logins + 1
+WHERE id = ?
+RETURNING failed_logins;
+
+-- name: LockUser :exec
+UPDATE users
+SET locked_until = ?
+WHERE id = ?;
+
+-- name: ResetFailedLogins :exec
+UPDATE users
+SET failed_logins = 0, locked_until = NULL
+WHERE id = ?;
+
+-- name: CreateAuthEvent :exec
+INSERT INTO auth_events (user_id, username, event, success, suspicious, ip, user_agent)
+VALUES (?, ?, ?, ?, ?, ?, ?);
+
+-- name: ListAuthEvents :many
+SELECT * FROM auth_events
+WHERE user_id = ?
+ORDER BY id DESC
+LIMIT ?;
+
+-- name: CountSuccessfulLogins :one
+SELECT COUNT(*) FROM auth_events WHERE user_id = ? AND success = 1;
+
+-- name: CountSuccessfulLoginsFromIP :one
+SELECT COUNT(*) FROM auth_events WHERE user_id = ? AND success = 1 AND ip = ?;
+
+-- name: ListUserIdentities :many
+SELECT * FROM user_identities WHERE user_id = ? ORDER BY id;
+
+-- name: GetUserByEmail :one
+SELECT * FROM users WHERE email = ? LIMIT 1;
+
+-- name: SetUserEmail :execrows
+UPDATE users
+SET email = ?, updated_at = CURRENT_TIMESTAMP
+WHERE id = ?;
+
+-- name: CreatePasswordReset :exec
+INSERT INTO password_resets (user_id, hash, expires_at)
+VALUES (?, ?, ?);
+
+-- name: UsePasswordReset :one
+DELETE FROM password_resets
+WHERE hash = ? AND expires_at > ?
+RETURNING user_id;
+
+-- name: DeletePasswordResets :exec
+DELETE FROM password_resets
+WHERE user_id = ?;
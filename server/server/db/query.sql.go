@@ -7,21 +7,179 @@ package db
 
 import (
 	"context"
+	"database/sql"
 )
 
-const createUser = `-- name: CreateUser :exec
-INSERT INTO users (username, password, api_key)
+const countDisabledUsers = `-- name: CountDisabledUsers :one
+SELECT COUNT(*) FROM users WHERE disabled = 1
+`
+
+func (q *Queries) CountDisabledUsers(ctx context.Context) (int64, error) {
+	row := q.db.QueryRowContext(ctx, countDisabledUsers)
+	var count int64
+	err := row.Scan(&count)
+	return count, err
+}
+
+const countSuccessfulLogins = `-- name: CountSuccessfulLogins :one
+SELECT COUNT(*) FROM auth_events WHERE user_id = ? AND success = 1
+`
+
+func (q *Queries) CountSuccessfulLogins(ctx context.Context, userID sql.NullInt64) (int64, error) {
+	row := q.db.QueryRowContext(ctx, countSuccessfulLogins, userID)
+	var count int64
+	err := row.Scan(&count)
+	return count, err
+}
+
+const countSuccessfulLoginsFromIP = `-- name: CountSuccessfulLoginsFromIP :one
+SELECT COUNT(*) FROM auth_events WHERE user_id = ? AND success = 1 AND ip = ?
+`
+
+type CountSuccessfulLoginsFromIPParams struct {
+	UserID sql.NullInt64
+	Ip     string
+}
+
+func (q *Queries) CountSuccessfulLoginsFromIP(ctx context.Context, arg CountSuccessfulLoginsFromIPParams) (int64, error) {
+	row := q.db.QueryRowContext(ctx, countSuccessfulLoginsFromIP, arg.UserID, arg.Ip)
+	var count int64
+	err := row.Scan(&count)
+	return count, err
+}
+
+const countUsers = `-- name: CountUsers :one
+SELECT COUNT(*) FROM users
+`
+
+func (q *Queries) CountUsers(ctx context.Context) (int64, error) {
+	row := q.db.QueryRowContext(ctx, countUsers)
+	var count int64
+	err := row.Scan(&count)
+	return count, err
+}
+
+const countUsersWithAPIKey = `-- name: CountUsersWithAPIKey :one
+SELECT COUNT(DISTINCT user_id) FROM api_keys
+`
+
+func (q *Queries) CountUsersWithAPIKey(ctx context.Context) (int64, error) {
+	row := q.db.QueryRowContext(ctx, countUsersWithAPIKey)
+	var count int64
+	err := row.Scan(&count)
+	return count, err
+}
+
+const createAPIKey = `-- name: CreateAPIKey :one
+INSERT INTO api_keys (user_id, prefix, hash, label, scopes, expires_at)
+VALUES (?, ?, ?, ?, ?, ?)
+RETURNING id, user_id, prefix, hash, label, scopes, created_at, last_used_at, expires_at
+`
+
+type CreateAPIKeyParams struct {
+	UserID    int64
+	Prefix    string
+	Hash      string
+	Label     string
+	Scopes    string
+	ExpiresAt sql.NullString
+}
+
+func (q *Queries) CreateAPIKey(ctx context.Context, arg CreateAPIKeyParams) (ApiKey, error) {
+	row := q.db.QueryRowContext(ctx, createAPIKey, arg.UserID, arg.Prefix, arg.Hash, arg.Label, arg.Scopes, arg.ExpiresAt)
+	var i ApiKey
+	err := row.Scan(
+		&i.ID,
+		&i.UserID,
+		&i.Prefix,
+		&i.Hash,
+		&i.Label,
+		&i.Scopes,
+		&i.CreatedAt,
+		&i.LastUsedAt,
+		&i.ExpiresAt,
+	)
+	return i, err
+}
+
+const createAuthEvent = `-- name: CreateAuthEvent :exec
+INSERT INTO auth_events (user_id, username, event, success, suspicious, ip, user_agent)
+VALUES (?, ?, ?, ?, ?, ?, ?)
+`
+
+type CreateAuthEventParams struct {
+	UserID     sql.NullInt64
+	Username   string
+	Event      string
+	Success    int64
+	Suspicious int64
+	Ip         string
+	UserAgent  string
+}
+
+func (q *Queries) CreateAuthEvent(ctx context.Context, arg CreateAuthEventParams) error {
+	_, err := q.db.ExecContext(ctx, createAuthEvent, arg.UserID, arg.Username, arg.Event, arg.Success, arg.Suspicious, arg.Ip, arg.UserAgent)
+	return err
+}
+
+const createPasswordReset = `-- name: CreatePasswordReset :exec
+INSERT INTO password_resets (user_id, hash, expires_at)
 VALUES (?, ?, ?)
 `
 
+type CreatePasswordResetParams struct {
+	UserID    int64
+	Hash      string
+	ExpiresAt string
+}
+
+func (q *Queries) CreatePasswordReset(ctx context.Context, arg CreatePasswordResetParams) error {
+	_, err := q.db.ExecContext(ctx, createPasswordReset, arg.UserID, arg.Hash, arg.ExpiresAt)
+	return err
+}
+
+const createUser = `-- name: CreateUser :one
+INSERT INTO users (username, password, email)
+VALUES (?, ?, ?)
+RETURNING id
+`
+
 type CreateUserParams struct {
 	Username string
 	Password string
-	ApiKey   interface{}
+	Email    sql.NullString
+}
+
+func (q *Queries) CreateUser(ctx context.Context, arg CreateUserParams) (int64, error) {
+	row := q.db.QueryRowContext(ctx, createUser, arg.Username, arg.Password, arg.Email)
+	var id int64
+	err := row.Scan(&id)
+	return id, err
+}
+
+const createUserIdentity = `-- name: CreateUserIdentity :exec
+INSERT INTO user_identities (user_id, issuer, subject)
+VALUES (?, ?, ?)
+`
+
+type CreateUserIdentityParams struct {
+	UserID  int64
+	Issuer  string
+	Subject string
 }
 
-func (q *Queries) CreateUser(ctx context.Context, arg CreateUserParams) error {
-	_, err := q.db.ExecContext(ctx, createUser, arg.Username, arg.Password, arg.ApiKey)
+func (q *Queries) CreateUserIdentity(ctx context.Context, arg CreateUserIdentityParams) error {
+	_, err := q.db.ExecContext(ctx, createUserIdentity, arg.UserID, arg.Issuer, arg.Subject)
+	return err
+}
+
+const deletePasswordResets = `-- name: DeletePasswordResets :exec
+DELETE FROM password_resets
+WHERE user_id = ?
+`
+
+func (q *Queries) DeletePasswordResets(ctx context.Context, userID int64) error {
+	_, err := q.db.ExecContext(ctx, deletePasswordResets, userID)
 	return err
 }
 
@@ -35,25 +193,112 @@ func (q *Queries) DeleteUser(ctx context.Context, id int64) error {
 	return err
 }
 
-const getUserByApikeys = `-- name: GetUserByApikeys :one
-SELECT id, username, password, api_key, updated_at FROM users WHERE api_key = ?
+const getAPIKeyByHash = `-- name: GetAPIKeyByHash :one
+SELECT api_keys.id, api_keys.user_id, api_keys.prefix, api_keys.hash, api_keys.label, api_keys.scopes, api_keys.created_at, api_keys.last_used_at, api_keys.expires_at, users.id, users.username, users.password, users.updated_at, users.disabled, users.failed_logins, users.locked_until, users.email
+FROM api_keys
+JOIN users ON users.id = api_keys.user_id
+WHERE api_keys.hash = ?
+`
+
+type GetAPIKeyByHashRow struct {
+	ApiKey ApiKey
+	User   User
+}
+
+func (q *Queries) GetAPIKeyByHash(ctx context.Context, hash string) (GetAPIKeyByHashRow, error) {
+	row := q.db.QueryRowContext(ctx, getAPIKeyByHash, hash)
+	var i GetAPIKeyByHashRow
+	err := row.Scan(
+		&i.ApiKey.ID,
+		&i.ApiKey.UserID,
+		&i.ApiKey.Prefix,
+		&i.ApiKey.Hash,
+		&i.ApiKey.Label,
+		&i.ApiKey.Scopes,
+		&i.ApiKey.CreatedAt,
+		&i.ApiKey.LastUsedAt,
+		&i.ApiKey.ExpiresAt,
+		&i.User.ID,
+		&i.User.Username,
+		&i.User.Password,
+		&i.User.UpdatedAt,
+		&i.User.Disabled,
+		&i.User.FailedLogins,
+		&i.User.LockedUntil,
+		&i.User.Email,
+	)
+	return i, err
+}
+
+const getUserByEmail = `-- name: GetUserByEmail :one
+SELECT id, username, password, updated_at, disabled, failed_logins, locked_until, email FROM users WHERE email = ? LIMIT 1
 `
 
-func (q *Queries) GetUserByApikeys(ctx context.Context, apiKey interface{}) (User, error) {
-	row := q.db.QueryRowContext(ctx, getUserByApikeys, apiKey)
+func (q *Queries) GetUserByEmail(ctx context.Context, email sql.NullString) (User, error) {
+	row := q.db.QueryRowContext(ctx, getUserByEmail, email)
 	var i User
 	err := row.Scan(
 		&i.ID,
 		&i.Username,
 		&i.Password,
-		&i.ApiKey,
 		&i.UpdatedAt,
+		&i.Disabled,
+		&i.FailedLogins,
+		&i.LockedUntil,
+		&i.Email,
+	)
+	return i, err
+}
+
+const getUserByID = `-- name: GetUserByID :one
+SELECT id, username, password, updated_at, disabled, failed_logins, locked_until, email FROM users WHERE id = ? LIMIT 1
+`
+
+func (q *Queries) GetUserByID(ctx context.Context, id int64) (User, error) {
+	row := q.db.QueryRowContext(ctx, getUserByID, id)
+	var i User
+	err := row.Scan(
+		&i.ID,
+		&i.Username,
+		&i.Password,
+		&i.UpdatedAt,
+		&i.Disabled,
+		&i.FailedLogins,
+		&i.LockedUntil,
+		&i.Email,
+	)
+	return i, err
+}
+
+const getUserByIdentity = `-- name: GetUserByIdentity :one
+SELECT users.id, users.username, users.password, users.updated_at, users.disabled, users.failed_logins, users.locked_until, users.email FROM users
+JOIN user_identities ON user_identities.user_id = users.id
+WHERE user_identities.issuer = ? AND user_identities.subject = ?
+`
+
+type GetUserByIdentityParams struct {
+	Issuer  string
+	Subject string
+}
+
+func (q *Queries) GetUserByIdentity(ctx context.Context, arg GetUserByIdentityParams) (User, error) {
+	row := q.db.QueryRowContext(ctx, getUserByIdentity, arg.Issuer, arg.Subject)
+	var i User
+	err := row.Scan(
+		&i.ID,
+		&i.Username,
+		&i.Password,
+		&i.UpdatedAt,
+		&i.Disabled,
+		&i.FailedLogins,
+		&i.LockedUntil,
+		&i.Email,
 	)
 	return i, err
 }
 
 const getUserByUsername = `-- name: GetUserByUsername :one
-SELECT id, username, password, api_key, updated_at FROM users WHERE username = ? LIMIT 1
+SELECT id, username, password, updated_at, disabled, failed_logins, locked_until, email FROM users WHERE username = ? LIMIT 1
 `
 
 func (q *Queries) GetUserByUsername(ctx context.Context, username string) (User, error) {
@@ -63,25 +308,300 @@ func (q *Queries) GetUserByUsername(ctx context.Context, username string) (User,
 		&i.ID,
 		&i.Username,
 		&i.Password,
-		&i.ApiKey,
 		&i.UpdatedAt,
+		&i.Disabled,
+		&i.FailedLogins,
+		&i.LockedUntil,
+		&i.Email,
 	)
 	return i, err
 }
 
-const updateAPIKey = `-- name: UpdateAPIKey :exec
+const listAPIKeys = `-- name: ListAPIKeys :many
+SELECT id, user_id, prefix, hash, label, scopes, created_at, last_used_at, expires_at FROM api_keys WHERE user_id = ? ORDER BY id
+`
+
+func (q *Queries) ListAPIKeys(ctx context.Context, userID int64) ([]ApiKey, error) {
+	rows, err := q.db.QueryContext(ctx, listAPIKeys, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ApiKey
+	for rows.Next() {
+		var i ApiKey
+		if err := rows.Scan(
+			&i.ID,
+			&i.UserID,
+			&i.Prefix,
+			&i.Hash,
+			&i.Label,
+			&i.Scopes,
+			&i.CreatedAt,
+			&i.LastUsedAt,
+			&i.ExpiresAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listAuthEvents = `-- name: ListAuthEvents :many
+SELECT * FROM auth_events
+WHERE user_id = ?
+ORDER BY id DESC
+LIMIT ?
+`
+
+type ListAuthEventsParams struct {
+	UserID sql.NullInt64
+	Limit  int64
+}
+
+func (q *Queries) ListAuthEvents(ctx context.Context, arg ListAuthEventsParams) ([]AuthEvent, error) {
+	rows, err := q.db.QueryContext(ctx, listAuthEvents, arg.UserID, arg.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []AuthEvent
+	for rows.Next() {
+		var i AuthEvent
+		if err := rows.Scan(
+			&i.ID,
+			&i.UserID,
+			&i.Username,
+			&i.Event,
+			&i.Success,
+			&i.Suspicious,
+			&i.Ip,
+			&i.UserAgent,
+			&i.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listUserIdentities = `-- name: ListUserIdentities :many
+SELECT * FROM user_identities WHERE user_id = ? ORDER BY id
+`
+
+func (q *Queries) ListUserIdentities(ctx context.Context, userID int64) ([]UserIdentity, error) {
+	rows, err := q.db.QueryContext(ctx, listUserIdentities, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []UserIdentity
+	for rows.Next() {
+		var i UserIdentity
+		if err := rows.Scan(
+			&i.ID,
+			&i.UserID,
+			&i.Issuer,
+			&i.Subject,
+			&i.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listUsers = `-- name: ListUsers :many
+SELECT id, username, password, updated_at, disabled, failed_logins, locked_until, email FROM users ORDER BY id
+`
+
+func (q *Queries) ListUsers(ctx context.Context) ([]User, error) {
+	rows, err := q.db.QueryContext(ctx, listUsers)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []User
+	for rows.Next() {
+		var i User
+		if err := rows.Scan(
+			&i.ID,
+			&i.Username,
+			&i.Password,
+			&i.UpdatedAt,
+			&i.Disabled,
+			&i.FailedLogins,
+			&i.LockedUntil,
+			&i.Email,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const lockUser = `-- name: LockUser :exec
+UPDATE users
+SET locked_until = ?
+WHERE id = ?
+`
+
+type LockUserParams struct {
+	LockedUntil sql.NullString
+	ID          int64
+}
+
+func (q *Queries) LockUser(ctx context.Context, arg LockUserParams) error {
+	_, err := q.db.ExecContext(ctx, lockUser, arg.LockedUntil, arg.ID)
+	return err
+}
+
+const ping = `-- name: Ping :one
+SELECT 1
+`
+
+func (q *Queries) Ping(ctx context.Context) (int64, error) {
+	row := q.db.QueryRowContext(ctx, ping)
+	var column_1 int64
+	err := row.Scan(&column_1)
+	return column_1, err
+}
+
+const recordFailedLogin = `-- name: RecordFailedLogin :one
+UPDATE users
+SET failed_logins = failed_logins + 1
+WHERE id = ?
+RETURNING failed_logins
+`
+
+func (q *Queries) RecordFailedLogin(ctx context.Context, id int64) (int64, error) {
+	row := q.db.QueryRowContext(ctx, recordFailedLogin, id)
+	var failed_logins int64
+	err := row.Scan(&failed_logins)
+	return failed_logins, err
+}
+
+const resetFailedLogins = `-- name: ResetFailedLogins :exec
+UPDATE users
+SET failed_logins = 0, locked_until = NULL
+WHERE id = ?
+`
+
+func (q *Queries) ResetFailedLogins(ctx context.Context, id int64) error {
+	_, err := q.db.ExecContext(ctx, resetFailedLogins, id)
+	return err
+}
+
+const revokeAPIKey = `-- name: RevokeAPIKey :execrows
+DELETE FROM api_keys
+WHERE id = ? AND user_id = ?
+`
+
+type RevokeAPIKeyParams struct {
+	ID     int64
+	UserID int64
+}
+
+func (q *Queries) RevokeAPIKey(ctx context.Context, arg RevokeAPIKeyParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, revokeAPIKey, arg.ID, arg.UserID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const revokeAllAPIKeys = `-- name: RevokeAllAPIKeys :execrows
+DELETE FROM api_keys
+WHERE user_id = ?
+`
+
+func (q *Queries) RevokeAllAPIKeys(ctx context.Context, userID int64) (int64, error) {
+	result, err := q.db.ExecContext(ctx, revokeAllAPIKeys, userID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const setUserDisabled = `-- name: SetUserDisabled :execrows
 UPDATE users
-SET api_key = ?, updated_at = CURRENT_TIMESTAMP
+SET disabled = ?, updated_at = CURRENT_TIMESTAMP
 WHERE username = ?
 `
 
-type UpdateAPIKeyParams struct {
-	ApiKey   interface{}
+type SetUserDisabledParams struct {
+	Disabled int64
 	Username string
 }
 
-func (q *Queries) UpdateAPIKey(ctx context.Context, arg UpdateAPIKeyParams) error {
-	_, err := q.db.ExecContext(ctx, updateAPIKey, arg.ApiKey, arg.Username)
+func (q *Queries) SetUserDisabled(ctx context.Context, arg SetUserDisabledParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, setUserDisabled, arg.Disabled, arg.Username)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const setUserEmail = `-- name: SetUserEmail :execrows
+UPDATE users
+SET email = ?, updated_at = CURRENT_TIMESTAMP
+WHERE id = ?
+`
+
+type SetUserEmailParams struct {
+	Email sql.NullString
+	ID    int64
+}
+
+func (q *Queries) SetUserEmail(ctx context.Context, arg SetUserEmailParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, setUserEmail, arg.Email, arg.ID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const touchAPIKey = `-- name: TouchAPIKey :exec
+UPDATE api_keys
+SET last_used_at = ?
+WHERE id = ?
+`
+
+type TouchAPIKeyParams struct {
+	LastUsedAt sql.NullString
+	ID         int64
+}
+
+func (q *Queries) TouchAPIKey(ctx context.Context, arg TouchAPIKeyParams) error {
+	_, err := q.db.ExecContext(ctx, touchAPIKey, arg.LastUsedAt, arg.ID)
 	return err
 }
 
@@ -100,3 +620,21 @@ func (q *Queries) UpdateUserPassword(ctx context.Context, arg UpdateUserPassword
 	_, err := q.db.ExecContext(ctx, updateUserPassword, arg.Password, arg.Username)
 	return err
 }
+
+const usePasswordReset = `-- name: UsePasswordReset :one
+DELETE FROM password_resets
+WHERE hash = ? AND expires_at > ?
+RETURNING user_id
+`
+
+type UsePasswordResetParams struct {
+	Hash      string
+	ExpiresAt string
+}
+
+func (q *Queries) UsePasswordReset(ctx context.Context, arg UsePasswordResetParams) (int64, error) {
+	row := q.db.QueryRowContext(ctx, usePasswordReset, arg.Hash, arg.ExpiresAt)
+	var user_id int64
+	err := row.Scan(&user_id)
+	return user_id, err
+}
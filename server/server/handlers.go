@@ -1,145 +1,146 @@
 package server
 
 import (
+	"database/sql"
 	"encoding/json"
-	"fmt"
-	"log"
+	"errors"
 	"net/http"
-	"strings"
 
 	"github.com/sushiag/go-webrtc-signaling-server/server/server/db"
-	sqlitedb "github.com/sushiag/go-webrtc-signaling-server/server/server/register"
+	"github.com/sushiag/go-webrtc-signaling-server/server/server/storage"
 	"golang.org/x/crypto/bcrypt"
 )
 
 // Registration
-func registerNewUser(w http.ResponseWriter, r *http.Request, queries *db.Queries) {
+func registerNewUser(w http.ResponseWriter, r *http.Request, queries db.Querier) {
 	var rqst struct {
 		Username string `json:"username"`
 		Password string `json:"password"`
+		// Optional, password reset links are sent to it
+		Email string `json:"email"`
 	}
 
-	log.Printf("[REGISTER] Request to create account received!")
+	logger := requestLogger(r)
+	logger.Info("request to create account received")
 
 	if err := json.NewDecoder(r.Body).Decode(&rqst); err != nil {
 		http.Error(w, "Invalid Input", http.StatusUnprocessableEntity)
 		return
 	}
 
-	log.Printf("[REGISTER] Received: username=%s password=%s", rqst.Username, rqst.Password)
+	logger = logger.With("username", rqst.Username)
 
 	// --- USERNAME & PASSWORD ---
 	if err := checkUsernameField(rqst.Username); err != nil {
+		logger.Info("rejected registration", "err", err)
 		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
 		return
 	}
 
 	if err := checkPasswordField(rqst.Password); err != nil {
+		logger.Info("rejected registration", "err", err)
 		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
 		return
 	}
 
+	var email sql.NullString
+	if rqst.Email != "" {
+		address, err := checkEmailField(rqst.Email)
+		if err != nil {
+			logger.Info("rejected registration", "err", err)
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		email = sql.NullString{String: address, Valid: true}
+	}
+
 	// --- HASH PASSWORD ---
 	hashed, _ := bcrypt.GenerateFromPassword([]byte(rqst.Password), bcrypt.DefaultCost)
 
-	// --- API-Key ---
-	apikey, err := sqlitedb.GenerateAPIKey()
-	if err != nil {
-		log.Printf("[REGISTER] Error generating API key: %v", err)
-		http.Error(w, "Unable to generate API Key", http.StatusInternalServerError)
-		return
-	}
 	// --- INSERT TO DB ---
-	err = queries.CreateUser(r.Context(), db.CreateUserParams{
+	userID, err := queries.CreateUser(r.Context(), db.CreateUserParams{
 		Username: rqst.Username,
 		Password: string(hashed),
-		ApiKey:   apikey,
+		Email:    email,
 	})
 
 	if err != nil {
-		if strings.Contains(err.Error(), "UNIQUE constraint") {
-			log.Printf("[FAILED TO REGISTER ACCOUNT] Username already taken")
+		if storage.IsUniqueViolation(err) {
+			// Either the username or the email is taken, it was the email when the username is free
+			if _, lookupErr := queries.GetUserByUsername(r.Context(), rqst.Username); email.Valid && errors.Is(lookupErr, sql.ErrNoRows) {
+				logger.Info("failed to register account, email already in use")
+				http.Error(w, "Email is already in use", http.StatusConflict)
+				return
+			}
+			logger.Info("failed to register account, username already taken")
 			http.Error(w, "Username is already taken", http.StatusConflict)
 		} else {
-			log.Printf("[REGISTER USERNAME] Unable to register username this time: %v", err)
+			logger.Error("failed to register account", "err", err)
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
 		}
 		return
 	}
 
+	// --- API-Key ---
+	apikey, err := IssueDefaultAPIKey(r.Context(), queries, userID)
+	if err != nil {
+		logger.Error("failed to create API key", "err", err)
+		http.Error(w, "Unable to generate API Key", http.StatusInternalServerError)
+		return
+	}
+
 	resp := struct {
 		APIKey string `json:"api_key"`
 	}{
 		APIKey: apikey,
 	}
 
+	logger.Info("account registered")
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	if err := json.NewEncoder(w).Encode(resp); err != nil {
-		log.Printf("[REGISTER] Failed to write JSON response: %v", err)
-	}
-}
-
-// LOGIN USER VIA API-KEY
-
-func getUserFromAPIKey(r *http.Request, queries *db.Queries) (*db.User, error) {
-	apiKey := r.Header.Get("X-API-Key")
-	if apiKey == "" {
-		// fallback if some clients send Authorization header instead
-		authHeader := r.Header.Get("Authorization")
-		if strings.HasPrefix(authHeader, "Bearer ") {
-			apiKey = strings.TrimPrefix(authHeader, "Bearer ")
-		}
-	}
-	if apiKey == "" {
-		return nil, fmt.Errorf("API key missing")
+		logger.Warn("failed to write JSON response", "err", err)
 	}
-
-	user, err := queries.GetUserByApikeys(r.Context(), apiKey)
-	if err != nil {
-		return nil, err
-	}
-	return &user, nil
 }
 
 //REGENERATE API Key
 
-func regenerateNewAPIKeys(w http.ResponseWriter, r *http.Request, queries *db.Queries) {
+func regenerateNewAPIKeys(w http.ResponseWriter, r *http.Request, queries db.Querier, lockout LockoutPolicy) {
 	var rqst struct {
 		Username string `json:"username"`
 		Password string `json:"password"`
 	}
+	logger := requestLogger(r)
 	if err := json.NewDecoder(r.Body).Decode(&rqst); err != nil {
 		http.Error(w, "Invalid input", http.StatusUnprocessableEntity)
 		return
 	}
+	logger = logger.With("username", rqst.Username)
 	// --- ACCESS USER ACCOUNT IN DATABASE ---
-	user, err := queries.GetUserByUsername(r.Context(), rqst.Username)
-	if err != nil || bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(rqst.Password)) != nil {
-		log.Printf("[LOGIN FOR NEW API KEY] Username and Password does not match")
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	user, err := checkPassword(r, queries, lockout, authEventRegenerate, rqst.Username, rqst.Password)
+	if err != nil {
+		logger.Info("failed to regenerate API key", "err", err)
+		writeLoginError(w, r, err)
 		return
 	}
 
 	// --- REGENENARATION LOGIC ---
-	newAPIKey, err := sqlitedb.GenerateAPIKey()
-	if err != nil {
-		log.Printf("Failed to generate new API KEY")
-		http.Error(w, "[GENERATE NEW API KEY] Failed to generate new API KEY", http.StatusInternalServerError)
+	// Every key of the user is replaced, this is how a lost or leaked key is recovered
+	if _, err := queries.RevokeAllAPIKeys(r.Context(), user.ID); err != nil {
+		logger.Error("failed to revoke API keys", "err", err)
+		http.Error(w, "[FAILURE] Failed to update API Key", http.StatusInternalServerError)
 		return
 	}
 
-	err = queries.UpdateAPIKey(r.Context(), db.UpdateAPIKeyParams{ // iF username & password passes, update API KEY
-		ApiKey:   newAPIKey,
-		Username: rqst.Username,
-	})
-
-	if err != nil { // if fails to update
-		log.Printf("Failed to update API Key")
-		http.Error(w, "[FAILURE] Failed to update API Key", http.StatusInternalServerError)
+	newAPIKey, err := IssueDefaultAPIKey(r.Context(), queries, user.ID)
+	if err != nil {
+		logger.Error("failed to generate new API key", "err", err)
+		http.Error(w, "[GENERATE NEW API KEY] Failed to generate new API KEY", http.StatusInternalServerError)
+		return
 	}
 
-	log.Printf("[SUCESS] Sucess: New API Key Generated!, %s", newAPIKey)
+	logger.Info("new API key generated")
 
 	resp := struct {
 		APIKey string `json:"api_key"`
@@ -154,23 +155,26 @@ func regenerateNewAPIKeys(w http.ResponseWriter, r *http.Request, queries *db.Qu
 }
 
 // PASSWORD UPDATE
-func updatePassword(w http.ResponseWriter, r *http.Request, queries *db.Queries) {
+func updatePassword(w http.ResponseWriter, r *http.Request, queries db.Querier, lockout LockoutPolicy) {
 	var rqst struct {
 		Username    string `json:"username"`
 		OldPassword string `json:"old_password"`
 		NewPassword string `json:"new_password"`
 	}
 
-	log.Printf("[PASSWORD] Attemping to update password")
+	logger := requestLogger(r)
+	logger.Info("attempting to update password")
 
 	if err := json.NewDecoder(r.Body).Decode(&rqst); err != nil {
 		http.Error(w, "Invalid Input", http.StatusBadRequest)
 		return
 	}
+	logger = logger.With("username", rqst.Username)
+
 	// --- GET USERNAME FROM DATABASE ---
-	user, err := queries.GetUserByUsername(r.Context(), rqst.Username)
-	if err != nil || bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(rqst.OldPassword)) != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	if _, err := checkPassword(r, queries, lockout, authEventNewPassword, rqst.Username, rqst.OldPassword); err != nil {
+		logger.Info("failed to update password", "err", err)
+		writeLoginError(w, r, err)
 		return
 	}
 	if rqst.NewPassword == rqst.OldPassword {
@@ -184,7 +188,7 @@ func updatePassword(w http.ResponseWriter, r *http.Request, queries *db.Queries)
 
 	hashed, err := bcrypt.GenerateFromPassword([]byte(rqst.NewPassword), bcrypt.DefaultCost)
 	if err != nil {
-		log.Printf("[ERROR] Failed to hash new password: %v", err)
+		logger.Error("failed to hash new password", "err", err)
 		http.Error(w, "Error hashing password", http.StatusInternalServerError)
 		return
 	}
@@ -194,11 +198,12 @@ func updatePassword(w http.ResponseWriter, r *http.Request, queries *db.Queries)
 		Password: string(hashed),
 	})
 	if err != nil {
+		logger.Error("failed to update password", "err", err)
 		http.Error(w, "Failed to update password", http.StatusInternalServerError)
 		return
 	}
 
-	log.Printf("[PASSWORD] Password updated for user: %s", rqst.Username)
+	logger.Info("password updated")
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("Password updated successfully"))
 }
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/sushiag/go-webrtc-signaling-server/server/server/db"
+)
+
+// This is how long the health probes wait for the run loop or the database before giving up
+const probeTimeout = 2 * time.Second
+
+var errRunLoopUnresponsive = errors.New("websocket manager run loop is not responding")
+
+// This does a round-trip through the run loop and every shard and returns a snapshot of the
+// manager's state. It fails if any of them doesn't respond before the context is done.
+func (wsm *WebSocketManager) status(ctx context.Context) (managerStatus, error) {
+	respCh := make(chan managerStatus, 1)
+
+	select {
+	case wsm.statusChan <- respCh:
+	case <-ctx.Done():
+		return managerStatus{}, errRunLoopUnresponsive
+	}
+
+	var status managerStatus
+	select {
+	case status = <-respCh:
+	case <-ctx.Done():
+		return managerStatus{}, errRunLoopUnresponsive
+	}
+
+	err := wsm.execAll(ctx, func(s *shard) {
+		status.Connections += len(s.connections)
+		status.Rooms += len(s.rooms)
+	})
+	return status, err
+}
+
+// This marks the manager as shutting down so the readiness probe starts failing
+func (wsm *WebSocketManager) markShuttingDown() {
+	wsm.shutdownChan <- struct{}{}
+}
+
+type probeResponse struct {
+	Status      string `json:"status"`
+	Error       string `json:"error,omitempty"`
+	Connections int    `json:"connections"`
+	Rooms       int    `json:"rooms"`
+}
+
+// This handles the /healthz endpoint, the process is healthy as long as the run loop is responding
+func handleHealthz(w http.ResponseWriter, r *http.Request, wsm *WebSocketManager) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), probeTimeout)
+	defer cancel()
+
+	status, err := wsm.status(ctx)
+	if err != nil {
+		requestLogger(r).Warn("liveness check failed", "err", err)
+		writeProbeResponse(w, r, http.StatusServiceUnavailable, probeResponse{Status: "unhealthy", Error: err.Error()})
+		return
+	}
+
+	writeProbeResponse(w, r, http.StatusOK, probeResponse{
+		Status:      "ok",
+		Connections: status.Connections,
+		Rooms:       status.Rooms,
+	})
+}
+
+// This handles the /readyz endpoint, the server is ready if the database answers and it isn't shutting down
+func handleReadyz(w http.ResponseWriter, r *http.Request, wsm *WebSocketManager, queries db.Querier) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), probeTimeout)
+	defer cancel()
+
+	if _, err := queries.Ping(ctx); err != nil {
+		requestLogger(r).Warn("readiness check failed, database unreachable", "err", err)
+		writeProbeResponse(w, r, http.StatusServiceUnavailable, probeResponse{Status: "unavailable", Error: "database unreachable"})
+		return
+	}
+
+	status, err := wsm.status(ctx)
+	if err != nil {
+		requestLogger(r).Warn("readiness check failed", "err", err)
+		writeProbeResponse(w, r, http.StatusServiceUnavailable, probeResponse{Status: "unavailable", Error: err.Error()})
+		return
+	}
+
+	if status.ShuttingDown {
+		writeProbeResponse(w, r, http.StatusServiceUnavailable, probeResponse{
+			Status:      "shutting down",
+			Connections: status.Connections,
+			Rooms:       status.Rooms,
+		})
+		return
+	}
+
+	writeProbeResponse(w, r, http.StatusOK, probeResponse{
+		Status:      "ready",
+		Connections: status.Connections,
+		Rooms:       status.Rooms,
+	})
+}
+
+type versionResponse struct {
+	GoVersion   string `json:"go_version"`
+	Path        string `json:"path"`
+	Version     string `json:"version"`
+	VCS         string `json:"vcs,omitempty"`
+	VCSRevision string `json:"vcs_revision,omitempty"`
+	VCSTime     string `json:"vcs_time,omitempty"`
+	VCSModified bool   `json:"vcs_modified,omitempty"`
+}
+
+// This handles the /version endpoint and reports the build info embedded by the Go toolchain
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		http.Error(w, "build info not available", http.StatusNotImplemented)
+		return
+	}
+
+	resp := versionResponse{
+		GoVersion: info.GoVersion,
+		Path:      info.Main.Path,
+		Version:   info.Main.Version,
+	}
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs":
+			resp.VCS = setting.Value
+		case "vcs.revision":
+			resp.VCSRevision = setting.Value
+		case "vcs.time":
+			resp.VCSTime = setting.Value
+		case "vcs.modified":
+			resp.VCSModified = setting.Value == "true"
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		requestLogger(r).Warn("failed to write JSON response", "err", err)
+	}
+}
+
+func writeProbeResponse(w http.ResponseWriter, r *http.Request, statusCode int, resp probeResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		requestLogger(r).Warn("failed to write JSON response", "err", err)
+	}
+}
@@ -1,130 +1,238 @@
 package server
 
 import (
-	"log"
+	"github.com/gorilla/websocket"
 
 	smsg "signaling-msgs"
 )
 
-// This is adds a users to the roomID it requests, if the user has already joined it will log it then updadates the room state.
-func (wsm *WebSocketManager) addUserToRoom(roomID uint64, joiningUserID uint64) {
-	log.Printf("[DEBUG] adding user %d to room %d", joiningUserID, roomID)
+// This registers a connection in the user's shard, a connection the user already had is replaced
+func (s *shard) addConnection(conn *Connection) {
+	if old, exists := s.connections[conn.UserID]; exists {
+		old.logger.Info("connection replaced by a new one")
+		s.kickConnection(old, websocket.ClosePolicyViolation, "replaced by a new connection")
+	}
+
+	s.connections[conn.UserID] = conn
+	if s.wsm.bus != nil {
+		s.userSubs[conn.UserID] = s.wsm.subscribe(userTopic(conn.UserID), s)
+	}
+}
+
+// This removes a connection and takes the user out of every room it's in. It does nothing when
+// the connection was already removed or replaced, so a late cleanup can't drop a newer connection.
+func (s *shard) removeConnection(conn *Connection) {
+	conn.Conn.Close()
+	s.dropConnection(conn)
+}
+
+// This removes the connection like removeConnection but leaves closing it to the caller
+func (s *shard) dropConnection(conn *Connection) {
+	if current, exists := s.connections[conn.UserID]; !exists || current.ID != conn.ID {
+		return
+	}
+	delete(s.connections, conn.UserID)
+	if unsubscribe, subscribed := s.userSubs[conn.UserID]; subscribed {
+		unsubscribe()
+		delete(s.userSubs, conn.UserID)
+	}
+
+	rooms := s.userRooms[conn.UserID]
+	delete(s.userRooms, conn.UserID)
+	for roomID := range rooms {
+		s.wsm.leaveRoom(conn, roomID)
+	}
+}
 
-	room, exists := wsm.Rooms[roomID]
+// This adds a room to the user's index, it runs in the user's shard after the room's shard added
+// the user. If the connection went away in the meantime the room is told to drop it again.
+func (s *shard) trackRoom(conn *Connection, roomID uint64) {
+	if current, exists := s.connections[conn.UserID]; !exists || current.ID != conn.ID {
+		s.wsm.leaveRoom(conn, roomID)
+		return
+	}
+
+	rooms, exists := s.userRooms[conn.UserID]
 	if !exists {
-		log.Printf("[ERROR] user %d tried to join non-existent room %d, skipping join", joiningUserID, roomID)
+		rooms = make(map[uint64]struct{})
+		s.userRooms[conn.UserID] = rooms
+	}
+	rooms[roomID] = struct{}{}
+}
+
+// This removes a room from the user's index
+func (s *shard) untrackRoom(conn *Connection, roomID uint64) {
+	if current, exists := s.connections[conn.UserID]; !exists || current.ID != conn.ID {
 		return
 	}
+	delete(s.userRooms[conn.UserID], roomID)
+}
 
-	if _, alreadyJoined := room.Users[joiningUserID]; alreadyJoined {
-		log.Printf("[WS] User %d is already in room %d, skipping join", joiningUserID, roomID)
+// This is adds a users to the roomID it requests, if the user has already joined it will log it then updadates the room state.
+// The reply echoes the ID of the join request.
+func (s *shard) addUserToRoom(roomID uint64, conn *Connection, requestID uint64) {
+	joiningUserID := conn.UserID
+	logger := s.logger.With("user_id", joiningUserID, "room_id", roomID)
+	logger.Debug("adding user to room")
+
+	room, exists := s.rooms[roomID]
+	if !exists {
+		logger.Warn("user tried to join non-existent room, skipping join")
+		_ = s.wsm.SafeWriteJSON(conn, joinError(requestID, smsg.CodeRoomNotFound, "the room doesn't exist"))
 		return
 	}
 
-	conn, ok := wsm.Connections[joiningUserID]
-	if !ok {
-		log.Printf("[ERROR] No active connection for user %d", joiningUserID)
+	if _, alreadyJoined := room.Users[joiningUserID]; alreadyJoined {
+		logger.Info("user is already in room, skipping join")
+		_ = s.wsm.SafeWriteJSON(conn, joinError(requestID, smsg.CodeAlreadyInRoom, "already in the room"))
 		return
 	}
+
 	room.Users[joiningUserID] = conn
 	room.ReadyMap[joiningUserID] = false
 	room.JoinOrder = append(room.JoinOrder, joiningUserID)
+	s.wsm.trackRoom(conn, roomID)
 
-	var peers []uint64
+	var clientsInRoom []uint64
 	for uid := range room.Users {
-		if uid != joiningUserID {
-			peers = append(peers, uid)
-		}
-	}
-
-	if conn != nil {
-		var clientsInRoom []uint64
-		for uid := range room.Users {
-			clientsInRoom = append(clientsInRoom, uid)
-		}
-
-		_ = wsm.SafeWriteJSON(conn, smsg.MessageAnyPayload{
-			MsgType: smsg.RoomJoined,
-			Payload: smsg.RoomJoinedPayload{
-				RoomID:        roomID,
-				ClientsInRoom: clientsInRoom},
-		})
+		clientsInRoom = append(clientsInRoom, uid)
 	}
 
+	iceServers, _ := s.wsm.iceServers.issue(joiningUserID)
+	_ = s.wsm.SafeWriteJSON(conn, smsg.MessageAnyPayload{
+		MsgType:   smsg.RoomJoined,
+		RequestID: requestID,
+		Payload: smsg.RoomJoinedPayload{
+			RoomID:        roomID,
+			ClientsInRoom: clientsInRoom,
+			ICEServers:    iceServers},
+	})
+
 	// TODO: notify everyone else in the room that a peer joined
-	log.Printf("[WS] User %d joined room %d", joiningUserID, roomID)
+	logger.Info("user joined room")
+}
+
+// This adds a connection to a room, rooms owned by other nodes are asked to add it over the bus
+func (s *shard) joinRoom(roomID uint64, conn *Connection, requestID uint64) {
+	if _, local := s.rooms[roomID]; !local && s.wsm.bus != nil {
+		s.wsm.publish(roomTopic(roomID), busJoinRoom, conn, roomID, &smsg.MessageAnyPayload{MsgType: smsg.JoinRoom, RequestID: requestID})
+		return
+	}
+	s.addUserToRoom(roomID, conn, requestID)
+}
+
+// This is the reply to a join request that failed in the room's shard
+func joinError(requestID uint64, code smsg.ErrorCode, message string) smsg.MessageAnyPayload {
+	return errorReply(&smsg.MessageRawJSONPayload{MsgType: smsg.JoinRoom, RequestID: requestID}, code, message)
 }
 
-// This checks if the users are in the same room ID
-func (wsm *WebSocketManager) AreInSameRoom(roomID uint64, userIDs []uint64) bool {
-	room, exists := wsm.Rooms[roomID]
+// This removes a user's connection from a room and deletes the room once it's empty
+func (s *shard) removeFromRoom(roomID uint64, conn *Connection) {
+	room, exists := s.rooms[roomID]
 	if !exists {
-		return false
+		return
+	}
+	if current, inRoom := room.Users[conn.UserID]; !inRoom || current.ID != conn.ID {
+		return
 	}
 
-	for _, id := range userIDs {
-		if _, ok := room.Users[id]; !ok {
-			return false
-		}
+	delete(room.Users, conn.UserID)
+	delete(room.ReadyMap, conn.UserID)
+
+	// TODO: Notify remaining peers that this user has left
+
+	s.logger.Info("user removed from room", "user_id", conn.UserID, "room_id", roomID)
+
+	// Delete the room if empty
+	if len(room.Users) == 0 {
+		s.deleteRoom(roomID)
+		s.logger.Info("room deleted because it is empty", "room_id", roomID)
 	}
-	return true
 }
 
-// This creates a room with a Host
-func (wsm *WebSocketManager) createRoom(hostID uint64) uint64 {
-	roomID := wsm.nextRoomID
-	wsm.nextRoomID++
+// This forgets a room and stops listening for other nodes' requests about it
+func (s *shard) deleteRoom(roomID uint64) {
+	delete(s.rooms, roomID)
+	if unsubscribe, subscribed := s.roomSubs[roomID]; subscribed {
+		unsubscribe()
+		delete(s.roomSubs, roomID)
+	}
+}
 
-	conn, exists := wsm.Connections[hostID]
-	if !exists {
-		log.Printf("[WS WARNING] Host %d not connected; cannot add to new room", hostID)
-		return roomID
+// This creates a room with a Host, it runs in the host's shard and the room stays in that shard
+func (s *shard) createRoom(host *Connection) (uint64, bool) {
+	if current, exists := s.connections[host.UserID]; !exists || current != host {
+		s.logger.Warn("host not connected, cannot create a room", "user_id", host.UserID)
+		return 0, false
 	}
 
+	roomID := s.nextRoomID
+	s.nextRoomID += uint64(len(s.wsm.shards))
+
 	room := &Room{
 		ID:        roomID,
-		Users:     map[uint64]*Connection{hostID: conn},
-		ReadyMap:  map[uint64]bool{hostID: false},
-		JoinOrder: []uint64{hostID},
-		HostID:    hostID,
+		Users:     map[uint64]*Connection{host.UserID: host},
+		ReadyMap:  map[uint64]bool{host.UserID: false},
+		JoinOrder: []uint64{host.UserID},
+		HostID:    host.UserID,
+	}
+	s.rooms[roomID] = room
+	s.trackRoom(host, roomID)
+	if s.wsm.bus != nil {
+		s.roomSubs[roomID] = s.wsm.subscribe(roomTopic(roomID), s)
 	}
-	wsm.Rooms[roomID] = room
 
-	log.Printf("[DEBUG] created room %d with host client %d", roomID, hostID)
-	return roomID
+	s.logger.Debug("created room", "room_id", roomID, "host_id", host.UserID)
+	return roomID, true
 }
 
-// This notifies if a user has discconected from the signaling server
-func (wsm *WebSocketManager) disconnectUser(userID uint64) {
-	// Close and remove the user's connection
-	if conn, exists := wsm.Connections[userID]; exists {
-		conn.Conn.Close()
-		delete(wsm.Connections, userID)
+// This closes a room, every member is notified with a RoomClosed message and stays connected
+func (s *shard) closeRoom(roomID uint64, reason string) bool {
+	room, exists := s.rooms[roomID]
+	if !exists {
+		return false
 	}
 
-	// Remove the user from rooms and notify remaining peers
-	for roomID, room := range wsm.Rooms {
-		if _, inRoom := room.Users[userID]; inRoom {
-			delete(room.Users, userID)
+	for _, conn := range room.Users {
+		_ = s.wsm.SafeWriteJSON(conn, smsg.MessageAnyPayload{
+			MsgType: smsg.RoomClosed,
+			Payload: smsg.RoomClosedPayload{RoomID: roomID, Reason: reason},
+		})
+		s.wsm.untrackRoom(conn, roomID)
+	}
+	s.deleteRoom(roomID)
 
-			// TODO: Notify remaining peers that this user has left
+	s.logger.Info("room closed", "room_id", roomID, "reason", reason)
+	return true
+}
 
-			log.Printf("[WS] User %d removed from room %d", userID, roomID)
+// This sends a server notice to every user connected to the shard
+func (s *shard) broadcastNotice(message string) int {
+	for _, conn := range s.connections {
+		_ = s.wsm.SafeWriteJSON(conn, smsg.MessageAnyPayload{
+			MsgType: smsg.ServerNotice,
+			Payload: smsg.ServerNoticePayload{Message: message},
+		})
+	}
+	return len(s.connections)
+}
 
-			// Delete the room if empty
-			if len(room.Users) == 0 {
-				delete(wsm.Rooms, roomID)
-				log.Printf("[WS] Room %d deleted because it is empty", roomID)
-			}
-		}
+// This closes the user's websocket with the given close code and reason, then cleans up the user's state
+func (s *shard) forceDisconnect(userID uint64, closeCode int, reason string) bool {
+	conn, exists := s.connections[userID]
+	if !exists {
+		return false
 	}
 
-	// TODO: Release the API key associated with this user ID
-	// for apiKey, id := range wsm.apiKeyToUserID {
-	// 	if id == userID {
-	// 		delete(wsm.apiKeyToUserID, apiKey)
-	// 		log.Printf("[WS] API key %s released for user %d", apiKey, userID)
-	// 		break
-	// 	}
-	// }
+	s.kickConnection(conn, closeCode, reason)
+	conn.logger.Info("user force-disconnected", "reason", reason)
+	return true
+}
+
+// This removes a connection and closes it with the given close code and reason. The close
+// handshake waits for the connection's writes, so it runs on its own goroutine rather than stall
+// the shard on a slow client.
+func (s *shard) kickConnection(conn *Connection, closeCode int, reason string) {
+	s.dropConnection(conn)
+	go conn.kick(closeCode, reason)
 }
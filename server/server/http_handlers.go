@@ -1,28 +1,28 @@
 package server
 
 import (
-	"log"
 	"net/http"
 	"strconv"
 
 	"github.com/gorilla/websocket"
-	"github.com/sushiag/go-webrtc-signaling-server/server/server/db"
 
 	smsg "signaling-msgs"
 )
 
 // This handles the /ws endpoint for upgrading the HTTP request
-func handleWSEndpoint(w http.ResponseWriter, r *http.Request, newConnCh chan *Connection, queries *db.Queries) {
+func handleWSEndpoint(w http.ResponseWriter, r *http.Request, wsm *WebSocketManager, auth Authenticator) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	// This authenticate the client if they match the API-key from the database
-	user, err := getUserFromAPIKey(r, queries)
+	logger := requestLogger(r)
+
+	// This authenticate the client with any credentials that allow signaling
+	principal, err := authenticate(r, auth, ScopeSignaling)
 	if err != nil {
-		log.Printf("[WS] Unauthorized WebSocket attempt: %v", err)
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		logger.Info("unauthorized WebSocket attempt", "err", err)
+		writeAuthError(w, r, err)
 		return
 	}
 
@@ -30,26 +30,27 @@ func handleWSEndpoint(w http.ResponseWriter, r *http.Request, newConnCh chan *Co
 	upgrader := websocket.Upgrader{
 		CheckOrigin: func(r *http.Request) bool { return true },
 	}
+	for _, codec := range smsg.Codecs() {
+		upgrader.Subprotocols = append(upgrader.Subprotocols, codec.Subprotocol())
+	}
 
 	// This attach the user's ID as a custom response header
 	header := http.Header{}
-	header.Set("X-Client-ID", strconv.FormatUint(uint64(user.ID), 10))
+	header.Set("X-Client-ID", strconv.FormatInt(principal.User.ID, 10))
 
 	// This performs the actual upgrade of the websocket connection
 	conn, err := upgrader.Upgrade(w, r, header)
 	if err != nil {
-		log.Printf("[WS] Failed to upgrade to WebSocket: %v", err)
+		logger.Warn("failed to upgrade to WebSocket", "err", err)
 		return
 	}
+	conn.SetReadLimit(wsm.payloads.MaxMessageSize)
 
 	// This creayes a new connection instance for thois websocket
-	newConn := &Connection{
-		UserID:   uint64(user.ID),
-		Conn:     conn,
-		Outgoing: make(chan smsg.MessageAnyPayload),
-	}
+	newConn := newConnection(uint64(principal.User.ID), conn, logger)
+	newConn.allowedRooms = principal.Rooms
 
-	// This sends the new connection into the manager's channel to be handled
-	newConnCh <- newConn
-	log.Printf("[WS] WebSocket connection established for user %s (ID %d)", user.Username, user.ID)
+	// This hands the new connection to the manager
+	wsm.handleNewConnection(newConn)
+	newConn.logger.Info("WebSocket connection established", "username", principal.User.Username, "auth", principal.Method)
 }
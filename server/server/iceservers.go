@@ -0,0 +1,131 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+const defaultTURNCredentialTTL = 24 * time.Hour
+
+// ICEConfig is the STUN and TURN servers clients create their peer connections with. The TURN
+// servers share a secret with this server, which hands out credentials derived from it that expire
+// (the TURN REST API scheme, coturn calls it use-auth-secret).
+type ICEConfig struct {
+	// STUN servers clients use as they are, like stun:stun.example.com:3478
+	STUNURLs []string
+	// TURN servers that accept credentials derived from TURNSecret, like
+	// turn:turn.example.com:3478?transport=udp
+	TURNURLs []string
+	// The secret shared with the TURN servers
+	TURNSecret string
+	// How long TURN credentials work, defaults to 24 hours
+	TURNCredentialTTL time.Duration
+}
+
+// This checks the config makes sense before the server starts with it
+func (cfg *ICEConfig) validate() error {
+	if len(cfg.TURNURLs) > 0 && cfg.TURNSecret == "" {
+		return errors.New("TURN servers need a TURNSecret")
+	}
+	if len(cfg.STUNURLs) == 0 && len(cfg.TURNURLs) == 0 {
+		return errors.New("no STUN or TURN servers")
+	}
+	return nil
+}
+
+// This hands out the ICE servers of an ICEConfig, a nil issuer has none to hand out
+type iceServerIssuer struct {
+	cfg ICEConfig
+}
+
+func newICEServerIssuer(cfg *ICEConfig) *iceServerIssuer {
+	if cfg == nil {
+		return nil
+	}
+	issuer := &iceServerIssuer{cfg: *cfg}
+	if issuer.cfg.TURNCredentialTTL <= 0 {
+		issuer.cfg.TURNCredentialTTL = defaultTURNCredentialTTL
+	}
+	return issuer
+}
+
+// This returns the ICE servers for the user and when their TURN credentials expire, which is nil
+// when there are no TURN servers. The username is the expiry as a unix timestamp and the user's ID
+// separated by a colon, the password is the base64 HMAC-SHA1 of the username keyed by the secret.
+func (i *iceServerIssuer) issue(userID uint64) ([]webrtc.ICEServer, *time.Time) {
+	if i == nil {
+		return nil, nil
+	}
+
+	var servers []webrtc.ICEServer
+	if len(i.cfg.STUNURLs) > 0 {
+		servers = append(servers, webrtc.ICEServer{URLs: slices.Clone(i.cfg.STUNURLs)})
+	}
+	if len(i.cfg.TURNURLs) == 0 {
+		return servers, nil
+	}
+
+	expiresAt := time.Now().Add(i.cfg.TURNCredentialTTL).UTC().Truncate(time.Second)
+	username := strconv.FormatInt(expiresAt.Unix(), 10) + ":" + strconv.FormatUint(userID, 10)
+	servers = append(servers, webrtc.ICEServer{
+		URLs:           slices.Clone(i.cfg.TURNURLs),
+		Username:       username,
+		Credential:     turnPassword(i.cfg.TURNSecret, username),
+		CredentialType: webrtc.ICECredentialTypePassword,
+	})
+	return servers, &expiresAt
+}
+
+// This derives the password of TURN credentials from their username
+func turnPassword(secret, username string) string {
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// This splits the username of TURN credentials into their expiry and user ID
+func parseTURNUsername(username string) (time.Time, uint64, error) {
+	expiry, userID, found := strings.Cut(username, ":")
+	if !found {
+		return time.Time{}, 0, errors.New("TURN username isn't expiry:user")
+	}
+	unix, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("invalid TURN credential expiry: %w", err)
+	}
+	id, err := strconv.ParseUint(userID, 10, 64)
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("invalid TURN credential user: %w", err)
+	}
+	return time.Unix(unix, 0), id, nil
+}
+
+// This hands the ICE servers to clients that want them before joining a room, they are the same
+// as the ones in RoomCreated and RoomJoined messages
+func handleICEServers(w http.ResponseWriter, r *http.Request, issuer *iceServerIssuer, auth Authenticator) {
+	principal, err := authenticate(r, auth, ScopeSignaling)
+	if err != nil {
+		requestLogger(r).Info("ICE server request rejected", "err", err)
+		writeAuthError(w, r, err)
+		return
+	}
+
+	servers, expiresAt := issuer.issue(uint64(principal.User.ID))
+	if servers == nil {
+		servers = []webrtc.ICEServer{}
+	}
+	writeJSON(w, r, http.StatusOK, struct {
+		ICEServers []webrtc.ICEServer `json:"ice_servers"`
+		ExpiresAt  *time.Time         `json:"expires_at,omitempty"`
+	}{servers, expiresAt})
+}
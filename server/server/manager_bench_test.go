@@ -0,0 +1,215 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+
+	smsg "signaling-msgs"
+	"signaling-msgs/logging"
+)
+
+const benchConnections = 10_000
+
+// This is a connection without a websocket behind it, every message sent to it is read by a
+// goroutine that records how long the message took to arrive
+type benchConn struct {
+	conn      *Connection
+	stop      chan struct{}
+	latencies chan []time.Duration
+}
+
+func newBenchConn(userID uint64) *benchConn {
+	return &benchConn{
+		conn: &Connection{
+			ID:       logging.NewID(),
+			UserID:   userID,
+			Outgoing: make(chan smsg.MessageAnyPayload),
+			done:     make(chan struct{}),
+			logger:   logging.Discard(),
+		},
+		stop:      make(chan struct{}),
+		latencies: make(chan []time.Duration, 1),
+	}
+}
+
+// This reads the next message synchronously, it's only used while setting up the rooms
+func (bc *benchConn) next(tb testing.TB) smsg.MessageAnyPayload {
+	select {
+	case msg := <-bc.conn.Outgoing:
+		return msg
+	case <-time.After(5 * time.Second):
+		tb.Fatalf("user %d didn't get a message", bc.conn.UserID)
+		return smsg.MessageAnyPayload{}
+	}
+}
+
+func (bc *benchConn) drain() {
+	var latencies []time.Duration
+	record := func(msg smsg.MessageAnyPayload) {
+		if sentAt, ok := benchSentAt(msg); ok {
+			latencies = append(latencies, time.Since(time.Unix(0, sentAt)))
+		}
+	}
+
+	for {
+		select {
+		case msg := <-bc.conn.Outgoing:
+			record(msg)
+		case <-bc.stop:
+			bc.latencies <- latencies
+			return
+		}
+	}
+}
+
+// This is an SDP or ICE candidate payload the server accepts, carrying when it was sent in an SDP
+// attribute or the candidate's foundation
+func benchPayload(msgType smsg.MessageType, sentAt int64) json.RawMessage {
+	var payload any = smsg.ICECandidatePayload{ICE: webrtc.ICECandidateInit{
+		Candidate: fmt.Sprintf("candidate:%d 1 udp 2122260223 203.0.113.7 54321 typ host", sentAt),
+	}}
+	if msgType == smsg.SDP {
+		payload = smsg.SDPPayload{SDP: webrtc.SessionDescription{
+			Type: webrtc.SDPTypeOffer,
+			SDP:  fmt.Sprintf("v=0\r\no=- 0 0 IN IP4 127.0.0.1\r\ns=-\r\nt=0 0\r\na=x-sent-at:%d\r\n", sentAt),
+		}}
+	}
+	raw, _ := json.Marshal(payload)
+	return raw
+}
+
+// This reads back when a message built by benchPayload was sent
+func benchSentAt(msg smsg.MessageAnyPayload) (int64, bool) {
+	raw, _ := msg.Payload.(json.RawMessage)
+	var sentAt string
+	switch msg.MsgType {
+	case smsg.SDP:
+		var payload smsg.SDPPayload
+		if json.Unmarshal(raw, &payload) != nil {
+			return 0, false
+		}
+		_, after, _ := strings.Cut(payload.SDP.SDP, "a=x-sent-at:")
+		sentAt, _, _ = strings.Cut(after, "\r\n")
+	case smsg.ICECandidate:
+		var payload smsg.ICECandidatePayload
+		if json.Unmarshal(raw, &payload) != nil {
+			return 0, false
+		}
+		sentAt, _, _ = strings.Cut(strings.TrimPrefix(payload.ICE.Candidate, "candidate:"), " ")
+	}
+	n, err := strconv.ParseInt(sentAt, 10, 64)
+	return n, err == nil
+}
+
+// This sets up the manager with benchConnections connections paired up in rooms of two
+func setupBenchManager(b *testing.B, shards int) (*WebSocketManager, []*benchConn) {
+	wsm := NewWebSocketManager(Options{Logger: logging.Discard(), Shards: shards})
+	ctx := context.Background()
+
+	conns := make([]*benchConn, benchConnections)
+	for i := range conns {
+		bc := newBenchConn(uint64(i + 1))
+		conns[i] = bc
+		err := wsm.exec(ctx, wsm.shardFor(bc.conn.UserID), func(s *shard) {
+			s.addConnection(bc.conn)
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	for i := 0; i < len(conns); i += 2 {
+		host, guest := conns[i], conns[i+1]
+
+		wsm.handleMessage(host.conn, &smsg.MessageRawJSONPayload{MsgType: smsg.CreateRoom, From: host.conn.UserID})
+		created, ok := host.next(b).Payload.(smsg.RoomCreatedPayload)
+		if !ok {
+			b.Fatalf("user %d didn't get a RoomCreated message", host.conn.UserID)
+		}
+
+		payload, err := json.Marshal(smsg.JoinRoomPayload{RoomID: created.RoomID})
+		if err != nil {
+			b.Fatal(err)
+		}
+		wsm.handleMessage(guest.conn, &smsg.MessageRawJSONPayload{MsgType: smsg.JoinRoom, From: guest.conn.UserID, Payload: payload})
+		if msg := guest.next(b); msg.MsgType != smsg.RoomJoined {
+			b.Fatalf("user %d didn't get a RoomJoined message", guest.conn.UserID)
+		}
+	}
+
+	for _, bc := range conns {
+		go bc.drain()
+	}
+	return wsm, conns
+}
+
+// This drives SDP and ICE messages between the peers of every room through handleMessage and
+// reports the delivery latency next to the throughput
+func BenchmarkHandleMessage(b *testing.B) {
+	for _, shards := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			wsm, conns := setupBenchManager(b, shards)
+
+			rooms := len(conns) / 2
+			offsets := make(chan int, rooms)
+			for i := range rooms {
+				offsets <- i
+			}
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				// every goroutine goes through all the rooms, starting at a different one
+				var offset int
+				select {
+				case offset = <-offsets:
+				default:
+				}
+
+				for n := offset; pb.Next(); n++ {
+					room := n % rooms
+					host, guest := conns[room*2].conn, conns[room*2+1].conn
+
+					msgType := smsg.ICECandidate
+					if n%4 == 0 {
+						msgType = smsg.SDP
+					}
+					wsm.handleMessage(host, &smsg.MessageRawJSONPayload{
+						MsgType: msgType,
+						From:    host.UserID,
+						To:      guest.UserID,
+						Payload: benchPayload(msgType, time.Now().UnixNano()),
+					})
+				}
+			})
+
+			// once every shard went through its mailbox all the messages were delivered
+			if err := wsm.execAll(context.Background(), func(*shard) {}); err != nil {
+				b.Fatal(err)
+			}
+			elapsed := b.Elapsed()
+			b.StopTimer()
+
+			var latencies []time.Duration
+			for _, bc := range conns {
+				close(bc.stop)
+				latencies = append(latencies, <-bc.latencies...)
+			}
+			if len(latencies) != b.N {
+				b.Fatalf("delivered %d of %d messages", len(latencies), b.N)
+			}
+
+			slices.Sort(latencies)
+			b.ReportMetric(float64(b.N)/elapsed.Seconds(), "msgs/s")
+			b.ReportMetric(float64(latencies[len(latencies)/2].Microseconds()), "p50-µs")
+			b.ReportMetric(float64(latencies[len(latencies)*99/100].Microseconds()), "p99-µs")
+		})
+	}
+}
@@ -0,0 +1,13 @@
+package server
+
+import "expvar"
+
+// These are published through expvar and can be read from /admin/metrics
+var (
+	// Messages that were dropped because a client's send queue was full, by message type
+	droppedMessages = expvar.NewMap("signaling_dropped_messages")
+	// Clients that were disconnected because they couldn't keep up with their messages
+	slowConsumerDisconnects = expvar.NewInt("signaling_slow_consumer_disconnects")
+	// Envelopes for other nodes that were dropped because the bus couldn't keep up
+	droppedBusPublishes = expvar.NewInt("signaling_dropped_bus_publishes")
+)
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"signaling-msgs/logging"
+)
+
+// Header used to pass a request ID from the caller and to echo it back
+const requestIDHeader = "X-Request-ID"
+
+// This returns the logger for the given request, it carries the request ID set by withRequestLogging
+func requestLogger(r *http.Request) *slog.Logger {
+	return logging.FromContext(r.Context(), nil)
+}
+
+// This assigns an ID to every HTTP request and attaches a logger carrying it to the request context.
+// A request ID sent by the caller is reused so logs can be correlated across services.
+func withRequestLogging(next http.Handler, logger *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(requestIDHeader)
+		if requestID == "" || len(requestID) > 64 {
+			requestID = logging.NewID()
+		}
+		w.Header().Set(requestIDHeader, requestID)
+
+		reqLogger := logger.With(
+			"request_id", requestID,
+			"method", r.Method,
+			"path", r.URL.Path,
+			"remote_addr", r.RemoteAddr,
+		)
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(rec, r.WithContext(logging.WithLogger(r.Context(), reqLogger)))
+
+		reqLogger.Debug("request handled", "status", rec.status, "duration", time.Since(start))
+	})
+}
+
+// This records the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if !rec.wroteHeader {
+		rec.status = status
+		rec.wroteHeader = true
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+// This lets the websocket upgrader take over the connection
+func (rec *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := rec.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not implement http.Hijacker")
+	}
+	rec.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
@@ -0,0 +1,160 @@
+package migrate_test
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sushiag/go-webrtc-signaling-server/server/server/migrate"
+)
+
+var testMigrations = fstest.MapFS{
+	"0001_create_rooms.up.sql":   {Data: []byte("CREATE TABLE rooms (id INTEGER PRIMARY KEY);")},
+	"0001_create_rooms.down.sql": {Data: []byte("DROP TABLE rooms;")},
+	"0002_add_name.up.sql":       {Data: []byte("ALTER TABLE rooms ADD COLUMN name TEXT;")},
+	"0002_add_name.down.sql":     {Data: []byte("ALTER TABLE rooms DROP COLUMN name;")},
+	"0003_seed.up.sql":           {Data: []byte("INSERT INTO rooms (id, name) VALUES (1, 'lobby');")},
+	"README.md":                  {Data: []byte("not a migration")},
+}
+
+func openTestDB(t *testing.T) *sql.DB {
+	conn, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "migrate.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func versions(migrations []migrate.Migration) []int64 {
+	var v []int64
+	for _, m := range migrations {
+		v = append(v, m.Version)
+	}
+	return v
+}
+
+func TestLoad(t *testing.T) {
+	migrations, err := migrate.Load(testMigrations)
+	require.NoError(t, err)
+	require.Equal(t, []int64{1, 2, 3}, versions(migrations))
+	require.Equal(t, "add_name", migrations[1].Name)
+	require.Empty(t, migrations[2].Down)
+
+	invalid := map[string]fstest.MapFS{
+		"no direction":  {"0001_rooms.sql": {}},
+		"no name":       {"0001.up.sql": {}},
+		"bad version":   {"first_rooms.up.sql": {}},
+		"down only":     {"0001_rooms.down.sql": {Data: []byte("DROP TABLE rooms;")}},
+		"name mismatch": {"0001_rooms.up.sql": {Data: []byte("SELECT 1;")}, "0001_users.down.sql": {Data: []byte("SELECT 1;")}},
+	}
+	for name, fsys := range invalid {
+		t.Run(name, func(t *testing.T) {
+			_, err := migrate.Load(fsys)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestUpDown(t *testing.T) {
+	ctx := context.Background()
+	conn := openTestDB(t)
+	migrator, err := migrate.New(conn, migrate.SQLite, testMigrations)
+	require.NoError(t, err)
+
+	pending, err := migrator.Pending(ctx)
+	require.NoError(t, err)
+	require.Len(t, pending, 3)
+
+	applied, err := migrator.Up(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []int64{1, 2, 3}, versions(applied))
+
+	var name string
+	require.NoError(t, conn.QueryRow("SELECT name FROM rooms WHERE id = 1").Scan(&name))
+	require.Equal(t, "lobby", name)
+
+	// applying again is a no-op
+	applied, err = migrator.Up(ctx)
+	require.NoError(t, err)
+	require.Empty(t, applied)
+
+	statuses, err := migrator.Status(ctx)
+	require.NoError(t, err)
+	require.Len(t, statuses, 3)
+	for _, status := range statuses {
+		require.True(t, status.Applied)
+		require.NotEmpty(t, status.AppliedAt)
+	}
+
+	// the seed has no down file so it can't be reverted
+	_, err = migrator.Down(ctx, 1)
+	require.ErrorContains(t, err, "can't be reverted")
+
+	// once it's gone from the applied ones the rest can be
+	_, err = conn.Exec("DELETE FROM schema_migrations WHERE version = 3")
+	require.NoError(t, err)
+	reverted, err := migrator.Down(ctx, 1)
+	require.NoError(t, err)
+	require.Equal(t, []int64{2}, versions(reverted))
+
+	_, err = conn.Exec("INSERT INTO rooms (id, name) VALUES (2, 'hall')")
+	require.Error(t, err, "the name column should be gone")
+
+	pending, err = migrator.Pending(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []int64{2, 3}, versions(pending))
+}
+
+func TestFailedMigrationRollsBack(t *testing.T) {
+	ctx := context.Background()
+	conn := openTestDB(t)
+	migrator, err := migrate.New(conn, migrate.SQLite, fstest.MapFS{
+		"0001_create_rooms.up.sql": {Data: []byte("CREATE TABLE rooms (id INTEGER PRIMARY KEY);")},
+		"0002_broken.up.sql":       {Data: []byte("CREATE TABLE halls (id INTEGER PRIMARY KEY); INSERT INTO nowhere VALUES (1);")},
+	})
+	require.NoError(t, err)
+
+	applied, err := migrator.Up(ctx)
+	require.ErrorContains(t, err, "0002")
+	require.Equal(t, []int64{1}, versions(applied))
+
+	var count int
+	require.NoError(t, conn.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'halls'").Scan(&count))
+	require.Zero(t, count, "the failed migration should have been rolled back")
+
+	pending, err := migrator.Pending(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []int64{2}, versions(pending))
+}
+
+func TestBaseline(t *testing.T) {
+	ctx := context.Background()
+	conn := openTestDB(t)
+	migrator, err := migrate.New(conn, migrate.SQLite, testMigrations)
+	require.NoError(t, err)
+
+	// the schema of the first two migrations was created by hand
+	_, err = conn.Exec("CREATE TABLE rooms (id INTEGER PRIMARY KEY, name TEXT)")
+	require.NoError(t, err)
+	require.NoError(t, migrator.Baseline(ctx, 2))
+
+	pending, err := migrator.Pending(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []int64{3}, versions(pending))
+
+	applied, err := migrator.Up(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []int64{3}, versions(applied))
+
+	// databases with applied migrations are left alone
+	_, err = conn.Exec("DELETE FROM schema_migrations WHERE version = 2")
+	require.NoError(t, err)
+	require.NoError(t, migrator.Baseline(ctx, 2))
+	pending, err = migrator.Pending(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []int64{2}, versions(pending))
+}
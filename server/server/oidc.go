@@ -0,0 +1,358 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+
+	"github.com/sushiag/go-webrtc-signaling-server/server/server/db"
+	"github.com/sushiag/go-webrtc-signaling-server/server/server/storage"
+)
+
+const (
+	oidcFlowCookie   = "oidc_flow"
+	oidcFlowTTL      = 10 * time.Minute
+	oidcCallbackPath = "/auth/oidc/callback"
+	// How many numbered variants of a taken username are tried when provisioning a user
+	maxUsernameAttempts = 10
+)
+
+// OIDCConfig configures logging in with an OpenID Connect provider instead of a local password
+type OIDCConfig struct {
+	// URL of the provider, its discovery document is read from /.well-known/openid-configuration
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// Where the provider sends users back to, defaults to /auth/oidc/callback on the host the
+	// login was started on
+	RedirectURL string
+	// Scopes besides openid, defaults to profile and email
+	Scopes []string
+	// ID token claim new users are named after, defaults to preferred_username. The local part of
+	// the email and the subject are used when the claim is missing.
+	UsernameClaim string
+	// Links the provider's users to local users with the same name instead of provisioning new
+	// ones. Only turn this on when the provider's usernames can't be picked by its users.
+	LinkExistingUsers bool
+}
+
+// This is what the login remembers until the provider sends the user back
+type oidcFlow struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	// Set when the user asked for an API key instead of an access token
+	APIKey bool `json:"api_key,omitempty"`
+}
+
+// This runs the authorization code flow, the provider is only discovered on the first login so a
+// provider that is down doesn't keep the server from starting
+type oidcLogin struct {
+	cfg     OIDCConfig
+	queries db.Querier
+	tokens  *tokenAuthority
+
+	mu       sync.Mutex
+	provider *oidc.Provider
+}
+
+func newOIDCLogin(cfg OIDCConfig, queries db.Querier, tokens *tokenAuthority) *oidcLogin {
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"profile", "email"}
+	}
+	if cfg.UsernameClaim == "" {
+		cfg.UsernameClaim = "preferred_username"
+	}
+	return &oidcLogin{cfg: cfg, queries: queries, tokens: tokens}
+}
+
+func (o *oidcLogin) oauth2Config(r *http.Request) (*oauth2.Config, *oidc.Provider, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.provider == nil {
+		provider, err := oidc.NewProvider(r.Context(), o.cfg.Issuer)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to discover OIDC provider: %w", err)
+		}
+		o.provider = provider
+	}
+
+	redirectURL := o.cfg.RedirectURL
+	if redirectURL == "" {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		redirectURL = fmt.Sprintf("%s://%s%s", scheme, r.Host, oidcCallbackPath)
+	}
+
+	return &oauth2.Config{
+		ClientID:     o.cfg.ClientID,
+		ClientSecret: o.cfg.ClientSecret,
+		Endpoint:     o.provider.Endpoint(),
+		RedirectURL:  redirectURL,
+		Scopes:       append([]string{oidc.ScopeOpenID}, o.cfg.Scopes...),
+	}, o.provider, nil
+}
+
+// This sends the user to the provider, ?issue=api_key makes the callback hand out an API key
+// instead of an access token
+func (o *oidcLogin) handleLogin(w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(r)
+
+	config, _, err := o.oauth2Config(r)
+	if err != nil {
+		logger.Error("OIDC login unavailable", "err", err)
+		http.Error(w, "Login provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	flow := oidcFlow{
+		State:    randomToken(),
+		Nonce:    randomToken(),
+		Verifier: oauth2.GenerateVerifier(),
+		APIKey:   r.URL.Query().Get("issue") == "api_key",
+	}
+	encoded, _ := json.Marshal(flow)
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcFlowCookie,
+		Value:    base64.RawURLEncoding.EncodeToString(encoded),
+		Path:     "/auth/oidc",
+		MaxAge:   int(oidcFlowTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	authURL := config.AuthCodeURL(flow.State, oidc.Nonce(flow.Nonce), oauth2.S256ChallengeOption(flow.Verifier))
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// This finishes the login, it links the provider's user to a local user, provisioning one the
+// first time they log in, and responds with an access token or API key for them
+func (o *oidcLogin) handleCallback(w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(r)
+
+	// the flow is single use
+	http.SetCookie(w, &http.Cookie{Name: oidcFlowCookie, Path: "/auth/oidc", MaxAge: -1, HttpOnly: true})
+
+	if providerErr := r.URL.Query().Get("error"); providerErr != "" {
+		logger.Info("OIDC login refused by the provider", "error", providerErr, "description", r.URL.Query().Get("error_description"))
+		http.Error(w, "Login refused by the provider", http.StatusUnauthorized)
+		return
+	}
+
+	flow, err := readOIDCFlow(r)
+	if err != nil || subtle.ConstantTimeCompare([]byte(flow.State), []byte(r.URL.Query().Get("state"))) != 1 {
+		logger.Info("OIDC callback with an unknown or expired login", "err", err)
+		http.Error(w, "Login expired, start over", http.StatusBadRequest)
+		return
+	}
+
+	config, provider, err := o.oauth2Config(r)
+	if err != nil {
+		logger.Error("OIDC login unavailable", "err", err)
+		http.Error(w, "Login provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	token, err := config.Exchange(r.Context(), r.URL.Query().Get("code"), oauth2.VerifierOption(flow.Verifier))
+	if err != nil {
+		logger.Info("failed to exchange OIDC code", "err", err)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	rawIDToken, _ := token.Extra("id_token").(string)
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: o.cfg.ClientID}).Verify(r.Context(), rawIDToken)
+	if err != nil || subtle.ConstantTimeCompare([]byte(idToken.Nonce), []byte(flow.Nonce)) != 1 {
+		logger.Info("invalid OIDC ID token", "err", err)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var claims map[string]any
+	if err := idToken.Claims(&claims); err != nil {
+		logger.Info("invalid OIDC ID token claims", "err", err)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	user, created, err := o.userForIdentity(r, idToken.Issuer, idToken.Subject, o.usernameFromClaims(claims, idToken.Subject))
+	if err != nil {
+		logger.Error("failed to link OIDC identity", "subject", idToken.Subject, "err", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	logger = logger.With("username", user.Username)
+	if user.Disabled != 0 {
+		recordAuthEvent(r, o.queries, user.ID, user.Username, authEventOIDC, false, false)
+		logger.Info("OIDC login rejected, account is disabled")
+		http.Error(w, "Account disabled", http.StatusForbidden)
+		return
+	}
+
+	recordLogin(r, o.queries, user, authEventOIDC)
+
+	resp := struct {
+		Username    string     `json:"username"`
+		Created     bool       `json:"created"`
+		APIKey      string     `json:"api_key,omitempty"`
+		AccessToken string     `json:"access_token,omitempty"`
+		TokenType   string     `json:"token_type,omitempty"`
+		ExpiresIn   int64      `json:"expires_in,omitempty"`
+		ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	}{Username: user.Username, Created: created}
+
+	if flow.APIKey {
+		resp.APIKey, _, err = issueAPIKey(r.Context(), o.queries, user.ID, "oidc", []string{ScopeSignaling}, nil)
+	} else {
+		var expiresAt time.Time
+		resp.AccessToken, expiresAt, err = o.tokens.issue(user, nil, true)
+		expiresAt = expiresAt.UTC().Truncate(time.Second)
+		resp.TokenType, resp.ExpiresIn, resp.ExpiresAt = "Bearer", int64(o.tokens.ttl.Seconds()), &expiresAt
+	}
+	if err != nil {
+		logger.Error("failed to issue credentials after OIDC login", "err", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	logger.Info("OIDC login", "created", created, "api_key", flow.APIKey)
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+// This returns the local user of the identity, linking or provisioning one when there is none yet
+func (o *oidcLogin) userForIdentity(r *http.Request, issuer, subject, username string) (db.User, bool, error) {
+	ctx := r.Context()
+	identity := db.GetUserByIdentityParams{Issuer: issuer, Subject: subject}
+
+	user, err := o.queries.GetUserByIdentity(ctx, identity)
+	if !errors.Is(err, sql.ErrNoRows) {
+		return user, false, err
+	}
+
+	created := false
+	if o.cfg.LinkExistingUsers {
+		user, err = o.queries.GetUserByUsername(ctx, username)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return db.User{}, false, err
+		}
+	}
+	if user.ID == 0 {
+		user, err = o.provisionUser(r, username)
+		if err != nil {
+			return db.User{}, false, err
+		}
+		created = true
+	}
+
+	err = o.queries.CreateUserIdentity(ctx, db.CreateUserIdentityParams{UserID: user.ID, Issuer: issuer, Subject: subject})
+	if storage.IsUniqueViolation(err) {
+		// a concurrent login of the same user linked it first
+		user, err = o.queries.GetUserByIdentity(ctx, identity)
+		return user, false, err
+	}
+	return user, created, err
+}
+
+// This creates a user without a password so they can only log in through the provider, numbered
+// variants of the name are tried when it's taken
+func (o *oidcLogin) provisionUser(r *http.Request, username string) (db.User, error) {
+	for attempt := 1; attempt <= maxUsernameAttempts; attempt++ {
+		candidate := username
+		if attempt > 1 {
+			suffix := fmt.Sprintf("%d", attempt)
+			candidate = username[:min(len(username), maxUsernameLen-len(suffix))] + suffix
+		}
+		// provisioned users follow the same rules as registered ones
+		if err := checkUsernameField(candidate); err != nil {
+			return db.User{}, fmt.Errorf("invalid username %q: %w", candidate, err)
+		}
+
+		userID, err := o.queries.CreateUser(r.Context(), db.CreateUserParams{Username: candidate})
+		if storage.IsUniqueViolation(err) {
+			continue
+		}
+		if err != nil {
+			return db.User{}, err
+		}
+		return o.queries.GetUserByID(r.Context(), userID)
+	}
+	return db.User{}, fmt.Errorf("no free username like %q", username)
+}
+
+// This picks the name a new user gets and makes it a valid username
+func (o *oidcLogin) usernameFromClaims(claims map[string]any, subject string) string {
+	name, _ := claims[o.cfg.UsernameClaim].(string)
+	if name == "" {
+		email, _ := claims["email"].(string)
+		name, _, _ = strings.Cut(email, "@")
+	}
+	if name == "" {
+		name = subject
+	}
+
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case b.Len() >= maxUsernameLen:
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z':
+			b.WriteRune(r)
+		case b.Len() == 0:
+			// usernames start with a letter
+			b.WriteString("u")
+			if r >= '0' && r <= '9' {
+				b.WriteRune(r)
+			}
+		case r >= '0' && r <= '9', r == '_':
+			b.WriteRune(r)
+		default:
+			b.WriteRune('_')
+		}
+	}
+	// short names are padded up to the minimum length of registered ones
+	if b.Len() < minUsernameLen {
+		b.WriteString("_user")
+	}
+	for b.Len() < minUsernameLen {
+		b.WriteRune('0')
+	}
+	return b.String()
+}
+
+func readOIDCFlow(r *http.Request) (oidcFlow, error) {
+	var flow oidcFlow
+	cookie, err := r.Cookie(oidcFlowCookie)
+	if err != nil {
+		return flow, err
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil {
+		return flow, err
+	}
+	if err := json.Unmarshal(decoded, &flow); err != nil {
+		return flow, err
+	}
+	if flow.State == "" {
+		return flow, errors.New("login has no state")
+	}
+	return flow, nil
+}
+
+func randomToken() string {
+	b := make([]byte, 24)
+	_, _ = rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,245 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/sushiag/go-webrtc-signaling-server/server/server/db"
+	sqlitedb "github.com/sushiag/go-webrtc-signaling-server/server/server/register"
+	"github.com/sushiag/go-webrtc-signaling-server/server/server/storage"
+)
+
+const (
+	defaultPasswordResetTTL = 30 * time.Minute
+	// The password was reset with an emailed token
+	authEventPasswordReset = "password_reset"
+)
+
+// PasswordResetConfig lets users who forgot their password set a new one through a token that is
+// emailed to the address on their account
+type PasswordResetConfig struct {
+	// Sends the reset emails
+	Mailer Mailer
+	// The page users reset their password on, the token is added to it as the token query
+	// parameter. The mail only contains the token when it's empty.
+	URL string
+	// How long a reset token works, defaults to 30 minutes
+	TTL time.Duration
+}
+
+// This hands out reset tokens and redeems them, a user only has one working token at a time
+type passwordReset struct {
+	cfg     PasswordResetConfig
+	queries db.Querier
+	wsm     *WebSocketManager
+}
+
+func newPasswordReset(cfg PasswordResetConfig, queries db.Querier, wsm *WebSocketManager) (*passwordReset, error) {
+	if cfg.Mailer == nil {
+		return nil, errors.New("password resets need a Mailer")
+	}
+	if cfg.URL != "" {
+		if _, err := url.Parse(cfg.URL); err != nil {
+			return nil, fmt.Errorf("invalid password reset URL: %w", err)
+		}
+	}
+	if cfg.TTL <= 0 {
+		cfg.TTL = defaultPasswordResetTTL
+	}
+	return &passwordReset{cfg: cfg, queries: queries, wsm: wsm}, nil
+}
+
+// This emails a reset token to the address if it belongs to a user. The response is the same
+// either way and the mail is sent in the background, so it doesn't tell which addresses are known.
+func (p *passwordReset) handleForgot(w http.ResponseWriter, r *http.Request) {
+	var rqst struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&rqst); err != nil {
+		http.Error(w, "Invalid input", http.StatusUnprocessableEntity)
+		return
+	}
+	email, err := checkEmailField(rqst.Email)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	if err := p.sendToken(r, email); err != nil {
+		requestLogger(r).Error("failed to start password reset", "err", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (p *passwordReset) sendToken(r *http.Request, email string) error {
+	ctx := r.Context()
+	logger := requestLogger(r)
+
+	user, err := p.queries.GetUserByEmail(ctx, sql.NullString{String: email, Valid: true})
+	if errors.Is(err, sql.ErrNoRows) {
+		logger.Info("password reset asked for an unknown email")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	logger = logger.With("username", user.Username)
+	if user.Disabled != 0 {
+		logger.Info("password reset asked for a disabled account")
+		return nil
+	}
+
+	// Only the newest token works
+	if err := p.queries.DeletePasswordResets(ctx, user.ID); err != nil {
+		return err
+	}
+	token, err := sqlitedb.GenerateAPIKey()
+	if err != nil {
+		return fmt.Errorf("failed to generate reset token: %w", err)
+	}
+	err = p.queries.CreatePasswordReset(ctx, db.CreatePasswordResetParams{
+		UserID:    user.ID,
+		Hash:      storage.HashAPIKey(token),
+		ExpiresAt: formatDBTime(time.Now().Add(p.cfg.TTL)).String,
+	})
+	if err != nil {
+		return err
+	}
+
+	mail := Mail{
+		To:      email,
+		Subject: "Reset your password",
+		Body:    p.mailBody(user.Username, token),
+	}
+	// The request is done before the mail is, so only its logger is kept
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		if err := p.cfg.Mailer.SendMail(ctx, mail); err != nil {
+			logger.Error("failed to send password reset mail", "err", err)
+			return
+		}
+		logger.Info("password reset mail sent")
+	}()
+	return nil
+}
+
+func (p *passwordReset) mailBody(username, token string) string {
+	reset := "Your reset token is " + token + ", send it to /password/reset with your new password."
+	if p.cfg.URL != "" {
+		link, _ := url.Parse(p.cfg.URL)
+		query := link.Query()
+		query.Set("token", token)
+		link.RawQuery = query.Encode()
+		reset = "Set a new password at " + link.String()
+	}
+	return fmt.Sprintf("Someone asked to reset the password of %s.\n\n%s\n\nThis only works once and expires in %s. If it wasn't you, ignore this mail.\n",
+		username, reset, p.cfg.TTL)
+}
+
+// This sets a new password with a reset token. Like /regenerate it replaces every API key of the
+// user, since a forgotten password may well come with a lost key, and it closes the user's session
+// in case it was opened with one. It also lifts a lockout.
+func (p *passwordReset) handleReset(w http.ResponseWriter, r *http.Request) {
+	var rqst struct {
+		Token       string `json:"token"`
+		NewPassword string `json:"new_password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&rqst); err != nil {
+		http.Error(w, "Invalid input", http.StatusUnprocessableEntity)
+		return
+	}
+	if err := checkPasswordField(rqst.NewPassword); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	ctx := r.Context()
+	logger := requestLogger(r)
+
+	userID, err := p.queries.UsePasswordReset(ctx, db.UsePasswordResetParams{
+		Hash:      storage.HashAPIKey(rqst.Token),
+		ExpiresAt: formatDBTime(time.Now()).String,
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		logger.Info("rejected password reset, unknown or expired token")
+		http.Error(w, "Invalid or expired reset token", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		logger.Error("failed to redeem reset token", "err", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	user, err := p.queries.GetUserByID(ctx, userID)
+	if err != nil {
+		logger.Error("failed to load user of reset token", "err", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	logger = logger.With("username", user.Username)
+	if user.Disabled != 0 {
+		recordAuthEvent(r, p.queries, user.ID, user.Username, authEventPasswordReset, false, false)
+		http.Error(w, "Account disabled", http.StatusForbidden)
+		return
+	}
+
+	hashed, err := bcrypt.GenerateFromPassword([]byte(rqst.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		logger.Error("failed to hash new password", "err", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if err := p.queries.UpdateUserPassword(ctx, db.UpdateUserPasswordParams{Password: string(hashed), Username: user.Username}); err != nil {
+		logger.Error("failed to update password", "err", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if err := p.queries.DeletePasswordResets(ctx, user.ID); err != nil {
+		logger.Warn("failed to delete other reset tokens", "err", err)
+	}
+	if err := p.queries.ResetFailedLogins(ctx, user.ID); err != nil {
+		logger.Warn("failed to lift lockout", "err", err)
+	}
+
+	if _, err := p.queries.RevokeAllAPIKeys(ctx, user.ID); err != nil {
+		logger.Error("failed to revoke API keys", "err", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	apiKey, err := IssueDefaultAPIKey(ctx, p.queries, user.ID)
+	if err != nil {
+		logger.Error("failed to create API key", "err", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// The password is reset either way, a session that can't be closed now fails its next reconnect
+	// with a revoked key
+	disconnectCtx, cancel := context.WithTimeout(ctx, adminTimeout)
+	defer cancel()
+	sessionID := uint64(user.ID)
+	err = p.wsm.exec(disconnectCtx, p.wsm.shardFor(sessionID), func(s *shard) {
+		s.forceDisconnect(sessionID, websocket.ClosePolicyViolation, "password reset")
+	})
+	if err != nil {
+		logger.Warn("failed to close the session of a reset account", "err", err)
+	}
+
+	recordLogin(r, p.queries, user, authEventPasswordReset)
+	logger.Info("password reset")
+	writeJSON(w, r, http.StatusOK, struct {
+		APIKey string `json:"api_key"`
+	}{apiKey})
+}
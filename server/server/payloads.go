@@ -0,0 +1,221 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/pion/ice/v4"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+
+	smsg "signaling-msgs"
+)
+
+const (
+	defaultMaxMessageSize   = 128 << 10
+	defaultMaxSDPSize       = 64 << 10
+	defaultMaxCandidateSize = 1 << 10
+)
+
+// This configures how the server checks the SDP and ICE candidate messages it forwards, the zero
+// value uses the default sizes and forwards every well formed payload
+type PayloadPolicy struct {
+	// The largest websocket message a client may send in bytes, defaults to 128KiB. Clients
+	// sending larger messages are disconnected with close code 1009 (message too big).
+	MaxMessageSize int64
+	// The longest SDP in bytes, defaults to 64KiB
+	MaxSDPSize int
+	// The longest ICE candidate in bytes, defaults to 1KiB
+	MaxCandidateSize int
+
+	// Drops host candidates, peers then only learn each other's public and relay addresses
+	StripHostCandidates bool
+	// Drops candidates with private, loopback or link-local addresses and mDNS host candidates
+	StripPrivateCandidates bool
+	// Codecs removed from SDPs by their name, like "H264" or "G722"
+	DisallowedCodecs []string
+}
+
+func newPayloadPolicy(policy PayloadPolicy) PayloadPolicy {
+	if policy.MaxMessageSize <= 0 {
+		policy.MaxMessageSize = defaultMaxMessageSize
+	}
+	if policy.MaxSDPSize <= 0 {
+		policy.MaxSDPSize = defaultMaxSDPSize
+	}
+	if policy.MaxCandidateSize <= 0 {
+		policy.MaxCandidateSize = defaultMaxCandidateSize
+	}
+	return policy
+}
+
+// This checks an SDP or ICE candidate payload and applies the policy to it. It returns the payload
+// to forward, which only has the fields of the payload type, and false when the policy dropped
+// the whole message. Rejected payloads return an *smsg.ErrorPayload.
+func (p *PayloadPolicy) sanitize(msg *smsg.MessageRawJSONPayload) (json.RawMessage, bool, error) {
+	switch msg.MsgType {
+	case smsg.SDP:
+		var payload smsg.SDPPayload
+		if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+			return nil, false, &smsg.ErrorPayload{Code: smsg.CodeInvalidPayload, Message: "invalid SDP payload"}
+		}
+		if err := p.sanitizeSDP(&payload.SDP); err != nil {
+			return nil, false, err
+		}
+		sanitized, err := json.Marshal(payload)
+		return sanitized, true, err
+
+	case smsg.ICECandidate:
+		var payload smsg.ICECandidatePayload
+		if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+			return nil, false, &smsg.ErrorPayload{Code: smsg.CodeInvalidPayload, Message: "invalid ICE candidate payload"}
+		}
+		allowed, err := p.checkCandidate(payload.ICE.Candidate)
+		if err != nil || !allowed {
+			return nil, false, err
+		}
+		sanitized, err := json.Marshal(payload)
+		return sanitized, true, err
+	}
+	return msg.Payload, true, nil
+}
+
+func (p *PayloadPolicy) sanitizeSDP(desc *webrtc.SessionDescription) error {
+	if len(desc.SDP) > p.MaxSDPSize {
+		return &smsg.ErrorPayload{Code: smsg.CodePayloadTooLarge, Message: fmt.Sprintf("the SDP is longer than %d bytes", p.MaxSDPSize)}
+	}
+	// a rollback is the only description without an SDP
+	if desc.Type == webrtc.SDPTypeRollback && desc.SDP == "" {
+		return nil
+	}
+
+	var parsed sdp.SessionDescription
+	if err := parsed.UnmarshalString(desc.SDP); err != nil {
+		return &smsg.ErrorPayload{Code: smsg.CodeInvalidPayload, Message: fmt.Sprintf("invalid SDP: %v", err)}
+	}
+
+	changed := false
+	for _, media := range parsed.MediaDescriptions {
+		attributes := media.Attributes[:0]
+		for _, attr := range media.Attributes {
+			if attr.IsICECandidate() {
+				allowed, err := p.checkCandidate(attr.Value)
+				if err != nil {
+					return err
+				}
+				if !allowed {
+					changed = true
+					continue
+				}
+			}
+			attributes = append(attributes, attr)
+		}
+		media.Attributes = attributes
+
+		removed, err := p.stripCodecs(media)
+		if err != nil {
+			return err
+		}
+		changed = changed || removed
+	}
+
+	// the SDP is only rewritten when the policy changed it, so it stays byte for byte what the
+	// sender wrote otherwise
+	if changed {
+		sanitized, err := parsed.Marshal()
+		if err != nil {
+			return &smsg.ErrorPayload{Code: smsg.CodeInvalidPayload, Message: fmt.Sprintf("invalid SDP: %v", err)}
+		}
+		desc.SDP = string(sanitized)
+	}
+	return nil
+}
+
+// This removes the disallowed codecs from a media section along with their parameters and the
+// retransmission formats that point at them. It tells whether anything was removed.
+func (p *PayloadPolicy) stripCodecs(media *sdp.MediaDescription) (bool, error) {
+	if len(p.DisallowedCodecs) == 0 || !slices.Contains(media.MediaName.Protos, "RTP") {
+		return false, nil
+	}
+
+	removed := map[string]bool{}
+	for _, attr := range media.Attributes {
+		if attr.Key != "rtpmap" {
+			continue
+		}
+		format, encoding, _ := strings.Cut(attr.Value, " ")
+		name, _, _ := strings.Cut(encoding, "/")
+		if slices.ContainsFunc(p.DisallowedCodecs, func(codec string) bool { return strings.EqualFold(codec, name) }) {
+			removed[format] = true
+		}
+	}
+	// retransmissions of a removed codec go with it
+	for _, attr := range media.Attributes {
+		if attr.Key != "fmtp" {
+			continue
+		}
+		format, params, _ := strings.Cut(attr.Value, " ")
+		for _, param := range strings.Split(params, ";") {
+			if key, value, _ := strings.Cut(strings.TrimSpace(param), "="); key == "apt" && removed[value] {
+				removed[format] = true
+			}
+		}
+	}
+	if len(removed) == 0 {
+		return false, nil
+	}
+
+	media.MediaName.Formats = slices.DeleteFunc(media.MediaName.Formats, func(format string) bool { return removed[format] })
+	if len(media.MediaName.Formats) == 0 {
+		return false, &smsg.ErrorPayload{Code: smsg.CodeForbidden, Message: fmt.Sprintf("the %s section has no allowed codecs", media.MediaName.Media)}
+	}
+	media.Attributes = slices.DeleteFunc(media.Attributes, func(attr sdp.Attribute) bool {
+		switch attr.Key {
+		case "rtpmap", "fmtp", "rtcp-fb":
+			format, _, _ := strings.Cut(attr.Value, " ")
+			return removed[format]
+		}
+		return false
+	})
+	return true, nil
+}
+
+// This parses an ICE candidate and tells whether the policy lets it through, the empty candidate
+// that ends the candidates always does
+func (p *PayloadPolicy) checkCandidate(raw string) (bool, error) {
+	if len(raw) > p.MaxCandidateSize {
+		return false, &smsg.ErrorPayload{Code: smsg.CodePayloadTooLarge, Message: fmt.Sprintf("the ICE candidate is longer than %d bytes", p.MaxCandidateSize)}
+	}
+	if raw == "" {
+		return true, nil
+	}
+
+	candidate, err := ice.UnmarshalCandidate(raw)
+	if err != nil {
+		return false, &smsg.ErrorPayload{Code: smsg.CodeInvalidPayload, Message: fmt.Sprintf("invalid ICE candidate: %v", err)}
+	}
+
+	if p.StripHostCandidates && candidate.Type() == ice.CandidateTypeHost {
+		return false, nil
+	}
+	if p.StripPrivateCandidates && isPrivateAddress(candidate.Address()) {
+		return false, nil
+	}
+	return true, nil
+}
+
+// This tells whether a candidate address can only be reached from the local network, mDNS names
+// hide a local address
+func isPrivateAddress(address string) bool {
+	if strings.HasSuffix(address, ".local") {
+		return true
+	}
+	addr, err := netip.ParseAddr(address)
+	if err != nil {
+		return false
+	}
+	return addr.IsPrivate() || addr.IsLoopback() || addr.IsLinkLocalUnicast() || addr.IsUnspecified()
+}
@@ -0,0 +1,8 @@
+package pgdb
+
+import "embed"
+
+// These are the migrations of the Postgres database, they mirror the ones of the SQLite database
+//
+//go:embed migrations/*.sql
+var Migrations embed.FS
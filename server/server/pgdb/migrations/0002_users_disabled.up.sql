@@ -0,0 +1 @@
+ALTER TABLE users ADD COLUMN disabled BIGINT NOT NULL DEFAULT 0;
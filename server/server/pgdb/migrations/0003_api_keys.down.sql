@@ -0,0 +1,3 @@
+-- Only the hashes are stored so the keys can't be moved back, users have to regenerate theirs
+DROP TABLE api_keys;
+ALTER TABLE users ADD COLUMN api_key TEXT NULL UNIQUE;
@@ -0,0 +1,21 @@
+-- API keys move to their own table where only a SHA-256 hash of each key is kept, the keys users
+-- already have keep working. Timestamps use the format of SQLite's CURRENT_TIMESTAMP.
+CREATE TABLE api_keys (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    prefix TEXT NOT NULL,
+    hash TEXT NOT NULL UNIQUE,
+    label TEXT NOT NULL,
+    scopes TEXT NOT NULL,
+    created_at TEXT NOT NULL DEFAULT to_char(CURRENT_TIMESTAMP AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS'),
+    last_used_at TEXT NULL,
+    expires_at TEXT NULL
+);
+CREATE INDEX api_keys_user_id ON api_keys (user_id);
+
+INSERT INTO api_keys (user_id, prefix, hash, label, scopes)
+SELECT id, substr(api_key, 1, 8), encode(sha256(convert_to(api_key, 'UTF8')), 'hex'), 'default', 'signaling keys'
+FROM users
+WHERE api_key IS NOT NULL;
+
+ALTER TABLE users DROP COLUMN api_key;
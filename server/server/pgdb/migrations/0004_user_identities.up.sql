@@ -0,0 +1,11 @@
+-- Links users to the accounts of external identity providers, an identity is the issuer and
+-- subject of the provider's ID tokens. Users provisioned this way have an empty password.
+CREATE TABLE user_identities (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    issuer TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    created_at TEXT NOT NULL DEFAULT to_char(CURRENT_TIMESTAMP AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS'),
+    UNIQUE (issuer, subject)
+);
+CREATE INDEX user_identities_user_id ON user_identities (user_id);
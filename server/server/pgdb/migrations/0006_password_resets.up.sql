@@ -0,0 +1,13 @@
+-- Users can leave an email address to have password reset links sent to. Reset tokens are
+-- single-use and only stored hashed, like API keys.
+ALTER TABLE users ADD COLUMN email TEXT NULL;
+CREATE UNIQUE INDEX users_email ON users (email);
+
+CREATE TABLE password_resets (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    hash TEXT NOT NULL UNIQUE,
+    expires_at TEXT NOT NULL,
+    created_at TEXT NOT NULL DEFAULT to_char(CURRENT_TIMESTAMP AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS')
+);
+CREATE INDEX password_resets_user_id ON password_resets (user_id);
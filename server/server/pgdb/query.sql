@@ -0,0 +1,131 @@
+-- name: CreateUser :one
+INSERT INTO users (username, password, email)
+VALUES ($1, $2, $3)
+RETURNING id;
+
+-- name: UpdateUserPassword :exec
+UPDATE users
+SET password = $1, updated_at = CURRENT_TIMESTAMP 
+WHERE username = $2;
+
+-- name: DeleteUser :exec
+DELETE FROM users
+WHERE id = $1;
+
+-- name: GetUserByUsername :one
+SELECT * FROM users WHERE username = $1 LIMIT 1;
+
+-- name: GetUserByID :one
+SELECT * FROM users WHERE id = $1 LIMIT 1;
+
+-- name: Ping :one
+SELECT 1;
+
+-- name: ListUsers :many
+SELECT * FROM users ORDER BY id;
+
+-- name: SetUserDisabled :execrows
+UPDATE users
+SET disabled = $1, updated_at = CURRENT_TIMESTAMP
+WHERE username = $2;
+
+-- name: CountUsers :one
+SELECT COUNT(*) FROM users;
+
+-- name: CountDisabledUsers :one
+SELECT COUNT(*) FROM users WHERE disabled = 1;
+
+-- name: CountUsersWithAPIKey :one
+SELECT COUNT(DISTINCT user_id) FROM api_keys;
+
+-- name: CreateAPIKey :one
+INSERT INTO api_keys (user_id, prefix, hash, label, scopes, expires_at)
+VALUES ($1, $2, $3, $4, $5, $6)
+RETURNING *;
+
+-- name: GetAPIKeyByHash :one
+SELECT sqlc.embed(api_keys), sqlc.embed(users)
+FROM api_keys
+JOIN users ON users.id = api_keys.user_id
+WHERE api_keys.hash = $1;
+
+-- name: TouchAPIKey :exec
+UPDATE api_keys
+SET last_used_at = $1
+WHERE id = $2;
+
+-- name: ListAPIKeys :many
+SELECT * FROM api_keys WHERE user_id = $1 ORDER BY id;
+
+-- name: RevokeAPIKey :execrows
+DELETE FROM api_keys
+WHERE id = $1 AND user_id = $2;
+
+-- name: RevokeAllAPIKeys :execrows
+DELETE FROM api_keys
+WHERE user_id = $1;
+
+-- name: CreateUserIdentity :exec
+INSERT INTO user_identities (user_id, issuer, subject)
+VALUES ($1, $2, $3);
+
+-- name: GetUserByIdentity :one
+SELECT users.* FROM users
+JOIN user_identities ON user_identities.user_id = users.id
+WHERE user_identities.issuer = $1 AND user_identities.subject = $2;
+
+-- name: RecordFailedLogin :one
+UPDATE users
+SET failed_logins = failed_logins + 1
+WHERE id = $1
+RETURNING failed_logins;
+
+-- name: LockUser :exec
+UPDATE users
+SET locked_until = $1
+WHERE id = $2;
+
+-- name: ResetFailedLogins :exec
+UPDATE users
+SET failed_logins = 0, locked_until = NULL
+WHERE id = $1;
+
+-- name: CreateAuthEvent :exec
+INSERT INTO auth_events (user_id, username, event, success, suspicious, ip, user_agent)
+VALUES ($1, $2, $3, $4, $5, $6, $7);
+
+-- name: ListAuthEvents :many
+SELECT * FROM auth_events
+WHERE user_id = $1
+ORDER BY id DESC
+LIMIT $2;
+
+-- name: CountSuccessfulLogins :one
+SELECT COUNT(*) FROM auth_events WHERE user_id = $1 AND success = 1;
+
+-- name: CountSuccessfulLoginsFromIP :one
+SELECT COUNT(*) FROM auth_events WHERE user_id = $1 AND success = 1 AND ip = $2;
+
+-- name: ListUserIdentities :many
+SELECT * FROM user_identities WHERE user_id = $1 ORDER BY id;
+
+-- name: GetUserByEmail :one
+SELECT * FROM users WHERE email = $1 LIMIT 1;
+
+-- name: SetUserEmail :execrows
+UPDATE users
+SET email = $1, updated_at = CURRENT_TIMESTAMP
+WHERE id = $2;
+
+-- name: CreatePasswordReset :exec
+INSERT INTO password_resets (user_id, hash, expires_at)
+VALUES ($1, $2, $3);
+
+-- name: UsePasswordReset :one
+DELETE FROM password_resets
+WHERE hash = $1 AND expires_at > $2
+RETURNING user_id;
+
+-- name: DeletePasswordResets :exec
+DELETE FROM password_resets
+WHERE user_id = $1;
@@ -0,0 +1,192 @@
+package pgdb
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/sushiag/go-webrtc-signaling-server/server/server/db"
+)
+
+// This adapts the Postgres queries to the db.Querier interface the server is written against,
+// sqlc generates slightly different types for Postgres so they are converted here
+type Store struct {
+	q *Queries
+}
+
+var _ db.Querier = (*Store)(nil)
+
+// This creates a store on top of the given Postgres connection
+func NewStore(conn DBTX) *Store {
+	return &Store{q: New(conn)}
+}
+
+func (s *Store) CountDisabledUsers(ctx context.Context) (int64, error) {
+	return s.q.CountDisabledUsers(ctx)
+}
+
+func (s *Store) CountSuccessfulLogins(ctx context.Context, userID sql.NullInt64) (int64, error) {
+	return s.q.CountSuccessfulLogins(ctx, userID)
+}
+
+func (s *Store) CountSuccessfulLoginsFromIP(ctx context.Context, arg db.CountSuccessfulLoginsFromIPParams) (int64, error) {
+	return s.q.CountSuccessfulLoginsFromIP(ctx, CountSuccessfulLoginsFromIPParams(arg))
+}
+
+func (s *Store) CountUsers(ctx context.Context) (int64, error) {
+	return s.q.CountUsers(ctx)
+}
+
+func (s *Store) CountUsersWithAPIKey(ctx context.Context) (int64, error) {
+	return s.q.CountUsersWithAPIKey(ctx)
+}
+
+func (s *Store) CreateAPIKey(ctx context.Context, arg db.CreateAPIKeyParams) (db.ApiKey, error) {
+	key, err := s.q.CreateAPIKey(ctx, CreateAPIKeyParams(arg))
+	return db.ApiKey(key), err
+}
+
+func (s *Store) CreateAuthEvent(ctx context.Context, arg db.CreateAuthEventParams) error {
+	return s.q.CreateAuthEvent(ctx, CreateAuthEventParams(arg))
+}
+
+func (s *Store) CreatePasswordReset(ctx context.Context, arg db.CreatePasswordResetParams) error {
+	return s.q.CreatePasswordReset(ctx, CreatePasswordResetParams(arg))
+}
+
+func (s *Store) CreateUser(ctx context.Context, arg db.CreateUserParams) (int64, error) {
+	return s.q.CreateUser(ctx, CreateUserParams(arg))
+}
+
+func (s *Store) CreateUserIdentity(ctx context.Context, arg db.CreateUserIdentityParams) error {
+	return s.q.CreateUserIdentity(ctx, CreateUserIdentityParams(arg))
+}
+
+func (s *Store) DeletePasswordResets(ctx context.Context, userID int64) error {
+	return s.q.DeletePasswordResets(ctx, userID)
+}
+
+func (s *Store) DeleteUser(ctx context.Context, id int64) error {
+	return s.q.DeleteUser(ctx, id)
+}
+
+func (s *Store) GetAPIKeyByHash(ctx context.Context, hash string) (db.GetAPIKeyByHashRow, error) {
+	row, err := s.q.GetAPIKeyByHash(ctx, hash)
+	return db.GetAPIKeyByHashRow{ApiKey: db.ApiKey(row.ApiKey), User: db.User(row.User)}, err
+}
+
+func (s *Store) GetUserByEmail(ctx context.Context, email sql.NullString) (db.User, error) {
+	user, err := s.q.GetUserByEmail(ctx, email)
+	return db.User(user), err
+}
+
+func (s *Store) GetUserByID(ctx context.Context, id int64) (db.User, error) {
+	user, err := s.q.GetUserByID(ctx, id)
+	return db.User(user), err
+}
+
+func (s *Store) GetUserByIdentity(ctx context.Context, arg db.GetUserByIdentityParams) (db.User, error) {
+	user, err := s.q.GetUserByIdentity(ctx, GetUserByIdentityParams(arg))
+	return db.User(user), err
+}
+
+func (s *Store) GetUserByUsername(ctx context.Context, username string) (db.User, error) {
+	user, err := s.q.GetUserByUsername(ctx, username)
+	return db.User(user), err
+}
+
+func (s *Store) ListAPIKeys(ctx context.Context, userID int64) ([]db.ApiKey, error) {
+	keys, err := s.q.ListAPIKeys(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]db.ApiKey, 0, len(keys))
+	for _, key := range keys {
+		items = append(items, db.ApiKey(key))
+	}
+	return items, nil
+}
+
+func (s *Store) ListAuthEvents(ctx context.Context, arg db.ListAuthEventsParams) ([]db.AuthEvent, error) {
+	events, err := s.q.ListAuthEvents(ctx, ListAuthEventsParams{UserID: arg.UserID, Limit: int32(arg.Limit)})
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]db.AuthEvent, 0, len(events))
+	for _, event := range events {
+		items = append(items, db.AuthEvent(event))
+	}
+	return items, nil
+}
+
+func (s *Store) ListUserIdentities(ctx context.Context, userID int64) ([]db.UserIdentity, error) {
+	identities, err := s.q.ListUserIdentities(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]db.UserIdentity, 0, len(identities))
+	for _, identity := range identities {
+		items = append(items, db.UserIdentity(identity))
+	}
+	return items, nil
+}
+
+func (s *Store) ListUsers(ctx context.Context) ([]db.User, error) {
+	users, err := s.q.ListUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]db.User, 0, len(users))
+	for _, user := range users {
+		items = append(items, db.User(user))
+	}
+	return items, nil
+}
+
+func (s *Store) LockUser(ctx context.Context, arg db.LockUserParams) error {
+	return s.q.LockUser(ctx, LockUserParams(arg))
+}
+
+func (s *Store) Ping(ctx context.Context) (int64, error) {
+	result, err := s.q.Ping(ctx)
+	return int64(result), err
+}
+
+func (s *Store) RecordFailedLogin(ctx context.Context, id int64) (int64, error) {
+	return s.q.RecordFailedLogin(ctx, id)
+}
+
+func (s *Store) ResetFailedLogins(ctx context.Context, id int64) error {
+	return s.q.ResetFailedLogins(ctx, id)
+}
+
+func (s *Store) RevokeAPIKey(ctx context.Context, arg db.RevokeAPIKeyParams) (int64, error) {
+	return s.q.RevokeAPIKey(ctx, RevokeAPIKeyParams(arg))
+}
+
+func (s *Store) RevokeAllAPIKeys(ctx context.Context, userID int64) (int64, error) {
+	return s.q.RevokeAllAPIKeys(ctx, userID)
+}
+
+func (s *Store) SetUserDisabled(ctx context.Context, arg db.SetUserDisabledParams) (int64, error) {
+	return s.q.SetUserDisabled(ctx, SetUserDisabledParams(arg))
+}
+
+func (s *Store) SetUserEmail(ctx context.Context, arg db.SetUserEmailParams) (int64, error) {
+	return s.q.SetUserEmail(ctx, SetUserEmailParams(arg))
+}
+
+func (s *Store) TouchAPIKey(ctx context.Context, arg db.TouchAPIKeyParams) error {
+	return s.q.TouchAPIKey(ctx, TouchAPIKeyParams(arg))
+}
+
+func (s *Store) UpdateUserPassword(ctx context.Context, arg db.UpdateUserPasswordParams) error {
+	return s.q.UpdateUserPassword(ctx, UpdateUserPasswordParams(arg))
+}
+
+func (s *Store) UsePasswordReset(ctx context.Context, arg db.UsePasswordResetParams) (int64, error) {
+	return s.q.UsePasswordReset(ctx, UsePasswordResetParams(arg))
+}
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	smsg "signaling-msgs"
+)
+
+// This is a token bucket limit, Rate tokens are added every second up to Burst tokens
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// This configures how fast clients may send signaling messages and hit the HTTP endpoints
+type RateLimits struct {
+	// Per connection (user) limits for each message type, types without an entry use DefaultMessage
+	Messages       map[smsg.MessageType]RateLimit
+	DefaultMessage RateLimit
+
+	// Per remote IP limits for the password based endpoints (/register, /regenerate, /newpassword),
+	// the other endpoints that check credentials and the admin API
+	Auth RateLimit
+	// Per remote IP limit for websocket upgrades on /ws
+	Upgrade RateLimit
+
+	// How many rate limited messages a connection may send per minute before it gets disconnected
+	MaxViolationsPerMinute int
+}
+
+// This returns the limits used when none are configured
+func DefaultRateLimits() RateLimits {
+	return RateLimits{
+		Messages: map[smsg.MessageType]RateLimit{
+			smsg.CreateRoom:   {Rate: 1, Burst: 5},
+			smsg.JoinRoom:     {Rate: 2, Burst: 10},
+			smsg.SDP:          {Rate: 5, Burst: 20},
+			smsg.ICECandidate: {Rate: 50, Burst: 100},
+		},
+		DefaultMessage:         RateLimit{Rate: 10, Burst: 20},
+		Auth:                   RateLimit{Rate: 0.5, Burst: 20},
+		Upgrade:                RateLimit{Rate: 2, Burst: 10},
+		MaxViolationsPerMinute: 10,
+	}
+}
+
+// This is a classic token bucket, it isn't safe for concurrent use so every bucket needs a single owner
+type tokenBucket struct {
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(limit RateLimit, now time.Time) *tokenBucket {
+	return &tokenBucket{limit: limit, tokens: float64(limit.Burst), last: now}
+}
+
+// This takes a token if there is one, otherwise it returns how long until the next token is available
+func (b *tokenBucket) take(now time.Time) (bool, time.Duration) {
+	elapsed := now.Sub(b.last).Seconds()
+	if elapsed > 0 {
+		b.tokens = math.Min(float64(b.limit.Burst), b.tokens+elapsed*b.limit.Rate)
+		b.last = now
+	}
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	if b.limit.Rate <= 0 {
+		return false, time.Minute
+	}
+	wait := time.Duration((1 - b.tokens) / b.limit.Rate * float64(time.Second))
+	return false, wait
+}
+
+// This tells whether the bucket is back to full and can be forgotten
+func (b *tokenBucket) isFull(now time.Time) bool {
+	elapsed := now.Sub(b.last).Seconds()
+	return b.tokens+elapsed*b.limit.Rate >= float64(b.limit.Burst)
+}
+
+// This limits the messages of a single connection, it is owned by the connection's read loop
+type messageLimiter struct {
+	limits     RateLimits
+	buckets    map[smsg.MessageType]*tokenBucket
+	violations *tokenBucket
+}
+
+func newMessageLimiter(limits RateLimits) *messageLimiter {
+	maxViolations := limits.MaxViolationsPerMinute
+	if maxViolations <= 0 {
+		maxViolations = 1
+	}
+
+	return &messageLimiter{
+		limits:     limits,
+		buckets:    make(map[smsg.MessageType]*tokenBucket),
+		violations: newTokenBucket(RateLimit{Rate: float64(maxViolations) / 60, Burst: maxViolations}, time.Now()),
+	}
+}
+
+// This checks if a message of the given type may be handled. When it may not, shouldDisconnect
+// tells whether the connection went over its allowed number of violations.
+func (l *messageLimiter) allow(msgType smsg.MessageType, now time.Time) (allowed bool, shouldDisconnect bool) {
+	bucket, exists := l.buckets[msgType]
+	if !exists {
+		limit, configured := l.limits.Messages[msgType]
+		if !configured {
+			limit = l.limits.DefaultMessage
+		}
+		bucket = newTokenBucket(limit, now)
+		l.buckets[msgType] = bucket
+	}
+
+	if ok, _ := bucket.take(now); ok {
+		return true, false
+	}
+
+	underLimit, _ := l.violations.take(now)
+	return false, !underLimit
+}
+
+// This is a request to the ipLimiter's loop
+type ipLimitRequest struct {
+	key    string
+	limit  RateLimit
+	respCh chan time.Duration
+}
+
+// This keeps a token bucket per remote IP, the buckets are owned by the limiter's own goroutine
+type ipLimiter struct {
+	requests chan ipLimitRequest
+}
+
+func newIPLimiter() *ipLimiter {
+	l := &ipLimiter{requests: make(chan ipLimitRequest)}
+	go l.run()
+	return l
+}
+
+func (l *ipLimiter) run() {
+	buckets := make(map[string]*tokenBucket)
+	cleanup := time.NewTicker(time.Minute)
+	defer cleanup.Stop()
+
+	for {
+		select {
+		case req := <-l.requests:
+			now := time.Now()
+			bucket, exists := buckets[req.key]
+			if !exists {
+				bucket = newTokenBucket(req.limit, now)
+				buckets[req.key] = bucket
+			}
+
+			_, retryAfter := bucket.take(now)
+			req.respCh <- retryAfter
+
+		// full buckets behave the same as new ones so there is no need to keep them around
+		case now := <-cleanup.C:
+			for key, bucket := range buckets {
+				if bucket.isFull(now) {
+					delete(buckets, key)
+				}
+			}
+		}
+	}
+}
+
+// This takes a token from the bucket of the given scope and IP, a zero duration means the request is allowed
+func (l *ipLimiter) take(scope string, ip string, limit RateLimit) time.Duration {
+	respCh := make(chan time.Duration, 1)
+	l.requests <- ipLimitRequest{key: scope + "|" + ip, limit: limit, respCh: respCh}
+	return <-respCh
+}
+
+// This wraps a handler so each remote IP can only call it as often as the given limit allows
+func (l *ipLimiter) middleware(scope string, limit RateLimit, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip := remoteIP(r)
+		if retryAfter := l.take(scope, ip, limit); retryAfter > 0 {
+			requestLogger(r).Warn("rate limited request", "scope", scope, "ip", ip)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// This returns the IP part of the request's remote address
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
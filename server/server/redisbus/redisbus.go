@@ -0,0 +1,127 @@
+// Package redisbus implements the signaling server's Bus on top of Redis pub/sub so several
+// server nodes can route messages to each other.
+package redisbus
+
+import (
+	"context"
+	"errors"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var errClosed = errors.New("redis bus is closed")
+
+// This is a Bus backed by Redis pub/sub, every node uses a single subscriber connection
+type Bus struct {
+	client   *redis.Client
+	pubsub   *redis.PubSub
+	requests chan func(*state)
+	closed   chan struct{}
+}
+
+// The handlers of every topic, they are owned by the bus' run loop
+type state struct {
+	subs   map[string]map[uint64]func([]byte)
+	nextID uint64
+}
+
+// This creates a bus on the given client, the client stays owned by the caller
+func New(client *redis.Client) *Bus {
+	b := &Bus{
+		client:   client,
+		pubsub:   client.Subscribe(context.Background()),
+		requests: make(chan func(*state)),
+		closed:   make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+// This delivers the messages from Redis to the handlers and serves subscribe requests, running
+// both in the same loop keeps every topic's messages in order
+func (b *Bus) run() {
+	st := &state{subs: make(map[string]map[uint64]func([]byte))}
+	msgs := b.pubsub.Channel()
+
+	for {
+		select {
+		case req := <-b.requests:
+			req(st)
+		case msg, ok := <-msgs:
+			if !ok {
+				return
+			}
+			for _, handler := range st.subs[msg.Channel] {
+				handler([]byte(msg.Payload))
+			}
+		case <-b.closed:
+			return
+		}
+	}
+}
+
+func (b *Bus) do(ctx context.Context, req func(*state)) error {
+	select {
+	case b.requests <- req:
+		return nil
+	case <-b.closed:
+		return errClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (b *Bus) Publish(ctx context.Context, topic string, msg []byte) error {
+	return b.client.Publish(ctx, topic, msg).Err()
+}
+
+func (b *Bus) Subscribe(ctx context.Context, topic string, handler func(msg []byte)) (func(), error) {
+	type result struct {
+		id  uint64
+		err error
+	}
+	resCh := make(chan result, 1)
+
+	err := b.do(ctx, func(st *state) {
+		handlers, exists := st.subs[topic]
+		if !exists {
+			// only the first handler of a topic needs a Redis subscription
+			if err := b.pubsub.Subscribe(ctx, topic); err != nil {
+				resCh <- result{err: err}
+				return
+			}
+			handlers = make(map[uint64]func([]byte))
+			st.subs[topic] = handlers
+		}
+
+		id := st.nextID
+		st.nextID++
+		handlers[id] = handler
+		resCh <- result{id: id}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res := <-resCh
+	if res.err != nil {
+		return nil, res.err
+	}
+
+	unsubscribe := func() {
+		_ = b.do(context.Background(), func(st *state) {
+			delete(st.subs[topic], res.id)
+			if len(st.subs[topic]) == 0 {
+				delete(st.subs, topic)
+				_ = b.pubsub.Unsubscribe(context.Background(), topic)
+			}
+		})
+	}
+	return unsubscribe, nil
+}
+
+// This closes the subscriber connection, it must only be called once
+func (b *Bus) Close() error {
+	close(b.closed)
+	return b.pubsub.Close()
+}
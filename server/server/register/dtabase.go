@@ -1,34 +1,31 @@
 package sqlitedb
 
 import (
+	"context"
 	"database/sql"
-	"fmt"
-	"io/ioutil"
 	"log"
 
 	"github.com/sushiag/go-webrtc-signaling-server/server/server/db"
+	"github.com/sushiag/go-webrtc-signaling-server/server/server/storage"
 )
 
-// This opens the SQLite database connection the the given filename
+// This opens the SQLite database connection the the given filename, migrating it to the latest schema
 func NewDatabase(filename string) (*db.Queries, *sql.DB) {
-	dsn := fmt.Sprintf("file:%s?cache=shared", filename)
-	conn, err := sql.Open("sqlite3", dsn)
-	if err != nil {
-		log.Fatalf("[SERVER] Failed to open DB: %v", err)
+	queries, conn, err := storage.OpenSQLite(filename)
+	if err == nil {
+		err = migrateSQLite(conn, filename)
 	}
-
-	if err := applySchema(conn, "../server/server/db/schema.sql"); err != nil {
-		log.Fatalf("[SERVER] Failed to apply schema: %v", err)
+	if err != nil {
+		log.Fatalf("[SERVER] %v", err)
 	}
-	return db.New(conn), conn
+	return queries, conn
 }
 
-// This reads the schema SQL file
-func applySchema(conn *sql.DB, path string) error {
-	schemaSQL, err := ioutil.ReadFile(path)
+func migrateSQLite(conn *sql.DB, filename string) error {
+	migrator, err := storage.Migrator(conn, filename)
 	if err != nil {
 		return err
 	}
-	_, err = conn.Exec(string(schemaSQL))
+	_, err = migrator.Up(context.Background())
 	return err
 }
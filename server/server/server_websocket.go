@@ -1,6 +1,13 @@
 package server
 
 import (
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"runtime"
+	"sync/atomic"
+	"time"
+
 	smsg "signaling-msgs"
 
 	"github.com/gorilla/websocket"
@@ -15,76 +22,122 @@ type Room struct {
 	HostID    uint64
 }
 
-// this handles connection and room management
-//
-// TODO: we should refactor our data structure for the connections+rooms.
-//
-// Connections should be map[uint64]*Connection where Connection has the following:
-//
-//	type Connection struct {
-//		clientID		uint64
-//		roomID			room
-//		isInRoom		bool
-//		isRoomOwner	bool
-//		... etc.
-//	}
-//
-// then the Rooms should be map[roomID]*Room where Room is:
-//
-//	type Room struct {
-//		clients	[]uint64
-//		owner		uint64
-//		... etc.
-//	}
-//
-// The change in the connection struct will make it easier to query if two users are in
-// the same room without iterating through the room clients struct
+// This handles connection and room management. The state is split into shards that each run in
+// their own goroutine, connections live in the shard of their user ID and rooms in the shard of
+// their room ID. Every shard also keeps an index of the rooms its users are in so disconnecting a
+// user doesn't have to look through every room.
 type WebSocketManager struct {
-	//validApiKeys    map[string]bool
-	//apiKeyToUserID  map[string]uint64
-	//candidateBuffer map[uint64][]Message
-	Connections    map[uint64]*Connection
-	Rooms          map[uint64]*Room
-	nextUserID     uint64
-	nextRoomID     uint64
-	messageChan    chan *smsg.MessageRawJSONPayload
-	disconnectChan chan uint64
-	newConnChan    chan *Connection
+	shards       []*shard
+	statusChan   chan chan managerStatus
+	shutdownChan chan struct{}
+	shuttingDown bool
+	rateLimits   *RateLimits
+	sendQueue    sendQueueConfig
+	// how many client messages can wait for a single shard
+	shardQueueSize int
+	bus            Bus
+	// bus operations are handed off to busMailbox and run by busRun
+	busInbox   chan busOp
+	busOps     chan busOp
+	nodeID     uint64
+	iceServers *iceServerIssuer
+	payloads   PayloadPolicy
+	logger     *slog.Logger
+}
+
+// This is a snapshot of the manager's state taken from inside the run loop
+type managerStatus struct {
+	Connections  int
+	Rooms        int
+	ShuttingDown bool
 }
 
 // This handles connection that starts its own goroutine
 type Connection struct {
-	UserID       uint64
-	Conn         *websocket.Conn
-	Outgoing     chan smsg.MessageAnyPayload
-	Disconnected chan<- uint64
+	ID          string
+	UserID      uint64
+	Conn        *websocket.Conn
+	RemoteAddr  string
+	ConnectedAt time.Time
+	Outgoing    chan smsg.MessageAnyPayload
+	toWrite     chan smsg.MessageAnyPayload
+	done        chan struct{}
+	onMessage   func(*smsg.MessageRawJSONPayload)
+	onClose     func()
+	limiter     *messageLimiter
+	// The only rooms the connection may join, set when it authenticated with a room scoped access
+	// token. Such connections can't create rooms either.
+	allowedRooms []uint64
+	// remote connections stand in for connections on other nodes
+	remote bool
+	// How messages are encoded, picked by the subprotocol the client offered
+	codec smsg.Codec
+	// The protocol version the client said it speaks in its Hello, zero until then. Clients
+	// speaking version 1 get message types as numbers.
+	protocolVersion atomic.Int32
+	logger          *slog.Logger
 }
 
-// This initializes a new manager
-func NewWebSocketManager() *WebSocketManager {
+// This initializes a new manager, a nil logger falls back to slog.Default(), the signaling messages
+// are only rate limited if opts.RateLimits is set and opts.Shards defaults to GOMAXPROCS
+func NewWebSocketManager(opts Options) *WebSocketManager {
+	logger := opts.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	rateLimits := opts.RateLimits
+	if opts.DisableRateLimits {
+		rateLimits = nil
+	}
+
+	shardCount := opts.Shards
+	if shardCount <= 0 {
+		shardCount = runtime.GOMAXPROCS(0)
+	}
+	shardQueueSize := opts.ShardQueueSize
+	if shardQueueSize <= 0 {
+		shardQueueSize = defaultShardQueueSize
+	}
+
 	wsm := &WebSocketManager{
-		Connections:    make(map[uint64]*Connection),
-		Rooms:          make(map[uint64]*Room),
-		nextUserID:     1,
-		nextRoomID:     1,
-		messageChan:    make(chan *smsg.MessageRawJSONPayload),
-		disconnectChan: make(chan uint64),
-		newConnChan:    make(chan *Connection),
+		statusChan:     make(chan chan managerStatus),
+		shutdownChan:   make(chan struct{}),
+		rateLimits:     rateLimits,
+		sendQueue:      newSendQueueConfig(opts),
+		shardQueueSize: shardQueueSize,
+		bus:            opts.Bus,
+		nodeID:         uint64(opts.NodeID),
+		iceServers:     newICEServerIssuer(opts.ICE),
+		payloads:       newPayloadPolicy(opts.Payloads),
+		logger:         logger,
 	}
+	if wsm.bus != nil {
+		if wsm.nodeID == 0 {
+			wsm.nodeID = uint64(rand.N(math.MaxUint16)) + 1
+			logger.Info("no node ID configured, picked a random one", "node_id", wsm.nodeID)
+		}
+		wsm.busInbox = make(chan busOp)
+		wsm.busOps = make(chan busOp)
+		go wsm.busMailbox()
+		go wsm.busRun()
+	}
+	for i := range shardCount {
+		wsm.shards = append(wsm.shards, newShard(uint64(i), uint64(shardCount), wsm))
+	}
+
 	go wsm.run()
 	return wsm
 }
 
-// This handles the channels for the client connections
+// This owns the manager wide state that doesn't belong to any shard
 func (wsm *WebSocketManager) run() {
 	for {
 		select {
-		case msg := <-wsm.messageChan:
-			wsm.handleMessage(msg)
-		case newConn := <-wsm.newConnChan:
-			wsm.handleNewConnection(newConn)
-		case userID := <-wsm.disconnectChan:
-			wsm.disconnectUser(userID)
+		case respCh := <-wsm.statusChan:
+			respCh <- managerStatus{ShuttingDown: wsm.shuttingDown}
+		case <-wsm.shutdownChan:
+			wsm.shuttingDown = true
 		}
 	}
 }
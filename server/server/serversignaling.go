@@ -2,87 +2,274 @@ package server
 
 import (
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/gorilla/websocket"
 
 	smsg "signaling-msgs"
 )
 
-// This handles the messages from the signaling client
-func (wsm *WebSocketManager) handleMessage(msg *smsg.MessageRawJSONPayload) {
+// This handles the messages from the signaling client. It runs in the sender's read loop and only
+// routes the message to the shard that owns what the message is about.
+func (wsm *WebSocketManager) handleMessage(conn *Connection, msg *smsg.MessageRawJSONPayload) {
 
 	// TODO:
 	// - implement a 'close-room' message that the room owner can use
 	switch msg.MsgType {
+	case smsg.Hello:
+		wsm.handleHello(conn, msg)
+
 	case smsg.CreateRoom:
 		{
-			log.Printf("[WS] User %d requested to create a room", msg.From)
-			roomID := wsm.createRoom(msg.From)
-			resp := smsg.MessageAnyPayload{
-				MsgType: smsg.RoomCreated,
-				Payload: smsg.RoomCreatedPayload{RoomID: roomID},
+			if conn.allowedRooms != nil {
+				wsm.logger.Info("room scoped user tried to create a room", "user_id", msg.From)
+				_ = conn.send(errorReply(msg, smsg.CodeForbidden, "access token doesn't allow creating rooms"))
+				break
 			}
 
-			if conn, ok := wsm.Connections[msg.From]; ok {
-				_ = wsm.SafeWriteJSON(conn, resp)
-			}
+			wsm.logger.Info("user requested to create a room", "user_id", msg.From)
+			wsm.shardFor(msg.From).postFromClient(func(s *shard) {
+				roomID, ok := s.createRoom(conn)
+				if !ok {
+					_ = wsm.SafeWriteJSON(conn, errorReply(msg, smsg.CodeInternal, "failed to create the room"))
+					return
+				}
+
+				iceServers, _ := wsm.iceServers.issue(conn.UserID)
+				_ = wsm.SafeWriteJSON(conn, smsg.MessageAnyPayload{
+					MsgType:   smsg.RoomCreated,
+					RequestID: msg.RequestID,
+					Payload:   smsg.RoomCreatedPayload{RoomID: roomID, ICEServers: iceServers},
+				})
+			})
 		}
 
 	case smsg.JoinRoom:
 		{
 			var payload smsg.JoinRoomPayload
 			if err := json.Unmarshal(msg.Payload, &payload); err != nil {
-				log.Printf("[ERROR] failed to unmarshal join room payload from: %d", msg.From)
+				wsm.logger.Warn("failed to unmarshal join room payload", "user_id", msg.From, "err", err)
+				_ = conn.send(errorReply(msg, smsg.CodeInvalidPayload, "invalid join room payload"))
+				break
+			}
+			if conn.allowedRooms != nil && !slices.Contains(conn.allowedRooms, payload.RoomID) {
+				wsm.logger.Info("room scoped user tried to join another room", "user_id", msg.From, "room_id", payload.RoomID)
+				_ = conn.send(errorReply(msg, smsg.CodeForbidden, "access token doesn't allow joining this room"))
 				break
 			}
 
-			log.Printf("[User %d] requested to join room: %d", msg.From, payload.RoomID)
-			wsm.addUserToRoom(payload.RoomID, msg.From)
+			wsm.logger.Info("user requested to join room", "user_id", msg.From, "room_id", payload.RoomID)
+			wsm.shardFor(payload.RoomID).postFromClient(func(s *shard) {
+				s.joinRoom(payload.RoomID, conn, msg.RequestID)
+			})
 		}
 
 	case smsg.SDP, smsg.ICECandidate:
 		{
-			conn, exists := wsm.Connections[msg.To]
-			if !exists {
-				log.Printf("[WARN] client %d tried to send a %s message to an unknown client: %d", msg.From, msg.MsgType.AsString(), msg.To)
-				return
+			payload, forward, err := wsm.payloads.sanitize(msg)
+			if err != nil {
+				wsm.logger.Info("rejected payload", "type", msg.MsgType.AsString(), "user_id", msg.From, "err", err)
+				var reply *smsg.ErrorPayload
+				if !errors.As(err, &reply) {
+					reply = &smsg.ErrorPayload{Code: smsg.CodeInternal, Message: "failed to encode the payload"}
+				}
+				_ = conn.send(errorReply(msg, reply.Code, reply.Message))
+				break
 			}
+			if !forward {
+				wsm.logger.Debug("dropped message by policy", "type", msg.MsgType.AsString(), "user_id", msg.From)
+				wsm.ack(conn, msg)
+				break
+			}
+			msg.Payload = payload
 
-			// TODO(rmarinn): i removed the check if the users are in the same room... need to re-implement it
-
-			log.Printf("[WS] Forwarding %s from %d to %d", msg.MsgType.AsString(), msg.From, msg.To)
-			// kinda wasteful casting but i haven't figured out a way to deserialize only the
-			// 'MsgType' field... gotta have to deal with the limitation of using JSON messages
-			wsm.SafeWriteJSON(conn, smsg.MessageAnyPayload{
-				MsgType: msg.MsgType,
-				From:    msg.From,
-				To:      msg.To,
-				Payload: msg.Payload,
+			wsm.shardFor(msg.To).postFromClient(func(s *shard) {
+				s.forward(conn, msg)
 			})
 		}
 
 	case smsg.LeaveRoom:
 		{
-			log.Printf("[WS] Disconnect request from user %d", msg.From)
-			wsm.disconnectChan <- msg.From
+			wsm.logger.Info("disconnect request from user", "user_id", msg.From)
+			// the ack goes out before the connection is closed
+			wsm.ack(conn, msg)
+			wsm.shardFor(msg.From).postFromClient(func(s *shard) {
+				s.removeConnection(conn)
+			})
 			// TODO: assign a new room owner if the one leaving the current owner
 		}
 
 	}
 }
 
-// This handles the connected users from the signaling client
-func (wsm *WebSocketManager) handleNewConnection(conn *Connection) {
-	log.Printf("[WS] User %d connected", conn.UserID)
-	conn.Disconnected = wsm.disconnectChan
+// This agrees on the protocol version with the client, clients speaking a version the server
+// doesn't are disconnected with the reason in the close message
+func (wsm *WebSocketManager) handleHello(conn *Connection, msg *smsg.MessageRawJSONPayload) {
+	var payload smsg.HelloPayload
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		wsm.logger.Warn("failed to unmarshal hello payload", "user_id", msg.From, "err", err)
+		_ = conn.send(errorReply(msg, smsg.CodeInvalidPayload, "invalid hello payload"))
+		return
+	}
+	if conn.protocolVersion.Load() != 0 {
+		_ = conn.send(errorReply(msg, smsg.CodeInvalidPayload, "the protocol version was already agreed on"))
+		return
+	}
+
+	if payload.ProtocolVersion < smsg.MinProtocolVersion || payload.ProtocolVersion > smsg.ProtocolVersion {
+		reason := fmt.Sprintf("unsupported protocol version %d, the server speaks %d to %d", payload.ProtocolVersion, smsg.MinProtocolVersion, smsg.ProtocolVersion)
+		conn.logger.Info("rejecting client", "reason", reason)
+		conn.kick(websocket.CloseProtocolError, reason)
+		return
+	}
+	conn.protocolVersion.Store(int32(payload.ProtocolVersion))
+
+	supported := []string{smsg.FeatureRequestIDs, smsg.FeatureAcks}
+	if wsm.iceServers != nil {
+		supported = append(supported, smsg.FeatureICEServers)
+	}
+	features := []string{}
+	for _, feature := range payload.Features {
+		if slices.Contains(supported, feature) {
+			features = append(features, feature)
+		}
+	}
+
+	conn.logger.Debug("agreed on protocol", "protocol_version", payload.ProtocolVersion, "features", features)
+	_ = conn.send(smsg.MessageAnyPayload{
+		MsgType:   smsg.Welcome,
+		RequestID: msg.RequestID,
+		Payload: smsg.WelcomePayload{
+			ProtocolVersion: payload.ProtocolVersion,
+			Features:        features,
+			ClientID:        conn.UserID,
+		},
+	})
+}
+
+// This forwards an SDP or ICE candidate message to its recipient, it runs in the recipient's shard
+// and hands the message to the bus when the recipient isn't connected to this node. The sender is
+// acked once the message reached the recipient, which for recipients on other nodes is when their
+// node confirms it, and gets CodePeerNotFound when the recipient isn't connected anywhere.
+func (s *shard) forward(sender *Connection, msg *smsg.MessageRawJSONPayload) {
+	conn, exists := s.connections[msg.To]
+	if !exists && s.wsm.bus != nil {
+		// the recipient might be connected to another node
+		envelope := busEnvelope{Kind: busDeliver, UserID: msg.To}
+		if msg.RequestID != 0 {
+			envelope.RequestID, envelope.SenderConnID = msg.RequestID, sender.ID
+			// the sender's shard is told before publishing so it can't miss the confirmation
+			s.wsm.shardFor(sender.UserID).post(func(ss *shard) {
+				ss.awaitDelivery(sender, msg)
+			})
+		}
+		s.wsm.publishEnvelope(userTopic(msg.To), envelope, &smsg.MessageAnyPayload{
+			MsgType: msg.MsgType,
+			From:    msg.From,
+			To:      msg.To,
+			Payload: msg.Payload,
+		})
+		return
+	}
+	if !exists {
+		s.logger.Warn("client tried to send a message to an unknown client", "type", msg.MsgType.AsString(), "from", msg.From, "to", msg.To)
+		_ = s.wsm.SafeWriteJSON(sender, errorReply(msg, smsg.CodePeerNotFound, "the recipient isn't connected"))
+		return
+	}
+
+	// TODO(rmarinn): i removed the check if the users are in the same room... need to re-implement it
+
+	s.logger.Debug("forwarding message", "type", msg.MsgType.AsString(), "from", msg.From, "to", msg.To)
+	// kinda wasteful casting but i haven't figured out a way to deserialize only the
+	// 'MsgType' field... gotta have to deal with the limitation of using JSON messages
+	s.wsm.SafeWriteJSON(conn, smsg.MessageAnyPayload{
+		MsgType: msg.MsgType,
+		From:    msg.From,
+		To:      msg.To,
+		Payload: msg.Payload,
+	})
+	s.wsm.ack(sender, msg)
+}
+
+// This waits for the node of a remote recipient to confirm the sender's message, it runs in the
+// sender's shard. Without a confirmation in time the sender is told the recipient isn't connected.
+func (s *shard) awaitDelivery(sender *Connection, msg *smsg.MessageRawJSONPayload) {
+	key := deliveryKey{connID: sender.ID, requestID: msg.RequestID}
+	if pending, exists := s.pendingDeliveries[key]; exists {
+		// the request ID was reused before the first one was settled
+		pending.timer.Stop()
+	}
+	timer := time.AfterFunc(remoteDeliveryTimeout, func() {
+		s.post(func(s *shard) {
+			pending, exists := s.pendingDeliveries[key]
+			if !exists || pending.msg != msg {
+				return
+			}
+			delete(s.pendingDeliveries, key)
+			_ = s.wsm.SafeWriteJSON(sender, errorReply(msg, smsg.CodePeerNotFound, "the recipient isn't connected"))
+		})
+	})
+	s.pendingDeliveries[key] = pendingDelivery{sender: sender, msg: msg, timer: timer}
+}
 
+// This acks a message whose delivery the recipient's node confirmed
+func (s *shard) confirmDelivery(connID string, requestID uint64) {
+	key := deliveryKey{connID: connID, requestID: requestID}
+	pending, exists := s.pendingDeliveries[key]
+	if !exists {
+		return
+	}
+	pending.timer.Stop()
+	delete(s.pendingDeliveries, key)
+	s.wsm.ack(pending.sender, pending.msg)
+}
+
+// This is the reply to a request that failed, it has the type the client waits for and echoes the
+// request's ID
+func errorReply(req *smsg.MessageRawJSONPayload, code smsg.ErrorCode, message string) smsg.MessageAnyPayload {
+	return smsg.MessageAnyPayload{
+		MsgType:   responseTypeFor(req.MsgType),
+		RequestID: req.RequestID,
+		Error:     &smsg.ErrorPayload{Code: code, Message: message},
+	}
+}
+
+// This acknowledges a request that has no reply of its own, requests without an ID aren't
+// acknowledged
+func (wsm *WebSocketManager) ack(conn *Connection, req *smsg.MessageRawJSONPayload) {
+	if req.RequestID == 0 {
+		return
+	}
+	_ = wsm.SafeWriteJSON(conn, smsg.MessageAnyPayload{MsgType: smsg.Ack, RequestID: req.RequestID})
+}
+
+// This handles the connected users from the signaling client, the connection's loops are only
+// started once it's registered so its first message can't get ahead of it
+func (wsm *WebSocketManager) handleNewConnection(conn *Connection) {
 	conn.Conn.SetPongHandler(func(string) error {
 		return nil
 	})
 
-	go conn.readLoop(wsm.messageChan)
-	go conn.writeLoop()
-	log.Printf("[WS] WS read and write loop for user %d started", conn.UserID)
+	if wsm.rateLimits != nil {
+		conn.limiter = newMessageLimiter(*wsm.rateLimits)
+	}
 
-	wsm.Connections[conn.UserID] = conn
+	userShard := wsm.shardFor(conn.UserID)
+	conn.onMessage = func(msg *smsg.MessageRawJSONPayload) {
+		wsm.handleMessage(conn, msg)
+	}
+	conn.onClose = func() {
+		userShard.post(func(s *shard) {
+			s.removeConnection(conn)
+		})
+	}
 
+	userShard.post(func(s *shard) {
+		s.addConnection(conn)
+		conn.start(wsm.sendQueue)
+		conn.logger.Info("user connected")
+	})
 }
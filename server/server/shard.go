@@ -0,0 +1,160 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	smsg "signaling-msgs"
+)
+
+const defaultShardQueueSize = 1024
+
+// This owns a part of the manager's state, connections are sharded by user ID and rooms by room ID.
+// A shard's state is only ever touched from its own goroutine, everything else (other shards, the
+// read loops, the admin API) posts operations to its mailbox.
+type shard struct {
+	index       uint64
+	wsm         *WebSocketManager
+	connections map[uint64]*Connection
+	rooms       map[uint64]*Room
+	// the rooms every user of this shard is in, the rooms themselves can live in any shard
+	userRooms  map[uint64]map[uint64]struct{}
+	nextRoomID uint64
+	// bus subscriptions of the users and rooms of this shard
+	userSubs map[uint64]func()
+	roomSubs map[uint64]func()
+	// messages of this shard's users that wait for another node to confirm their delivery
+	pendingDeliveries map[deliveryKey]pendingDelivery
+	inbox             chan func(*shard)
+	ops               chan func(*shard)
+	// holds a slot for every client message waiting for the shard, see postFromClient
+	admitted chan struct{}
+	logger   *slog.Logger
+}
+
+// This identifies a message by the connection that sent it and its request ID
+type deliveryKey struct {
+	connID    string
+	requestID uint64
+}
+
+type pendingDelivery struct {
+	sender *Connection
+	msg    *smsg.MessageRawJSONPayload
+	timer  *time.Timer
+}
+
+func newShard(index uint64, count uint64, wsm *WebSocketManager) *shard {
+	s := &shard{
+		index:             index,
+		wsm:               wsm,
+		connections:       make(map[uint64]*Connection),
+		rooms:             make(map[uint64]*Room),
+		userRooms:         make(map[uint64]map[uint64]struct{}),
+		userSubs:          make(map[uint64]func()),
+		roomSubs:          make(map[uint64]func()),
+		pendingDeliveries: make(map[deliveryKey]pendingDelivery),
+		inbox:             make(chan func(*shard)),
+		ops:               make(chan func(*shard)),
+		admitted:          make(chan struct{}, wsm.shardQueueSize),
+		logger:            wsm.logger.With("shard", index),
+	}
+	// room IDs are handed out so that every room lands in the shard that created it, the node ID
+	// in the upper bits keeps them unique across nodes
+	base := wsm.nodeID << 32
+	s.nextRoomID = base + (index+count-base%count)%count
+	if s.nextRoomID == 0 {
+		s.nextRoomID = count
+	}
+
+	go s.mailbox()
+	go s.run()
+	return s
+}
+
+// This buffers the operations posted to the shard. The mailbox is unbounded so posting never
+// waits on the shard itself, which is what lets shards post to each other without deadlocking.
+// Client messages are bounded before they get here by postFromClient.
+func (s *shard) mailbox() {
+	var queue []func(*shard)
+
+	for {
+		// only offer an operation to the run loop when there is one
+		var ops chan<- func(*shard)
+		var next func(*shard)
+		if len(queue) > 0 {
+			ops = s.ops
+			next = queue[0]
+		}
+
+		select {
+		case op := <-s.inbox:
+			queue = append(queue, op)
+		case ops <- next:
+			queue[0] = nil
+			queue = queue[1:]
+		}
+	}
+}
+
+// This runs the shard's operations one at a time, in the order they were posted
+func (s *shard) run() {
+	for op := range s.ops {
+		op(s)
+	}
+}
+
+// This queues an operation to run inside the shard
+func (s *shard) post(op func(*shard)) {
+	s.inbox <- op
+}
+
+// This queues an operation on behalf of a client message. Only so many of them can wait for the
+// shard at once, past that the read loops posting them wait too and clients get TCP backpressure
+// instead of growing the mailbox. Shards never call it so they can't block each other.
+func (s *shard) postFromClient(op func(*shard)) {
+	s.admitted <- struct{}{}
+	s.post(func(s *shard) {
+		<-s.admitted
+		op(s)
+	})
+}
+
+// This returns the shard that owns the given user or room ID
+func (wsm *WebSocketManager) shardFor(id uint64) *shard {
+	return wsm.shards[id%uint64(len(wsm.shards))]
+}
+
+// This runs fn inside the given shard and waits for it to finish, this is how anything outside
+// the shards safely reads or changes their state
+func (wsm *WebSocketManager) exec(ctx context.Context, s *shard, fn func(*shard)) error {
+	done := make(chan struct{})
+	op := func(s *shard) {
+		fn(s)
+		close(done)
+	}
+
+	select {
+	case s.inbox <- op:
+	case <-ctx.Done():
+		return errRunLoopUnresponsive
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return errRunLoopUnresponsive
+	}
+}
+
+// This runs fn inside every shard, one shard after the other
+func (wsm *WebSocketManager) execAll(ctx context.Context, fn func(*shard)) error {
+	for _, s := range wsm.shards {
+		if err := wsm.exec(ctx, s, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
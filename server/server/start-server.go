@@ -1,76 +1,290 @@
 package server
 
 import (
+	"crypto/tls"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
 	"time"
 
 	"github.com/sushiag/go-webrtc-signaling-server/server/server/db"
+
+	"signaling-msgs/logging"
 )
 
+// This holds the optional settings of the signaling server, the zero value is a valid config
+type Options struct {
+	// Logger used by the server, defaults to a logger configured by LOG_LEVEL and LOG_FORMAT
+	Logger *slog.Logger
+	// Credential for the /admin API, defaults to ADMIN_API_KEY. The admin API is disabled without one.
+	AdminAPIKey string
+	// Limits for signaling messages and the HTTP endpoints, defaults to DefaultRateLimits()
+	RateLimits *RateLimits
+	// Turns off every rate limit
+	DisableRateLimits bool
+
+	// How many messages can wait to be sent to a single client, defaults to 64
+	SendQueueSize int
+	// What to do when a client's send queue is full, defaults to OverflowDropOldestICE
+	OverflowPolicy OverflowPolicy
+	// How long a single websocket write may take before the client is dropped, defaults to 10s
+	WriteTimeout time.Duration
+
+	// Sizes and what the server strips from the SDP and ICE candidate messages it forwards
+	Payloads PayloadPolicy
+
+	// How many shards the connections and rooms are split across, defaults to GOMAXPROCS
+	Shards int
+	// How many client messages can wait for a single shard, defaults to 1024. Clients whose
+	// messages go to a full shard aren't read from until it catches up.
+	ShardQueueSize int
+
+	// Connects this server to other nodes so peers connected to different nodes can signal each
+	// other, a single node doesn't need one
+	Bus Bus
+	// Identifies this node in the cluster and must be unique per node, picked at random when a Bus
+	// is set without one. Room IDs start with it so they don't clash across nodes.
+	NodeID uint16
+
+	// Keys the access tokens handed out by /token are signed with, the first one signs and all of
+	// them verify. A random key is generated when there are none, tokens then only work on this
+	// node until it restarts.
+	TokenKeys []TokenKey
+	// How long access tokens are valid, defaults to 5 minutes
+	TokenTTL time.Duration
+
+	// How accounts are locked after failed password attempts, defaults to DefaultLockoutPolicy()
+	Lockout *LockoutPolicy
+
+	// Serves HTTPS instead of plain HTTP. Clients presenting a certificate verified against its
+	// ClientCAs are authenticated as the user named by the certificate's common name, set
+	// ClientAuth to tls.VerifyClientCertIfGiven or stricter for that.
+	TLS *tls.Config
+	// Authenticate requests carrying other kinds of credentials, they are asked after the built-in
+	// access token, API key and client certificate checks
+	Authenticators []Authenticator
+
+	// Lets users log in through an OpenID Connect provider at /auth/oidc/login, disabled when nil
+	OIDC *OIDCConfig
+
+	// Lets users who forgot their password reset it through /password/forgot and /password/reset,
+	// disabled when nil
+	PasswordReset *PasswordResetConfig
+
+	// The STUN and TURN servers handed to clients at /ice-servers and in RoomCreated and
+	// RoomJoined messages, clients pick their own when nil
+	ICE *ICEConfig
+	// Runs a STUN and TURN server next to this one, it's handed to clients with the servers of
+	// ICE. Disabled when nil.
+	TURN *TURNServerConfig
+}
+
 // This handles the setup of the HTTP signaling server
-func StartServer(port string, queries *db.Queries) (*http.Server, string) {
+func StartServer(port string, queries db.Querier) (*http.Server, string) {
+	return StartServerWithOptions(port, queries, Options{})
+}
+
+// This handles the setup of the HTTP signaling server with the given options
+func StartServerWithOptions(port string, queries db.Querier, opts Options) (*http.Server, string) {
+	logger := opts.Logger
+	if logger == nil {
+		logger = logging.FromEnv()
+	}
+	opts.Logger = logger
+
+	if opts.RateLimits == nil {
+		limits := DefaultRateLimits()
+		opts.RateLimits = &limits
+	}
+	if opts.Lockout == nil {
+		lockout := DefaultLockoutPolicy()
+		opts.Lockout = &lockout
+	}
+
 	host := os.Getenv("SERVER_HOST")
 	if host == "" {
 		host = "127.0.0.1"
 	}
-	log.Printf("[SERVER] Using host: %s", host)
+	logger.Debug("using host", "host", host)
 
 	// This builds url from host:port
 	serverUrl := fmt.Sprintf("%s:%s", host, port)
-	log.Printf("[SERVER] Binding to %s", serverUrl)
+	logger.Debug("binding", "addr", serverUrl)
 
 	// Create the TCP listener
 	listener, err := net.Listen("tcp", serverUrl)
 	if err != nil {
-		log.Fatalf("[SERVER] Error starting server: %v", err)
+		logger.Error("error starting server", "err", err)
+		os.Exit(1)
+	}
+	if opts.TLS != nil {
+		listener = tls.NewListener(listener, opts.TLS)
 	}
 	// This gets the actual bound address (if "0" it will automatically choose an available one)
 	serverUrl = listener.Addr().String()
-	log.Printf("[SERVER] Listening on %s", serverUrl)
+	logger.Info("listening", "addr", serverUrl)
+
+	tokens, err := newTokenAuthority(opts.TokenKeys, opts.TokenTTL)
+	if err != nil {
+		logger.Error("invalid access token keys", "err", err)
+		os.Exit(1)
+	}
+	if tokens.ephemeral {
+		logger.Warn("no access token keys configured, using a random key so tokens won't work across nodes or restarts")
+	}
+
+	// The built-in TURN server stops with the HTTP server
+	if opts.TURN != nil {
+		turnServer, ice, err := startTURNServer(*opts.TURN, opts.ICE, queries, logger)
+		if err != nil {
+			logger.Error("failed to start the TURN server", "err", err)
+			os.Exit(1)
+		}
+		opts.ICE = ice
+		listener = &listenerWithTURN{Listener: listener, turn: turnServer}
+	}
+	if opts.ICE != nil {
+		if err := opts.ICE.validate(); err != nil {
+			logger.Error("invalid ICE server config", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	// Every endpoint that authenticates users goes through this
+	auth := newAuthChain(queries, tokens, opts.Authenticators)
 
 	// This creayes a new WebsocketManger to manager all the active websocket from the signaling client
-	wsManager := NewWebSocketManager()
+	wsManager := NewWebSocketManager(opts)
+
+	// This limits how often a single IP can hit an endpoint
+	limitByIP := func(scope string, limit RateLimit, handler http.HandlerFunc) http.HandlerFunc {
+		return handler
+	}
+	if !opts.DisableRateLimits {
+		limitByIP = newIPLimiter().middleware
+	}
 
 	mux := http.NewServeMux()
 
 	// This set the HTTP handlers
-	mux.HandleFunc("/register", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/register", limitByIP("auth", opts.RateLimits.Auth, func(w http.ResponseWriter, r *http.Request) {
 		registerNewUser(w, r, queries)
-	})
-	mux.HandleFunc("/newpassword", func(w http.ResponseWriter, r *http.Request) {
-		updatePassword(w, r, queries)
-	})
-	mux.HandleFunc("/regenerate", func(w http.ResponseWriter, r *http.Request) {
-		regenerateNewAPIKeys(w, r, queries)
-	})
+	}))
+	mux.HandleFunc("/newpassword", limitByIP("auth", opts.RateLimits.Auth, func(w http.ResponseWriter, r *http.Request) {
+		updatePassword(w, r, queries, *opts.Lockout)
+	}))
+	mux.HandleFunc("/regenerate", limitByIP("auth", opts.RateLimits.Auth, func(w http.ResponseWriter, r *http.Request) {
+		regenerateNewAPIKeys(w, r, queries, *opts.Lockout)
+	}))
+
+	// API keys of the user the request is authenticated as
+	mux.HandleFunc("POST /apikeys", limitByIP("auth", opts.RateLimits.Auth, func(w http.ResponseWriter, r *http.Request) {
+		createAPIKey(w, r, queries, auth)
+	}))
+	mux.HandleFunc("GET /apikeys", limitByIP("auth", opts.RateLimits.Auth, func(w http.ResponseWriter, r *http.Request) {
+		listAPIKeys(w, r, queries, auth)
+	}))
+	mux.HandleFunc("DELETE /apikeys/{id}", limitByIP("auth", opts.RateLimits.Auth, func(w http.ResponseWriter, r *http.Request) {
+		revokeAPIKey(w, r, queries, auth)
+	}))
+
+	// The user's own account
+	mux.HandleFunc("GET /account", limitByIP("auth", opts.RateLimits.Auth, func(w http.ResponseWriter, r *http.Request) {
+		getAccount(w, r, queries, auth)
+	}))
+	mux.HandleFunc("DELETE /account", limitByIP("auth", opts.RateLimits.Auth, func(w http.ResponseWriter, r *http.Request) {
+		deleteAccount(w, r, wsManager, queries, auth, *opts.Lockout)
+	}))
+	mux.HandleFunc("PUT /account/email", limitByIP("auth", opts.RateLimits.Auth, func(w http.ResponseWriter, r *http.Request) {
+		setAccountEmail(w, r, queries, auth)
+	}))
+	mux.HandleFunc("GET /account/auth-events", limitByIP("auth", opts.RateLimits.Auth, func(w http.ResponseWriter, r *http.Request) {
+		listAuthEvents(w, r, queries, auth)
+	}))
+
+	// Who the request's credentials authenticate as
+	mux.HandleFunc("GET /auth", limitByIP("auth", opts.RateLimits.Auth, func(w http.ResponseWriter, r *http.Request) {
+		handleAuthIntrospection(w, r, auth)
+	}))
+
+	// Short lived access tokens for /ws
+	mux.HandleFunc("POST /token", limitByIP("auth", opts.RateLimits.Auth, func(w http.ResponseWriter, r *http.Request) {
+		handleToken(w, r, queries, auth, tokens, *opts.Lockout)
+	}))
+
+	// STUN and TURN servers with credentials for the user
+	mux.HandleFunc("GET /ice-servers", limitByIP("auth", opts.RateLimits.Auth, func(w http.ResponseWriter, r *http.Request) {
+		handleICEServers(w, r, wsManager.iceServers, auth)
+	}))
+
+	// Single sign-on through an OpenID Connect provider
+	if opts.OIDC != nil {
+		login := newOIDCLogin(*opts.OIDC, queries, tokens)
+		mux.HandleFunc("GET /auth/oidc/login", limitByIP("auth", opts.RateLimits.Auth, login.handleLogin))
+		mux.HandleFunc("GET "+oidcCallbackPath, limitByIP("auth", opts.RateLimits.Auth, login.handleCallback))
+	}
+
+	// Password resets through an emailed token
+	if opts.PasswordReset != nil {
+		reset, err := newPasswordReset(*opts.PasswordReset, queries, wsManager)
+		if err != nil {
+			logger.Error("invalid password reset config", "err", err)
+			os.Exit(1)
+		}
+		mux.HandleFunc("POST /password/forgot", limitByIP("auth", opts.RateLimits.Auth, reset.handleForgot))
+		mux.HandleFunc("POST /password/reset", limitByIP("auth", opts.RateLimits.Auth, reset.handleReset))
+	}
 
 	// WebSocket Connection
-	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("[SERVER] /ws called from %s", r.RemoteAddr)
-		handleWSEndpoint(w, r, wsManager.newConnChan, queries)
+	mux.HandleFunc("/ws", limitByIP("upgrade", opts.RateLimits.Upgrade, func(w http.ResponseWriter, r *http.Request) {
+		requestLogger(r).Debug("/ws called")
+		handleWSEndpoint(w, r, wsManager, auth)
+	}))
+
+	// Health, readiness and build info probes
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		handleHealthz(w, r, wsManager)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		handleReadyz(w, r, wsManager, queries)
 	})
+	mux.HandleFunc("/version", handleVersion)
+
+	// Admin API for inspecting and managing the live state, guesses at its key are
+	// limited like password guesses
+	adminKey := opts.AdminAPIKey
+	if adminKey == "" {
+		adminKey = os.Getenv(adminAPIKeyEnvName)
+	}
+	if adminKey != "" {
+		mux.HandleFunc("/admin/", limitByIP("auth", opts.RateLimits.Auth, adminRoutes(wsManager, queries, adminKey).ServeHTTP))
+	} else {
+		logger.Info("admin API disabled, no admin API key configured")
+	}
 
 	// This creates the HTTP server with the given handler
 	server := &http.Server{
-		Addr:    serverUrl,
-		Handler: mux,
+		Addr:     serverUrl,
+		Handler:  withRequestLogging(mux, logger),
+		ErrorLog: slog.NewLogLogger(logger.Handler(), slog.LevelWarn),
 	}
 
+	// This makes the readiness probe fail as soon as a graceful shutdown starts
+	server.RegisterOnShutdown(wsManager.markShuttingDown)
+
 	// This starts the HTTP server in a new goroutine
 	go func() {
-		log.Printf("[SERVER] Starting HTTP server goroutine")
+		logger.Debug("starting HTTP server goroutine")
 		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
-			log.Printf("[SERVER] HTTP server error: %v", err)
+			logger.Error("HTTP server error", "err", err)
 		}
-		log.Printf("[SERVER] HTTP server goroutine stopped")
+		logger.Debug("HTTP server goroutine stopped")
 	}()
 
 	time.Sleep(100 * time.Millisecond)
-	log.Printf("[SERVER] StartServer returning")
+	logger.Debug("StartServer returning")
 
 	return server, serverUrl
 }
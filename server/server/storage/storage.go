@@ -0,0 +1,163 @@
+// Package storage opens the signaling server's database, either SQLite or PostgreSQL, behind the
+// db.Querier interface the rest of the server is written against.
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/mattn/go-sqlite3"
+
+	"github.com/sushiag/go-webrtc-signaling-server/server/server/db"
+	"github.com/sushiag/go-webrtc-signaling-server/server/server/migrate"
+	"github.com/sushiag/go-webrtc-signaling-server/server/server/pgdb"
+)
+
+// SQLSTATE of a unique constraint violation in Postgres
+const pgUniqueViolation = "23505"
+
+// This is the SQLite driver with the functions the migrations rely on
+const sqliteDriverName = "sqlite3_signaling"
+
+func init() {
+	sql.Register(sqliteDriverName, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			return conn.RegisterFunc("sha256_hex", HashAPIKey, true)
+		},
+	})
+}
+
+// This opens the database at the given location. postgres:// and postgresql:// URLs open a
+// Postgres database, anything else is the filename of a SQLite database. The schema isn't touched,
+// see Migrator and OpenAndMigrate.
+func Open(location string) (db.Querier, *sql.DB, error) {
+	if IsPostgresURL(location) {
+		return OpenPostgres(location)
+	}
+	return OpenSQLite(location)
+}
+
+// This tells whether the location is a Postgres connection URL
+func IsPostgresURL(location string) bool {
+	return strings.HasPrefix(location, "postgres://") || strings.HasPrefix(location, "postgresql://")
+}
+
+// This opens (and creates if needed) the SQLite database in the given file
+func OpenSQLite(filename string) (*db.Queries, *sql.DB, error) {
+	dsn := fmt.Sprintf("file:%s?cache=shared&_foreign_keys=1", filename)
+	conn, err := sql.Open(sqliteDriverName, dsn)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open SQLite database: %w", err)
+	}
+
+	return db.New(conn), conn, nil
+}
+
+// This connects to the Postgres database at the given URL
+func OpenPostgres(dsn string) (*pgdb.Store, *sql.DB, error) {
+	conn, err := sql.Open("pgx", dsn)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open Postgres database: %w", err)
+	}
+
+	return pgdb.NewStore(conn), conn, nil
+}
+
+// This opens the database at the given location and applies every pending migration
+func OpenAndMigrate(ctx context.Context, location string) (db.Querier, *sql.DB, error) {
+	queries, conn, err := Open(location)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	migrator, err := Migrator(conn, location)
+	if err == nil {
+		_, err = migrator.Up(ctx)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return queries, conn, nil
+}
+
+// This returns the migrator with the embedded migrations of the database opened from location
+func Migrator(conn *sql.DB, location string) (*migrate.Migrator, error) {
+	dialect, migrations := migrate.SQLite, fs.FS(db.Migrations)
+	if IsPostgresURL(location) {
+		dialect, migrations = migrate.Postgres, pgdb.Migrations
+	}
+
+	migrations, err := fs.Sub(migrations, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	migrator, err := migrate.New(conn, dialect, migrations)
+	if err != nil {
+		return nil, err
+	}
+	if dialect == migrate.SQLite {
+		if err := baselineSchemaFile(context.Background(), conn, migrator); err != nil {
+			return nil, err
+		}
+	}
+	return migrator, nil
+}
+
+// Databases created from the schema file that came before migrations already have the disabled
+// column 0002_users_disabled adds, so they start out migrated up to it
+func baselineSchemaFile(ctx context.Context, conn *sql.DB, migrator *migrate.Migrator) error {
+	var hasDisabled bool
+	err := conn.QueryRowContext(ctx, "SELECT COUNT(*) > 0 FROM pragma_table_info('users') WHERE name = 'disabled'").Scan(&hasDisabled)
+	if err != nil || !hasDisabled {
+		return err
+	}
+	return migrator.Baseline(ctx, 2)
+}
+
+// This fails when the database is missing migrations, the error tells how to apply them
+func CheckMigrated(ctx context.Context, conn *sql.DB, location string) error {
+	migrator, err := Migrator(conn, location)
+	if err != nil {
+		return err
+	}
+
+	pending, err := migrator.Pending(ctx)
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("database has %d pending migrations (next is %04d_%s), run `admin migrate up` first", len(pending), pending[0].Version, pending[0].Name)
+	}
+	return nil
+}
+
+// This is how API keys are stored, the hex encoded SHA-256 of the key. The keys are random so a
+// fast hash is enough and lets them be looked up by their hash.
+func HashAPIKey(apiKey string) string {
+	sum := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(sum[:])
+}
+
+// This tells whether err comes from a unique constraint, whichever database returned it
+func IsUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique || sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code == pgUniqueViolation
+	}
+
+	return false
+}
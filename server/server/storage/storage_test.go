@@ -0,0 +1,372 @@
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	embeddedpostgres "github.com/fergusstrange/embedded-postgres"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sushiag/go-webrtc-signaling-server/server/server/db"
+	"github.com/sushiag/go-webrtc-signaling-server/server/server/storage"
+)
+
+// Set this to a Postgres URL (e.g. a local container) to run the suite against that database
+// instead of an embedded one, its users table is emptied along with every table referencing it
+const postgresDSNEnvName = "TEST_POSTGRES_DSN"
+
+// Set this to skip the Postgres suite where the embedded Postgres can't run, like without network
+// access to download it
+const skipPostgresEnvName = "TEST_SKIP_POSTGRES"
+
+func TestStorage(t *testing.T) {
+	t.Run("sqlite", func(t *testing.T) {
+		queries, conn, err := storage.OpenAndMigrate(context.Background(), filepath.Join(t.TempDir(), "storage.db"))
+		require.NoError(t, err)
+		defer conn.Close()
+
+		testStorage(t, queries)
+	})
+
+	t.Run("postgres", func(t *testing.T) {
+		dsn := startPostgres(t)
+
+		queries, conn, err := storage.OpenAndMigrate(context.Background(), dsn)
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = conn.Exec("TRUNCATE users RESTART IDENTITY CASCADE")
+		require.NoError(t, err)
+
+		testStorage(t, queries)
+	})
+}
+
+// This returns the URL of the Postgres database the suite runs against, an embedded Postgres is
+// started unless TEST_POSTGRES_DSN is set. The binaries are downloaded on the first run.
+func startPostgres(t *testing.T) string {
+	if dsn := os.Getenv(postgresDSNEnvName); dsn != "" {
+		return dsn
+	}
+	if os.Getenv(skipPostgresEnvName) != "" {
+		t.Skipf("%s is set", skipPostgresEnvName)
+	}
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	port := listener.Addr().(*net.TCPAddr).Port
+	require.NoError(t, listener.Close())
+
+	var logs bytes.Buffer
+	config := embeddedpostgres.DefaultConfig().
+		Port(uint32(port)).
+		RuntimePath(t.TempDir()).
+		Logger(&logs)
+	postgres := embeddedpostgres.NewDatabase(config)
+	require.NoError(t, postgres.Start(), "failed to start the embedded Postgres, set %s to use another one or %s to skip it\n%s", postgresDSNEnvName, skipPostgresEnvName, logs.String())
+	t.Cleanup(func() { _ = postgres.Stop() })
+
+	return config.GetConnectionURL() + "?sslmode=disable"
+}
+
+// This checks that a backend behaves the way the server expects
+func testStorage(t *testing.T, queries db.Querier) {
+	ctx := context.Background()
+
+	one, err := queries.Ping(ctx)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, one)
+
+	spongebobID, err := queries.CreateUser(ctx, db.CreateUserParams{Username: "spongebob", Password: "hash1"})
+	require.NoError(t, err)
+	patrickID, err := queries.CreateUser(ctx, db.CreateUserParams{Username: "patrickstar", Password: "hash2"})
+	require.NoError(t, err)
+	require.NotEqual(t, spongebobID, patrickID)
+
+	// duplicates are classified the same way on every backend
+	_, err = queries.CreateUser(ctx, db.CreateUserParams{Username: "spongebob", Password: "hash3"})
+	require.Error(t, err)
+	require.True(t, storage.IsUniqueViolation(err), "expected a unique violation, got: %v", err)
+	require.False(t, storage.IsUniqueViolation(sql.ErrNoRows))
+
+	user, err := queries.GetUserByUsername(ctx, "spongebob")
+	require.NoError(t, err)
+	require.Equal(t, spongebobID, user.ID)
+	require.Equal(t, "hash1", user.Password)
+	require.True(t, user.UpdatedAt.Valid)
+
+	byID, err := queries.GetUserByID(ctx, patrickID)
+	require.NoError(t, err)
+	require.Equal(t, "patrickstar", byID.Username)
+
+	_, err = queries.GetUserByUsername(ctx, "squidward")
+	require.ErrorIs(t, err, sql.ErrNoRows)
+
+	// API keys are looked up by their hash along with their user
+	key1, err := queries.CreateAPIKey(ctx, db.CreateAPIKeyParams{UserID: spongebobID, Prefix: "key1", Hash: storage.HashAPIKey("key1"), Label: "laptop", Scopes: "signaling keys"})
+	require.NoError(t, err)
+	require.Equal(t, "laptop", key1.Label)
+	require.NotEmpty(t, key1.CreatedAt)
+	require.False(t, key1.LastUsedAt.Valid)
+
+	expiresAt := sql.NullString{String: "2030-01-01 00:00:00", Valid: true}
+	key2, err := queries.CreateAPIKey(ctx, db.CreateAPIKeyParams{UserID: spongebobID, Prefix: "key2", Hash: storage.HashAPIKey("key2"), Label: "ci", Scopes: "signaling", ExpiresAt: expiresAt})
+	require.NoError(t, err)
+	require.Equal(t, expiresAt, key2.ExpiresAt)
+
+	_, err = queries.CreateAPIKey(ctx, db.CreateAPIKeyParams{UserID: patrickID, Prefix: "key1", Hash: storage.HashAPIKey("key1"), Label: "copy", Scopes: "signaling"})
+	require.True(t, storage.IsUniqueViolation(err), "expected a unique violation, got: %v", err)
+
+	row, err := queries.GetAPIKeyByHash(ctx, storage.HashAPIKey("key2"))
+	require.NoError(t, err)
+	require.Equal(t, key2, row.ApiKey)
+	require.Equal(t, user, row.User)
+
+	_, err = queries.GetAPIKeyByHash(ctx, storage.HashAPIKey("key3"))
+	require.ErrorIs(t, err, sql.ErrNoRows)
+
+	lastUsed := sql.NullString{String: "2026-01-01 12:00:00", Valid: true}
+	require.NoError(t, queries.TouchAPIKey(ctx, db.TouchAPIKeyParams{LastUsedAt: lastUsed, ID: key1.ID}))
+
+	keys, err := queries.ListAPIKeys(ctx, spongebobID)
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+	require.Equal(t, key1.ID, keys[0].ID)
+	require.Equal(t, lastUsed, keys[0].LastUsedAt)
+	require.Equal(t, key2.ID, keys[1].ID)
+
+	withKey, err := queries.CountUsersWithAPIKey(ctx)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, withKey)
+
+	// a key can only be revoked by its owner
+	revoked, err := queries.RevokeAPIKey(ctx, db.RevokeAPIKeyParams{ID: key1.ID, UserID: patrickID})
+	require.NoError(t, err)
+	require.EqualValues(t, 0, revoked)
+	revoked, err = queries.RevokeAPIKey(ctx, db.RevokeAPIKeyParams{ID: key1.ID, UserID: spongebobID})
+	require.NoError(t, err)
+	require.EqualValues(t, 1, revoked)
+	_, err = queries.GetAPIKeyByHash(ctx, storage.HashAPIKey("key1"))
+	require.ErrorIs(t, err, sql.ErrNoRows)
+
+	_, err = queries.CreateAPIKey(ctx, db.CreateAPIKeyParams{UserID: patrickID, Prefix: "key4", Hash: storage.HashAPIKey("key4"), Label: "default", Scopes: "signaling"})
+	require.NoError(t, err)
+	revoked, err = queries.RevokeAllAPIKeys(ctx, patrickID)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, revoked)
+
+	// passwords
+	require.NoError(t, queries.UpdateUserPassword(ctx, db.UpdateUserPasswordParams{Password: "hash4", Username: "patrickstar"}))
+	patrick, err := queries.GetUserByUsername(ctx, "patrickstar")
+	require.NoError(t, err)
+	require.Equal(t, "hash4", patrick.Password)
+
+	// disabling
+	updated, err := queries.SetUserDisabled(ctx, db.SetUserDisabledParams{Disabled: 1, Username: "spongebob"})
+	require.NoError(t, err)
+	require.EqualValues(t, 1, updated)
+	row, err = queries.GetAPIKeyByHash(ctx, storage.HashAPIKey("key2"))
+	require.NoError(t, err)
+	require.EqualValues(t, 1, row.User.Disabled)
+
+	updated, err = queries.SetUserDisabled(ctx, db.SetUserDisabledParams{Disabled: 1, Username: "squidward"})
+	require.NoError(t, err)
+	require.EqualValues(t, 0, updated)
+
+	total, err := queries.CountUsers(ctx)
+	require.NoError(t, err)
+	require.EqualValues(t, 2, total)
+	disabled, err := queries.CountDisabledUsers(ctx)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, disabled)
+
+	users, err := queries.ListUsers(ctx)
+	require.NoError(t, err)
+	require.Len(t, users, 2)
+	require.Equal(t, "spongebob", users[0].Username)
+	require.EqualValues(t, 1, users[0].Disabled)
+	require.Equal(t, "patrickstar", users[1].Username)
+
+	// failed logins and auth events
+	failures, err := queries.RecordFailedLogin(ctx, patrickID)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, failures)
+	failures, err = queries.RecordFailedLogin(ctx, patrickID)
+	require.NoError(t, err)
+	require.EqualValues(t, 2, failures)
+	require.NoError(t, queries.LockUser(ctx, db.LockUserParams{LockedUntil: sql.NullString{String: "2030-01-01 00:00:00", Valid: true}, ID: patrickID}))
+	patrick, err = queries.GetUserByUsername(ctx, "patrickstar")
+	require.NoError(t, err)
+	require.EqualValues(t, 2, patrick.FailedLogins)
+	require.Equal(t, "2030-01-01 00:00:00", patrick.LockedUntil.String)
+	require.NoError(t, queries.ResetFailedLogins(ctx, patrickID))
+	patrick, err = queries.GetUserByUsername(ctx, "patrickstar")
+	require.NoError(t, err)
+	require.Zero(t, patrick.FailedLogins)
+	require.False(t, patrick.LockedUntil.Valid)
+
+	patrickRef := sql.NullInt64{Int64: patrickID, Valid: true}
+	for _, ip := range []string{"10.0.0.1", "10.0.0.1", "10.0.0.2"} {
+		require.NoError(t, queries.CreateAuthEvent(ctx, db.CreateAuthEventParams{UserID: patrickRef, Username: "patrickstar", Event: "token", Success: 1, Ip: ip, UserAgent: "test"}))
+	}
+	require.NoError(t, queries.CreateAuthEvent(ctx, db.CreateAuthEventParams{Username: "nobody", Event: "token", Ip: "10.0.0.3", UserAgent: "test"}))
+	logins, err := queries.CountSuccessfulLogins(ctx, patrickRef)
+	require.NoError(t, err)
+	require.EqualValues(t, 3, logins)
+	logins, err = queries.CountSuccessfulLoginsFromIP(ctx, db.CountSuccessfulLoginsFromIPParams{UserID: patrickRef, Ip: "10.0.0.1"})
+	require.NoError(t, err)
+	require.EqualValues(t, 2, logins)
+	events, err := queries.ListAuthEvents(ctx, db.ListAuthEventsParams{UserID: patrickRef, Limit: 2})
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	require.Equal(t, "10.0.0.2", events[0].Ip)
+	require.NotEmpty(t, events[0].CreatedAt)
+
+	// identities from an external provider
+	identity := db.GetUserByIdentityParams{Issuer: "https://sso.example.com", Subject: "1234"}
+	_, err = queries.GetUserByIdentity(ctx, identity)
+	require.ErrorIs(t, err, sql.ErrNoRows)
+	require.NoError(t, queries.CreateUserIdentity(ctx, db.CreateUserIdentityParams{UserID: spongebobID, Issuer: identity.Issuer, Subject: identity.Subject}))
+	linked, err := queries.GetUserByIdentity(ctx, identity)
+	require.NoError(t, err)
+	require.Equal(t, "spongebob", linked.Username)
+	err = queries.CreateUserIdentity(ctx, db.CreateUserIdentityParams{UserID: patrickID, Issuer: identity.Issuer, Subject: identity.Subject})
+	require.True(t, storage.IsUniqueViolation(err))
+
+	// emails and password reset tokens
+	email := sql.NullString{String: "patrick@bikinibottom.sea", Valid: true}
+	updated, err = queries.SetUserEmail(ctx, db.SetUserEmailParams{Email: email, ID: patrickID})
+	require.NoError(t, err)
+	require.EqualValues(t, 1, updated)
+	byEmail, err := queries.GetUserByEmail(ctx, email)
+	require.NoError(t, err)
+	require.Equal(t, patrickID, byEmail.ID)
+	require.Equal(t, email, byEmail.Email)
+	_, err = queries.SetUserEmail(ctx, db.SetUserEmailParams{Email: email, ID: spongebobID})
+	require.True(t, storage.IsUniqueViolation(err), "expected a unique violation, got: %v", err)
+	_, err = queries.GetUserByEmail(ctx, sql.NullString{String: "squidward@bikinibottom.sea", Valid: true})
+	require.ErrorIs(t, err, sql.ErrNoRows)
+
+	require.NoError(t, queries.CreatePasswordReset(ctx, db.CreatePasswordResetParams{UserID: patrickID, Hash: "reset1", ExpiresAt: "2030-01-01 00:00:00"}))
+	require.NoError(t, queries.CreatePasswordReset(ctx, db.CreatePasswordResetParams{UserID: spongebobID, Hash: "reset2", ExpiresAt: "2030-01-01 00:00:00"}))
+	// expired tokens and used tokens don't work
+	_, err = queries.UsePasswordReset(ctx, db.UsePasswordResetParams{Hash: "reset1", ExpiresAt: "2030-01-01 00:00:00"})
+	require.ErrorIs(t, err, sql.ErrNoRows)
+	resetUser, err := queries.UsePasswordReset(ctx, db.UsePasswordResetParams{Hash: "reset1", ExpiresAt: "2026-01-01 00:00:00"})
+	require.NoError(t, err)
+	require.Equal(t, patrickID, resetUser)
+	_, err = queries.UsePasswordReset(ctx, db.UsePasswordResetParams{Hash: "reset1", ExpiresAt: "2026-01-01 00:00:00"})
+	require.ErrorIs(t, err, sql.ErrNoRows)
+	require.NoError(t, queries.CreatePasswordReset(ctx, db.CreatePasswordResetParams{UserID: patrickID, Hash: "reset3", ExpiresAt: "2030-01-01 00:00:00"}))
+	require.NoError(t, queries.DeletePasswordResets(ctx, patrickID))
+	_, err = queries.UsePasswordReset(ctx, db.UsePasswordResetParams{Hash: "reset3", ExpiresAt: "2026-01-01 00:00:00"})
+	require.ErrorIs(t, err, sql.ErrNoRows)
+
+	// deleting a user takes their keys and identities with them
+	require.NoError(t, queries.DeleteUser(ctx, spongebobID))
+	total, err = queries.CountUsers(ctx)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, total)
+	_, err = queries.GetAPIKeyByHash(ctx, storage.HashAPIKey("key2"))
+	require.ErrorIs(t, err, sql.ErrNoRows)
+	keys, err = queries.ListAPIKeys(ctx, spongebobID)
+	require.NoError(t, err)
+	require.Empty(t, keys)
+	_, err = queries.GetUserByIdentity(ctx, identity)
+	require.ErrorIs(t, err, sql.ErrNoRows)
+	_, err = queries.UsePasswordReset(ctx, db.UsePasswordResetParams{Hash: "reset2", ExpiresAt: "2026-01-01 00:00:00"})
+	require.ErrorIs(t, err, sql.ErrNoRows)
+}
+
+// The schema.sql the server created its database from before there were migrations
+const baselineSchema = `CREATE TABLE IF NOT EXISTS users (
+    id INTEGER PRIMARY KEY,
+    username TEXT NOT NULL UNIQUE,
+    password TEXT NOT NULL,
+    api_key TEXT NULL UNIQUE,
+    updated_at TEXT DEFAULT CURRENT_TIMESTAMP
+);
+`
+
+// Databases created from the baseline schema are migrated to the latest one
+func TestBaselineSchemaMigrated(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "baseline.db")
+
+	// the first migration has to stay the baseline schema so it's a no-op on those databases
+	first, err := fs.ReadFile(db.Migrations, "migrations/0001_create_users.up.sql")
+	require.NoError(t, err)
+	require.Equal(t, baselineSchema, string(first))
+
+	_, conn, err := storage.Open(filename)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Exec(baselineSchema)
+	require.NoError(t, err)
+	_, err = conn.Exec("INSERT INTO users (username, password, api_key) VALUES ('spongebob', 'hash1', 'abcdef0123456789')")
+	require.NoError(t, err)
+
+	queries, migrated, err := storage.OpenAndMigrate(ctx, filename)
+	require.NoError(t, err)
+	defer migrated.Close()
+
+	user, err := queries.GetUserByUsername(ctx, "spongebob")
+	require.NoError(t, err)
+	require.Zero(t, user.Disabled)
+	_, err = queries.SetUserDisabled(ctx, db.SetUserDisabledParams{Username: user.Username, Disabled: 1})
+	require.NoError(t, err)
+	disabled, err := queries.CountDisabledUsers(ctx)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, disabled)
+
+	row, err := queries.GetAPIKeyByHash(ctx, storage.HashAPIKey("abcdef0123456789"))
+	require.NoError(t, err)
+	require.Equal(t, "spongebob", row.User.Username)
+
+	require.NoError(t, storage.CheckMigrated(ctx, migrated, filename))
+}
+
+// Databases from before API keys had their own table keep their keys, hashed
+func TestLegacyAPIKeysMigrated(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "legacy.db")
+
+	_, conn, err := storage.Open(filename)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Exec(`CREATE TABLE users (
+    id INTEGER PRIMARY KEY,
+    username TEXT NOT NULL UNIQUE,
+    password TEXT NOT NULL,
+    api_key TEXT NULL UNIQUE,
+    updated_at TEXT DEFAULT CURRENT_TIMESTAMP,
+    disabled INTEGER NOT NULL DEFAULT 0
+)`)
+	require.NoError(t, err)
+	_, err = conn.Exec("INSERT INTO users (username, password, api_key) VALUES ('spongebob', 'hash1', 'abcdef0123456789'), ('patrickstar', 'hash2', NULL)")
+	require.NoError(t, err)
+
+	queries, migrated, err := storage.OpenAndMigrate(ctx, filename)
+	require.NoError(t, err)
+	defer migrated.Close()
+
+	row, err := queries.GetAPIKeyByHash(ctx, storage.HashAPIKey("abcdef0123456789"))
+	require.NoError(t, err)
+	require.Equal(t, "spongebob", row.User.Username)
+	require.Equal(t, "abcdef01", row.ApiKey.Prefix)
+	require.Equal(t, "default", row.ApiKey.Label)
+
+	var plaintext int
+	require.NoError(t, migrated.QueryRow("SELECT COUNT(*) FROM api_keys WHERE hash = 'abcdef0123456789'").Scan(&plaintext))
+	require.Zero(t, plaintext)
+
+	withKey, err := queries.CountUsersWithAPIKey(ctx)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, withKey)
+}
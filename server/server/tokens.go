@@ -0,0 +1,270 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+
+	"github.com/sushiag/go-webrtc-signaling-server/server/server/db"
+)
+
+// Algorithms access tokens can be signed with
+const (
+	TokenHS256 = "HS256"
+	TokenEdDSA = "EdDSA"
+)
+
+const (
+	defaultTokenTTL  = 5 * time.Minute
+	minHS256KeyBytes = 32
+	tokenIssuer      = "go-webrtc-signaling-server"
+)
+
+// Browsers can't set headers on websocket upgrades so they offer the access token as a
+// subprotocol, next to the subprotocol of a codec which the server picks since browsers drop the
+// connection when the server doesn't pick one of the offered protocols
+const tokenSubprotocolPrefix = "access_token."
+
+var errAccessTokenInvalid = errors.New("invalid access token")
+
+// TokenKey is a key access tokens are signed and verified with, its ID is the kid header of the
+// tokens it signs
+type TokenKey struct {
+	ID        string
+	Algorithm string
+	// The shared secret of an HS256 key, at least 32 bytes
+	Secret []byte
+	// The private key of an EdDSA key
+	PrivateKey ed25519.PrivateKey
+}
+
+// ParseTokenKeys parses keys written as kid:algorithm:base64 and separated by commas, the base64
+// part is the secret of HS256 keys and the 32 byte seed of EdDSA keys
+func ParseTokenKeys(spec string) ([]TokenKey, error) {
+	var keys []TokenKey
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("token key %q must be written as kid:algorithm:base64", entry)
+		}
+		material, err := base64.StdEncoding.DecodeString(parts[2])
+		if err != nil {
+			return nil, fmt.Errorf("token key %q isn't valid base64: %w", parts[0], err)
+		}
+
+		key := TokenKey{ID: parts[0], Algorithm: parts[1]}
+		switch key.Algorithm {
+		case TokenHS256:
+			key.Secret = material
+		case TokenEdDSA:
+			if len(material) != ed25519.SeedSize {
+				return nil, fmt.Errorf("EdDSA token key %q must be a %d byte seed", key.ID, ed25519.SeedSize)
+			}
+			key.PrivateKey = ed25519.NewKeyFromSeed(material)
+		default:
+			return nil, fmt.Errorf("token key %q has unsupported algorithm %q", key.ID, key.Algorithm)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// This is what an access token says about its holder
+type accessClaims struct {
+	jwt.RegisteredClaims
+	Username string `json:"username"`
+	// The only rooms the holder may join, any room when empty
+	Rooms []uint64 `json:"rooms,omitempty"`
+	// When the user logged in with their password or through OIDC to get the token, unset for
+	// tokens exchanged for other credentials
+	AuthTime *jwt.NumericDate `json:"auth_time,omitempty"`
+}
+
+// This signs access tokens with its first key and accepts tokens signed by any of its keys, so
+// keys are rotated by putting the new key first and dropping the old one once its tokens expired
+type tokenAuthority struct {
+	keys []TokenKey
+	byID map[string]TokenKey
+	ttl  time.Duration
+	// Set when the key was generated at startup
+	ephemeral bool
+}
+
+func newTokenAuthority(keys []TokenKey, ttl time.Duration) (*tokenAuthority, error) {
+	ta := &tokenAuthority{keys: keys, byID: make(map[string]TokenKey), ttl: ttl}
+	if ta.ttl <= 0 {
+		ta.ttl = defaultTokenTTL
+	}
+
+	if len(ta.keys) == 0 {
+		secret := make([]byte, minHS256KeyBytes)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, fmt.Errorf("failed to generate token key: %w", err)
+		}
+		ta.keys = []TokenKey{{ID: "ephemeral", Algorithm: TokenHS256, Secret: secret}}
+		ta.ephemeral = true
+	}
+
+	for _, key := range ta.keys {
+		if key.ID == "" {
+			return nil, errors.New("token keys need an ID")
+		}
+		if _, exists := ta.byID[key.ID]; exists {
+			return nil, fmt.Errorf("token key ID %q is used twice", key.ID)
+		}
+		switch {
+		case key.Algorithm == TokenHS256 && len(key.Secret) < minHS256KeyBytes:
+			return nil, fmt.Errorf("HS256 token key %q must be at least %d bytes", key.ID, minHS256KeyBytes)
+		case key.Algorithm == TokenEdDSA && len(key.PrivateKey) != ed25519.PrivateKeySize:
+			return nil, fmt.Errorf("EdDSA token key %q needs a private key", key.ID)
+		case key.Algorithm != TokenHS256 && key.Algorithm != TokenEdDSA:
+			return nil, fmt.Errorf("token key %q has unsupported algorithm %q", key.ID, key.Algorithm)
+		}
+		ta.byID[key.ID] = key
+	}
+	return ta, nil
+}
+
+// This signs a token for the user, restricted to the given rooms when there are any. login tells
+// whether the user just logged in to get it.
+func (ta *tokenAuthority) issue(user db.User, rooms []uint64, login bool) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(ta.ttl)
+	claims := accessClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    tokenIssuer,
+			Subject:   strconv.FormatInt(user.ID, 10),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+		Username: user.Username,
+		Rooms:    rooms,
+	}
+	if login {
+		claims.AuthTime = jwt.NewNumericDate(now)
+	}
+
+	key := ta.keys[0]
+	var token *jwt.Token
+	var signingKey any
+	if key.Algorithm == TokenEdDSA {
+		token, signingKey = jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims), key.PrivateKey
+	} else {
+		token, signingKey = jwt.NewWithClaims(jwt.SigningMethodHS256, claims), key.Secret
+	}
+	token.Header["kid"] = key.ID
+
+	signed, err := token.SignedString(signingKey)
+	return signed, expiresAt, err
+}
+
+// This checks the token's signature, issuer and expiry
+func (ta *tokenAuthority) verify(raw string) (*accessClaims, error) {
+	var claims accessClaims
+	_, err := jwt.ParseWithClaims(raw, &claims, func(token *jwt.Token) (any, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, exists := ta.byID[kid]
+		if !exists {
+			return nil, fmt.Errorf("unknown key %q", kid)
+		}
+		// a token can't pick another algorithm than the one of its key
+		if token.Method.Alg() != key.Algorithm {
+			return nil, fmt.Errorf("key %q doesn't sign %s tokens", kid, token.Method.Alg())
+		}
+		if key.Algorithm == TokenEdDSA {
+			return key.PrivateKey.Public(), nil
+		}
+		return key.Secret, nil
+	}, jwt.WithValidMethods([]string{TokenHS256, TokenEdDSA}), jwt.WithIssuer(tokenIssuer), jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errAccessTokenInvalid, err)
+	}
+	return &claims, nil
+}
+
+// This finds an access token in the Authorization header, the access token subprotocol or the
+// access_token query parameter
+func accessTokenFromRequest(r *http.Request) string {
+	// API keys are sent as bearer tokens too, only JWTs have dots in them
+	if bearer, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); found && strings.Count(bearer, ".") == 2 {
+		return bearer
+	}
+	for _, protocol := range websocket.Subprotocols(r) {
+		if token, found := strings.CutPrefix(protocol, tokenSubprotocolPrefix); found {
+			return token
+		}
+	}
+	return r.URL.Query().Get("access_token")
+}
+
+// This exchanges credentials with the signaling scope or a username and password for an access
+// token. Access tokens can't be exchanged themselves, or a token limited to some rooms could be
+// swapped for one that isn't.
+func handleToken(w http.ResponseWriter, r *http.Request, queries db.Querier, auth Authenticator, tokens *tokenAuthority, lockout LockoutPolicy) {
+	var rqst struct {
+		Username string   `json:"username"`
+		Password string   `json:"password"`
+		Rooms    []uint64 `json:"rooms"`
+	}
+	// the body is optional when authenticating with credentials
+	if err := json.NewDecoder(r.Body).Decode(&rqst); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid input", http.StatusUnprocessableEntity)
+		return
+	}
+
+	logger := requestLogger(r)
+
+	var user db.User
+	login := false
+	principal, err := authenticate(r, auth, ScopeSignaling)
+	switch {
+	case err == nil && principal.Method == AuthAccessToken:
+		http.Error(w, "Access tokens can't be exchanged for new ones", http.StatusForbidden)
+		return
+	case err == nil:
+		user = principal.User
+	case !errors.Is(err, ErrNoCredentials):
+		logger.Info("token request rejected", "err", err)
+		writeAuthError(w, r, err)
+		return
+	default:
+		user, err = checkPassword(r, queries, lockout, authEventToken, rqst.Username, rqst.Password)
+		if err != nil {
+			logger.Info("token request rejected", "username", rqst.Username, "err", err)
+			writeLoginError(w, r, err)
+			return
+		}
+		login = true
+	}
+
+	token, expiresAt, err := tokens.issue(user, rqst.Rooms, login)
+	if err != nil {
+		logger.Error("failed to sign access token", "err", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	logger.Info("access token issued", "username", user.Username, "rooms", rqst.Rooms)
+
+	writeJSON(w, r, http.StatusOK, struct {
+		AccessToken string    `json:"access_token"`
+		TokenType   string    `json:"token_type"`
+		ExpiresIn   int64     `json:"expires_in"`
+		ExpiresAt   time.Time `json:"expires_at"`
+	}{token, "Bearer", int64(tokens.ttl.Seconds()), expiresAt.UTC().Truncate(time.Second)})
+}
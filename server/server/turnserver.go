@@ -0,0 +1,276 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pion/turn/v4"
+
+	"github.com/sushiag/go-webrtc-signaling-server/server/server/db"
+)
+
+const (
+	defaultTURNListenAddr        = ":3478"
+	defaultTURNRealm             = "signaling"
+	defaultMaxAllocationsPerUser = 10
+	// How long checking a user in the database may take before a TURN request is refused
+	turnAuthTimeout = 5 * time.Second
+)
+
+// TURNServerConfig runs a STUN and TURN server next to the signaling server, so deployments don't
+// need a separate one. Clients get its address and credentials like those of ICEConfig's TURN
+// servers, and the credentials only work while their user exists and isn't disabled.
+type TURNServerConfig struct {
+	// The UDP address the server listens on, defaults to :3478
+	ListenAddr string
+	// The IP clients reach the server and its relays on, usually the host's public IP
+	PublicIP string
+	// The ports relays are allocated on, any free port when both are zero
+	MinRelayPort uint16
+	MaxRelayPort uint16
+	// Defaults to "signaling"
+	Realm string
+	// How many relays a user can hold at once, every peer connection needs one. Defaults to 10.
+	MaxAllocationsPerUser int
+	// Peers relays may reach even though their address is loopback, private, link-local, multicast
+	// or unspecified. Relays to such peers are refused otherwise, so users can't reach the
+	// server's own network through them.
+	AllowedPeers []netip.Prefix
+}
+
+// This is the built-in TURN server, it checks credentials issued for ICEConfig.TURNSecret and
+// counts every user's allocations
+type turnServer struct {
+	server       *turn.Server
+	url          string
+	secret       string
+	queries      db.Querier
+	maxPer       int
+	allowedPeers []netip.Prefix
+	logger       *slog.Logger
+
+	mu          sync.Mutex
+	allocations map[uint64]int
+	// The users whose allocation passed the quota but isn't created yet by the client address
+	// asking for it, they count against the quota until it's created or fails
+	reserved map[string]uint64
+}
+
+// This starts the TURN server and adds it to the ICE servers handed to clients. Without a secret
+// for the configured TURN servers a random one is generated, which only the built-in server knows.
+func startTURNServer(cfg TURNServerConfig, ice *ICEConfig, queries db.Querier, logger *slog.Logger) (*turnServer, *ICEConfig, error) {
+	publicIP := net.ParseIP(cfg.PublicIP)
+	if publicIP == nil {
+		return nil, nil, fmt.Errorf("invalid TURN public IP %q", cfg.PublicIP)
+	}
+	if cfg.ListenAddr == "" {
+		cfg.ListenAddr = defaultTURNListenAddr
+	}
+	if cfg.Realm == "" {
+		cfg.Realm = defaultTURNRealm
+	}
+	if cfg.MaxAllocationsPerUser <= 0 {
+		cfg.MaxAllocationsPerUser = defaultMaxAllocationsPerUser
+	}
+
+	merged := ICEConfig{}
+	if ice != nil {
+		merged = *ice
+	}
+	if merged.TURNSecret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, nil, fmt.Errorf("failed to generate TURN secret: %w", err)
+		}
+		merged.TURNSecret = hex.EncodeToString(secret)
+	}
+
+	var relays turn.RelayAddressGenerator = &turn.RelayAddressGeneratorStatic{RelayAddress: publicIP, Address: "0.0.0.0"}
+	if cfg.MinRelayPort != 0 || cfg.MaxRelayPort != 0 {
+		if cfg.MinRelayPort == 0 || cfg.MaxRelayPort < cfg.MinRelayPort {
+			return nil, nil, errors.New("TURN relay port range needs a minimum no larger than its maximum")
+		}
+		relays = &turn.RelayAddressGeneratorPortRange{
+			RelayAddress: publicIP,
+			Address:      "0.0.0.0",
+			MinPort:      cfg.MinRelayPort,
+			MaxPort:      cfg.MaxRelayPort,
+		}
+	}
+
+	conn, err := net.ListenPacket("udp", cfg.ListenAddr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to listen for TURN: %w", err)
+	}
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	hostPort := net.JoinHostPort(publicIP.String(), strconv.Itoa(port))
+
+	ts := &turnServer{
+		url:          "turn:" + hostPort + "?transport=udp",
+		secret:       merged.TURNSecret,
+		queries:      queries,
+		maxPer:       cfg.MaxAllocationsPerUser,
+		allowedPeers: cfg.AllowedPeers,
+		logger:       logger.With("component", "turn"),
+		allocations:  make(map[uint64]int),
+		reserved:     make(map[string]uint64),
+	}
+	ts.server, err = turn.NewServer(turn.ServerConfig{
+		Realm:        cfg.Realm,
+		AuthHandler:  ts.authenticate,
+		QuotaHandler: ts.allowAllocation,
+		EventHandler: turn.EventHandler{
+			OnAllocationCreated: func(srcAddr, _ net.Addr, _, username, _ string, relayAddr net.Addr, _ int) {
+				ts.allocationCreated(srcAddr)
+				ts.logger.Debug("relay allocated", "username", username, "relay_addr", relayAddr)
+			},
+			OnAllocationDeleted: func(_, _ net.Addr, _, username, _ string) {
+				ts.countAllocation(username, -1)
+				ts.logger.Debug("relay released", "username", username)
+			},
+			// every failed request ends up here, including allocations that failed after passing
+			// the quota
+			OnAllocationError: func(srcAddr, _ net.Addr, _, _ string) {
+				ts.releaseReservation(srcAddr)
+			},
+		},
+		PacketConnConfigs: []turn.PacketConnConfig{{
+			PacketConn:            conn,
+			RelayAddressGenerator: relays,
+			PermissionHandler:     ts.allowPeer,
+		}},
+	})
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("failed to start TURN server: %w", err)
+	}
+
+	// the server answers STUN binding requests too
+	merged.STUNURLs = append(merged.STUNURLs, "stun:"+hostPort)
+	merged.TURNURLs = append(merged.TURNURLs, ts.url)
+	ts.logger.Info("TURN server listening", "addr", conn.LocalAddr().String(), "url", ts.url)
+	return ts, &merged, nil
+}
+
+// This checks TURN credentials issued by the signaling server and returns the key their messages
+// are signed with. Credentials stop working once they expire or their user is gone or disabled.
+func (ts *turnServer) authenticate(username, realm string, srcAddr net.Addr) ([]byte, bool) {
+	expiresAt, userID, err := parseTURNUsername(username)
+	if err != nil {
+		ts.logger.Info("TURN request rejected", "src_addr", srcAddr, "err", err)
+		return nil, false
+	}
+	if !time.Now().Before(expiresAt) {
+		ts.logger.Info("TURN request with expired credentials", "src_addr", srcAddr, "user_id", userID)
+		return nil, false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), turnAuthTimeout)
+	defer cancel()
+	user, err := ts.queries.GetUserByID(ctx, int64(userID))
+	if err != nil || user.Disabled != 0 {
+		ts.logger.Info("TURN request for unknown or disabled user", "src_addr", srcAddr, "user_id", userID, "err", err)
+		return nil, false
+	}
+	return turn.GenerateAuthKey(username, realm, turnPassword(ts.secret, username)), true
+}
+
+// This refuses new allocations of users who hold as many as they may, otherwise it reserves one
+// for the client address so concurrent requests can't all pass the quota
+func (ts *turnServer) allowAllocation(username, _ string, srcAddr net.Addr) bool {
+	_, userID, err := parseTURNUsername(username)
+	if err != nil {
+		return false
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	held := ts.allocations[userID]
+	for addr, reservedFor := range ts.reserved {
+		if reservedFor == userID && addr != srcAddr.String() {
+			held++
+		}
+	}
+	if held >= ts.maxPer {
+		ts.logger.Info("TURN allocation quota reached", "src_addr", srcAddr, "user_id", userID)
+		return false
+	}
+	ts.reserved[srcAddr.String()] = userID
+	return true
+}
+
+// This turns the reservation of the client address into an allocation
+func (ts *turnServer) allocationCreated(srcAddr net.Addr) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	userID, exists := ts.reserved[srcAddr.String()]
+	if !exists {
+		return
+	}
+	delete(ts.reserved, srcAddr.String())
+	ts.allocations[userID]++
+}
+
+func (ts *turnServer) releaseReservation(srcAddr net.Addr) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	delete(ts.reserved, srcAddr.String())
+}
+
+// This keeps relays from reaching addresses that are only meaningful on the server's own network,
+// like its loopback interface or the cloud metadata service, unless they are explicitly allowed
+func (ts *turnServer) allowPeer(clientAddr net.Addr, peerIP net.IP) bool {
+	addr, ok := netip.AddrFromSlice(peerIP)
+	if !ok {
+		return false
+	}
+	addr = addr.Unmap()
+	if slices.ContainsFunc(ts.allowedPeers, func(prefix netip.Prefix) bool { return prefix.Contains(addr) }) {
+		return true
+	}
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsMulticast() || addr.IsUnspecified() {
+		ts.logger.Info("TURN permission refused", "src_addr", clientAddr, "peer_ip", addr)
+		return false
+	}
+	return true
+}
+
+func (ts *turnServer) countAllocation(username string, delta int) {
+	_, userID, err := parseTURNUsername(username)
+	if err != nil {
+		return
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.allocations[userID] += delta
+	if ts.allocations[userID] <= 0 {
+		delete(ts.allocations, userID)
+	}
+}
+
+func (ts *turnServer) Close() error {
+	return ts.server.Close()
+}
+
+// This closes the TURN server together with the HTTP server's listener, which both Close and
+// Shutdown do
+type listenerWithTURN struct {
+	net.Listener
+	turn *turnServer
+}
+
+func (l *listenerWithTURN) Close() error {
+	return errors.Join(l.Listener.Close(), l.turn.Close())
+}
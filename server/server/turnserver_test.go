@@ -0,0 +1,137 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/turn/v4"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sushiag/go-webrtc-signaling-server/server/server/db"
+	"signaling-msgs/logging"
+)
+
+// This knows every user the TURN server asks about
+type turnTestQueries struct {
+	db.Querier
+}
+
+func (turnTestQueries) GetUserByID(_ context.Context, id int64) (db.User, error) {
+	return db.User{ID: id, Username: "user" + strconv.FormatInt(id, 10)}, nil
+}
+
+// This starts a TURN server on the loopback interface and returns its address along with the
+// username and password of a user
+func startTestTURNServer(t *testing.T, cfg TURNServerConfig) (string, string, string) {
+	cfg.ListenAddr, cfg.PublicIP = "127.0.0.1:0", "127.0.0.1"
+	ts, ice, err := startTURNServer(cfg, nil, turnTestQueries{}, logging.Discard())
+	require.NoError(t, err)
+	t.Cleanup(func() { ts.Close() })
+
+	username := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10) + ":1"
+	addr := strings.TrimPrefix(ice.STUNURLs[len(ice.STUNURLs)-1], "stun:")
+	return addr, username, turnPassword(ice.TURNSecret, username)
+}
+
+// This allocates a relay from a client of its own, the relay is closed when the test ends
+func allocateTestRelay(t *testing.T, addr, username, password string) (net.PacketConn, error) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	client, err := turn.NewClient(&turn.ClientConfig{
+		STUNServerAddr: addr,
+		TURNServerAddr: addr,
+		Username:       username,
+		Password:       password,
+		Conn:           conn,
+	})
+	require.NoError(t, err)
+	t.Cleanup(client.Close)
+	require.NoError(t, client.Listen())
+
+	relay, err := client.Allocate()
+	if err != nil {
+		return nil, err
+	}
+	t.Cleanup(func() { relay.Close() })
+	return relay, nil
+}
+
+func TestTURNRefusesLocalPeers(t *testing.T) {
+	peer, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer peer.Close()
+
+	addr, username, password := startTestTURNServer(t, TURNServerConfig{})
+	relay, err := allocateTestRelay(t, addr, username, password)
+	require.NoError(t, err)
+	_, err = relay.WriteTo([]byte("hello"), peer.LocalAddr())
+	require.Error(t, err)
+
+	// unless the peer is allowed
+	addr, username, password = startTestTURNServer(t, TURNServerConfig{AllowedPeers: []netip.Prefix{netip.MustParsePrefix("127.0.0.1/32")}})
+	relay, err = allocateTestRelay(t, addr, username, password)
+	require.NoError(t, err)
+	_, err = relay.WriteTo([]byte("hello"), peer.LocalAddr())
+	require.NoError(t, err)
+
+	require.NoError(t, peer.SetReadDeadline(time.Now().Add(3*time.Second)))
+	buf := make([]byte, 16)
+	n, _, err := peer.ReadFrom(buf)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf[:n]))
+}
+
+func TestTURNAllowPeer(t *testing.T) {
+	ts := &turnServer{logger: logging.Discard(), allowedPeers: []netip.Prefix{netip.MustParsePrefix("10.1.0.0/16")}}
+	for peer, allowed := range map[string]bool{
+		"127.0.0.1":        false,
+		"::1":              false,
+		"10.0.0.1":         false,
+		"172.16.0.1":       false,
+		"192.168.1.1":      false,
+		"169.254.169.254":  false,
+		"fe80::1":          false,
+		"224.0.0.1":        false,
+		"0.0.0.0":          false,
+		"::ffff:127.0.0.1": false,
+		"10.1.2.3":         true,
+		"203.0.113.7":      true,
+		"2001:db8::1":      true,
+	} {
+		require.Equal(t, allowed, ts.allowPeer(nil, net.ParseIP(peer)), peer)
+	}
+}
+
+func TestTURNQuotaUnderConcurrentAllocations(t *testing.T) {
+	const maxAllocations = 3
+	addr, username, password := startTestTURNServer(t, TURNServerConfig{MaxAllocationsPerUser: maxAllocations})
+
+	var wg sync.WaitGroup
+	errs := make(chan error, maxAllocations+1)
+	for range maxAllocations + 1 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := allocateTestRelay(t, addr, username, password)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	allocated := 0
+	for err := range errs {
+		if err == nil {
+			allocated++
+		}
+	}
+	require.Equal(t, maxAllocations, allocated)
+}
@@ -2,16 +2,17 @@ package server
 
 import (
 	"errors"
-	"log"
+	"net/mail"
 	"regexp"
+	"strings"
 	"unicode"
-
-	"github.com/sushiag/go-webrtc-signaling-server/server/server/db"
 )
 
-type Handler struct {
-	Queries *db.Queries
-}
+const (
+	minUsernameLen = 8
+	maxUsernameLen = 16
+	maxEmailLen    = 254
+)
 
 // This validates the username
 var (
@@ -42,19 +43,14 @@ func noWhitespace(in string) bool {
 func checkUsernameField(username string) error {
 	switch {
 	case username == "":
-		log.Printf("Username field: must not be blank")
 		return errors.New("username shouldn't be blank")
-	case len(username) < 8 || len(username) > 16:
-		log.Printf("Username field: Username must be 8–16 characters")
+	case len(username) < minUsernameLen || len(username) > maxUsernameLen:
 		return errors.New("username must be between 8 and 16 characters")
 	case !usernameReg.MatchString(username):
-		log.Printf("Username field: invalid characters")
 		return errors.New("username should only contain alphanumeric/underscore and max 16 characters")
 	case noWhitespace(username):
-		log.Printf("Username field: shouldn't contain whitespace")
 		return errors.New("username shouldn't have whitespaces")
 	case !onlyASCII(username):
-		log.Printf("Username field: only ASCII allowed")
 		return errors.New("username must only be contain ASCII")
 	}
 	return nil
@@ -64,17 +60,40 @@ func checkUsernameField(username string) error {
 func checkPasswordField(password string) error {
 	switch {
 	case password == "":
-		log.Printf("Password field: must not be blank")
 		return errors.New("password must not be blank")
 	case len(password) < 8 || len(password) > 32:
-		log.Printf("Password field: should only be 8-32 characters")
 		return errors.New("password should only be 8-32 characters only")
 	case noWhitespace(password):
-		log.Printf("Password field: no whitespace allowed")
 		return errors.New("password should not contain whitespaces")
 	case !onlyASCII(password):
-		log.Printf("Username field: ONLYASCII allowed")
 		return errors.New("password must only be ACSII")
 	}
 	return nil
 }
+
+// This checks the email address is a bare address and returns it lowercased, which is how emails
+// are stored so they are looked up case insensitively
+func checkEmailField(email string) (string, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	switch {
+	case email == "":
+		return "", errors.New("email must not be blank")
+	case len(email) > maxEmailLen:
+		return "", errors.New("email must be at most 254 characters")
+	}
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return "", errors.New("email must be a plain address like name@example.com")
+	}
+	return email, nil
+}
+
+// ValidateUsername checks if the username meets the same requirements as the /register endpoint
+func ValidateUsername(username string) error {
+	return checkUsernameField(username)
+}
+
+// ValidatePassword checks if the password meets the same requirements as the /register endpoint
+func ValidatePassword(password string) error {
+	return checkPasswordField(password)
+}
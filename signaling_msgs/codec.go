@@ -0,0 +1,161 @@
+package ws_messages
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Codec encodes signaling messages for the wire, the client picks one by offering its WebSocket
+// subprotocol and connections without one use JSON
+type Codec interface {
+	// The WebSocket subprotocol that selects the codec
+	Subprotocol() string
+	// Whether the messages go in binary frames instead of text ones
+	Binary() bool
+	Marshal(msg MessageAnyPayload) ([]byte, error)
+	// Payloads are always handed out as JSON, since that is what the rest of the code parses
+	Unmarshal(data []byte, msg *MessageRawJSONPayload) error
+}
+
+var (
+	// JSON is the default codec, its subprotocol is the one browsers offer
+	JSON Codec = jsonCodec{}
+	// CBOR (RFC 8949) is a compact binary codec, message fields are keyed by small integers
+	CBOR Codec = cborCodec{}
+)
+
+// Codecs are all the codecs, servers accept each of them
+func Codecs() []Codec {
+	return []Codec{JSON, CBOR}
+}
+
+// CodecFor returns the codec of a WebSocket subprotocol, JSON when there is none for it
+func CodecFor(subprotocol string) Codec {
+	for _, codec := range Codecs() {
+		if codec.Subprotocol() == subprotocol {
+			return codec
+		}
+	}
+	return JSON
+}
+
+// NewPayload returns a pointer to a new payload of the message type, nil for types without one
+func NewPayload(ty MessageType) any {
+	switch ty {
+	case RoomCreated:
+		return &RoomCreatedPayload{}
+	case JoinRoom:
+		return &JoinRoomPayload{}
+	case RoomJoined:
+		return &RoomJoinedPayload{}
+	case SDP:
+		return &SDPPayload{}
+	case ICECandidate:
+		return &ICECandidatePayload{}
+	case RoomClosed:
+		return &RoomClosedPayload{}
+	case ServerNotice:
+		return &ServerNoticePayload{}
+	case Hello:
+		return &HelloPayload{}
+	case Welcome:
+		return &WelcomePayload{}
+	default:
+		return nil
+	}
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Subprotocol() string { return "signaling" }
+
+func (jsonCodec) Binary() bool { return false }
+
+func (jsonCodec) Marshal(msg MessageAnyPayload) ([]byte, error) {
+	return json.Marshal(msg)
+}
+
+func (jsonCodec) Unmarshal(data []byte, msg *MessageRawJSONPayload) error {
+	return json.Unmarshal(data, msg)
+}
+
+type cborCodec struct{}
+
+// This is a message as CBOR encodes it, payloads are encoded as their own type instead of as JSON
+type cborEnvelope struct {
+	MsgType   MessageType     `cbor:"1,keyasint"`
+	To        uint64          `cbor:"2,keyasint,omitempty"`
+	From      uint64          `cbor:"3,keyasint,omitempty"`
+	RequestID uint64          `cbor:"4,keyasint,omitempty"`
+	Payload   cbor.RawMessage `cbor:"5,keyasint,omitempty"`
+	Error     *ErrorPayload   `cbor:"6,keyasint,omitempty"`
+}
+
+func (cborCodec) Subprotocol() string { return "signaling.cbor" }
+
+func (cborCodec) Binary() bool { return true }
+
+func (cborCodec) Marshal(msg MessageAnyPayload) ([]byte, error) {
+	envelope := cborEnvelope{
+		MsgType:   msg.MsgType,
+		To:        msg.To,
+		From:      msg.From,
+		RequestID: msg.RequestID,
+		Error:     msg.Error,
+	}
+
+	if msg.Payload != nil {
+		payload := msg.Payload
+		// payloads that are passed on as they came in are JSON, they go out as their type
+		if raw, isJSON := payload.(json.RawMessage); isJSON {
+			typed := NewPayload(msg.MsgType)
+			if typed == nil {
+				return nil, fmt.Errorf("%s messages don't have a payload", msg.MsgType.AsString())
+			}
+			if err := json.Unmarshal(raw, typed); err != nil {
+				return nil, fmt.Errorf("invalid %s payload: %w", msg.MsgType.AsString(), err)
+			}
+			payload = typed
+		}
+
+		encoded, err := cbor.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		envelope.Payload = encoded
+	}
+
+	return cbor.Marshal(envelope)
+}
+
+func (cborCodec) Unmarshal(data []byte, msg *MessageRawJSONPayload) error {
+	var envelope cborEnvelope
+	if err := cbor.Unmarshal(data, &envelope); err != nil {
+		return err
+	}
+	*msg = MessageRawJSONPayload{
+		MsgType:   envelope.MsgType,
+		To:        envelope.To,
+		From:      envelope.From,
+		RequestID: envelope.RequestID,
+		Error:     envelope.Error,
+	}
+
+	if len(envelope.Payload) > 0 {
+		typed := NewPayload(envelope.MsgType)
+		if typed == nil {
+			return fmt.Errorf("%s messages don't have a payload", envelope.MsgType.AsString())
+		}
+		if err := cbor.Unmarshal(envelope.Payload, typed); err != nil {
+			return fmt.Errorf("invalid %s payload: %w", envelope.MsgType.AsString(), err)
+		}
+		payload, err := json.Marshal(typed)
+		if err != nil {
+			return err
+		}
+		msg.Payload = payload
+	}
+	return nil
+}
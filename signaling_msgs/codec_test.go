@@ -0,0 +1,106 @@
+package ws_messages
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/stretchr/testify/require"
+)
+
+const benchmarkSDP = "v=0\r\no=- 4215754462498436462 1719950000 IN IP4 0.0.0.0\r\ns=-\r\nt=0 0\r\n" +
+	"a=fingerprint:sha-256 2F:6E:3A:1B:9C:44:7D:0E:52:A8:61:3F:90:BC:D4:17:28:E5:4A:03:6B:F9:C2:8D:11:7E:A0:35:5C:D8:92:4F\r\n" +
+	"a=extmap-allow-mixed\r\na=group:BUNDLE 0\r\nm=application 9 UDP/DTLS/SCTP webrtc-datachannel\r\n" +
+	"c=IN IP4 0.0.0.0\r\na=setup:actpass\r\na=mid:0\r\na=sendrecv\r\na=sctp-port:5000\r\n" +
+	"a=ice-ufrag:qXcJzLhRmWdPkTfV\r\na=ice-pwd:YbNsGzEwQrUaHtMcKvLpXjDf\r\n" +
+	"a=candidate:1966762134 1 udp 2130706431 192.168.1.23 54321 typ host\r\na=end-of-candidates\r\n"
+
+type namedMessage struct {
+	name string
+	msg  MessageAnyPayload
+}
+
+func benchmarkMessages() []namedMessage {
+	mid, index := "0", uint16(0)
+	return []namedMessage{
+		{"sdp", MessageAnyPayload{
+			MsgType: SDP,
+			To:      2,
+			Payload: SDPPayload{SDP: webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: benchmarkSDP}},
+		}},
+		{"ice", MessageAnyPayload{
+			MsgType: ICECandidate,
+			To:      2,
+			Payload: ICECandidatePayload{ICE: webrtc.ICECandidateInit{
+				Candidate:     "candidate:1966762134 1 udp 2130706431 192.168.1.23 54321 typ host",
+				SDPMid:        &mid,
+				SDPMLineIndex: &index,
+			}},
+		}},
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	for _, codec := range Codecs() {
+		for _, named := range benchmarkMessages() {
+			name, msg := named.name, named.msg
+			data, err := codec.Marshal(msg)
+			require.NoError(t, err, "%s %s", codec.Subprotocol(), name)
+
+			var decoded MessageRawJSONPayload
+			require.NoError(t, codec.Unmarshal(data, &decoded))
+			require.Equal(t, msg.MsgType, decoded.MsgType)
+			require.Equal(t, msg.To, decoded.To)
+
+			// the payload comes out as JSON whatever the codec
+			expected, err := json.Marshal(msg.Payload)
+			require.NoError(t, err)
+			require.JSONEq(t, string(expected), string(decoded.Payload))
+
+			// and can be passed on through any codec
+			forwarded, err := codec.Marshal(MessageAnyPayload{MsgType: decoded.MsgType, From: 1, Payload: decoded.Payload})
+			require.NoError(t, err)
+			var again MessageRawJSONPayload
+			require.NoError(t, codec.Unmarshal(forwarded, &again))
+			require.JSONEq(t, string(expected), string(again.Payload))
+		}
+	}
+
+	errorReply := MessageAnyPayload{MsgType: RoomJoined, RequestID: 3, Error: &ErrorPayload{Code: CodeRoomNotFound, Message: "gone"}}
+	data, err := CBOR.Marshal(errorReply)
+	require.NoError(t, err)
+	var decoded MessageRawJSONPayload
+	require.NoError(t, CBOR.Unmarshal(data, &decoded))
+	require.Equal(t, uint64(3), decoded.RequestID)
+	require.Equal(t, errorReply.Error, decoded.Error)
+	require.Nil(t, decoded.Payload)
+
+	require.Equal(t, JSON, CodecFor(""))
+	require.Equal(t, CBOR, CodecFor("signaling.cbor"))
+}
+
+// These encode a message like a client sending it and decode it like the server receiving it,
+// bytes/msg is the size on the wire
+func BenchmarkCodecs(b *testing.B) {
+	for _, codec := range Codecs() {
+		for _, named := range benchmarkMessages() {
+			name, msg := named.name, named.msg
+			b.Run(codec.Subprotocol()+"/"+name, func(b *testing.B) {
+				var size int
+				b.ReportAllocs()
+				for b.Loop() {
+					data, err := codec.Marshal(msg)
+					if err != nil {
+						b.Fatal(err)
+					}
+					var decoded MessageRawJSONPayload
+					if err := codec.Unmarshal(data, &decoded); err != nil {
+						b.Fatal(err)
+					}
+					size = len(data)
+				}
+				b.ReportMetric(float64(size), "bytes/msg")
+			})
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package ws_messages
+
+import "fmt"
+
+// ErrorCode tells clients why a request failed without parsing the message
+type ErrorCode string
+
+const (
+	CodeInvalidPayload  ErrorCode = "invalid_payload"
+	CodeRateLimited     ErrorCode = "rate_limited"
+	CodeForbidden       ErrorCode = "forbidden"
+	CodeRoomNotFound    ErrorCode = "room_not_found"
+	CodeAlreadyInRoom   ErrorCode = "already_in_room"
+	CodePeerNotFound    ErrorCode = "peer_not_found"
+	CodePayloadTooLarge ErrorCode = "payload_too_large"
+	CodeInternal        ErrorCode = "internal"
+)
+
+// ErrorCodes are all the codes the server puts in ErrorPayload
+func ErrorCodes() []ErrorCode {
+	return []ErrorCode{
+		CodeInvalidPayload,
+		CodeRateLimited,
+		CodeForbidden,
+		CodeRoomNotFound,
+		CodeAlreadyInRoom,
+		CodePeerNotFound,
+		CodePayloadTooLarge,
+		CodeInternal,
+	}
+}
+
+// ErrorPayload is why a request failed, it's sent in the reply to the request. It's an error so
+// clients can return it as is and match it by code:
+//
+//	errors.Is(err, &ws_messages.ErrorPayload{Code: ws_messages.CodeRoomNotFound})
+type ErrorPayload struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message,omitempty"`
+}
+
+func (e *ErrorPayload) Error() string {
+	if e.Message == "" {
+		return string(e.Code)
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// Is matches errors with the same code
+func (e *ErrorPayload) Is(target error) bool {
+	t, ok := target.(*ErrorPayload)
+	return ok && t.Code == e.Code
+}
@@ -0,0 +1,41 @@
+package ws_messages
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// This reads the ErrorCode constants from errors.go, so a code added there but not to ErrorCodes
+// fails the test
+func TestErrorCodesAreComplete(t *testing.T) {
+	file, err := parser.ParseFile(token.NewFileSet(), "errors.go", nil, 0)
+	require.NoError(t, err)
+
+	var declared []ErrorCode
+	for _, decl := range file.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.CONST {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			value := spec.(*ast.ValueSpec)
+			if ident, ok := value.Type.(*ast.Ident); !ok || ident.Name != "ErrorCode" {
+				continue
+			}
+			for i, name := range value.Names {
+				lit, ok := value.Values[i].(*ast.BasicLit)
+				require.True(t, ok, "%s isn't a string literal", name.Name)
+				code, err := strconv.Unquote(lit.Value)
+				require.NoError(t, err)
+				declared = append(declared, ErrorCode(code))
+			}
+		}
+	}
+	require.NotEmpty(t, declared)
+	require.ElementsMatch(t, declared, ErrorCodes())
+}
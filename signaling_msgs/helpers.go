@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"strings"
 )
 
 // Helper function for serializing message payloads to json.RawMessage
@@ -38,7 +39,66 @@ func (ty MessageType) AsString() string {
 		return "sdp"
 	case ICECandidate:
 		return "ice-candidate"
+	case RoomClosed:
+		return "room-closed"
+	case ServerNotice:
+		return "server-notice"
+	case Ack:
+		return "ack"
+	case Hello:
+		return "hello"
+	case Welcome:
+		return "welcome"
 	default:
 		return fmt.Sprintf("unknown (%d)", ty)
 	}
 }
+
+// ParseMessageType is the reverse of AsString
+func ParseMessageType(name string) (MessageType, error) {
+	for ty := Ping; ty <= Welcome; ty++ {
+		if ty.AsString() == name {
+			return ty, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown message type %q", name)
+}
+
+// This sends the type by its name, types without one are sent as their number
+func (ty MessageType) MarshalJSON() ([]byte, error) {
+	name := ty.AsString()
+	if strings.HasPrefix(name, "unknown") {
+		return json.Marshal(uint8(ty))
+	}
+	return json.Marshal(name)
+}
+
+// This takes the type by its name or its number
+func (ty *MessageType) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		parsed, err := ParseMessageType(name)
+		if err != nil {
+			return err
+		}
+		*ty = parsed
+		return nil
+	}
+
+	var number uint8
+	if err := json.Unmarshal(data, &number); err != nil {
+		return fmt.Errorf("message type is neither a name nor a number: %s", data)
+	}
+	*ty = MessageType(number)
+	return nil
+}
+
+// MarshalV1 encodes the message for clients that speak protocol version 1, which only know message
+// types by their number
+func (msg MessageAnyPayload) MarshalV1() ([]byte, error) {
+	type plain MessageAnyPayload
+	return json.Marshal(struct {
+		MsgType uint8 `json:"type"`
+		plain
+	}{uint8(msg.MsgType), plain(msg)})
+}
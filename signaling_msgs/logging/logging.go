@@ -0,0 +1,129 @@
+// Package logging builds the log/slog loggers shared by the signaling server and client.
+//
+// Loggers created here redact secrets (passwords, API keys, tokens) from attributes so they never
+// end up in the logs, even if a caller passes one by mistake.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+const (
+	// Environment variable for the minimum log level: debug, info, warn or error
+	LevelEnvName = "LOG_LEVEL"
+	// Environment variable for the output format: text or json
+	FormatEnvName = "LOG_FORMAT"
+
+	redactedValue = "[REDACTED]"
+)
+
+// Options configures a new logger.
+type Options struct {
+	Level  slog.Leveler
+	JSON   bool
+	Output io.Writer
+}
+
+// New creates a logger that redacts sensitive attributes.
+func New(opts Options) *slog.Logger {
+	out := opts.Output
+	if out == nil {
+		out = os.Stderr
+	}
+	level := opts.Level
+	if level == nil {
+		level = slog.LevelInfo
+	}
+
+	handlerOpts := &slog.HandlerOptions{
+		Level:       level,
+		ReplaceAttr: RedactAttr,
+	}
+
+	if opts.JSON {
+		return slog.New(slog.NewJSONHandler(out, handlerOpts))
+	}
+	return slog.New(slog.NewTextHandler(out, handlerOpts))
+}
+
+// FromEnv creates a logger configured by the LOG_LEVEL and LOG_FORMAT environment variables.
+func FromEnv() *slog.Logger {
+	return New(Options{
+		Level: ParseLevel(os.Getenv(LevelEnvName)),
+		JSON:  strings.EqualFold(os.Getenv(FormatEnvName), "json"),
+	})
+}
+
+// ParseLevel converts a level name to a slog.Level, unknown or empty names default to info.
+func ParseLevel(name string) slog.Level {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(strings.TrimSpace(name))); err != nil {
+		return slog.LevelInfo
+	}
+	return level
+}
+
+// sensitiveKeys are normalized attribute keys (lowercase, without '_' and '-') that get redacted.
+var sensitiveKeys = map[string]bool{
+	"password":      true,
+	"oldpassword":   true,
+	"newpassword":   true,
+	"apikey":        true,
+	"xapikey":       true,
+	"authorization": true,
+	"token":         true,
+	"accesstoken":   true,
+	"secret":        true,
+}
+
+// IsSensitiveKey reports whether values logged under the given key are redacted.
+func IsSensitiveKey(key string) bool {
+	normalized := strings.NewReplacer("_", "", "-", "").Replace(strings.ToLower(key))
+	return sensitiveKeys[normalized]
+}
+
+// RedactAttr is a slog.HandlerOptions.ReplaceAttr func that hides the values of sensitive attributes.
+func RedactAttr(_ []string, a slog.Attr) slog.Attr {
+	if IsSensitiveKey(a.Key) {
+		return slog.String(a.Key, redactedValue)
+	}
+	return a
+}
+
+// NewID returns a short random identifier used to correlate log lines of a request or connection.
+func NewID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+type ctxKey struct{}
+
+// WithLogger returns a copy of ctx that carries the given logger.
+func WithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, ctxKey{}, logger)
+}
+
+// FromContext returns the logger stored in ctx or the fallback if there is none.
+func FromContext(ctx context.Context, fallback *slog.Logger) *slog.Logger {
+	if logger, ok := ctx.Value(ctxKey{}).(*slog.Logger); ok && logger != nil {
+		return logger
+	}
+	if fallback != nil {
+		return fallback
+	}
+	return slog.Default()
+}
+
+// Discard returns a logger that drops everything, handy for tests and benchmarks.
+func Discard() *slog.Logger {
+	return slog.New(slog.DiscardHandler)
+}
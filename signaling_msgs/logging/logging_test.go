@@ -0,0 +1,50 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedactsSensitiveAttributes(t *testing.T) {
+	var out bytes.Buffer
+	logger := New(Options{Level: slog.LevelDebug, JSON: true, Output: &out})
+
+	logger.Info("login", "username", "spongebob", "password", "hunter22", "api_key", "abcd", "X-API-Key", "efgh")
+
+	var line map[string]any
+	require.NoError(t, json.Unmarshal(out.Bytes(), &line))
+	require.Equal(t, "spongebob", line["username"])
+	require.Equal(t, redactedValue, line["password"])
+	require.Equal(t, redactedValue, line["api_key"])
+	require.Equal(t, redactedValue, line["X-API-Key"])
+	require.NotContains(t, out.String(), "hunter22")
+}
+
+func TestLevelFiltering(t *testing.T) {
+	var out bytes.Buffer
+	logger := New(Options{Level: ParseLevel("warn"), Output: &out})
+
+	logger.Debug("hidden")
+	logger.Info("hidden")
+	require.Empty(t, out.String())
+
+	logger.Warn("shown")
+	require.Contains(t, out.String(), "shown")
+
+	require.Equal(t, slog.LevelInfo, ParseLevel("not-a-level"))
+	require.Equal(t, slog.LevelDebug, ParseLevel("DEBUG"))
+}
+
+func TestContextLogger(t *testing.T) {
+	fallback := Discard()
+	require.Same(t, fallback, FromContext(context.Background(), fallback))
+
+	logger := Discard().With("request_id", NewID())
+	ctx := WithLogger(context.Background(), logger)
+	require.Same(t, logger, FromContext(ctx, fallback))
+}
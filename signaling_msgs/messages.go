@@ -6,22 +6,28 @@ import (
 	"github.com/pion/webrtc/v4"
 )
 
+// MessageType is sent by its name (see AsString), numbers are still accepted from older peers.
+// New types are only ever appended so the numbers stay the same.
 type MessageType uint8
 
 type MessageAnyPayload struct {
 	MsgType MessageType `json:"type"`
 	To      uint64      `json:"to,omitempty"`
 	From    uint64      `json:"from,omitempty"`
-	Payload any         `json:"payload,omitempty"`
-	Error   string      `json:"err,omitempty"`
+	// Set by clients on requests, the server's reply to a request carries the same ID
+	RequestID uint64        `json:"request_id,omitempty"`
+	Payload   any           `json:"payload,omitempty"`
+	Error     *ErrorPayload `json:"error,omitempty"`
 }
 
 type MessageRawJSONPayload struct {
-	MsgType MessageType     `json:"type"`
-	To      uint64          `json:"to,omitempty"`
-	From    uint64          `json:"from,omitempty"`
-	Payload json.RawMessage `json:"payload,omitempty"`
-	Error   string          `json:"err,omitempty"`
+	MsgType MessageType `json:"type"`
+	To      uint64      `json:"to,omitempty"`
+	From    uint64      `json:"from,omitempty"`
+	// Set by clients on requests, the server's reply to a request carries the same ID
+	RequestID uint64          `json:"request_id,omitempty"`
+	Payload   json.RawMessage `json:"payload,omitempty"`
+	Error     *ErrorPayload   `json:"error,omitempty"`
 }
 
 const (
@@ -34,10 +40,50 @@ const (
 	LeaveRoom
 	SDP
 	ICECandidate
+	RoomClosed
+	ServerNotice
+	// The reply to requests that have none of their own, like SDP and ICECandidate. It's only sent
+	// for requests with a RequestID.
+	Ack
+	// The first message of a client, it tells the server which protocol version it speaks
+	Hello
+	// The server's reply to Hello
+	Welcome
+)
+
+// The protocol version this module speaks. Version 1 had numeric message types and no Hello,
+// clients that don't send a Hello are taken to speak it.
+const (
+	ProtocolVersion    = 2
+	MinProtocolVersion = 1
+)
+
+// The optional parts of the protocol a client can ask for in its Hello, the Welcome lists the ones
+// the server supports
+const (
+	// Replies echo the request_id of requests
+	FeatureRequestIDs = "request_ids"
+	// Requests without a reply of their own are acknowledged with an Ack
+	FeatureAcks = "acks"
+	// RoomCreated and RoomJoined carry the ICE servers to connect with
+	FeatureICEServers = "ice_servers"
 )
 
+type HelloPayload struct {
+	ProtocolVersion int      `json:"protocol_version"`
+	Features        []string `json:"features,omitempty"`
+}
+
+type WelcomePayload struct {
+	ProtocolVersion int      `json:"protocol_version"`
+	Features        []string `json:"features"`
+	ClientID        uint64   `json:"client_id"`
+}
+
 type RoomCreatedPayload struct {
 	RoomID uint64 `json:"room_id"`
+	// The STUN and TURN servers to create peer connections with, TURN credentials expire
+	ICEServers []webrtc.ICEServer `json:"ice_servers,omitempty"`
 }
 
 type JoinRoomPayload struct {
@@ -47,6 +93,8 @@ type JoinRoomPayload struct {
 type RoomJoinedPayload struct {
 	RoomID        uint64   `json:"room_id"`
 	ClientsInRoom []uint64 `json:"clients"`
+	// The STUN and TURN servers to create peer connections with, TURN credentials expire
+	ICEServers []webrtc.ICEServer `json:"ice_servers,omitempty"`
 }
 
 type SDPPayload struct {
@@ -56,3 +104,12 @@ type SDPPayload struct {
 type ICECandidatePayload struct {
 	ICE webrtc.ICECandidateInit `json:"ice"`
 }
+
+type RoomClosedPayload struct {
+	RoomID uint64 `json:"room_id"`
+	Reason string `json:"reason,omitempty"`
+}
+
+type ServerNoticePayload struct {
+	Message string `json:"message"`
+}
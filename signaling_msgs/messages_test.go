@@ -23,7 +23,7 @@ func TestMessageMarshalling(t *testing.T) {
 	jsonMsg, jsonMarshalErr := json.Marshal(msgToSend)
 	require.NoError(t, jsonMarshalErr)
 
-	expectedJSON := fmt.Sprintf(`{"type":%d,"from":1,"to":2,"payload":{"sdp":{"type":"offer","sdp":""}}}`, SDP)
+	expectedJSON := `{"type":"sdp","from":1,"to":2,"payload":{"sdp":{"type":"offer","sdp":""}}}`
 	require.JSONEq(t, expectedJSON, string(jsonMsg), "Marshalled JSON mismatch")
 
 	// Unmarshal message
@@ -33,7 +33,7 @@ func TestMessageMarshalling(t *testing.T) {
 	require.Equal(t, msgToSend.MsgType, msgToReceive.MsgType)
 	t.Logf("msgToReceive type: %s", msgToReceive.MsgType.AsString())
 	t.Logf("msgToReceive payload: %s", string(msgToReceive.Payload))
-	require.Equal(t, "", msgToReceive.Error)
+	require.Nil(t, msgToReceive.Error)
 
 	// Unmarshal payload
 	var receivedPayload SDPPayload
@@ -41,3 +41,32 @@ func TestMessageMarshalling(t *testing.T) {
 	require.NoError(t, unmarshalPayloadErr)
 	require.Equal(t, msgToSend.Payload, receivedPayload)
 }
+
+func TestMessageTypeNames(t *testing.T) {
+	for ty := Ping; ty <= Welcome; ty++ {
+		jsonType, err := json.Marshal(ty)
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("%q", ty.AsString()), string(jsonType))
+
+		// older peers send the number
+		var fromName, fromNumber MessageType
+		require.NoError(t, json.Unmarshal(jsonType, &fromName))
+		require.NoError(t, json.Unmarshal([]byte(fmt.Sprint(uint8(ty))), &fromNumber))
+		require.Equal(t, ty, fromName)
+		require.Equal(t, ty, fromNumber)
+	}
+
+	// the numbers are part of the protocol and must never change
+	require.Equal(t, MessageType(3), RoomCreated)
+	require.Equal(t, MessageType(10), ServerNotice)
+	require.Equal(t, MessageType(13), Welcome)
+
+	// version 1 clients get the number
+	v1, err := MessageAnyPayload{MsgType: RoomClosed, Payload: RoomClosedPayload{RoomID: 7}}.MarshalV1()
+	require.NoError(t, err)
+	require.JSONEq(t, fmt.Sprintf(`{"type":%d,"payload":{"room_id":7}}`, RoomClosed), string(v1))
+
+	var ty MessageType
+	require.Error(t, json.Unmarshal([]byte(`"no-such-type"`), &ty))
+	require.Error(t, json.Unmarshal([]byte(`{}`), &ty))
+}
@@ -0,0 +1,124 @@
+package schema
+
+import (
+	smsg "signaling-msgs"
+)
+
+// This is what a message type is for
+var summaries = map[smsg.MessageType]string{
+	smsg.Ping:         "Keepalive from the server",
+	smsg.Pong:         "Reply to ping",
+	smsg.CreateRoom:   "Create a room and become its host",
+	smsg.RoomCreated:  "Reply to create-room with the room's ID and the ICE servers",
+	smsg.JoinRoom:     "Join an existing room",
+	smsg.RoomJoined:   "Reply to join-room with the users in the room and the ICE servers",
+	smsg.LeaveRoom:    "Leave every room and disconnect",
+	smsg.SDP:          "An SDP offer or answer for the user in to, forwarded with from set",
+	smsg.ICECandidate: "An ICE candidate for the user in to, forwarded with from set",
+	smsg.RoomClosed:   "The room was closed by an administrator",
+	smsg.ServerNotice: "A notice broadcast by an administrator",
+	smsg.Ack:          "Reply to requests without a reply of their own, only sent when they have a request_id",
+	smsg.Hello:        "The protocol version and features the client speaks, sent first",
+	smsg.Welcome:      "Reply to hello with the agreed version and features",
+}
+
+// This is an operation of the server, receive is a message clients send and send one the server
+// sends. Requests name the message the server replies with.
+type operation struct {
+	id      string
+	action  string
+	msgType smsg.MessageType
+	reply   *smsg.MessageType
+}
+
+func replyWith(ty smsg.MessageType) *smsg.MessageType {
+	return &ty
+}
+
+var operations = []operation{
+	{"hello", "receive", smsg.Hello, replyWith(smsg.Welcome)},
+	{"createRoom", "receive", smsg.CreateRoom, replyWith(smsg.RoomCreated)},
+	{"joinRoom", "receive", smsg.JoinRoom, replyWith(smsg.RoomJoined)},
+	{"leaveRoom", "receive", smsg.LeaveRoom, replyWith(smsg.Ack)},
+	{"sendSDP", "receive", smsg.SDP, replyWith(smsg.Ack)},
+	{"sendICECandidate", "receive", smsg.ICECandidate, replyWith(smsg.Ack)},
+	{"pong", "receive", smsg.Pong, nil},
+	{"ping", "send", smsg.Ping, nil},
+	{"forwardSDP", "send", smsg.SDP, nil},
+	{"forwardICECandidate", "send", smsg.ICECandidate, nil},
+	{"roomClosed", "send", smsg.RoomClosed, nil},
+	{"serverNotice", "send", smsg.ServerNotice, nil},
+}
+
+type object = map[string]any
+
+func ref(path string) object {
+	return object{"$ref": path}
+}
+
+// This is the AsyncAPI 3 document of the WebSocket protocol, its messages point at the schemas
+func asyncAPI() object {
+	messages := object{}
+	channelMessages := object{}
+	for _, ty := range messageTypes() {
+		name := ty.AsString()
+		payload := object{
+			"allOf": []any{
+				ref(MessageSchema),
+				object{"properties": object{"type": object{"const": name}}},
+			},
+		}
+		messages[name] = object{
+			"name":        name,
+			"summary":     summaries[ty],
+			"contentType": "application/json",
+			"payload":     object{"schemaFormat": "application/schema+json;version=draft-2020-12", "schema": payload},
+		}
+		channelMessages[name] = ref("#/components/messages/" + name)
+	}
+
+	ops := object{}
+	for _, op := range operations {
+		spec := object{
+			"action":   op.action,
+			"channel":  ref("#/channels/signaling"),
+			"summary":  summaries[op.msgType],
+			"messages": []any{ref("#/channels/signaling/messages/" + op.msgType.AsString())},
+		}
+		if op.reply != nil {
+			spec["reply"] = object{
+				"channel":  ref("#/channels/signaling"),
+				"messages": []any{ref("#/channels/signaling/messages/" + op.reply.AsString())},
+			}
+		}
+		ops[op.id] = spec
+	}
+
+	return object{
+		"asyncapi": "3.0.0",
+		"info": object{
+			"title":   "WebRTC signaling",
+			"version": "2",
+			"description": "The WebSocket protocol peers exchange SDP and ICE candidates over. Clients start with hello, " +
+				"replies echo the request_id of requests and failed requests get an error instead of a payload. " +
+				"Offering the signaling.cbor subprotocol switches to CBOR, these schemas describe the JSON codec.",
+		},
+		"defaultContentType": "application/json",
+		"servers": object{
+			"signaling": object{
+				"host":        "localhost:8080",
+				"protocol":    "ws",
+				"description": "Authenticated with an X-API-Key header, an Authorization bearer token or an access_token.<token> subprotocol",
+			},
+		},
+		"channels": object{
+			"signaling": object{
+				"address":  "/ws",
+				"messages": channelMessages,
+				"bindings": object{"ws": object{"method": "GET", "bindingVersion": "0.1.0"}},
+			},
+		},
+		"operations": ops,
+		"components": object{"messages": messages},
+	}
+}
@@ -0,0 +1,21 @@
+// This writes the schemas and the AsyncAPI document, go generate runs it in the schema package
+package main
+
+import (
+	"log"
+	"os"
+
+	"signaling-msgs/schema"
+)
+
+func main() {
+	files, err := schema.Generate()
+	if err != nil {
+		log.Fatal(err)
+	}
+	for name, data := range files {
+		if err := os.WriteFile(name, data, 0o644); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
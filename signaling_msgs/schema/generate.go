@@ -0,0 +1,150 @@
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/invopop/jsonschema"
+	"github.com/pion/webrtc/v4"
+
+	smsg "signaling-msgs"
+)
+
+const draft = "https://json-schema.org/draft/2020-12/schema"
+
+// This is every message type in the order they were added
+func messageTypes() []smsg.MessageType {
+	var types []smsg.MessageType
+	for ty := smsg.Ping; ty <= smsg.Welcome; ty++ {
+		types = append(types, ty)
+	}
+	return types
+}
+
+// Generate returns the contents of Files by their name. It has to run in this package's directory,
+// like go generate and go test do, since the doc comments of the ws_messages types are read from
+// the source next to it and end up as descriptions.
+func Generate() (map[string][]byte, error) {
+	reflector := &jsonschema.Reflector{
+		Anonymous: true,
+		Mapper:    mapType,
+	}
+	// the comments are keyed by the import path of the working directory joined with their file's
+	if err := reflector.AddGoComments("signaling-msgs/schema", ".."); err != nil {
+		return nil, fmt.Errorf("failed to read the doc comments: %w", err)
+	}
+
+	files := make(map[string]any)
+	for _, ty := range messageTypes() {
+		payload := smsg.NewPayload(ty)
+		if payload == nil {
+			continue
+		}
+		s := reflector.Reflect(payload)
+		s.Version = draft
+		s.ID = jsonschema.ID(BaseURL + PayloadSchema(ty.AsString()))
+		s.Title = fmt.Sprintf("%s payload", ty.AsString())
+		files[PayloadSchema(ty.AsString())] = s
+	}
+
+	errSchema := reflector.Reflect(&smsg.ErrorPayload{})
+	errSchema.Version = draft
+	errSchema.ID = jsonschema.ID(BaseURL + ErrorSchema)
+	errSchema.Title = "error"
+	files[ErrorSchema] = errSchema
+
+	files[MessageSchema] = messageSchema()
+	files[AsyncAPI] = asyncAPI()
+
+	encoded := make(map[string][]byte, len(files))
+	for name, doc := range files {
+		data, err := json.MarshalIndent(doc, "", "  ")
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode %s: %w", name, err)
+		}
+		encoded[name] = append(data, '\n')
+	}
+	return encoded, nil
+}
+
+// This describes the types that are encoded differently from what their Go type says
+func mapType(t reflect.Type) *jsonschema.Schema {
+	switch t {
+	case reflect.TypeOf(webrtc.SDPType(0)):
+		return &jsonschema.Schema{Type: "string", Enum: []any{"offer", "pranswer", "answer", "rollback"}}
+	case reflect.TypeOf(webrtc.ICECredentialType(0)):
+		return &jsonschema.Schema{Type: "string", Enum: []any{"password", "oauth"}}
+	case reflect.TypeOf(smsg.ErrorCode("")):
+		errorCodes := smsg.ErrorCodes()
+		codes := make([]any, len(errorCodes))
+		for i, code := range errorCodes {
+			codes[i] = string(code)
+		}
+		return &jsonschema.Schema{Type: "string", Enum: codes}
+	case reflect.TypeOf(webrtc.ICECandidateInit{}):
+		// the optional fields are null rather than missing
+		props := jsonschema.NewProperties()
+		props.Set("candidate", &jsonschema.Schema{Type: "string"})
+		props.Set("sdpMid", nullable(&jsonschema.Schema{Type: "string"}))
+		props.Set("sdpMLineIndex", nullable(&jsonschema.Schema{Type: "integer", Minimum: "0", Maximum: "65535"}))
+		props.Set("usernameFragment", nullable(&jsonschema.Schema{Type: "string"}))
+		return &jsonschema.Schema{Type: "object", Properties: props, Required: []string{"candidate"}}
+	default:
+		return nil
+	}
+}
+
+func nullable(s *jsonschema.Schema) *jsonschema.Schema {
+	return &jsonschema.Schema{OneOf: []*jsonschema.Schema{s, {Type: "null"}}}
+}
+
+// This is the schema of the envelope, the payload's schema depends on the type. Types are matched
+// by name and by number, which clients speaking protocol version 1 get.
+func messageSchema() *jsonschema.Schema {
+	var typeNames []any
+	var conditions []*jsonschema.Schema
+	for _, ty := range messageTypes() {
+		typeNames = append(typeNames, ty.AsString(), uint8(ty))
+
+		props := jsonschema.NewProperties()
+		props.Set("type", &jsonschema.Schema{Enum: []any{ty.AsString(), uint8(ty)}})
+		then := &jsonschema.Schema{Not: &jsonschema.Schema{Required: []string{"payload"}}}
+		if smsg.NewPayload(ty) != nil {
+			payloadProps := jsonschema.NewProperties()
+			payloadProps.Set("payload", &jsonschema.Schema{Ref: PayloadSchema(ty.AsString())})
+			then = &jsonschema.Schema{Properties: payloadProps}
+		}
+		conditions = append(conditions, &jsonschema.Schema{
+			If:   &jsonschema.Schema{Properties: props, Required: []string{"type"}},
+			Then: then,
+		})
+	}
+
+	id := &jsonschema.Schema{Type: "integer", Minimum: "0"}
+	props := jsonschema.NewProperties()
+	props.Set("type", &jsonschema.Schema{Enum: typeNames, Description: "The message type by name, or by number for protocol version 1"})
+	props.Set("to", withDescription(id, "The user the message is for"))
+	props.Set("from", withDescription(id, "The user who sent the message, set by the server"))
+	props.Set("request_id", withDescription(id, "Set by clients on requests, the reply carries the same ID"))
+	props.Set("payload", &jsonschema.Schema{Description: "Depends on the type"})
+	props.Set("error", &jsonschema.Schema{Ref: ErrorSchema, Description: "Why a request failed, replies with an error have no payload"})
+
+	return &jsonschema.Schema{
+		Version:              draft,
+		ID:                   jsonschema.ID(BaseURL + MessageSchema),
+		Title:                "signaling message",
+		Description:          "A message sent over the WebSocket with the JSON codec",
+		Type:                 "object",
+		Properties:           props,
+		Required:             []string{"type"},
+		AdditionalProperties: jsonschema.FalseSchema,
+		AllOf:                conditions,
+	}
+}
+
+func withDescription(s *jsonschema.Schema, description string) *jsonschema.Schema {
+	described := *s
+	described.Description = description
+	return &described
+}
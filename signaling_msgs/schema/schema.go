@@ -0,0 +1,29 @@
+// Package schema describes the signaling protocol for clients written in other languages: a JSON
+// Schema of the message envelope, one per payload and an AsyncAPI document of the WebSocket
+// protocol. The files are generated from the ws_messages types, run go generate after changing them.
+package schema
+
+import "embed"
+
+//go:generate go run ./gen
+
+// Files are the generated schemas and the AsyncAPI document
+//
+//go:embed *.json
+var Files embed.FS
+
+// The schemas' IDs are their file names under BaseURL
+const BaseURL = "https://github.com/sushiag/go-webrtc-signaling-server/signaling_msgs/schema/"
+
+const (
+	// The schema every JSON message matches
+	MessageSchema = "message.schema.json"
+	// The schema of the error of failed requests
+	ErrorSchema = "error.schema.json"
+	AsyncAPI    = "asyncapi.json"
+)
+
+// PayloadSchema is the file of the schema of a message type's payload
+func PayloadSchema(typeName string) string {
+	return typeName + ".schema.json"
+}
@@ -0,0 +1,67 @@
+package schema
+
+import (
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/stretchr/testify/require"
+
+	smsg "signaling-msgs"
+)
+
+func TestFilesAreUpToDate(t *testing.T) {
+	generated, err := Generate()
+	require.NoError(t, err)
+	for name, data := range generated {
+		onDisk, err := Files.ReadFile(name)
+		require.NoError(t, err, "%s is missing, run go generate", name)
+		require.Equal(t, string(data), string(onDisk), "%s is out of date, run go generate", name)
+	}
+}
+
+func TestValidator(t *testing.T) {
+	validator, err := NewValidator()
+	require.NoError(t, err)
+
+	mid, index := "0", uint16(0)
+	valid := []smsg.MessageAnyPayload{
+		{MsgType: smsg.Ping},
+		{MsgType: smsg.Welcome, RequestID: 1, Payload: smsg.WelcomePayload{ProtocolVersion: 2, Features: []string{smsg.FeatureAcks}, ClientID: 3}},
+		{MsgType: smsg.SDP, From: 1, To: 2, Payload: smsg.SDPPayload{SDP: webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: "v=0"}}},
+		{MsgType: smsg.ICECandidate, From: 1, To: 2, Payload: smsg.ICECandidatePayload{ICE: webrtc.ICECandidateInit{Candidate: "candidate:1", SDPMid: &mid, SDPMLineIndex: &index}}},
+		{MsgType: smsg.ICECandidate, From: 1, To: 2, Payload: smsg.ICECandidatePayload{}},
+		{MsgType: smsg.RoomJoined, Payload: smsg.RoomJoinedPayload{RoomID: 1, ClientsInRoom: []uint64{1, 2}, ICEServers: []webrtc.ICEServer{
+			{URLs: []string{"turn:example.com"}, Username: "1:2", Credential: "secret", CredentialType: webrtc.ICECredentialTypePassword},
+		}}},
+		{MsgType: smsg.RoomJoined, RequestID: 4, Error: &smsg.ErrorPayload{Code: smsg.CodeRoomNotFound, Message: "gone"}},
+		{MsgType: smsg.Ack, RequestID: 5},
+	}
+	// every code the server sends is in the schema
+	for _, code := range smsg.ErrorCodes() {
+		valid = append(valid, smsg.MessageAnyPayload{MsgType: smsg.Ack, RequestID: 6, Error: &smsg.ErrorPayload{Code: code}})
+	}
+	for _, msg := range valid {
+		data, err := smsg.JSON.Marshal(msg)
+		require.NoError(t, err)
+		require.NoError(t, validator.Validate(data), string(data))
+
+		// version 1 clients get the number
+		data, err = msg.MarshalV1()
+		require.NoError(t, err)
+		require.NoError(t, validator.Validate(data), string(data))
+	}
+
+	invalid := []string{
+		`{}`,
+		`{"type":"no-such-type"}`,
+		`{"type":"ping","payload":{}}`,
+		`{"type":"sdp","payload":{"sdp":{"type":"offer"}}}`,
+		`{"type":"sdp","payload":{"sdp":{"type":1,"sdp":""}}}`,
+		`{"type":"room-joined","error":{"code":"oops"}}`,
+		`{"type":"room-closed","payload":{"room_id":"1"}}`,
+		`{"type":"ack","extra":true}`,
+	}
+	for _, msg := range invalid {
+		require.Error(t, validator.Validate([]byte(msg)), msg)
+	}
+}
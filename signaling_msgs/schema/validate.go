@@ -0,0 +1,51 @@
+package schema
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+)
+
+// Validator checks JSON messages against the message schema
+type Validator struct {
+	schema *jsonschema.Schema
+}
+
+// NewValidator compiles the message schema and the schemas it refers to from Files
+func NewValidator() (*Validator, error) {
+	compiler := jsonschema.NewCompiler()
+	names, err := fs.Glob(Files, "*.schema.json")
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		data, err := Files.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		doc, err := jsonschema.UnmarshalJSON(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", name, err)
+		}
+		if err := compiler.AddResource(BaseURL+name, doc); err != nil {
+			return nil, err
+		}
+	}
+
+	schema, err := compiler.Compile(BaseURL + MessageSchema)
+	if err != nil {
+		return nil, err
+	}
+	return &Validator{schema: schema}, nil
+}
+
+// Validate tells why a JSON message doesn't match the schema
+func (v *Validator) Validate(msg []byte) error {
+	inst, err := jsonschema.UnmarshalJSON(bytes.NewReader(msg))
+	if err != nil {
+		return err
+	}
+	return v.schema.Validate(inst)
+}